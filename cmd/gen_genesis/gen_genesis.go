@@ -90,6 +90,7 @@ func main() {
 	outDir := flag.String("dir", "./genesis", "output directoy name")
 	distributeTo := flag.String("distribute-to", "./credentials", "the native token (and the optionally created tokens) will be evenly distributed to all credentials in this folder")
 	seed := flag.String("seed", "dex-genesis-group", "random seed")
+	stakesFlag := flag.String("stakes", "", "comma separated stakes of the nodes in the order of the node IDs, the fork choice weight of a block is proportional to the stake of its proposer, empty gives every node the default stake")
 	additionalTokenPath := flag.String("tokens", "", "path to the file which contains additional tokens to evenly distribute, each row is in format SYMBOL,QUANTITY,DECIMALS. BNB does not have to be in this file, it's distributed by default")
 	flag.Parse()
 
@@ -132,6 +133,24 @@ func main() {
 		}
 	}
 
+	stakes := make([]uint64, *numNode)
+	if *stakesFlag != "" {
+		ss := strings.Split(*stakesFlag, ",")
+		if len(ss) != *numNode {
+			fmt.Printf("stakes count %d does not match the number of nodes %d\n", len(ss), *numNode)
+			return
+		}
+
+		for i, str := range ss {
+			stake, err := strconv.ParseUint(str, 10, 64)
+			if err != nil || stake == 0 {
+				fmt.Printf("invalid stake of node %d: %q\n", i, str)
+				return
+			}
+			stakes[i] = stake
+		}
+	}
+
 	owners, err := loadCredentials(*distributeTo)
 	if err != nil {
 		fmt.Printf("error loading credentials to which the tokens will be distributed to, err: %v\n", err)
@@ -161,8 +180,9 @@ func main() {
 		rand = rand.Derive(rand[:])
 
 		txn := consensus.ReadyJoinGroupTxn{
-			ID: i,
-			PK: nodePKs[i],
+			ID:    i,
+			PK:    nodePKs[i],
+			Stake: stakes[i],
 		}
 		sysTxns = append(sysTxns, consensus.SysTxn{
 			Type: consensus.ReadyJoinGroup,
@@ -217,7 +237,11 @@ func main() {
 		Data: gobEncode(l),
 	})
 
-	state := dex.CreateGenesisState(owners, additionalTokens)
+	state, err := dex.CreateGenesisState(owners, additionalTokens, nil)
+	if err != nil {
+		panic(err)
+	}
+
 	stateBlob, err := state.Serialize()
 	if err != nil {
 		panic(err)
@@ -7,7 +7,10 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/pprof"
+	"syscall"
 	"time"
 
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -30,10 +33,11 @@ func decodeFromFile(path string, v interface{}) {
 	}
 }
 
-func createNode(c consensus.NodeCredentials, genesis consensus.Genesis, u consensus.Updater, cfg consensus.Config) *consensus.Node {
+func createNode(c consensus.NodeCredentials, genesis consensus.Genesis, u consensus.Updater, cfg consensus.Config, maxCachedAccounts int, blockDB ethdb.Database) *consensus.Node {
 	state := dex.NewState(ethdb.NewMemDatabase())
+	state.SetMaxCachedAccounts(maxCachedAccounts)
 	pk, _ := dex.RandKeyPair()
-	return consensus.MakeNode(c, cfg, genesis, state, dex.NewTxnPool(state), u, pk)
+	return consensus.MakeNode(c, cfg, genesis, state, dex.NewTxnPool(state), u, pk, blockDB)
 }
 
 func main() {
@@ -47,6 +51,19 @@ func main() {
 	port := flag.Int("port", 11001, "node address to listen connection on")
 	seedNode := flag.String("seed", "", "seed node address")
 	g := flag.String("genesis", "", "path to the genesis block file")
+	beaconTimeout := flag.Duration("beacon-timeout", 10*time.Second, "duration without a new random beacon signature after which the random beacon is reported as stalled, 0 disables the check")
+	historyRetention := flag.Uint64("history-retention", 0, "number of the rounds below the last finalized round whose committee assignments are kept in memory, 0 keeps all of them")
+	maxClockSkew := flag.Duration("max-clock-skew", 5*time.Second, "maximum tolerated time a block proposal timestamp can be ahead of the local clock, 0 disables the check")
+	maxForks := flag.Int("max-forks", 0, "maximum number of the unfinalized top-level branches, the lightest branches are dropped when exceeded, 0 means no limit")
+	shareGossipWindow := flag.Duration("share-gossip-window", 0, "duration since the first notarization share of a block proposal during which its shares are accepted, 0 means no limit")
+	maxFutureRounds := flag.Uint64("max-future-rounds", 10, "maximum number of rounds a received block, block proposal or notarization share can be ahead of the current round, 0 means no limit")
+	maxRecentBlocks := flag.Int("max-recent-blocks", 0, "maximum number of the finalized blocks kept in memory, the older finalized blocks are offloaded to the block database, 0 keeps all of them in memory")
+	minBlockInterval := flag.Duration("min-block-interval", 0, "minimum duration between the ends of two consecutive rounds, the next round is delayed if the block arrives early, 0 means no limit")
+	codec := flag.String("codec", "rlp", "codec used to store the offloaded blocks, possible values: rlp, protobuf")
+	sigCacheSize := flag.Int("sig-cache-size", 4096, "maximum number of the verified group signatures cached to skip their re-verification, 0 disables the cache")
+	maxCachedAccounts := flag.Int("max-cached-accounts", 0, "maximum number of the accounts kept in the in-memory cache of a state, the least recently used accounts are evicted, 0 means no limit")
+	txnCodec := flag.String("txn-codec", "rlp", "codec of the txns received by the wallet RPC service, possible values: rlp, protobuf")
+	dataDir := flag.String("data-dir", "./data", "directory of the block database where the offloaded finalized blocks are stored")
 	rpcAddr := flag.String("rpc-addr", ":12001", "rpc address used to serve wallet RPC calls")
 	flag.Parse()
 
@@ -88,13 +105,35 @@ func main() {
 	}
 
 	cfg := consensus.Config{
-		BlockTime:      time.Second,
-		GroupSize:      *groupSize,
-		GroupThreshold: *threshold,
+		BlockTime:         time.Second,
+		GroupSize:         *groupSize,
+		GroupThreshold:    *threshold,
+		BeaconTimeout:     *beaconTimeout,
+		HistoryRetention:  *historyRetention,
+		MaxClockSkew:      *maxClockSkew,
+		MaxForks:          *maxForks,
+		ShareGossipWindow: *shareGossipWindow,
+		MaxFutureRounds:   *maxFutureRounds,
+		MaxRecentBlocks:   *maxRecentBlocks,
+		MinBlockInterval:  *minBlockInterval,
+		Codec:             *codec,
+		SigCacheSize:      *sigCacheSize,
+	}
+
+	blockDB, err := ethdb.NewLDBDatabase(filepath.Join(*dataDir, "blocks"), 16, 16)
+	if err != nil {
+		panic(err)
+	}
+	defer blockDB.Close()
+
+	tc, err := dex.NewTxnCodec(*txnCodec)
+	if err != nil {
+		panic(err)
 	}
 
 	server := dex.NewRPCServer()
-	n := createNode(credential, genesis, server, cfg)
+	server.SetTxnCodec(tc)
+	n := createNode(credential, genesis, server, cfg, *maxCachedAccounts, blockDB)
 	server.SetSender(n)
 	server.SetStater(n.Chain())
 	err = server.Start(*rpcAddr)
@@ -112,5 +151,9 @@ func main() {
 	log15.Info("node info", "addr", pk.Addr(), "member of groups", credential.Groups)
 	n.EndRound(0)
 
-	select {}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+	log15.Info("shutting down node")
+	n.Stop()
 }
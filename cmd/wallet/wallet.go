@@ -28,6 +28,7 @@ const (
 
 var rpcAddr string
 var credentialPath string
+var txnCodec string
 
 func nonce(client *rpc.Client, addr consensus.Addr) (uint64, error) {
 	var nonce uint64
@@ -39,6 +40,27 @@ func nonce(client *rpc.Client, addr consensus.Addr) (uint64, error) {
 	return nonce, nil
 }
 
+// sendTxn sends the RLP encoded txn to the wallet service, encoded by
+// the txn codec of the node.
+func sendTxn(client *rpc.Client, txn []byte) error {
+	codec, err := dex.NewTxnCodec(txnCodec)
+	if err != nil {
+		return err
+	}
+
+	rlpCodec, err := dex.NewTxnCodec("rlp")
+	if err != nil {
+		return err
+	}
+
+	t, err := rlpCodec.DecodeTxn(txn)
+	if err != nil {
+		return err
+	}
+
+	return client.Call("WalletService.SendTxn", codec.EncodeTxn(t), nil)
+}
+
 func getTokens(client *rpc.Client) ([]dex.Token, error) {
 	var tokens dex.TokenState
 	err := client.Call("WalletService.Tokens", 0, &tokens)
@@ -285,7 +307,7 @@ func sendToken(c *cli.Context) error {
 	}
 
 	txn := dex.MakeSendTokenTxn(credential.SK, credential.PK.Addr(), pk, tokenID, uint64(quant*mul), n)
-	err = client.Call("WalletService.SendTxn", txn, nil)
+	err = sendTxn(client, txn)
 	if err != nil {
 		return err
 	}
@@ -470,7 +492,7 @@ func issueToken(c *cli.Context) error {
 	}
 
 	txn := dex.MakeIssueTokenTxn(credential.SK, credential.PK.Addr(), tokenInfo, n)
-	err = client.Call("WalletService.SendTxn", txn, nil)
+	err = sendTxn(client, txn)
 	if err != nil {
 		return err
 	}
@@ -554,7 +576,7 @@ func burnToken(c *cli.Context) error {
 
 	t := dex.BurnTokenTxn{ID: tokenID, Quant: uint64(quant * mul)}
 	txn := dex.MakeBurnTokenTxn(credential.SK, credential.PK.Addr(), t, n)
-	err = client.Call("WalletService.SendTxn", txn, nil)
+	err = sendTxn(client, txn)
 	if err != nil {
 		return err
 	}
@@ -616,7 +638,7 @@ func freezeToken(c *cli.Context) error {
 
 	t := dex.FreezeTokenTxn{TokenID: tokenID, AvailableRound: availableHeight, Quant: uint64(quant * mul)}
 	txn := dex.MakeFreezeTokenTxn(credential.SK, credential.PK.Addr(), t, n)
-	err = client.Call("WalletService.SendTxn", txn, nil)
+	err = sendTxn(client, txn)
 	if err != nil {
 		return err
 	}
@@ -648,7 +670,7 @@ func cancelOrder(c *cli.Context) error {
 	}
 
 	txn := dex.MakeCancelOrderTxn(credential.SK, credential.PK.Addr(), id, n)
-	err = client.Call("WalletService.SendTxn", txn, nil)
+	err = sendTxn(client, txn)
 	if err != nil {
 		return err
 	}
@@ -751,7 +773,7 @@ func placeOrder(c *cli.Context) error {
 		Market:      market,
 	}
 	txn := dex.MakePlaceOrderTxn(credential.SK, credential.PK.Addr(), placeOrderTxn, n)
-	err = client.Call("WalletService.SendTxn", txn, nil)
+	err = sendTxn(client, txn)
 	if err != nil {
 		return err
 	}
@@ -776,6 +798,12 @@ func main() {
 			Usage:       "node's wallet RPC endpoint",
 			Destination: &rpcAddr,
 		},
+		cli.StringFlag{
+			Name:        "txn-codec",
+			Value:       "rlp",
+			Usage:       "codec of the txns sent to the node's wallet RPC endpoint, possible values: rlp, protobuf",
+			Destination: &txnCodec,
+		},
 	}
 
 	app.Commands = []cli.Command{
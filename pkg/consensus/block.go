@@ -1,7 +1,9 @@
 package consensus
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/dfinity/go-dfinity-crypto/bls"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -66,6 +68,38 @@ func (r *RandBeaconSig) Encode(withSig bool) []byte {
 	return b
 }
 
+// RandBeaconSigV0 is the first version of the versioned random
+// beacon signature encoding, its payload is identical to Encode(true),
+// so the signed message Encode(false) is not changed.
+const RandBeaconSigV0 byte = 0
+
+// EncodeVersioned encodes the random beacon signature prefixed with
+// the encoding version.
+func (r *RandBeaconSig) EncodeVersioned() []byte {
+	return append([]byte{RandBeaconSigV0}, r.Encode(true)...)
+}
+
+// DecodeRandBeaconSig decodes the random beacon signature encoded by
+// EncodeVersioned.
+func DecodeRandBeaconSig(b []byte) (*RandBeaconSig, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty random beacon signature encoding")
+	}
+
+	switch b[0] {
+	case RandBeaconSigV0:
+		var r RandBeaconSig
+		err := rlp.DecodeBytes(b[1:], &r)
+		if err != nil {
+			return nil, err
+		}
+
+		return &r, nil
+	default:
+		return nil, fmt.Errorf("unsupported random beacon signature encoding version: %d", b[0])
+	}
+}
+
 // Hash returns the hash of the random beacon signature.
 func (r *RandBeaconSig) Hash() Hash {
 	return SHA3(r.Encode(true))
@@ -136,6 +170,9 @@ type BlockProposal struct {
 	PrevBlock Hash
 	Txns      []byte
 	Owner     Addr
+	// Timestamp is the unix time in nanoseconds when the block
+	// proposal is created.
+	Timestamp int64
 	// The signature of the gob serialized BlockProposal with
 	// OwnerSig set to nil.
 	OwnerSig Sig
@@ -161,6 +198,23 @@ func (bp *BlockProposal) Hash() Hash {
 	return SHA3(bp.Encode(true))
 }
 
+// ValidateTime checks that the block proposal is not created in the
+// future by more than maxSkew according to the local clock. A
+// proposal from the past is valid, it could be a proposal received
+// during syncing.
+func (bp *BlockProposal) ValidateTime(now time.Time, maxSkew time.Duration) error {
+	if maxSkew == 0 {
+		return nil
+	}
+
+	t := time.Unix(0, bp.Timestamp)
+	if d := t.Sub(now); d > maxSkew {
+		return fmt.Errorf("block proposal timestamp %v is %v ahead of local time, max clock skew: %v", t, d, maxSkew)
+	}
+
+	return nil
+}
+
 // Genesis is the genesis block and the serialized genesis state.
 type Genesis struct {
 	Block Block
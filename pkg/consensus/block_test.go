@@ -2,6 +2,7 @@ package consensus
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/stretchr/testify/assert"
@@ -20,6 +21,7 @@ func TestBlockProposalEncodeDecode(t *testing.T) {
 		PrevBlock: Hash{3},
 		Txns:      []byte{1, 2, 3},
 		Owner:     Addr{4},
+		Timestamp: 7,
 		OwnerSig:  []byte{4, 5, 6},
 	}
 
@@ -48,6 +50,20 @@ func TestBlockProposalEncodeDecode(t *testing.T) {
 	assert.Equal(t, b2.Encode(false), b.Encode(false))
 }
 
+func TestBlockProposalValidateTime(t *testing.T) {
+	now := time.Unix(100, 0)
+	skew := 2 * time.Second
+	bp := BlockProposal{Timestamp: now.Add(skew).UnixNano()}
+	assert.Nil(t, bp.ValidateTime(now, skew))
+
+	bp.Timestamp++
+	assert.NotNil(t, bp.ValidateTime(now, skew))
+	assert.Nil(t, bp.ValidateTime(now, 0))
+
+	bp.Timestamp = now.Add(-time.Hour).UnixNano()
+	assert.Nil(t, bp.ValidateTime(now, skew))
+}
+
 func TestBlockEncodeDecode(t *testing.T) {
 	b := Block{
 		Owner:         Addr{1},
@@ -107,6 +123,51 @@ func TestRandSigEncodeDecode(t *testing.T) {
 	assert.Equal(t, b0, b1)
 }
 
+func TestRandSigVersionedEncodeDecode(t *testing.T) {
+	b := RandBeaconSig{
+		Round:       1,
+		LastSigHash: Hash{1},
+		Sig:         []byte{4, 5, 6},
+	}
+
+	en := b.EncodeVersioned()
+	assert.Equal(t, RandBeaconSigV0, en[0])
+	assert.Equal(t, b.Encode(true), en[1:])
+
+	b0, err := DecodeRandBeaconSig(en)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, b, *b0)
+
+	_, err = DecodeRandBeaconSig(nil)
+	assert.NotNil(t, err)
+
+	en[0] = RandBeaconSigV0 + 1
+	_, err = DecodeRandBeaconSig(en)
+	assert.NotNil(t, err)
+}
+
+func TestRandSigV0SignatureCompat(t *testing.T) {
+	lastSigHash := Hash{1}
+	msg := randBeaconSigMsg(1, lastSigHash)
+
+	// the v0 signed message must stay byte-identical, otherwise
+	// the existing signatures can not be verified.
+	expected := append([]byte{0xe3, 0x01, 0xa0}, lastSigHash[:]...)
+	expected = append(expected, 0x80)
+	assert.Equal(t, expected, msg)
+
+	sk := DeterministicSK([]byte("rand sig compat"))
+	b := RandBeaconSig{Round: 1, LastSigHash: lastSigHash, Sig: sk.Sign(msg)}
+	b0, err := DecodeRandBeaconSig(b.EncodeVersioned())
+	if err != nil {
+		panic(err)
+	}
+
+	assert.True(t, b0.Sig.Verify(sk.MustPK(), b0.Encode(false)))
+}
+
 func TestNtShareEncodeDecode(t *testing.T) {
 	nt := NtShare{
 		Round:     1,
@@ -1,9 +1,12 @@
 package consensus
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +19,34 @@ const (
 	sysTxnNotImplemented = "system transaction not implemented, will be implemented when open participation is necessary, however, the DEX is fully functional"
 )
 
+// ErrBlockExists is returned when adding a block that is already
+// added to the chain, it can be safely ignored.
+var ErrBlockExists = errors.New("block already exists")
+
+// ErrInvalidBlockWeight is returned when adding a block whose fork
+// choice weight is not a positive finite number.
+var ErrInvalidBlockWeight = errors.New("block weight must be positive")
+
+// ErrBlockProposalNotarized is returned when adding a block whose
+// block proposal is already notarized by a different block, a block
+// proposal is used by at most one block. The first added block is
+// kept and the later ones are rejected.
+var ErrBlockProposalNotarized = errors.New("block proposal is already notarized by a different block")
+
+// ErrBlockSysTxns is returned when adding a block carrying sys txns,
+// the sys txns are only applied at genesis, so no unfinalized block
+// can advance the system state.
+var ErrBlockSysTxns = errors.New("block carrying sys txns is not supported")
+
+// The errors returned when a block proposal is rejected.
+var (
+	ErrBlockProposalExists     = errors.New("block proposal already exists")
+	ErrUnknownPrevBlock        = errors.New("prev block of block proposal not found")
+	ErrInvalidPrevBlockRound   = errors.New("prev block round is not block proposal round - 1")
+	ErrInvalidProposer         = errors.New("block proposal owner is not in the block proposal committee")
+	ErrInvalidBlockProposalSig = errors.New("invalid block proposal signature")
+)
+
 type blockNode struct {
 	Block  Hash
 	Weight float64
@@ -51,17 +82,44 @@ type Chain struct {
 	store        *storage
 	txnPool      TxnPool
 	updater      Updater
+	logger       log.Logger
 
 	mu               sync.RWMutex
 	roundMetrics     []RoundMetric
 	lastEndRoundTime time.Time
+	// lastEndRoundNotify is the time when the node is notified
+	// the end of the last round, it is delayed to respect
+	// Config.MinBlockInterval.
+	lastEndRoundNotify time.Time
+	now                func() time.Time
+	// afterFunc calls f after d, it returns the function
+	// stopping the call. It uses the same clock as now.
+	afterFunc func(d time.Duration, f func()) (stop func() bool)
+	// stopEndRound stops the pending end of round notification
+	// of endRoundSeq, nil if there is none.
+	stopEndRound func() bool
+	endRoundSeq  uint64
 	// reorg will never happen to the finalized block
-	finalized             []Hash
+	finalized []Hash
+	// finalizedRound indexes the recently finalized blocks by
+	// hash, so that a replayed finalized block is detected without
+	// loading the offloaded block. Only the blocks kept in memory
+	// by Config.MaxRecentBlocks are indexed, an older block is
+	// detected by loading it from the block database.
+	finalizedRound        map[Hash]uint64
 	lastFinalizedState    State
 	lastFinalizedSysState *SysState
 	fork                  []*blockNode
 	unFinalizedState      map[Hash]State
 	roundWaitCh           map[uint64]chan struct{}
+	// leaderSeq is the sequence number of the latest leader
+	// notification, protected by mu.
+	leaderSeq uint64
+
+	updateMu sync.Mutex
+	// updatedSeq is the sequence number of the last leader
+	// notification delivered to the updater.
+	updatedSeq uint64
 }
 
 // Updater updates the application layer (DEX) about the current
@@ -70,23 +128,38 @@ type Updater interface {
 	Update(s State)
 }
 
-// NewChain creates a new chain.
+// NewChain creates a new chain, it panics if the genesis is invalid.
 func NewChain(genesis *Block, genesisState State, seed Rand, cfg Config, txnPool TxnPool, u Updater, store *storage, proposerPK []byte) *Chain {
+	c, err := NewChainChecked(genesis, genesisState, seed, cfg, txnPool, u, store, proposerPK)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+// NewChainChecked creates a new chain, an error is returned if the
+// genesis is invalid.
+func NewChainChecked(genesis *Block, genesisState State, seed Rand, cfg Config, txnPool TxnPool, u Updater, store *storage, proposerPK []byte) (*Chain, error) {
 	if genesisState.Hash() != genesis.StateRoot {
-		panic(fmt.Errorf("genesis state hash and block state root does not match, state hash: %v, blocks state root: %v", genesisState.Hash(), genesis.StateRoot))
+		return nil, fmt.Errorf("genesis state hash and block state root does not match, state hash: %v, blocks state root: %v", genesisState.Hash(), genesis.StateRoot)
 	}
 
 	sysState := NewSysState()
 	t := sysState.Transition()
-	for _, txn := range genesis.SysTxns {
+	for i, txn := range genesis.SysTxns {
 		valid := t.Record(txn)
 		if !valid {
-			panic("sys txn in genesis is invalid")
+			return nil, fmt.Errorf("sys txn %d in genesis is invalid, type: %d", i, txn.Type)
 		}
 	}
 
+	sysState, err := t.commit()
+	if err != nil {
+		return nil, fmt.Errorf("invalid genesis: %v", err)
+	}
+
 	u.Update(genesisState)
-	sysState = t.Commit()
 	gh := genesis.Hash()
 	store.AddBlock(genesis, gh)
 	return &Chain{
@@ -94,15 +167,21 @@ func NewChain(genesis *Block, genesisState State, seed Rand, cfg Config, txnPool
 		proposerPK:            proposerPK,
 		store:                 store,
 		updater:               u,
+		logger:                cfg.logger(),
 		txnPool:               txnPool,
 		randomBeacon:          NewRandomBeacon(seed, sysState.groups, cfg),
 		finalized:             []Hash{gh},
+		finalizedRound:        map[Hash]uint64{gh: 0},
 		lastFinalizedState:    genesisState,
 		lastFinalizedSysState: sysState,
 		unFinalizedState:      make(map[Hash]State),
 		roundWaitCh:           make(map[uint64]chan struct{}),
 		lastEndRoundTime:      time.Now(),
-	}
+		now:                   time.Now,
+		afterFunc: func(d time.Duration, f func()) func() bool {
+			return time.AfterFunc(d, f).Stop
+		},
+	}, nil
 }
 
 // Genesis returns the hash of the genesis block.
@@ -130,6 +209,13 @@ func (c *Chain) TxnPoolSize() int {
 	return c.txnPool.Size()
 }
 
+// PendingProposals returns the block proposals of the given round
+// that are not notarized yet, ordered by their hashes. The block
+// proposals of a finalized round are no longer pending.
+func (c *Chain) PendingProposals(round uint64) []*BlockProposal {
+	return c.store.UnNotarized(round)
+}
+
 // WaitUntil will not return until the given round is reached.
 func (c *Chain) WaitUntil(round uint64) {
 	c.mu.Lock()
@@ -151,13 +237,16 @@ func (c *Chain) WaitUntil(round uint64) {
 
 // ProposeBlock proposes a new block proposal.
 func (c *Chain) ProposeBlock(ctx context.Context, sk SK, round uint64) *BlockProposal {
+	if n := c.txnPool.RemoveExpired(round); n > 0 {
+		c.logger.Debug("removed expired txns from txn pool", "count", n, "round", round)
+	}
 	txns := c.txnPool.Txns()
 	block, state, _ := c.Leader()
 	if block.Round+1 < round {
-		log.Info("proposing block skipped", "expected round", round-1, "block round", block.Round)
+		c.logger.Info("proposing block skipped", "expected round", round-1, "block round", block.Round)
 		return nil
 	} else if block.Round+1 > round {
-		log.Error("want to propose block, but does not find the suitable block", "expected round", round-1, "block round", block.Round)
+		c.logger.Error("want to propose block, but does not find the suitable block", "expected round", round-1, "block round", block.Round)
 		return nil
 	}
 
@@ -174,10 +263,12 @@ loop:
 		err := trans.Record(txns[i])
 		if err == nil {
 			recorded++
+		} else if err == ErrBlockCostExceeded {
+			break loop
 		}
 
 		if err != nil && err != ErrTxnNonceTooBig {
-			log.Warn("error record txn", "err", err, "miner", txns[i].MinerFeeTxn)
+			c.logger.Warn("error record txn", "err", err, "miner", txns[i].MinerFeeTxn)
 			// TODO: handle "lost" txn due to reorg.
 			c.txnPool.Remove(SHA3(txns[i].Raw))
 		}
@@ -190,6 +281,7 @@ loop:
 		PrevBlock: block.Hash(),
 		Txns:      txnsBytes,
 		Owner:     pk.Addr(),
+		Timestamp: time.Now().UnixNano(),
 	}
 
 	bp.OwnerSig = sk.Sign(bp.Encode(false))
@@ -203,6 +295,23 @@ func (c *Chain) FinalizedRound() uint64 {
 	return uint64(len(c.finalized) - 1)
 }
 
+// RoundRandomness returns the randomness derived from the random
+// beacon signature of the given finalized round. It is the same for
+// all nodes, so it can be consumed by the deterministic application
+// logic, e.g., the random tie-breaks.
+func (c *Chain) RoundRandomness(round uint64) (Hash, error) {
+	if finalized := c.FinalizedRound(); round > finalized {
+		return Hash{}, fmt.Errorf("round %d is not finalized, last finalized round: %d", round, finalized)
+	}
+
+	history := c.randomBeacon.History()
+	if round >= uint64(len(history)) {
+		return Hash{}, fmt.Errorf("random beacon signature of round %d not found", round)
+	}
+
+	return SHA3(history[round].Sig), nil
+}
+
 func (c *Chain) round() uint64 {
 	round := len(c.finalized)
 	round += maxHeight(c.fork)
@@ -217,17 +326,62 @@ func (c *Chain) Round() uint64 {
 	return c.round()
 }
 
+// ValidateRound checks if the round of a received block, block
+// proposal or notarization share is plausible: after the last
+// finalized round, and at most Config.MaxFutureRounds ahead of the
+// current round of the chain or the random beacon, whichever is
+// higher.
+func (c *Chain) ValidateRound(round uint64) error {
+	c.mu.Lock()
+	finalizedRound := uint64(len(c.finalized) - 1)
+	cur := c.round()
+	c.mu.Unlock()
+
+	if round <= finalizedRound {
+		return fmt.Errorf("round %d is already finalized, last finalized round: %d", round, finalizedRound)
+	}
+
+	if rb := c.randomBeacon.Round(); rb > cur {
+		cur = rb
+	}
+
+	if max := c.cfg.MaxFutureRounds; max > 0 && round > cur && round-cur > max {
+		return fmt.Errorf("round %d is too far ahead of the current round %d, max future rounds: %d", round, cur, max)
+	}
+
+	return nil
+}
+
+// maxHeight returns the number of the levels of the fork tree. The
+// tree is walked level by level rather than recursively, since the
+// depth of the unfinalized fork tree is not bounded while the
+// finalization is blocked by the competing branches.
 func maxHeight(ns []*blockNode) int {
-	max := 0
-	for _, n := range ns {
-		h := maxHeight(n.blockChildren) + 1
-		if max < h {
-			max = h
-		}
+	h := 0
+	for ; len(ns) > 0; h++ {
+		ns = nextLevel(ns)
 	}
-	return max
+	return h
 }
 
+// blockWeight returns the fork choice weight of the block proposed by
+// the owner of the given rank, it is the stake of the owner registered
+// in the genesis times 0.5^rank. The weight of a staked owner is
+// clamped to the smallest positive number when 0.5^rank underflows,
+// so the block of a high rank is not rejected.
+func (c *Chain) blockWeight(owner Addr, rank uint16) float64 {
+	c.mu.RLock()
+	stake := c.lastFinalizedSysState.Stake(owner)
+	c.mu.RUnlock()
+	w := float64(stake) * rankToWeight(rank)
+	if stake > 0 && w == 0 {
+		w = math.SmallestNonzeroFloat64
+	}
+	return w
+}
+
+// weight returns the accumulated weight of the path from the
+// top-level node of the fork to n.
 func weight(n *blockNode) float64 {
 	w := n.Weight
 	prev := n.parent
@@ -238,21 +392,20 @@ func weight(n *blockNode) float64 {
 	return w
 }
 
+// heaviestFork returns the node at the given depth of the fork whose
+// path from the top-level node has the highest accumulated weight.
+// Only the nodes at the same depth are compared, since the next
+// block can only extend a block of the latest round.
 func heaviestFork(fork []*blockNode, depth int) *blockNode {
-	var nodes []*blockNode
-	if depth == 0 {
-		nodes = fork
-	} else {
-		for _, v := range fork {
-			nodes = append(nodes, nodesAtDepth(v.blockChildren, depth-1)...)
-		}
-	}
-
+	nodes := nodesAtDepth(fork, depth)
 	var maxWeight float64
 	var r *blockNode
 	for _, n := range nodes {
+		// the nodes of the same weight are ordered by the
+		// block hash, so the leader does not depend on the
+		// order the blocks arrived.
 		w := weight(n)
-		if w > maxWeight {
+		if r == nil || w > maxWeight || w == maxWeight && bytes.Compare(n.Block[:], r.Block[:]) < 0 {
 			r = n
 			maxWeight = w
 		}
@@ -261,23 +414,32 @@ func heaviestFork(fork []*blockNode, depth int) *blockNode {
 	return r
 }
 
+// nodesAtDepth returns the nodes at depth d of the tree whose
+// top-level nodes are children, in the order of a depth-first
+// traversal. The tree is walked level by level, so a deep fork tree
+// does not grow the stack.
 func nodesAtDepth(children []*blockNode, d int) []*blockNode {
-	if d == 0 {
-		if len(children) == 0 {
-			return nil
-		}
-
-		return children
+	nodes := children
+	for i := 0; i < d && len(nodes) > 0; i++ {
+		nodes = nextLevel(nodes)
 	}
 
-	var nodes []*blockNode
-	for _, child := range children {
-		nodes = append(nodes, nodesAtDepth(child.blockChildren, d-1)...)
+	if len(nodes) == 0 {
+		return nil
 	}
-
 	return nodes
 }
 
+// nextLevel returns the children of the nodes, the children of the
+// same node are kept together in the order of the nodes.
+func nextLevel(nodes []*blockNode) []*blockNode {
+	var next []*blockNode
+	for _, n := range nodes {
+		next = append(next, n.blockChildren...)
+	}
+	return next
+}
+
 func (c *Chain) leader() (*Block, State, *SysState) {
 	if len(c.fork) == 0 {
 		return c.store.Block(c.finalized[len(c.finalized)-1]), c.lastFinalizedState, c.lastFinalizedSysState
@@ -290,13 +452,47 @@ func (c *Chain) leader() (*Block, State, *SysState) {
 
 // Leader returns the block of the current round whose chain is the
 // heaviest.
+//
+// When there is no block beyond the genesis block, the genesis block
+// and the genesis state is returned.
+//
+// The returned system state is the system state of the last
+// finalized block. The sys txns are only applied at genesis and
+// AddBlock rejects the blocks carrying sys txns, so no unfinalized
+// block can advance the system state. Once the sys txns of the
+// blocks are applied, the system state of the leader block must be
+// tracked like its state, otherwise the notary would read a stale
+// system state.
 func (c *Chain) Leader() (*Block, State, *SysState) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	return c.leader()
 }
 
-// BlockState returns the block's state given block's hash.
+// FinalizedState returns the state of the last finalized block.
+//
+// The finalized state is the same on every node, it can be used to
+// serve the data that must be consistent across the nodes.
+func (c *Chain) FinalizedState() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastFinalizedState
+}
+
+// HasProgressed returns true if the chain has any block beyond the
+// genesis block, finalized or not.
+func (c *Chain) HasProgressed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.finalized) > 1 || len(c.fork) > 0
+}
+
+// BlockState returns the block's state given block's hash. The
+// states of the unfinalized blocks and the last finalized block are
+// kept, nil is returned for the other blocks, including the finalized
+// blocks buried by a later finalized block. The genesis block is no
+// exception once round 1 is finalized.
 func (c *Chain) BlockState(h Hash) State {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -312,29 +508,225 @@ func (c *Chain) blockState(h Hash) State {
 	return c.unFinalizedState[h]
 }
 
-// AddBlock adds a block to the chain.
+// ApplyProposal applies the transactions of the block proposal of
+// the given round to the state, returning the new state and its root
+// hash. It takes the same transition path as notarizing and syncing
+// blocks, so the root can be checked against the block state root.
+func (c *Chain) ApplyProposal(state State, bp *BlockProposal, round uint64) (State, Hash, error) {
+	s, _, err := c.applyProposal(state, bp, round)
+	if err != nil {
+		return nil, Hash{}, err
+	}
+
+	return s, s.Hash(), nil
+}
+
+// SubmitBlockProposal submits a block proposal built outside of the
+// node, it is gossiped and notarized the same as the received block
+// proposals. The previous block must be on the chain, and the random
+// beacon must have reached the round of the block proposal. An error
+// is returned if the block proposal is rejected.
+func (c *Chain) SubmitBlockProposal(bp *BlockProposal) error {
+	err := c.ValidateRound(bp.Round)
+	if err != nil {
+		return err
+	}
+
+	if rb := c.randomBeacon.Round(); rb < bp.Round {
+		return fmt.Errorf("random beacon round %d has not reached the block proposal round %d", rb, bp.Round)
+	}
+
+	h := bp.Hash()
+	if c.store.BlockProposal(h) != nil {
+		return ErrBlockProposalExists
+	}
+
+	prev := c.store.Block(bp.PrevBlock)
+	if prev == nil {
+		return ErrUnknownPrevBlock
+	}
+
+	err = c.validateBlockProposal(bp, prev)
+	if err != nil {
+		return err
+	}
+
+	if !c.store.AddBlockProposal(bp, h) {
+		return ErrBlockProposalExists
+	}
+
+	if c.n != nil {
+		go c.n.recvBPForNotary(bp)
+		go c.n.gateway.broadcast(Item{T: blockProposalItem, Hash: h})
+	}
+	return nil
+}
+
+// validateBlockProposal validates the block proposal against its
+// previous block, the random beacon must have reached the round of
+// the block proposal.
+func (c *Chain) validateBlockProposal(bp *BlockProposal, prev *Block) error {
+	if prev.Round != bp.Round-1 {
+		return ErrInvalidPrevBlockRound
+	}
+
+	// make sure proposer is in the current proposal group
+	_, err := c.randomBeacon.Rank(bp.Owner, bp.Round)
+	if err != nil {
+		return ErrInvalidProposer
+	}
+
+	pk, ok := c.lastFinalizedSysState.addrToPK[bp.Owner]
+	if !ok {
+		return ErrInvalidProposer
+	}
+
+	if !bp.OwnerSig.Verify(pk, bp.Encode(false)) {
+		return ErrInvalidBlockProposalSig
+	}
+
+	return bp.ValidateTime(c.now(), c.cfg.MaxClockSkew)
+}
+
+// ProposalStateRoot returns the state root resulting from applying
+// the block proposal to the state of its previous block, nothing is
+// signed. It is the state root of the block if the block proposal
+// is notarized.
+func (c *Chain) ProposalStateRoot(bp *BlockProposal) (Hash, error) {
+	state := c.BlockState(bp.PrevBlock)
+	if state == nil {
+		return Hash{}, fmt.Errorf("can not find the state of prev block %v", bp.PrevBlock)
+	}
+
+	_, root, err := c.ApplyProposal(state, bp, bp.Round)
+	return root, err
+}
+
+func (c *Chain) applyProposal(state State, bp *BlockProposal, round uint64) (State, int, error) {
+	if bp.Round != round {
+		return nil, 0, fmt.Errorf("block proposal round %d does not match round %d", bp.Round, round)
+	}
+
+	return state.CommitTxns(bp.Txns, c.txnPool, round)
+}
+
+// addBlock generates the state of the block independently by applying
+// the block proposal to the prev block's state rather than trusting
+// the block, and adds the block with the generated state. An error is
+// returned if the generated state root does not match the block's.
+func (c *Chain) addBlock(b *Block, bp *BlockProposal, weight float64) (bool, error) {
+	if h := bp.Hash(); h != b.BlockProposal {
+		return false, fmt.Errorf("block proposal %v does not match the block's block proposal %v", h, b.BlockProposal)
+	}
+
+	state := c.BlockState(b.PrevBlock)
+	if state == nil {
+		// the prev block is buried by a later finalized
+		// block.
+		return false, fmt.Errorf("can not find the state of prev block %v", b.PrevBlock)
+	}
+
+	s, count, err := c.applyProposal(state, bp, b.Round)
+	if err != nil {
+		return false, err
+	}
+
+	if root := s.Hash(); root != b.StateRoot {
+		return false, fmt.Errorf("invalid state root of block %v, generated: %v, block: %v", b.Hash(), root, b.StateRoot)
+	}
+
+	return c.AddBlock(b, s, weight, count)
+}
+
+// AddBlock adds a block to the chain with its state, the state
+// resulted from applying the block proposal's txns to the prev block's
+// state, see ApplyProposal. An error is returned if the state root
+// does not match the block's state root. ErrBlockExists is returned
+// if the block is already added, finalized or not. ErrBlockSysTxns is
+// returned if the block carries sys txns.
 func (c *Chain) AddBlock(b *Block, s State, weight float64, txnCount int) (bool, error) {
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		return false, ErrInvalidBlockWeight
+	}
+
+	if len(b.SysTxns) > 0 {
+		return false, ErrBlockSysTxns
+	}
+
+	if root := s.Hash(); root != b.StateRoot {
+		// the state must be the result of applying the
+		// block's proposal to the prev block's state.
+		return false, fmt.Errorf("state root %v does not match the block's state root %v", root, b.StateRoot)
+	}
+
 	hash := b.Hash()
-	log.Debug("add block to chain", "hash", hash)
+	c.logger.Debug("add block to chain", "hash", hash)
+	c.mu.RLock()
+	_, finalized := c.finalizedRound[hash]
+	c.mu.RUnlock()
+	if finalized {
+		return false, ErrBlockExists
+	}
+
 	if saved := c.store.Block(hash); saved != nil {
-		return false, nil
+		return false, ErrBlockExists
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if saved := c.store.Block(hash); saved != nil {
+		// the same block is added concurrently, it must not
+		// be attached twice. Distinct blocks of the same prev
+		// block are attached as siblings.
+		return false, ErrBlockExists
+	}
+
 	startingRound := c.round()
 	finalizedRound := uint64(len(c.finalized) - 1)
 	if b.Round <= finalizedRound {
 		return false, fmt.Errorf("block's round is already finalized, round: %d, last finalized round: %d", b.Round, finalizedRound)
 	}
 
+	// the blocks of the same block proposal are of the same
+	// round, only the unfinalized blocks of the round need to
+	// be checked.
+	for _, n := range nodesAtDepth(c.fork, int(b.Round-finalizedRound-1)) {
+		if nb := c.store.Block(n.Block); nb != nil && nb.BlockProposal == b.BlockProposal {
+			return false, ErrBlockProposalNotarized
+		}
+	}
+
 	node := &blockNode{Block: hash, Weight: weight}
 	if b.Round == finalizedRound+1 {
+		// the block extends the last finalized block, including
+		// the first block after the genesis block, where the
+		// genesis block is the only finalized block and the
+		// block's state is derived from the genesis state.
 		if b.PrevBlock != c.finalized[len(c.finalized)-1] {
 			return false, errors.New("block's prev round is finalized, but prev block is not the finalized block")
 		}
 		c.fork = append(c.fork, node)
-		c.unFinalizedState[node.Block] = s
+		if max := c.cfg.MaxForks; max > 0 && len(c.fork) > max {
+			var dropped []*blockNode
+			var bodies [][]byte
+			c.fork, dropped = pruneFork(c.fork, max)
+			selfDropped := false
+			for _, d := range dropped {
+				if d == node {
+					// the block is not added yet, it
+					// has no state or txns to clean.
+					selfDropped = true
+					continue
+				}
+				bodies = append(bodies, c.branchTxns(d)...)
+				c.removeBranchState(d)
+			}
+			c.reinject(bodies)
+
+			if selfDropped {
+				return false, fmt.Errorf("block dropped, the fork limit %d is reached by heavier branches", max)
+			}
+		}
 	} else {
 		depth := int(b.Round - finalizedRound - 2)
 		nodes := nodesAtDepth(c.fork, depth)
@@ -348,7 +740,9 @@ func (c *Chain) AddBlock(b *Block, s State, weight float64, txnCount int) (bool,
 		}
 
 		if prev == nil {
-			panic(fmt.Errorf("should never happen: can not find prev block %v, it should be already synced", b.PrevBlock))
+			// the prev block is synced, so it must be
+			// on a branch dropped due to the fork limit.
+			return false, fmt.Errorf("can not find prev block %v, it is on a dropped branch", b.PrevBlock)
 		}
 
 		node.parent = prev
@@ -363,12 +757,13 @@ func (c *Chain) AddBlock(b *Block, s State, weight float64, txnCount int) (bool,
 	if startingRound == b.Round && startingRound+1 == round {
 		// when round n ended, round n - 2 can be
 		// finalized. See corollary 9.19 in page 15 of
-		// https://arxiv.org/abs/1805.04548
-		if startingRound > 2 {
-			c.finalize(startingRound - 2)
+		// https://arxiv.org/abs/1805.04548 A deeper
+		// depth can be configured to be conservative.
+		if depth := c.cfg.finalizeDepth(); startingRound > depth {
+			c.finalize(startingRound - depth)
 		}
 
-		now := time.Now()
+		now := c.now()
 		metric := RoundMetric{
 			Round:     startingRound,
 			BlockTime: now.Sub(c.lastEndRoundTime),
@@ -383,90 +778,263 @@ func (c *Chain) AddBlock(b *Block, s State, weight float64, txnCount int) (bool,
 		}
 		c.lastEndRoundTime = now
 
-		go c.n.EndRound(startingRound)
+		c.scheduleEndRound(startingRound, now)
 		if ch, ok := c.roundWaitCh[round]; ok {
 			close(ch)
 			delete(c.roundWaitCh, round)
 		}
 	}
-	go c.updater.Update(leaderState)
+	c.notifyLeader(leaderState)
 	return true, nil
 }
 
-func widthAtDepth(n *blockNode, d int) int {
-	if d == 0 {
-		return len(n.blockChildren)
+// notifyLeader notifies the updater the state of the leader
+// asynchronously. The blocks could be added concurrently, e.g., a
+// synced block and a block of a competing branch received live, so
+// the notifications could be delivered out of order. A notification
+// older than the delivered one is dropped, so the updater always
+// ends with the state of the latest leader. It must be called with
+// c.mu held.
+func (c *Chain) notifyLeader(s State) {
+	c.leaderSeq++
+	seq := c.leaderSeq
+	go func() {
+		c.updateMu.Lock()
+		defer c.updateMu.Unlock()
+		if seq <= c.updatedSeq {
+			return
+		}
+
+		c.updatedSeq = seq
+		c.updater.Update(s)
+	}()
+}
+
+// scheduleEndRound notifies the node the end of the round after
+// endRoundDelay. A pending notification of an earlier round is stale
+// once the round ends, it is collapsed into the notification of the
+// round at the pending notification time. It must be called with
+// c.mu held.
+func (c *Chain) scheduleEndRound(round uint64, now time.Time) {
+	var delay time.Duration
+	if c.stopEndRound != nil && c.stopEndRound() {
+		delay = c.lastEndRoundNotify.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+	} else {
+		delay = c.endRoundDelay(now)
 	}
 
-	width := 0
-	for _, child := range n.blockChildren {
-		width += widthAtDepth(child, d-1)
+	n := c.n
+	if n == nil {
+		// the chain is not attached to a node.
+		return
 	}
-	return width
+
+	c.endRoundSeq++
+	seq := c.endRoundSeq
+	c.stopEndRound = c.afterFunc(delay, func() {
+		c.mu.Lock()
+		if c.endRoundSeq == seq {
+			c.stopEndRound = nil
+		}
+		c.mu.Unlock()
+		n.EndRound(round)
+	})
 }
 
-func forkWidth(fork []*blockNode, depth int) int {
-	if depth == 0 {
-		return len(fork)
+// endRoundDelay returns the delay before notifying the node the end
+// of the round ended at now, so that the rounds don't advance faster
+// than Config.MinBlockInterval even if the blocks arrive early.
+func (c *Chain) endRoundDelay(now time.Time) time.Duration {
+	notify := c.lastEndRoundNotify.Add(c.cfg.MinBlockInterval)
+	if notify.Before(now) {
+		notify = now
 	}
 
-	width := 0
-	for _, branch := range fork {
-		width += widthAtDepth(branch, depth-1)
-	}
-	return width
+	c.lastEndRoundNotify = notify
+	return notify.Sub(now)
 }
 
-func nodeAtDepth(n *blockNode, d int) *blockNode {
-	if d == 0 {
-		if len(n.blockChildren) == 0 {
-			return nil
-		}
+// Rewind discards the blocks, block proposals and states above the
+// given round, restoring the chain head to the round. It is used by
+// the integration tests and admin recovery.
+//
+// The finalized blocks are never discarded, rewinding to a round
+// before the last finalized round returns an error, since the states
+// of the older finalized blocks are not kept.
+func (c *Chain) Rewind(round uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		return n.blockChildren[0]
+	finalizedRound := uint64(len(c.finalized) - 1)
+	if round < finalizedRound {
+		return fmt.Errorf("can not rewind to round %d, round %d is already finalized", round, finalizedRound)
 	}
 
-	for _, child := range n.blockChildren {
-		r := nodeAtDepth(child, d-1)
-		if r != nil {
-			return r
+	var bodies [][]byte
+	if round == finalizedRound {
+		for _, n := range c.fork {
+			bodies = append(bodies, c.branchTxns(n)...)
+			c.removeBranchState(n)
+		}
+		c.fork = nil
+	} else {
+		for _, n := range nodesAtDepth(c.fork, int(round-finalizedRound-1)) {
+			for _, child := range n.blockChildren {
+				bodies = append(bodies, c.branchTxns(child)...)
+				c.removeBranchState(child)
+			}
+			n.blockChildren = nil
 		}
 	}
 
+	c.store.RemoveAbove(round)
+	c.reinject(bodies)
+	_, leaderState, _ := c.leader()
+	c.notifyLeader(leaderState)
 	return nil
 }
 
-func nodeAtDepthInFork(fork []*blockNode, depth int) *blockNode {
-	if depth == 0 {
-		return fork[0]
+// branchWeight returns the weight of the heaviest chain in the
+// branch rooted at n.
+func branchWeight(n *blockNode) float64 {
+	var max float64
+	for _, child := range n.blockChildren {
+		w := branchWeight(child)
+		if w > max {
+			max = w
+		}
 	}
+	return n.Weight + max
+}
 
-	for _, branch := range fork {
-		r := nodeAtDepth(branch, depth-1)
-		if r != nil {
-			return r
+// pruneFork keeps the maxForks heaviest branches of the fork in their
+// original order, branches of the same weight are ordered by the
+// block hash, so every node drops the same branches.
+func pruneFork(fork []*blockNode, maxForks int) (kept, dropped []*blockNode) {
+	if len(fork) <= maxForks {
+		return fork, nil
+	}
+
+	weights := make(map[*blockNode]float64, len(fork))
+	sorted := make([]*blockNode, len(fork))
+	for i, n := range fork {
+		weights[n] = branchWeight(n)
+		sorted[i] = n
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		wi, wj := weights[sorted[i]], weights[sorted[j]]
+		if wi != wj {
+			return wi > wj
 		}
+		return bytes.Compare(sorted[i].Block[:], sorted[j].Block[:]) < 0
+	})
+
+	keep := make(map[*blockNode]bool, maxForks)
+	for _, n := range sorted[:maxForks] {
+		keep[n] = true
 	}
 
-	return nil
+	for _, n := range fork {
+		if keep[n] {
+			kept = append(kept, n)
+		} else {
+			dropped = append(dropped, n)
+		}
+	}
+	return
 }
 
-// must be called with mutex held
-func (c *Chain) finalize(round uint64) {
-	count := uint64(len(c.finalized))
-	if round < count {
-		return
+// branchTxns returns the serialized txns of the blocks of the branch
+// rooted at n. It must be called with c.mu held.
+func (c *Chain) branchTxns(n *blockNode) [][]byte {
+	var r [][]byte
+	if b := c.store.Block(n.Block); b != nil {
+		if bp := c.store.BlockProposal(b.BlockProposal); bp != nil && len(bp.Txns) > 0 {
+			r = append(r, bp.Txns)
+		}
 	}
 
-	depth := int(round - count)
+	for _, child := range n.blockChildren {
+		r = append(r, c.branchTxns(child)...)
+	}
+	return r
+}
 
-	if forkWidth(c.fork, depth) > 1 {
-		// more than one block in the finalized round,
-		// wait for next time to determin which fork
-		// is finalized.
+// reinject returns the txns of the discarded blocks to the txn pool,
+// so they are not lost in a reorg. The txns are validated against the
+// state of the leader.
+func (c *Chain) reinject(bodies [][]byte) {
+	if c.txnPool == nil || len(bodies) == 0 {
 		return
 	}
 
+	_, s, _ := c.leader()
+	count := 0
+	for _, b := range bodies {
+		count += c.txnPool.Reinject(b, s)
+	}
+	c.logger.Debug("reinjected txns of the discarded blocks", "bodies", len(bodies), "txns", count)
+}
+
+// removeBranchState removes the states of the blocks of the branch
+// rooted at n. It must be called with c.mu held.
+func (c *Chain) removeBranchState(n *blockNode) {
+	delete(c.unFinalizedState, n.Block)
+	for _, child := range n.blockChildren {
+		c.removeBranchState(child)
+	}
+}
+
+// removeBranchBlocks removes the blocks and the block proposals of
+// the branch rooted at n from the storage, the branch can never be
+// finalized. It must be called with c.mu held.
+func (c *Chain) removeBranchBlocks(n *blockNode) {
+	c.store.RemoveBlock(n.Block)
+	for _, child := range n.blockChildren {
+		c.removeBranchBlocks(child)
+	}
+}
+
+func forkWidth(fork []*blockNode, depth int) int {
+	return len(nodesAtDepth(fork, depth))
+}
+
+func nodeAtDepthInFork(fork []*blockNode, depth int) *blockNode {
+	nodes := nodesAtDepth(fork, depth)
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	return nodes[0]
+}
+
+// finalize finalizes the blocks up to the given round. The block of
+// a round is finalized once it is the only block of its round on the
+// unfinalized branches at the given round, the other branches are
+// discarded. The finalization catches up the rounds that are not
+// finalized earlier due to the competing branches. It must be called
+// with c.mu held.
+func (c *Chain) finalize(round uint64) {
+	for count := uint64(len(c.finalized)); count <= round; count = uint64(len(c.finalized)) {
+		depth := int(round - count)
+		if forkWidth(c.fork, depth) != 1 {
+			// more than one block in the finalized round,
+			// wait for next time to determin which fork
+			// is finalized.
+			return
+		}
+
+		c.finalizeRoot(depth)
+	}
+}
+
+// finalizeRoot finalizes the top-level ancestor of the only block at
+// the given depth of the fork. It must be called with c.mu held.
+func (c *Chain) finalizeRoot(depth int) {
 	root := nodeAtDepthInFork(c.fork, depth)
 	for i := depth; i > 0; i-- {
 		root = root.parent
@@ -484,16 +1052,38 @@ func (c *Chain) finalize(round uint64) {
 		panic("should not happen: the node to be finalized is not on fork")
 	}
 
+	c.finalizedRound[root.Block] = uint64(len(c.finalized))
 	c.finalized = append(c.finalized, root.Block)
+	if n := c.cfg.MaxRecentBlocks; n > 0 && len(c.finalized) > n {
+		delete(c.finalizedRound, c.finalized[len(c.finalized)-1-n])
+	}
+	c.store.Offload(root.Block)
 	c.lastFinalizedState = c.unFinalizedState[root.Block]
 	delete(c.unFinalizedState, root.Block)
-	c.fork = root.blockChildren
 
+	var bodies [][]byte
+	for _, b := range c.fork {
+		if b != root {
+			bodies = append(bodies, c.branchTxns(b)...)
+			c.removeBranchState(b)
+			c.removeBranchBlocks(b)
+		}
+	}
+
+	c.fork = root.blockChildren
 	for i := range c.fork {
 		c.fork[i].parent = nil
 	}
+	c.reinject(bodies)
+
+	c.randomBeacon.SetFinalizedRound(uint64(len(c.finalized) - 1))
+	if c.n != nil {
+		c.n.gateway.pruneNtShares(uint64(len(c.finalized) - 1))
+	}
 
-	// TODO: delete the state/block/bp of the removed branches from the map
+	// the block proposals of the finalized round that are not
+	// notarized will never be.
+	c.store.RemoveUnNotarized(uint64(len(c.finalized) - 1))
 }
 
 // Graphviz returns the Graphviz format encoded chain visualization.
@@ -1,8 +1,16 @@
 package consensus
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/ethdb"
+	log "github.com/helinwang/log15"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -91,6 +99,44 @@ func TestForkTraversal(t *testing.T) {
 	assert.Equal(t, n, nodeAtDepthInFork(fork, 3))
 }
 
+func TestDeepForkTree(t *testing.T) {
+	const depth = 100000
+	state := &myState{}
+	chain := NewChain(&Block{}, state, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+
+	// two competing branches, so none of the rounds can be
+	// finalized and the fork tree keeps growing.
+	var tips [2]*blockNode
+	for b := range tips {
+		var parent *blockNode
+		for i := 0; i < depth; i++ {
+			n := &blockNode{Block: SHA3([]byte(fmt.Sprintf("%d_%d", b, i))), Weight: float64(b + 1), parent: parent}
+			if parent == nil {
+				chain.fork = append(chain.fork, n)
+			} else {
+				parent.blockChildren = []*blockNode{n}
+			}
+			parent = n
+		}
+		tips[b] = parent
+		chain.unFinalizedState[parent.Block] = state
+	}
+
+	assert.Equal(t, depth, maxHeight(chain.fork))
+	assert.Equal(t, 2, forkWidth(chain.fork, depth-1))
+	assert.Equal(t, tips[0], nodeAtDepthInFork(chain.fork, depth-1))
+	assert.Equal(t, tips[1], heaviestFork(chain.fork, depth-1))
+	assert.Nil(t, nodesAtDepth(chain.fork, depth))
+
+	// the prev block is found at the bottom of the tree.
+	b := &Block{Round: depth + 1, PrevBlock: tips[0].Block, BlockProposal: Hash{1}}
+	_, err := chain.AddBlock(b, state, 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, b.Hash(), tips[0].blockChildren[0].Block)
+	assert.Equal(t, depth+1, maxHeight(chain.fork))
+	assert.Equal(t, uint64(0), chain.FinalizedRound())
+}
+
 func TestHeaviestFork(t *testing.T) {
 	fork := make([]*blockNode, 2)
 	fork[0] = &blockNode{Weight: 1}
@@ -118,3 +164,1160 @@ func TestHeaviestFork(t *testing.T) {
 	assert.Equal(t, n1, r)
 	assert.Equal(t, 4, maxHeight(fork))
 }
+
+func TestHeaviestForkAccumulatedWeight(t *testing.T) {
+	node := func(b byte, w float64, parent *blockNode) *blockNode {
+		n := &blockNode{Block: Hash{b}, Weight: w, parent: parent}
+		if parent != nil {
+			parent.blockChildren = append(parent.blockChildren, n)
+		}
+		return n
+	}
+
+	// the heavy leaf is on the light path: a(1) -> a2(0.125) ->
+	// a3(1), while b(1) -> b2(1) -> b3(0.25) is heavier.
+	a := node(1, 1, nil)
+	a3 := node(3, 1, node(2, 0.125, a))
+	b := node(4, 1, nil)
+	b2 := node(5, 1, b)
+	b3 := node(6, 0.25, b2)
+	c3 := node(7, 0.125, b2)
+	fork := []*blockNode{a, b}
+	assert.Equal(t, 2.125, weight(a3))
+	assert.Equal(t, 2.25, weight(b3))
+	assert.Equal(t, b3, heaviestFork(fork, 2))
+	assert.Equal(t, b2, heaviestFork(fork, 1))
+
+	// the leaves of the same accumulated weight are ordered by
+	// the block hash.
+	c3.Weight = 0.25
+	assert.Equal(t, b3, heaviestFork(fork, 2))
+	assert.Equal(t, b3, heaviestFork([]*blockNode{b, a}, 2))
+	b3.Block, c3.Block = c3.Block, b3.Block
+	assert.Equal(t, c3, heaviestFork(fork, 2))
+}
+
+func TestLeaderGenesisOnly(t *testing.T) {
+	genesis := &Block{}
+	state := &myState{}
+	chain := NewChain(genesis, state, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	assert.False(t, chain.HasProgressed())
+
+	b, s, _ := chain.Leader()
+	assert.Equal(t, genesis.Hash(), b.Hash())
+	assert.Equal(t, State(state), s)
+	assert.Equal(t, uint64(0), chain.FinalizedRound())
+
+	var blocks []*Block
+	var states []State
+	prev := genesis
+	for round := uint64(1); round <= 3; round++ {
+		s := &testState{h: SHA3([]byte{byte(round)})}
+		b := &Block{Round: round, PrevBlock: prev.Hash(), StateRoot: s.Hash()}
+		_, err := chain.AddBlock(b, s, 1, 0)
+		assert.Nil(t, err)
+		blocks = append(blocks, b)
+		states = append(states, s)
+		prev = b
+
+		if round == 1 {
+			// the notarized block counts as progress before
+			// it is finalized.
+			assert.True(t, chain.HasProgressed())
+			assert.Equal(t, uint64(0), chain.FinalizedRound())
+		}
+	}
+
+	// round 1 is finalized, the leader is the heaviest notarized
+	// block on top of it.
+	assert.Equal(t, uint64(1), chain.FinalizedRound())
+	assert.Equal(t, states[0], chain.FinalizedState())
+	assert.True(t, chain.HasProgressed())
+	b, s, _ = chain.Leader()
+	assert.Equal(t, blocks[2].Hash(), b.Hash())
+	assert.Equal(t, states[2], s)
+}
+
+func TestLeaderSysState(t *testing.T) {
+	genesis := &Block{}
+	state := &myState{}
+	chain := NewChain(genesis, state, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	_, _, sys := chain.Leader()
+	assert.Equal(t, chain.lastFinalizedSysState, sys)
+
+	b := &Block{Round: 1, PrevBlock: genesis.Hash(), StateRoot: state.Hash()}
+	_, err := chain.AddBlock(b, state, 1, 0)
+	assert.Nil(t, err)
+	leader, _, sys := chain.Leader()
+	assert.Equal(t, b.Hash(), leader.Hash())
+	assert.Equal(t, chain.lastFinalizedSysState, sys)
+
+	// a block carrying sys txns is rejected, it can not advance
+	// the system state of the leader.
+	bp := &BlockProposal{Round: 2, PrevBlock: b.Hash()}
+	nb := &Block{Round: 2, PrevBlock: b.Hash(), BlockProposal: bp.Hash(), StateRoot: state.Hash(), SysTxns: []SysTxn{{Type: ListGroups}}}
+	_, err = chain.AddBlock(nb, state, 1, 0)
+	assert.Equal(t, ErrBlockSysTxns, err)
+	leader, _, sys = chain.Leader()
+	assert.Equal(t, b.Hash(), leader.Hash())
+	assert.Equal(t, chain.lastFinalizedSysState, sys)
+}
+
+func TestApplyProposal(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, &testTxnPool{}, &myUpdater{}, newStorage(), nil)
+
+	sk := DeterministicSK([]byte("apply proposal"))
+	notary := NewNotary(sk.MustPK().Addr(), sk, sk, chain, chain.store)
+	bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Txns: []byte{1, 2, 3}}
+	s, root, err := chain.ApplyProposal(genesisState, bp, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, s.Hash(), root)
+
+	nts, _, err := notary.notarize(bp)
+	assert.Nil(t, err)
+	assert.Equal(t, nts.StateRoot, root)
+
+	_, _, err = chain.ApplyProposal(genesisState, bp, 2)
+	assert.NotNil(t, err)
+}
+
+func TestProposalStateRoot(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, &testTxnPool{}, &myUpdater{}, newStorage(), nil)
+
+	bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Txns: []byte{1, 2, 3}}
+	root, err := chain.ProposalStateRoot(bp)
+	assert.Nil(t, err)
+
+	sk := DeterministicSK([]byte("proposal state root"))
+	notary := NewNotary(sk.MustPK().Addr(), sk, sk, chain, chain.store)
+	nts, _, err := notary.notarize(bp)
+	assert.Nil(t, err)
+	assert.Equal(t, nts.StateRoot, root)
+	assert.Equal(t, genesisState.Hash(), chain.BlockState(genesis.Hash()).Hash())
+
+	_, err = chain.ProposalStateRoot(&BlockProposal{Round: 1, PrevBlock: Hash{1}})
+	assert.NotNil(t, err)
+}
+
+func TestMaxForks(t *testing.T) {
+	state := &myState{}
+	chain := NewChain(&Block{}, state, Rand{}, Config{MaxForks: 2}, nil, &myUpdater{}, newStorage(), nil)
+	genesis := chain.Genesis()
+	// a branch of height 2 keeps the round beyond the added blocks,
+	// so adding them does not end the round.
+	heavy := &blockNode{Block: Hash{1}, Weight: 0.5}
+	heavy.blockChildren = []*blockNode{{Block: Hash{2}, Weight: 0.5, parent: heavy}}
+	chain.fork = []*blockNode{heavy}
+	chain.unFinalizedState[Hash{1}] = state
+	chain.unFinalizedState[Hash{2}] = state
+
+	add := func(owner byte, weight float64) (Hash, error) {
+		b := &Block{Round: 1, PrevBlock: genesis, Owner: Addr{owner}, BlockProposal: Hash{owner}}
+		_, err := chain.AddBlock(b, state, weight, 0)
+		return b.Hash(), err
+	}
+
+	h0, err := add(1, 0.25)
+	assert.Nil(t, err)
+	h1, err := add(2, 0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(chain.fork))
+	assert.Equal(t, heavy, chain.fork[0])
+	assert.Equal(t, h1, chain.fork[1].Block)
+	_, ok := chain.unFinalizedState[h0]
+	assert.False(t, ok)
+
+	_, err = add(3, 0.125)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, len(chain.fork))
+
+	_, err = chain.AddBlock(&Block{Round: 2, PrevBlock: h0}, state, 1, 0)
+	assert.NotNil(t, err)
+}
+
+func TestMaxForksDropsNewBlock(t *testing.T) {
+	state := &myState{}
+	chain := NewChain(&Block{}, state, Rand{}, Config{MaxForks: 1}, nil, &myUpdater{}, newStorage(), nil)
+	genesis := chain.Genesis()
+	// the fork is over the limit, every branch lighter than
+	// the heaviest one is dropped together with the new block.
+	for i := byte(1); i <= 3; i++ {
+		n := &blockNode{Block: Hash{i}, Weight: float64(i)}
+		n.blockChildren = []*blockNode{{Block: Hash{i, 1}, Weight: 1, parent: n}}
+		chain.fork = append(chain.fork, n)
+		chain.unFinalizedState[n.Block] = state
+		chain.unFinalizedState[n.blockChildren[0].Block] = state
+	}
+
+	b := &Block{Round: 1, PrevBlock: genesis, Owner: Addr{9}, BlockProposal: Hash{9}}
+	_, err := chain.AddBlock(b, state, 0.5, 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(chain.fork))
+	assert.Equal(t, Hash{3}, chain.fork[0].Block)
+	assert.Equal(t, 2, len(chain.unFinalizedState))
+	assert.NotNil(t, chain.unFinalizedState[Hash{3}])
+	assert.NotNil(t, chain.unFinalizedState[Hash{3, 1}])
+}
+
+func TestPruneForkTie(t *testing.T) {
+	fork := []*blockNode{{Block: Hash{3}, Weight: 1}, {Block: Hash{1}, Weight: 1}, {Block: Hash{2}, Weight: 1}}
+	kept, dropped := pruneFork(fork, 2)
+	assert.Equal(t, []*blockNode{fork[1], fork[2]}, kept)
+	assert.Equal(t, []*blockNode{fork[0]}, dropped)
+}
+
+func TestNewChainInvalidGenesis(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{
+		StateRoot: genesisState.Hash(),
+		SysTxns: []SysTxn{
+			{Type: ListGroups, Data: testGobEncode(ListGroupsTxn{GroupIDs: []int{0}})},
+		},
+	}
+
+	_, err := NewChainChecked(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	assert.NotNil(t, err)
+	assert.Panics(t, func() {
+		NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	})
+
+	genesis.SysTxns = nil
+	_, err = NewChainChecked(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	assert.Nil(t, err)
+}
+
+func TestAddFirstBlockAfterGenesis(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	gh := genesis.Hash()
+
+	// the genesis round is finalized, round 1 is the first round
+	// producing blocks.
+	assert.Equal(t, uint64(0), chain.FinalizedRound())
+	assert.Equal(t, uint64(1), chain.Round())
+	assert.Equal(t, State(genesisState), chain.BlockState(gh))
+
+	root := genesisState.Hash()
+	_, err := chain.AddBlock(&Block{Round: 0, PrevBlock: gh, StateRoot: root}, genesisState, 1, 0)
+	assert.NotNil(t, err)
+	_, err = chain.AddBlock(&Block{Round: 1, PrevBlock: Hash{1}, StateRoot: root}, genesisState, 1, 0)
+	assert.NotNil(t, err)
+	_, err = chain.AddBlock(&Block{Round: 2, PrevBlock: gh, StateRoot: root}, genesisState, 1, 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), chain.Round())
+
+	s1 := &testState{h: SHA3([]byte("round 1"))}
+	b1 := &Block{Round: 1, PrevBlock: gh, StateRoot: s1.Hash()}
+	broadcast, err := chain.AddBlock(b1, s1, 1, 3)
+	assert.Nil(t, err)
+	assert.True(t, broadcast)
+	assert.Equal(t, uint64(2), chain.Round())
+	assert.Equal(t, uint64(0), chain.FinalizedRound())
+	assert.Equal(t, State(s1), chain.BlockState(b1.Hash()))
+
+	b, s, _ := chain.Leader()
+	assert.Equal(t, b1.Hash(), b.Hash())
+	assert.Equal(t, State(s1), s)
+
+	// round 1 ended exactly once.
+	status := chain.ChainStatus()
+	assert.Equal(t, 1, len(status.RoundMetrics))
+	assert.Equal(t, uint64(1), status.RoundMetrics[0].Round)
+	assert.Equal(t, 3, status.RoundMetrics[0].TxnCount)
+
+	done := make(chan struct{})
+	go func() {
+		chain.WaitUntil(2)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("round 2 is not started")
+	}
+
+	// another block of round 1 does not end the round again.
+	b1Other := &Block{Round: 1, PrevBlock: gh, Owner: Addr{1}, StateRoot: s1.Hash(), BlockProposal: Hash{1}}
+	_, err = chain.AddBlock(b1Other, s1, 0.5, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), chain.Round())
+	assert.Equal(t, 1, len(chain.ChainStatus().RoundMetrics))
+}
+
+func TestAddBlockStateRootMismatch(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+
+	// the stale prev state is not the state of the block.
+	bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Txns: []byte("txns")}
+	s, root, err := chain.ApplyProposal(genesisState, bp, 1)
+	assert.Nil(t, err)
+	b := &Block{Round: 1, PrevBlock: genesis.Hash(), StateRoot: root}
+	_, err = chain.AddBlock(b, genesisState, 1, 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(chain.fork))
+	assert.Nil(t, chain.store.Block(b.Hash()))
+
+	_, err = chain.AddBlock(b, s, 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, s, chain.BlockState(b.Hash()))
+	_, leaderState, _ := chain.Leader()
+	assert.Equal(t, root, leaderState.Hash())
+}
+
+func TestAddBlockCorruptedStateRoot(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, &testTxnPool{}, &myUpdater{}, newStorage(), nil)
+
+	bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Txns: []byte{1, 2, 3}}
+	root, err := chain.ProposalStateRoot(bp)
+	assert.Nil(t, err)
+
+	corrupted := &Block{Round: 1, PrevBlock: genesis.Hash(), BlockProposal: bp.Hash(), StateRoot: SHA3([]byte("corrupted"))}
+	_, err = chain.addBlock(corrupted, bp, 1)
+	assert.NotNil(t, err)
+	assert.Nil(t, chain.store.Block(corrupted.Hash()))
+	assert.Equal(t, 0, len(chain.fork))
+
+	b := &Block{Round: 1, PrevBlock: genesis.Hash(), BlockProposal: bp.Hash(), StateRoot: root}
+	_, err = chain.addBlock(b, bp, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, root, chain.BlockState(b.Hash()).Hash())
+}
+
+func TestAddBlockSameProposal(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+
+	bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Txns: []byte{1}}
+	s, root, err := chain.ApplyProposal(genesisState, bp, 1)
+	assert.Nil(t, err)
+
+	// the same block proposal with different notarizations.
+	b0 := &Block{Round: 1, PrevBlock: genesis.Hash(), StateRoot: root, BlockProposal: bp.Hash(), Notarization: Sig{1}}
+	b1 := &Block{Round: 1, PrevBlock: genesis.Hash(), StateRoot: root, BlockProposal: bp.Hash(), Notarization: Sig{2}}
+	_, err = chain.AddBlock(b0, s, 1, 0)
+	assert.Nil(t, err)
+	_, err = chain.AddBlock(b1, s, 1, 0)
+	assert.Equal(t, ErrBlockProposalNotarized, err)
+	assert.Nil(t, chain.store.Block(b1.Hash()))
+	assert.Equal(t, 1, len(chain.fork))
+	assert.Equal(t, b0.Hash(), chain.fork[0].Block)
+
+	// the first block is kept.
+	_, err = chain.AddBlock(b0, s, 1, 0)
+	assert.Equal(t, ErrBlockExists, err)
+}
+
+func TestPendingProposals(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+
+	var bps []*BlockProposal
+	for i := 0; i < 3; i++ {
+		bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: Addr{byte(i)}}
+		bps = append(bps, bp)
+		assert.True(t, chain.store.AddBlockProposal(bp, bp.Hash()))
+	}
+	next := &BlockProposal{Round: 2, PrevBlock: genesis.Hash()}
+	assert.True(t, chain.store.AddBlockProposal(next, next.Hash()))
+
+	sort.Slice(bps, func(i, j int) bool {
+		hi, hj := bps[i].Hash(), bps[j].Hash()
+		return bytes.Compare(hi[:], hj[:]) < 0
+	})
+	assert.Equal(t, bps, chain.PendingProposals(1))
+	assert.Equal(t, []*BlockProposal{next}, chain.PendingProposals(2))
+	assert.Equal(t, 0, len(chain.PendingProposals(3)))
+
+	s, root, err := chain.ApplyProposal(genesisState, bps[1], 1)
+	assert.Nil(t, err)
+	b := &Block{Round: 1, PrevBlock: genesis.Hash(), BlockProposal: bps[1].Hash(), StateRoot: root}
+	_, err = chain.AddBlock(b, s, 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []*BlockProposal{bps[0], bps[2]}, chain.PendingProposals(1))
+}
+
+func TestValidateRound(t *testing.T) {
+	chain := NewChain(&Block{}, &myState{}, Rand{}, Config{MaxFutureRounds: 5}, nil, &myUpdater{}, newStorage(), nil)
+	assert.Equal(t, uint64(1), chain.Round())
+
+	assert.NotNil(t, chain.ValidateRound(0))
+	assert.Nil(t, chain.ValidateRound(1))
+	assert.Nil(t, chain.ValidateRound(6))
+
+	// far-future and absurd rounds
+	assert.NotNil(t, chain.ValidateRound(7))
+	assert.NotNil(t, chain.ValidateRound(math.MaxUint64))
+
+	chain.finalized = append(chain.finalized, Hash{1}, Hash{2})
+	assert.NotNil(t, chain.ValidateRound(2))
+	assert.Nil(t, chain.ValidateRound(3))
+	assert.Nil(t, chain.ValidateRound(8))
+	assert.NotNil(t, chain.ValidateRound(9))
+
+	chain.cfg.MaxFutureRounds = 0
+	assert.Nil(t, chain.ValidateRound(math.MaxUint64))
+}
+
+func TestFinalizedState(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	assert.Equal(t, State(genesisState), chain.FinalizedState())
+
+	prev := genesis.Hash()
+	states := make([]State, 4)
+	for round := uint64(1); round <= 3; round++ {
+		s := &testState{h: SHA3([]byte{byte(round)})}
+		states[round] = s
+		b := &Block{Round: round, PrevBlock: prev, StateRoot: s.Hash()}
+		_, err := chain.AddBlock(b, s, 1, 0)
+		assert.Nil(t, err)
+		prev = b.Hash()
+	}
+
+	// round 1 is finalized when round 3 ends.
+	assert.Equal(t, uint64(1), chain.FinalizedRound())
+	assert.Equal(t, states[1], chain.FinalizedState())
+}
+
+func TestAddSiblingBlocks(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	gh := genesis.Hash()
+
+	add := func(round uint64, prev Hash, owner byte, weight float64) *Block {
+		s := &testState{h: SHA3([]byte{byte(round), owner})}
+		b := &Block{Round: round, PrevBlock: prev, Owner: Addr{owner}, StateRoot: s.Hash(), BlockProposal: Hash{owner}}
+		_, err := chain.AddBlock(b, s, weight, 0)
+		assert.Nil(t, err)
+		return b
+	}
+
+	// two proposals of the same prev block with different txns
+	// produce two blocks of different state roots.
+	a1 := add(1, gh, 1, 0.5)
+	b1 := add(1, gh, 2, 1)
+	assert.Equal(t, 2, len(chain.fork))
+	assert.Equal(t, a1.Hash(), chain.fork[0].Block)
+	assert.Equal(t, b1.Hash(), chain.fork[1].Block)
+
+	a2 := add(2, a1.Hash(), 1, 1)
+	b2 := add(2, a1.Hash(), 2, 0.25)
+	children := chain.fork[0].blockChildren
+	assert.Equal(t, 2, len(children))
+	assert.Equal(t, a2.Hash(), children[0].Block)
+	assert.Equal(t, b2.Hash(), children[1].Block)
+	assert.Equal(t, chain.fork[0], children[0].parent)
+	assert.Equal(t, chain.fork[0], children[1].parent)
+	assert.Equal(t, 0, len(chain.fork[1].blockChildren))
+
+	// each sibling is weighted independently.
+	assert.Equal(t, 1.5, weight(children[0]))
+	assert.Equal(t, 0.75, weight(children[1]))
+	leader, s, _ := chain.Leader()
+	assert.Equal(t, a2.Hash(), leader.Hash())
+	assert.Equal(t, a2.StateRoot, s.Hash())
+
+	// adding the same block again does not attach it twice.
+	broadcast, err := chain.AddBlock(b2, &testState{h: b2.StateRoot}, 0.25, 0)
+	assert.Equal(t, ErrBlockExists, err)
+	assert.False(t, broadcast)
+	assert.Equal(t, 2, len(chain.fork[0].blockChildren))
+}
+
+func TestRewind(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+
+	add := func(round uint64, prev Hash, owner byte, weight float64) *Block {
+		s := &testState{h: SHA3([]byte{byte(round), owner})}
+		b := &Block{Round: round, PrevBlock: prev, Owner: Addr{owner}, StateRoot: s.Hash(), BlockProposal: Hash{owner}}
+		_, err := chain.AddBlock(b, s, weight, 0)
+		assert.Nil(t, err)
+		return b
+	}
+
+	blocks := []*Block{genesis}
+	for round := uint64(1); round <= 5; round++ {
+		blocks = append(blocks, add(round, blocks[round-1].Hash(), 1, 1))
+	}
+	sibling := add(4, blocks[3].Hash(), 2, 0.5)
+	assert.Equal(t, uint64(6), chain.Round())
+	assert.Equal(t, uint64(3), chain.FinalizedRound())
+
+	assert.NotNil(t, chain.Rewind(2))
+	assert.Equal(t, uint64(6), chain.Round())
+
+	assert.Nil(t, chain.Rewind(4))
+	assert.Equal(t, uint64(5), chain.Round())
+	assert.Equal(t, uint64(3), chain.FinalizedRound())
+	leader, s, _ := chain.Leader()
+	assert.Equal(t, blocks[4].Hash(), leader.Hash())
+	assert.Equal(t, blocks[4].StateRoot, s.Hash())
+	assert.Nil(t, chain.store.Block(blocks[5].Hash()))
+	assert.NotNil(t, chain.store.Block(sibling.Hash()))
+	_, ok := chain.unFinalizedState[blocks[5].Hash()]
+	assert.False(t, ok)
+
+	// the discarded block can be added again.
+	add(5, blocks[4].Hash(), 1, 1)
+	assert.Equal(t, uint64(6), chain.Round())
+
+	assert.Nil(t, chain.Rewind(3))
+	assert.Equal(t, uint64(4), chain.Round())
+	assert.Equal(t, uint64(3), chain.FinalizedRound())
+	assert.Equal(t, genesis.Hash(), chain.Genesis())
+	leader, s, _ = chain.Leader()
+	assert.Equal(t, blocks[3].Hash(), leader.Hash())
+	assert.Equal(t, blocks[3].StateRoot, s.Hash())
+	assert.Equal(t, 0, len(chain.unFinalizedState))
+	assert.Nil(t, chain.store.Block(sibling.Hash()))
+}
+
+func TestRoundRandomness(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	groups := []*group{newGroup(nil), newGroup(nil)}
+	chain.randomBeacon = NewRandomBeacon(Rand{}, groups, Config{})
+
+	prev := genesis.Hash()
+	var sigs []*RandBeaconSig
+	for round := uint64(1); round <= 3; round++ {
+		sig := &RandBeaconSig{Round: round, Sig: []byte{byte(round)}}
+		sigs = append(sigs, sig)
+		assert.True(t, chain.randomBeacon.AddRandBeaconSig(sig, false))
+
+		s := &testState{h: SHA3([]byte{byte(round)})}
+		b := &Block{Round: round, PrevBlock: prev, StateRoot: s.Hash()}
+		_, err := chain.AddBlock(b, s, 1, 0)
+		assert.Nil(t, err)
+		prev = b.Hash()
+	}
+	assert.Equal(t, uint64(1), chain.FinalizedRound())
+
+	r, err := chain.RoundRandomness(1)
+	assert.Nil(t, err)
+	assert.Equal(t, SHA3(sigs[0].Sig), r)
+	assert.Equal(t, SHA3(chain.randomBeacon.RandBeaconSig(1).Sig), r)
+
+	r, err = chain.RoundRandomness(0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, SHA3(sigs[0].Sig), r)
+
+	_, err = chain.RoundRandomness(2)
+	assert.NotNil(t, err)
+}
+
+func TestMinBlockInterval(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{MinBlockInterval: time.Second}, nil, &myUpdater{}, newStorage(), nil)
+	now := time.Unix(100, 0)
+	chain.now = func() time.Time { return now }
+
+	prev := genesis.Hash()
+	add := func(round uint64) {
+		s := &testState{h: SHA3([]byte{byte(round)})}
+		b := &Block{Round: round, PrevBlock: prev, StateRoot: s.Hash()}
+		_, err := chain.AddBlock(b, s, 1, 0)
+		assert.Nil(t, err)
+		prev = b.Hash()
+	}
+
+	// the blocks arrive at the same time, the ends of the rounds
+	// are spaced by the minimum interval.
+	for round := uint64(1); round <= 3; round++ {
+		add(round)
+		assert.Equal(t, round+1, chain.Round())
+		assert.Equal(t, now.Add(time.Duration(round-1)*time.Second), chain.lastEndRoundNotify)
+	}
+
+	// the block arrives late, the round ends immediately.
+	now = now.Add(10 * time.Second)
+	add(4)
+	assert.Equal(t, now, chain.lastEndRoundNotify)
+}
+
+// fakeTimer is a call scheduled by Chain.afterFunc in the tests.
+type fakeTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func TestEndRoundSchedule(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	store := newStorage()
+	// no round is finalized, the node has no gateway to prune
+	// the nt shares.
+	chain := NewChain(genesis, genesisState, Rand{}, Config{MinBlockInterval: time.Second, FinalizeDepth: 10}, nil, &myUpdater{}, store, nil)
+	now := time.Unix(100, 0)
+	chain.now = func() time.Time { return now }
+	var timers []*fakeTimer
+	chain.afterFunc = func(d time.Duration, f func()) func() bool {
+		ft := &fakeTimer{at: now.Add(d), f: f}
+		timers = append(timers, ft)
+		return func() bool {
+			if ft.stopped {
+				return false
+			}
+
+			ft.stopped = true
+			return true
+		}
+	}
+	fire := func(ft *fakeTimer) {
+		now = ft.at
+		ft.stopped = true
+		ft.f()
+	}
+
+	n := NewNode(chain, DeterministicSK([]byte{1}), nil, Config{}, store)
+	var ended []uint64
+	for round := uint64(1); round <= 4; round++ {
+		r := round
+		n.cancelNotarize[r] = func() { ended = append(ended, r) }
+	}
+
+	prev := genesis.Hash()
+	add := func(round uint64) {
+		s := &testState{h: SHA3([]byte{byte(round)})}
+		b := &Block{Round: round, PrevBlock: prev, StateRoot: s.Hash()}
+		_, err := chain.AddBlock(b, s, 1, 0)
+		assert.Nil(t, err)
+		prev = b.Hash()
+	}
+
+	// the first round ends immediately.
+	add(1)
+	assert.Equal(t, 1, len(timers))
+	assert.Equal(t, now, timers[0].at)
+	fire(timers[0])
+	assert.Equal(t, []uint64{1}, ended)
+
+	// the round 2 ends early, it is delayed by the minimum
+	// interval.
+	add(2)
+	assert.Equal(t, 2, len(timers))
+	assert.Equal(t, time.Unix(101, 0), timers[1].at)
+
+	// the round 3 ends before the round 2 is notified, the stale
+	// notification is collapsed into the round 3 at the same
+	// time.
+	add(3)
+	assert.Equal(t, 3, len(timers))
+	assert.True(t, timers[1].stopped)
+	assert.Equal(t, time.Unix(101, 0), timers[2].at)
+	fire(timers[2])
+	sort.Slice(ended, func(i, j int) bool { return ended[i] < ended[j] })
+	assert.Equal(t, []uint64{1, 2, 3}, ended)
+
+	// the round 4 is notified no earlier than the minimum
+	// interval after the last notification.
+	now = now.Add(200 * time.Millisecond)
+	add(4)
+	assert.Equal(t, 4, len(timers))
+	assert.Equal(t, time.Unix(102, 0), timers[3].at)
+	fire(timers[3])
+	assert.Equal(t, 4, len(ended))
+}
+
+func TestAddBlockReplay(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+
+	prev := genesis.Hash()
+	var blocks []*Block
+	var states []State
+	for round := uint64(1); round <= 3; round++ {
+		s := &testState{h: SHA3([]byte{byte(round)})}
+		b := &Block{Round: round, PrevBlock: prev, StateRoot: s.Hash()}
+		_, err := chain.AddBlock(b, s, 1, 0)
+		assert.Nil(t, err)
+		blocks = append(blocks, b)
+		states = append(states, s)
+		prev = b.Hash()
+	}
+	assert.Equal(t, uint64(1), chain.FinalizedRound())
+	assert.Equal(t, uint64(4), chain.Round())
+
+	// replaying the finalized block and the unfinalized block
+	// are both no-ops.
+	for _, i := range []int{0, 2} {
+		broadcast, err := chain.AddBlock(blocks[i], states[i], 1, 0)
+		assert.Equal(t, ErrBlockExists, err)
+		assert.False(t, broadcast)
+		assert.Equal(t, uint64(1), chain.FinalizedRound())
+		assert.Equal(t, uint64(4), chain.Round())
+	}
+
+	// the replayed genesis block is detected as well.
+	_, err := chain.AddBlock(genesis, genesisState, 1, 0)
+	assert.Equal(t, ErrBlockExists, err)
+}
+
+func TestFinalizedRoundBounded(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	store := newStorage()
+	store.SetBlockDB(ethdb.NewMemDatabase(), 1)
+	chain := NewChain(genesis, genesisState, Rand{}, Config{MaxRecentBlocks: 1}, nil, &myUpdater{}, store, nil)
+
+	prev := genesis.Hash()
+	var blocks []*Block
+	var states []State
+	for round := uint64(1); round <= 6; round++ {
+		s := &testState{h: SHA3([]byte{byte(round)})}
+		b := &Block{Round: round, PrevBlock: prev, StateRoot: s.Hash()}
+		_, err := chain.AddBlock(b, s, 1, 0)
+		assert.Nil(t, err)
+		blocks = append(blocks, b)
+		states = append(states, s)
+		prev = b.Hash()
+	}
+	assert.Equal(t, uint64(4), chain.FinalizedRound())
+
+	// only the recently finalized blocks are indexed.
+	assert.Equal(t, 1, len(chain.finalizedRound))
+	_, ok := chain.finalizedRound[blocks[3].Hash()]
+	assert.True(t, ok)
+
+	// the replayed old finalized block is still detected.
+	_, err := chain.AddBlock(blocks[0], states[0], 1, 0)
+	assert.Equal(t, ErrBlockExists, err)
+}
+
+// reinjectPool records the reinjected block bodies.
+type reinjectPool struct {
+	testTxnPool
+	bodies [][]byte
+}
+
+func (p *reinjectPool) Reinject(body []byte, s State) int {
+	p.bodies = append(p.bodies, body)
+	return 1
+}
+
+func TestReorgReinjectTxns(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	pool := &reinjectPool{}
+	store := newStorage()
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, pool, &myUpdater{}, store, nil)
+
+	add := func(round uint64, prev Hash, owner byte, txns []byte) *Block {
+		bp := &BlockProposal{Round: round, PrevBlock: prev, Owner: Addr{owner}, Txns: txns}
+		store.AddBlockProposal(bp, bp.Hash())
+		s := &testState{h: SHA3([]byte{byte(round), owner})}
+		b := &Block{Round: round, PrevBlock: prev, Owner: Addr{owner}, StateRoot: s.Hash(), BlockProposal: bp.Hash()}
+		_, err := chain.AddBlock(b, s, 1, 0)
+		assert.Nil(t, err)
+		return b
+	}
+
+	a1 := add(1, genesis.Hash(), 1, []byte("a1"))
+	add(1, genesis.Hash(), 2, []byte("b1"))
+	a2 := add(2, a1.Hash(), 1, []byte("a2"))
+	a3 := add(3, a2.Hash(), 1, []byte("a3"))
+	assert.Equal(t, 0, len(pool.bodies))
+
+	// a1 and a2 are finalized, the txns of the sibling of a1
+	// are reinjected.
+	add(4, a3.Hash(), 1, nil)
+	assert.Equal(t, uint64(2), chain.FinalizedRound())
+	assert.Equal(t, [][]byte{[]byte("b1")}, pool.bodies)
+
+	// the txns of the rewound blocks are reinjected as well.
+	pool.bodies = nil
+	assert.Nil(t, chain.Rewind(2))
+	assert.Equal(t, [][]byte{[]byte("a3")}, pool.bodies)
+}
+
+func TestLeaderOfLinearFork(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+
+	prev := genesis.Hash()
+	var state State = genesisState
+	for round := uint64(1); round <= 5; round++ {
+		var err error
+		state, _, err = state.CommitTxns(nil, nil, round)
+		assert.Nil(t, err)
+		b := &Block{Round: round, PrevBlock: prev, StateRoot: state.Hash()}
+		// the blocks of the lowest weight are still on the
+		// chain.
+		_, err = chain.AddBlock(b, state, math.SmallestNonzeroFloat64, 0)
+		assert.Nil(t, err)
+		prev = b.Hash()
+
+		leader, s, _ := chain.Leader()
+		assert.Equal(t, prev, leader.Hash())
+		assert.Equal(t, state.Hash(), s.Hash())
+	}
+	assert.Equal(t, uint64(3), chain.FinalizedRound())
+}
+
+func TestChainLogger(t *testing.T) {
+	var msgs []string
+	l := log.New("node", "test")
+	l.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		msgs = append(msgs, r.Msg)
+		return nil
+	}))
+
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{Logger: l}, nil, &myUpdater{}, newStorage(), nil)
+	s := &testState{h: SHA3([]byte{1})}
+	b := &Block{Round: 1, PrevBlock: genesis.Hash(), StateRoot: s.Hash()}
+	_, err := chain.AddBlock(b, s, 1, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, msgs, "add block to chain")
+}
+
+func TestForkChoiceStake(t *testing.T) {
+	a, b := testSysPK(1), testSysPK(2)
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{
+		StateRoot: genesisState.Hash(),
+		SysTxns: []SysTxn{
+			{Type: ReadyJoinGroup, Data: testGobEncode(ReadyJoinGroupTxn{ID: 0, PK: a})},
+			{Type: ReadyJoinGroup, Data: testGobEncode(ReadyJoinGroupTxn{ID: 1, PK: b, Stake: 3})},
+		},
+	}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	assert.Equal(t, uint64(DefaultStake), chain.lastFinalizedSysState.Stake(a.Addr()))
+	assert.Equal(t, uint64(3), chain.lastFinalizedSysState.Stake(b.Addr()))
+
+	// the block of the higher stake wins despite its lower rank.
+	wa := chain.blockWeight(a.Addr(), 0)
+	wb := chain.blockWeight(b.Addr(), 1)
+	assert.Equal(t, 1.0, wa)
+	assert.Equal(t, 1.5, wb)
+
+	s := &testState{h: SHA3([]byte{1})}
+	ba := &Block{Round: 1, Owner: a.Addr(), PrevBlock: genesis.Hash(), StateRoot: s.Hash(), BlockProposal: Hash{1}}
+	bb := &Block{Round: 1, Owner: b.Addr(), PrevBlock: genesis.Hash(), StateRoot: s.Hash(), BlockProposal: Hash{2}}
+	_, err := chain.AddBlock(ba, s, wa, 0)
+	assert.Nil(t, err)
+	_, err = chain.AddBlock(bb, s, wb, 0)
+	assert.Nil(t, err)
+
+	leader, _, _ := chain.Leader()
+	assert.Equal(t, bb.Hash(), leader.Hash())
+}
+
+func TestSubmitBlockProposal(t *testing.T) {
+	sk := DeterministicSK([]byte{1})
+	pk := sk.MustPK()
+	owner := pk.Addr()
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{
+		StateRoot: genesisState.Hash(),
+		SysTxns:   []SysTxn{{Type: ReadyJoinGroup, Data: testGobEncode(ReadyJoinGroupTxn{ID: 0, PK: pk})}},
+	}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	g := newGroup(nil)
+	g.Members = []Addr{owner}
+	chain.randomBeacon = NewRandomBeacon(Rand{}, []*group{g}, Config{})
+
+	bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner}
+	bp.OwnerSig = sk.Sign(bp.Encode(false))
+
+	// the random beacon has not reached round 1.
+	assert.NotNil(t, chain.SubmitBlockProposal(bp))
+	assert.True(t, chain.randomBeacon.AddRandBeaconSig(&RandBeaconSig{Round: 1}, false))
+
+	assert.Nil(t, chain.SubmitBlockProposal(bp))
+	assert.Equal(t, bp, chain.store.BlockProposal(bp.Hash()))
+	assert.Equal(t, ErrBlockProposalExists, chain.SubmitBlockProposal(bp))
+
+	unknownPrev := &BlockProposal{Round: 1, PrevBlock: Hash{1}, Owner: owner}
+	unknownPrev.OwnerSig = sk.Sign(unknownPrev.Encode(false))
+	assert.Equal(t, ErrUnknownPrevBlock, chain.SubmitBlockProposal(unknownPrev))
+
+	other := DeterministicSK([]byte{2})
+	notMember := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: other.MustPK().Addr()}
+	notMember.OwnerSig = other.Sign(notMember.Encode(false))
+	assert.Equal(t, ErrInvalidProposer, chain.SubmitBlockProposal(notMember))
+
+	badSig := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner, Timestamp: 1}
+	badSig.OwnerSig = other.Sign(badSig.Encode(false))
+	assert.Equal(t, ErrInvalidBlockProposalSig, chain.SubmitBlockProposal(badSig))
+	assert.Nil(t, chain.store.BlockProposal(badSig.Hash()))
+}
+
+func TestFinalizedBoundary(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	store := newStorage()
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, store, nil)
+	sk := DeterministicSK([]byte{1})
+	notary := NewNotary(sk.MustPK().Addr(), sk, sk, chain, store)
+
+	add := func(prev *Block, s State, round uint64, txns []byte) (*Block, State, error) {
+		bp := &BlockProposal{Round: round, PrevBlock: prev.Hash(), Txns: txns}
+		s, root, err := chain.ApplyProposal(s, bp, round)
+		assert.Nil(t, err)
+		b := &Block{Round: round, PrevBlock: prev.Hash(), StateRoot: root, BlockProposal: bp.Hash()}
+		_, err = chain.AddBlock(b, s, 1, 0)
+		return b, s, err
+	}
+
+	blocks := []*Block{genesis}
+	states := []State{genesisState}
+	for round := uint64(1); round <= 4; round++ {
+		b, s, err := add(blocks[round-1], states[round-1], round, nil)
+		assert.Nil(t, err)
+		blocks = append(blocks, b)
+		states = append(states, s)
+	}
+	assert.Equal(t, uint64(2), chain.FinalizedRound())
+
+	// the state of the last finalized block is kept, the buried
+	// finalized blocks' states are not, including the genesis
+	// block's.
+	assert.Equal(t, states[2], chain.BlockState(blocks[2].Hash()))
+	assert.Nil(t, chain.BlockState(blocks[1].Hash()))
+	assert.Nil(t, chain.BlockState(genesis.Hash()))
+
+	// a block extending the last finalized block derives its state
+	// from the last finalized state.
+	bp := &BlockProposal{Round: 3, PrevBlock: blocks[2].Hash(), Txns: []byte("sibling")}
+	nts, _, err := notary.notarize(bp)
+	assert.Nil(t, err)
+	want, _, err := states[2].CommitTxns(bp.Txns, nil, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, want.Hash(), nts.StateRoot)
+	_, _, err = add(blocks[2], states[2], 3, bp.Txns)
+	assert.Nil(t, err)
+
+	// the block proposal extending the buried finalized block is
+	// skipped instead of panicking.
+	_, _, err = notary.notarize(&BlockProposal{Round: 2, PrevBlock: blocks[1].Hash()})
+	assert.NotNil(t, err)
+	_, err = chain.ProposalStateRoot(&BlockProposal{Round: 2, PrevBlock: blocks[1].Hash()})
+	assert.NotNil(t, err)
+
+	// two blocks of round 3 extend the last finalized block, the
+	// finalization waits when round 5 ends.
+	b5, s5, err := add(blocks[4], states[4], 5, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), chain.FinalizedRound())
+	assert.Equal(t, states[2], chain.BlockState(blocks[2].Hash()))
+
+	// once round 6 ends, rounds 3 and 4 are finalized and the
+	// previously last finalized block is buried.
+	_, _, err = add(b5, s5, 6, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), chain.FinalizedRound())
+	assert.Nil(t, chain.BlockState(blocks[2].Hash()))
+	assert.Nil(t, chain.BlockState(blocks[3].Hash()))
+	assert.Equal(t, states[4], chain.BlockState(blocks[4].Hash()))
+	_, _, err = add(blocks[2], states[2], 3, []byte("late"))
+	assert.NotNil(t, err)
+}
+
+func TestAddBlockInvalidWeight(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+
+	s := &testState{h: SHA3([]byte{1})}
+	b := &Block{Round: 1, PrevBlock: genesis.Hash(), StateRoot: s.Hash()}
+	for _, w := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		_, err := chain.AddBlock(b, s, w, 0)
+		assert.Equal(t, ErrInvalidBlockWeight, err)
+	}
+	assert.Equal(t, 0, len(chain.fork))
+	assert.Nil(t, chain.store.Block(b.Hash()))
+
+	// the weight of a staked owner never underflows to 0.
+	pk := testSysPK(1)
+	genesis = &Block{
+		StateRoot: genesisState.Hash(),
+		SysTxns:   []SysTxn{{Type: ReadyJoinGroup, Data: testGobEncode(ReadyJoinGroupTxn{ID: 0, PK: pk})}},
+	}
+	chain = NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+	assert.Equal(t, math.SmallestNonzeroFloat64, chain.blockWeight(pk.Addr(), math.MaxUint16))
+	assert.Equal(t, 0.0, chain.blockWeight(Addr{1}, 0))
+}
+
+func TestLeaderEqualWeightTie(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+
+	var blocks []*Block
+	for owner := byte(1); owner <= 3; owner++ {
+		s := &testState{h: SHA3([]byte{owner})}
+		blocks = append(blocks, &Block{Round: 1, Owner: Addr{owner}, PrevBlock: genesis.Hash(), StateRoot: s.Hash(), BlockProposal: Hash{owner}})
+	}
+
+	min := blocks[0].Hash()
+	for _, b := range blocks[1:] {
+		h := b.Hash()
+		if bytes.Compare(h[:], min[:]) < 0 {
+			min = h
+		}
+	}
+
+	// the leader among the blocks of the same weight is the
+	// same regardless of the order they are added.
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+		chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, newStorage(), nil)
+		for _, i := range order {
+			b := blocks[i]
+			_, err := chain.AddBlock(b, &testState{h: b.StateRoot}, 1, 0)
+			assert.Nil(t, err)
+		}
+
+		leader, _, _ := chain.Leader()
+		assert.Equal(t, min, leader.Hash())
+	}
+}
+
+type lastUpdater struct {
+	mu sync.Mutex
+	s  State
+}
+
+func (l *lastUpdater) Update(s State) {
+	l.mu.Lock()
+	l.s = s
+	l.mu.Unlock()
+}
+
+func (l *lastUpdater) State() State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.s
+}
+
+func TestConcurrentAddCompetingBranches(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+
+	block := func(round uint64, prev Hash, owner byte) (*Block, State) {
+		s := &testState{h: SHA3([]byte{byte(round), owner})}
+		return &Block{Round: round, PrevBlock: prev, Owner: Addr{owner}, StateRoot: s.Hash(), BlockProposal: Hash{owner}}, s
+	}
+
+	a1, sa1 := block(1, genesis.Hash(), 1)
+	b1, sb1 := block(1, genesis.Hash(), 2)
+	a2, sa2 := block(2, a1.Hash(), 1)
+	b2, sb2 := block(2, b1.Hash(), 2)
+
+	for i := 0; i < 50; i++ {
+		u := &lastUpdater{}
+		chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, u, newStorage(), nil)
+		_, err := chain.AddBlock(a1, sa1, 1, 0)
+		assert.Nil(t, err)
+		_, err = chain.AddBlock(b1, sb1, 0.5, 0)
+		assert.Nil(t, err)
+
+		// the synced block and the live block of the
+		// competing branch are added concurrently.
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := chain.AddBlock(a2, sa2, 0.25, 0)
+			assert.Nil(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := chain.AddBlock(b2, sb2, 1, 0)
+			assert.Nil(t, err)
+		}()
+		wg.Wait()
+
+		assert.Equal(t, 2, len(chain.fork))
+		for _, n := range chain.fork {
+			assert.Equal(t, 1, len(n.blockChildren))
+		}
+
+		leader, s, _ := chain.Leader()
+		assert.Equal(t, b2.Hash(), leader.Hash())
+		assert.Equal(t, sb2, s)
+
+		// the updater ends with the state of the leader
+		// regardless of the order the blocks are added.
+		deadline := time.Now().Add(time.Second)
+		for u.State() != sb2 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		// give a stale notification the chance to arrive.
+		time.Sleep(time.Millisecond)
+		assert.Equal(t, sb2, u.State())
+	}
+}
+
+func TestFinalizeDepth(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	chain := NewChain(genesis, genesisState, Rand{}, Config{FinalizeDepth: 3}, nil, &myUpdater{}, newStorage(), nil)
+
+	add := func(round uint64, prev Hash, owner byte, weight float64) *Block {
+		s := &testState{h: SHA3([]byte{byte(round), owner})}
+		b := &Block{Round: round, PrevBlock: prev, Owner: Addr{owner}, StateRoot: s.Hash(), BlockProposal: Hash{owner}}
+		_, err := chain.AddBlock(b, s, weight, 0)
+		assert.Nil(t, err)
+		return b
+	}
+
+	// two competing branches, the branch a is heavier.
+	a := []*Block{genesis}
+	bp1 := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: Addr{2}}
+	chain.store.AddBlockProposal(bp1, Hash{2})
+	b1 := add(1, genesis.Hash(), 2, 0.5)
+	b2 := add(2, b1.Hash(), 2, 0.5)
+	for round := uint64(1); round <= 5; round++ {
+		a = append(a, add(round, a[round-1].Hash(), 1, 1))
+	}
+
+	// round n - 3 is not finalized when round n ends, since
+	// there are competing blocks.
+	assert.Equal(t, uint64(0), chain.FinalizedRound())
+	assert.Equal(t, 2, len(chain.fork))
+	assert.Equal(t, uint64(6), chain.Round())
+
+	a = append(a, add(6, a[5].Hash(), 1, 1))
+	assert.Equal(t, uint64(3), chain.FinalizedRound())
+	assert.Equal(t, uint64(7), chain.Round())
+	assert.Equal(t, 1, len(chain.fork))
+	assert.Equal(t, a[4].Hash(), chain.fork[0].Block)
+	assert.Equal(t, State(&testState{h: a[3].StateRoot}), chain.FinalizedState())
+	leader, _, _ := chain.Leader()
+	assert.Equal(t, a[6].Hash(), leader.Hash())
+
+	// the states of the discarded branch are removed.
+	_, ok := chain.unFinalizedState[b1.Hash()]
+	assert.False(t, ok)
+	_, ok = chain.unFinalizedState[b2.Hash()]
+	assert.False(t, ok)
+	assert.Equal(t, 3, len(chain.unFinalizedState))
+
+	// so are the blocks and the block proposals.
+	assert.Nil(t, chain.store.Block(b1.Hash()))
+	assert.Nil(t, chain.store.Block(b2.Hash()))
+	assert.Nil(t, chain.store.BlockProposal(Hash{2}))
+	assert.NotNil(t, chain.store.Block(a[4].Hash()))
+}
@@ -0,0 +1,163 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/helinwang/dex/pkg/pb"
+)
+
+// Codec encodes the blocks and the block proposals for transport and
+// storage. The hashes and the signatures are always computed over
+// the canonical RLP encoding regardless of the codec.
+type Codec interface {
+	EncodeBlock(b *Block) []byte
+	DecodeBlock(d []byte) (*Block, error)
+	EncodeBlockProposal(bp *BlockProposal) []byte
+	DecodeBlockProposal(d []byte) (*BlockProposal, error)
+}
+
+// NewCodec returns the codec of the given name: "rlp" or "protobuf",
+// the empty name means "rlp".
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case "", "rlp":
+		return rlpCodec{}, nil
+	case "protobuf":
+		return protobufCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+type rlpCodec struct{}
+
+func (rlpCodec) EncodeBlock(b *Block) []byte {
+	return b.Encode(true)
+}
+
+func (rlpCodec) DecodeBlock(d []byte) (*Block, error) {
+	var b Block
+	err := rlp.DecodeBytes(d, &b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+func (rlpCodec) EncodeBlockProposal(bp *BlockProposal) []byte {
+	return bp.Encode(true)
+}
+
+func (rlpCodec) DecodeBlockProposal(d []byte) (*BlockProposal, error) {
+	var bp BlockProposal
+	err := rlp.DecodeBytes(d, &bp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bp, nil
+}
+
+// protobufCodec encodes the fields in the order of the struct fields,
+// numbered from 1.
+type protobufCodec struct{}
+
+func (protobufCodec) EncodeBlock(b *Block) []byte {
+	var e pb.Encoder
+	e.Bytes(1, b.Owner[:])
+	e.Uint64(2, b.Round)
+	e.Bytes(3, b.StateRoot[:])
+	e.Bytes(4, b.BlockProposal[:])
+	e.Bytes(5, b.PrevBlock[:])
+	for _, txn := range b.SysTxns {
+		var te pb.Encoder
+		te.Uint64(1, uint64(txn.Type))
+		te.Bytes(2, txn.Data)
+		te.Bytes(3, txn.Sig)
+		e.Message(6, te.Data())
+	}
+	e.Bytes(7, b.Notarization)
+	return e.Data()
+}
+
+func (protobufCodec) DecodeBlock(d []byte) (*Block, error) {
+	var b Block
+	err := pb.Decode(d, func(field int, v uint64, f []byte) error {
+		switch field {
+		case 1:
+			return pb.Fixed(b.Owner[:], f)
+		case 2:
+			b.Round = v
+		case 3:
+			return pb.Fixed(b.StateRoot[:], f)
+		case 4:
+			return pb.Fixed(b.BlockProposal[:], f)
+		case 5:
+			return pb.Fixed(b.PrevBlock[:], f)
+		case 6:
+			var txn SysTxn
+			err := pb.Decode(f, func(field int, v uint64, f []byte) error {
+				switch field {
+				case 1:
+					txn.Type = SysTxnType(v)
+				case 2:
+					txn.Data = pb.Copy(f)
+				case 3:
+					txn.Sig = pb.Copy(f)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			b.SysTxns = append(b.SysTxns, txn)
+		case 7:
+			b.Notarization = pb.Copy(f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+func (protobufCodec) EncodeBlockProposal(bp *BlockProposal) []byte {
+	var e pb.Encoder
+	e.Uint64(1, bp.Round)
+	e.Bytes(2, bp.PrevBlock[:])
+	e.Bytes(3, bp.Txns)
+	e.Bytes(4, bp.Owner[:])
+	e.Uint64(5, uint64(bp.Timestamp))
+	e.Bytes(6, bp.OwnerSig)
+	return e.Data()
+}
+
+func (protobufCodec) DecodeBlockProposal(d []byte) (*BlockProposal, error) {
+	var bp BlockProposal
+	err := pb.Decode(d, func(field int, v uint64, f []byte) error {
+		switch field {
+		case 1:
+			bp.Round = v
+		case 2:
+			return pb.Fixed(bp.PrevBlock[:], f)
+		case 3:
+			bp.Txns = pb.Copy(f)
+		case 4:
+			return pb.Fixed(bp.Owner[:], f)
+		case 5:
+			bp.Timestamp = int64(v)
+		case 6:
+			bp.OwnerSig = pb.Copy(f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &bp, nil
+}
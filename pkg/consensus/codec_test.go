@@ -0,0 +1,50 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	bp := &BlockProposal{
+		Round:     3,
+		PrevBlock: Hash{1},
+		Txns:      []byte{1, 2, 3},
+		Owner:     Addr{2},
+		Timestamp: 1530000000000000000,
+		OwnerSig:  Sig{3},
+	}
+	b := &Block{
+		Owner:         Addr{2},
+		Round:         3,
+		StateRoot:     Hash{4},
+		BlockProposal: bp.Hash(),
+		PrevBlock:     Hash{1},
+		SysTxns: []SysTxn{
+			{Type: ListGroups, Data: []byte{5}, Sig: []byte{6}},
+			{Type: ReadyJoinGroup, Data: []byte{7}, Sig: []byte{8}},
+		},
+		Notarization: Sig{9},
+	}
+
+	for _, name := range []string{"rlp", "protobuf"} {
+		codec, err := NewCodec(name)
+		assert.Nil(t, err)
+
+		decodedBP, err := codec.DecodeBlockProposal(codec.EncodeBlockProposal(bp))
+		assert.Nil(t, err, name)
+		assert.Equal(t, bp, decodedBP, name)
+		assert.Equal(t, bp.Hash(), decodedBP.Hash(), name)
+
+		decoded, err := codec.DecodeBlock(codec.EncodeBlock(b))
+		assert.Nil(t, err, name)
+		assert.Equal(t, b, decoded, name)
+		assert.Equal(t, b.Hash(), decoded.Hash(), name)
+	}
+
+	_, err := protobufCodec{}.DecodeBlock([]byte{0x0a, 0x01, 0x01})
+	assert.NotNil(t, err)
+	_, err = NewCodec("json")
+	assert.NotNil(t, err)
+}
@@ -1,7 +1,10 @@
 package consensus
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 )
@@ -10,48 +13,129 @@ import (
 // is reached. It is used to collect the signature shares.
 type collector struct {
 	threshold int
-	merged    *lru.Cache
+	// size is the maximum number of the items buffered for a
+	// target, typically the committee size, 0 means no limit.
+	size   int
+	merged *lru.Cache
+	// window is the duration since the first item of a target
+	// during which the items of the target are accepted, 0 means
+	// no limit.
+	window time.Duration
+	stale  *lru.Cache
+	pruned *lru.Cache
+	now    func() time.Time
 
 	mu         sync.Mutex
 	mergeItems map[Hash][]Hash
 	items      map[Hash]interface{}
+	// owners of the items collected for each target, an owner is
+	// only counted once towards the threshold.
+	owners map[Hash]map[Addr]bool
+	start  map[Hash]time.Time
 }
 
-func newCollector(threshold int) *collector {
+func newCollector(threshold, size int, window time.Duration) *collector {
 	c, err := lru.New(1024)
 	if err != nil {
 		panic(err)
 	}
 
+	stale, err := lru.New(1024)
+	if err != nil {
+		panic(err)
+	}
+
+	pruned, err := lru.New(1024)
+	if err != nil {
+		panic(err)
+	}
+
 	return &collector{
 		threshold:  threshold,
+		size:       size,
 		merged:     c,
+		window:     window,
+		stale:      stale,
+		pruned:     pruned,
+		now:        time.Now,
 		mergeItems: make(map[Hash][]Hash),
 		items:      make(map[Hash]interface{}),
+		owners:     make(map[Hash]map[Addr]bool),
+		start:      make(map[Hash]time.Time),
 	}
 }
 
-func (c *collector) Remove(target Hash) {
-	c.mu.Lock()
+func (c *collector) remove(target Hash) {
 	current := c.mergeItems[target]
 	for i := range current {
 		delete(c.items, current[i])
 	}
 	delete(c.mergeItems, target)
-	c.mu.Unlock()
+	delete(c.owners, target)
+	delete(c.start, target)
 }
 
-func (c *collector) Add(target Hash, itemHash Hash, item interface{}) ([]interface{}, bool) {
-	if c.merged.Contains(target) {
-		// already merged before
-		return nil, false
+// ErrProposalPruned is returned when adding an item for a target
+// that is already pruned.
+var ErrProposalPruned = errors.New("proposal pruned")
+
+// Add adds the item of the owner for the target, the collected items
+// are returned once the threshold is reached. An error is returned if
+// the threshold is not positive, rather than treating a single item as
+// reaching the threshold.
+//
+// Items are deduplicated by owner, so re-adding the items recovered
+// after a restart, including the node's own previously submitted
+// share, does not count an owner twice.
+//
+// An error is returned if the buffered items of the target would
+// exceed the size, which should not happen since the items are
+// deduplicated by owner.
+//
+// Items arriving after the collection window of the target is closed
+// are ignored, and the items collected so far are dropped.
+//
+// ErrProposalPruned is returned if the target is pruned.
+//
+// The item reaching the threshold is intentionally not stored: the
+// collected items of the target are removed once released, the
+// target is only remembered as merged, so the later items are
+// ignored.
+func (c *collector) Add(target Hash, itemHash Hash, owner Addr, item interface{}) ([]interface{}, bool, error) {
+	if c.threshold <= 0 {
+		return nil, false, fmt.Errorf("internal error: invalid collector threshold %d", c.threshold)
+	}
+
+	if c.merged.Contains(target) || c.stale.Contains(target) {
+		// already merged or stale
+		return nil, false, nil
 	}
 
 	c.mu.Lock()
+	if c.pruned.Contains(target) {
+		// checked with the mutex held, so no item is added
+		// after the target is pruned.
+		c.mu.Unlock()
+		return nil, false, ErrProposalPruned
+	}
+
+	if c.expired(target) {
+		c.remove(target)
+		c.stale.Add(target, struct{}{})
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+
 	if _, ok := c.items[itemHash]; ok {
 		// already added
 		c.mu.Unlock()
-		return nil, false
+		return nil, false, nil
+	}
+
+	if c.owners[target][owner] {
+		// the owner already contributed an item
+		c.mu.Unlock()
+		return nil, false, nil
 	}
 
 	current := c.mergeItems[target]
@@ -63,14 +147,74 @@ func (c *collector) Add(target Hash, itemHash Hash, item interface{}) ([]interfa
 			items[i+1] = c.items[h]
 		}
 		c.merged.Add(target, struct{}{})
+		c.remove(target)
 		c.mu.Unlock()
-		return items, false
+		return items, false, nil
 	}
 
+	if c.size > 0 && len(current) >= c.size {
+		c.mu.Unlock()
+		return nil, false, fmt.Errorf("collected items of target %v exceeded the size %d", target, c.size)
+	}
+
+	if len(current) == 0 {
+		c.start[target] = c.now()
+	}
 	c.mergeItems[target] = append(current, itemHash)
 	c.items[itemHash] = item
+	if c.owners[target] == nil {
+		c.owners[target] = make(map[Addr]bool)
+	}
+	c.owners[target][owner] = true
+	c.mu.Unlock()
+	return nil, true, nil
+}
+
+// Count returns the number of the items collected for the target
+// that has not reached the threshold.
+func (c *collector) Count(target Hash) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.mergeItems[target])
+}
+
+// Prune drops the items collected for the target, the target can no
+// longer reach the threshold. Items added for a pruned target are
+// rejected with ErrProposalPruned.
+func (c *collector) Prune(target Hash) {
+	c.mu.Lock()
+	c.remove(target)
+	c.pruned.Add(target, struct{}{})
 	c.mu.Unlock()
-	return nil, true
+}
+
+// Merged returns true if the items of the target have already
+// reached the threshold and been released. Items added for a merged
+// target are ignored.
+func (c *collector) Merged(target Hash) bool {
+	return c.merged.Contains(target)
+}
+
+// Stale returns true if the collection window of the target is
+// closed before the threshold is reached. Items added for a stale
+// target are ignored.
+func (c *collector) Stale(target Hash) bool {
+	if c.stale.Contains(target) {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expired(target)
+}
+
+func (c *collector) expired(target Hash) bool {
+	if c.window <= 0 {
+		return false
+	}
+
+	start, ok := c.start[target]
+	return ok && c.now().Sub(start) > c.window
 }
 
 func (c *collector) Get(itemHash Hash) interface{} {
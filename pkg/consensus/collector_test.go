@@ -0,0 +1,207 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectorLateItemAfterMerged(t *testing.T) {
+	c := newCollector(2, 0, 0)
+	target := Hash{1}
+	items, broadcast, err := c.Add(target, Hash{2}, Addr{2}, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, items)
+	assert.True(t, broadcast)
+	assert.False(t, c.Merged(target))
+
+	items, broadcast, err = c.Add(target, Hash{3}, Addr{3}, 3)
+	assert.Equal(t, []interface{}{3, 2}, items)
+	assert.False(t, broadcast)
+	assert.True(t, c.Merged(target))
+
+	// a late item arriving after merged is ignored, and the
+	// target is reported as merged rather than failed.
+	items, broadcast, err = c.Add(target, Hash{4}, Addr{4}, 4)
+	assert.Nil(t, items)
+	assert.False(t, broadcast)
+	assert.True(t, c.Merged(target))
+	assert.False(t, c.Merged(Hash{5}))
+}
+
+func TestCollectorInvalidThreshold(t *testing.T) {
+	// bypass the config validation, a single item must not be
+	// treated as reaching the threshold.
+	for _, threshold := range []int{0, -1} {
+		c := newCollector(threshold, 0, 0)
+		items, broadcast, err := c.Add(Hash{1}, Hash{2}, Addr{2}, 2)
+		assert.NotNil(t, err)
+		assert.Nil(t, items)
+		assert.False(t, broadcast)
+		assert.False(t, c.Merged(Hash{1}))
+	}
+}
+
+func TestCollectorRecoverPartialSet(t *testing.T) {
+	c := newCollector(3, 0, 0)
+	target := Hash{1}
+	self := Addr{1}
+
+	// the partial set recovered after restart, including the
+	// node's own share.
+	_, _, err := c.Add(target, Hash{2}, self, "self")
+	assert.Nil(t, err)
+	_, _, err = c.Add(target, Hash{3}, Addr{2}, "other")
+	assert.Nil(t, err)
+
+	// the node submits its own share again, it must not be
+	// counted twice.
+	items, broadcast, err := c.Add(target, Hash{4}, self, "self again")
+	assert.Nil(t, err)
+	assert.Nil(t, items)
+	assert.False(t, broadcast)
+	assert.False(t, c.Merged(target))
+
+	items, _, err = c.Add(target, Hash{5}, Addr{3}, "third")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"third", "self", "other"}, items)
+	assert.True(t, c.Merged(target))
+}
+
+func TestCollectorStaleAfterWindow(t *testing.T) {
+	now := time.Unix(100, 0)
+	c := newCollector(3, 0, time.Second)
+	c.now = func() time.Time { return now }
+	target := Hash{1}
+
+	_, broadcast, err := c.Add(target, Hash{2}, Addr{2}, 2)
+	assert.Nil(t, err)
+	assert.True(t, broadcast)
+
+	now = now.Add(time.Second)
+	_, broadcast, err = c.Add(target, Hash{3}, Addr{3}, 3)
+	assert.Nil(t, err)
+	assert.True(t, broadcast)
+	assert.False(t, c.Stale(target))
+
+	// the window is closed, the share is stale even though it
+	// would reach the threshold.
+	now = now.Add(time.Millisecond)
+	assert.True(t, c.Stale(target))
+	items, broadcast, err := c.Add(target, Hash{4}, Addr{4}, 4)
+	assert.Nil(t, err)
+	assert.Nil(t, items)
+	assert.False(t, broadcast)
+	assert.False(t, c.Merged(target))
+	assert.Nil(t, c.Get(Hash{2}))
+	assert.True(t, c.Stale(target))
+
+	// other targets are not affected.
+	_, broadcast, err = c.Add(Hash{5}, Hash{6}, Addr{2}, 6)
+	assert.Nil(t, err)
+	assert.True(t, broadcast)
+	assert.False(t, c.Stale(Hash{5}))
+}
+
+func TestCollectorCleanAfterMerged(t *testing.T) {
+	c := newCollector(3, 0, time.Second)
+	target := Hash{1}
+	_, _, err := c.Add(target, Hash{2}, Addr{2}, 2)
+	assert.Nil(t, err)
+	_, _, err = c.Add(target, Hash{3}, Addr{3}, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, c.Count(target))
+
+	items, _, err := c.Add(target, Hash{4}, Addr{4}, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{4, 2, 3}, items)
+	assert.True(t, c.Merged(target))
+
+	// the collected items are removed, and the final item is
+	// never stored.
+	assert.Equal(t, 0, c.Count(target))
+	assert.Equal(t, 0, len(c.mergeItems))
+	assert.Equal(t, 0, len(c.items))
+	assert.Equal(t, 0, len(c.owners))
+	assert.Equal(t, 0, len(c.start))
+	assert.Nil(t, c.Get(Hash{2}))
+	assert.Nil(t, c.Get(Hash{4}))
+}
+
+func TestCollectorSize(t *testing.T) {
+	// the threshold is higher than the committee size due to a
+	// bug elsewhere, the buffered items must not exceed the size.
+	c := newCollector(5, 3, 0)
+	target := Hash{1}
+	for i := byte(0); i < 3; i++ {
+		items, broadcast, err := c.Add(target, Hash{2 + i}, Addr{2 + i}, i)
+		assert.Nil(t, err)
+		assert.Nil(t, items)
+		assert.True(t, broadcast)
+	}
+
+	items, broadcast, err := c.Add(target, Hash{5}, Addr{5}, 3)
+	assert.NotNil(t, err)
+	assert.Nil(t, items)
+	assert.False(t, broadcast)
+	assert.Equal(t, 3, c.Count(target))
+	assert.Nil(t, c.Get(Hash{5}))
+	assert.False(t, c.Merged(target))
+
+	// other targets are not affected.
+	_, broadcast, err = c.Add(Hash{6}, Hash{7}, Addr{2}, 7)
+	assert.Nil(t, err)
+	assert.True(t, broadcast)
+}
+
+func TestCollectorPrune(t *testing.T) {
+	c := newCollector(3, 0, 0)
+	target := Hash{1}
+	_, _, err := c.Add(target, Hash{2}, Addr{2}, 2)
+	assert.Nil(t, err)
+	_, _, err = c.Add(Hash{5}, Hash{6}, Addr{2}, 6)
+	assert.Nil(t, err)
+
+	c.Prune(target)
+	assert.Equal(t, 0, c.Count(target))
+	assert.Nil(t, c.Get(Hash{2}))
+	assert.Equal(t, 1, c.Count(Hash{5}))
+
+	// a late item of the pruned target is rejected.
+	items, broadcast, err := c.Add(target, Hash{3}, Addr{3}, 3)
+	assert.Equal(t, ErrProposalPruned, err)
+	assert.Nil(t, items)
+	assert.False(t, broadcast)
+	assert.Equal(t, 0, c.Count(target))
+}
+
+func TestCollectorReleaseAtThreshold(t *testing.T) {
+	for threshold := 1; threshold <= 4; threshold++ {
+		// the size is the group size, which could be the
+		// same as the threshold.
+		c := newCollector(threshold, threshold, 0)
+		target := Hash{1}
+		for i := 0; i < threshold-1; i++ {
+			items, broadcast, err := c.Add(target, Hash{byte(2 + i)}, Addr{byte(2 + i)}, i)
+			assert.Nil(t, err)
+			assert.Nil(t, items)
+			assert.True(t, broadcast)
+			assert.False(t, c.Merged(target))
+		}
+		assert.Equal(t, threshold-1, c.Count(target))
+
+		// the item reaching the threshold releases exactly
+		// threshold items immediately.
+		items, _, err := c.Add(target, Hash{100}, Addr{100}, threshold-1)
+		assert.Nil(t, err)
+		assert.Equal(t, threshold, len(items))
+		assert.True(t, c.Merged(target))
+
+		// the item beyond the threshold is not needed.
+		items, broadcast, err := c.Add(target, Hash{101}, Addr{101}, threshold)
+		assert.Nil(t, err)
+		assert.Nil(t, items)
+		assert.False(t, broadcast)
+	}
+}
@@ -14,12 +14,13 @@ import (
 // in the network.
 type gateway struct {
 	addr                     unicastAddr
-	net                      *network
+	net                      transport
 	chain                    *Chain
 	syncer                   *syncer
 	blockCache               *lru.Cache
 	bpCache                  *lru.Cache
 	randBeaconSigCache       *lru.Cache
+	ntSigRecoverers          *ntSigRecoverers
 	node                     *Node
 	store                    *storage
 	ntShareCollector         *collector
@@ -30,6 +31,12 @@ type gateway struct {
 	blockWaiters   map[Hash][]chan *Block
 	bpWaiters      map[Hash][]chan *BlockProposal
 	requestingItem map[Item]bool
+
+	ntShareMu sync.Mutex
+	// ntShareRounds is the rounds of the block proposals having
+	// nt shares collected, so the shares of the pruned block
+	// proposals can be dropped.
+	ntShareRounds map[Hash]uint64
 }
 
 // Item is the identification of an item that the current node owns.
@@ -87,7 +94,7 @@ func (i itemType) String() string {
 	}
 }
 
-func newGateway(net *network, chain *Chain, store *storage, groupThreshold int) *gateway {
+func newGateway(net transport, chain *Chain, store *storage, groupSize, groupThreshold int, shareGossipWindow time.Duration) *gateway {
 	bCache, err := lru.New(1024)
 	if err != nil {
 		panic(err)
@@ -109,13 +116,15 @@ func newGateway(net *network, chain *Chain, store *storage, groupThreshold int)
 		blockCache:               bCache,
 		bpCache:                  bpCache,
 		randBeaconSigCache:       randBeaconSigCache,
+		ntSigRecoverers:          newNtSigRecoverers(64),
 		chain:                    chain,
 		rbSigWaiters:             make(map[uint64][]chan *RandBeaconSig),
 		blockWaiters:             make(map[Hash][]chan *Block),
 		bpWaiters:                make(map[Hash][]chan *BlockProposal),
 		requestingItem:           make(map[Item]bool),
-		ntShareCollector:         newCollector(groupThreshold),
-		randBeaconShareCollector: newCollector(groupThreshold),
+		ntShareRounds:            make(map[Hash]uint64),
+		ntShareCollector:         newCollector(groupThreshold, groupSize, shareGossipWindow),
+		randBeaconShareCollector: newCollector(groupThreshold, groupSize, 0),
 	}
 
 	n.syncer = newSyncer(chain, n, store)
@@ -212,6 +221,15 @@ func (n *gateway) RequestBlock(ctx context.Context, addr unicastAddr, hash Hash)
 
 	c := make(chan *Block, 1)
 	n.mu.Lock()
+	// the block could be delivered after the cache miss above,
+	// it is added to the cache before the waiters are notified
+	// under n.mu, so checking again under n.mu makes sure the
+	// notification is not missed.
+	if v, ok := n.blockCache.Get(hash); ok {
+		n.mu.Unlock()
+		return v.(*Block), nil
+	}
+
 	n.blockWaiters[hash] = append(n.blockWaiters[hash], c)
 	if len(n.blockWaiters[hash]) == 1 {
 		err := n.requestItem(addr, Item{
@@ -245,6 +263,12 @@ func (n *gateway) RequestBlockProposal(ctx context.Context, addr unicastAddr, ha
 
 	c := make(chan *BlockProposal, 1)
 	n.mu.Lock()
+	// see RequestBlock for why the cache is checked again.
+	if v, ok := n.bpCache.Get(hash); ok {
+		n.mu.Unlock()
+		return v.(*BlockProposal), nil
+	}
+
 	n.bpWaiters[hash] = append(n.bpWaiters[hash], c)
 	if len(n.bpWaiters[hash]) == 1 {
 		err := n.requestItem(addr, Item{
@@ -362,7 +386,12 @@ func (n *gateway) recvRandBeaconSig(addr unicastAddr, r *RandBeaconSig) {
 
 func (n *gateway) validateNtShare(addr unicastAddr, r *NtShare) bool {
 	n.chain.randomBeacon.WaitUntil(r.Round)
-	_, _, nt := n.chain.randomBeacon.Committees(r.Round)
+	_, _, nt, err := n.chain.randomBeacon.Committees(r.Round)
+	if err != nil {
+		log.Warn("validateNtShare: can not find the nt cmte", "err", err)
+		return false
+	}
+
 	group := n.chain.randomBeacon.groups[nt]
 	sharePK, ok := group.MemberPK[r.Owner]
 	if !ok {
@@ -392,41 +421,61 @@ func (n *gateway) validateNtShare(addr unicastAddr, r *NtShare) bool {
 	}
 
 	b := ntToBlock(r, bp, r.BP)
-	msg := b.Encode(false)
-	if !r.SigShare.Verify(sharePK, msg) {
+	msg := NotarizationMessage(b)
+	if !n.chain.randomBeacon.sigCache.Verify(r.SigShare, sharePK, msg) {
 		return false
 	}
 
 	return true
 }
 
+// validateRandBeaconShareOwner returns true if the random beacon sig
+// share is signed by its owner, it does not depend on the round.
+func (n *gateway) validateRandBeaconShareOwner(r *RandBeaconSigShare) bool {
+	pk, ok := n.chain.lastFinalizedSysState.addrToPK[r.Owner]
+	if !ok {
+		log.Warn("rancom beacon sig shareowner not found", "owner", r.Owner)
+		return false
+	}
+
+	if !r.OwnerSig.Verify(pk, r.Encode(false)) {
+		log.Warn("invalid rand beacon share signature", "rand beacon share", r.Hash())
+		return false
+	}
+
+	return true
+}
+
+// validateRandBeaconSigShare validates the random beacon sig share
+// of the expected round, the owner signature is validated by the
+// caller.
 func (n *gateway) validateRandBeaconSigShare(r *RandBeaconSigShare) (int, bool) {
-	if h := SHA3(n.chain.randomBeacon.sigHistory[r.Round-1].Sig); h != r.LastSigHash {
-		log.Warn("validate random beacon share last sig error", "hash", r.LastSigHash, "expected", h)
+	last := n.chain.randomBeacon.RandBeaconSig(r.Round - 1)
+	if last == nil {
+		log.Warn("validate random beacon share last sig not found", "round", r.Round)
 		return 0, false
 	}
 
-	rb, _, _ := n.chain.randomBeacon.Committees(r.Round - 1)
-	group := n.chain.randomBeacon.groups[rb]
-	sharePK, ok := group.MemberPK[r.Owner]
-	if !ok {
-		log.Warn("ValidateRandBeaconSigShare: owner not a member of the rb cmte")
+	if h := SHA3(last.Sig); h != r.LastSigHash {
+		log.Warn("validate random beacon share last sig error", "hash", r.LastSigHash, "expected", h)
 		return 0, false
 	}
 
-	pk, ok := n.chain.lastFinalizedSysState.addrToPK[r.Owner]
-	if !ok {
-		log.Warn("rancom beacon sig shareowner not found", "owner", r.Owner)
+	rb, _, _, err := n.chain.randomBeacon.Committees(r.Round - 1)
+	if err != nil {
+		log.Warn("ValidateRandBeaconSigShare: can not find the rb cmte", "err", err)
 		return 0, false
 	}
 
-	if !r.OwnerSig.Verify(pk, r.Encode(false)) {
-		log.Warn("invalid rand beacon share signature", "rand beacon share", r.Hash())
+	group := n.chain.randomBeacon.groups[rb]
+	sharePK, ok := group.MemberPK[r.Owner]
+	if !ok {
+		log.Warn("ValidateRandBeaconSigShare: owner not a member of the rb cmte")
 		return 0, false
 	}
 
 	msg := randBeaconSigMsg(r.Round, r.LastSigHash)
-	if !r.Share.Verify(sharePK, msg) {
+	if !n.chain.randomBeacon.sigCache.Verify(r.Share, sharePK, msg) {
 		log.Warn("validate random beacon sig share error")
 		return 0, false
 	}
@@ -440,17 +489,42 @@ func (n *gateway) recvRandBeaconSigShare(addr unicastAddr, r *RandBeaconSigShare
 		return
 	}
 
+	if !n.validateRandBeaconShareOwner(r) {
+		return
+	}
+
+	deferred, err := n.chain.randomBeacon.DeferSigShare(r, func() {
+		n.recvRandBeaconSigShare(addr, r)
+	})
+	if err != nil {
+		log.Warn("dropped random beacon sig share", "round", r.Round, "err", err)
+		return
+	}
+
+	if deferred {
+		return
+	}
+
+	if r.Round <= n.chain.randomBeacon.Round() {
+		// the signature of the round is already recovered
+		// or received, the share is no longer needed.
+		return
+	}
+
 	h := r.Hash()
-	n.chain.randomBeacon.WaitUntil(r.Round - 1)
 	groupID, valid := n.validateRandBeaconSigShare(r)
 
 	if !valid {
 		return
 	}
 
-	shares, broadcast := n.randBeaconShareCollector.Add(r.LastSigHash, h, r)
+	shares, broadcast, err := n.randBeaconShareCollector.Add(r.LastSigHash, h, r.Owner, r)
+	if err != nil {
+		log.Error("collect rand beacon sig share error", "err", err)
+		return
+	}
+
 	if shares != nil {
-		n.randBeaconShareCollector.Remove(r.LastSigHash)
 		s := make([]*RandBeaconSigShare, len(shares))
 		for i := range s {
 			s[i] = shares[i].(*RandBeaconSigShare)
@@ -471,8 +545,9 @@ func (n *gateway) recvRandBeaconSigShare(addr unicastAddr, r *RandBeaconSigShare
 	n.store.KeepLastRoundRandBeaconSigShare(r)
 }
 
-func (n *gateway) recvBlock(addr unicastAddr, b *Block, h Hash) {
-	go n.node.BlockForRoundProduced(b.Round)
+// deliverBlock caches the received block and notifies the waiters
+// of RequestBlock.
+func (n *gateway) deliverBlock(b *Block, h Hash) {
 	n.blockCache.Add(h, b)
 
 	n.mu.Lock()
@@ -481,6 +556,29 @@ func (n *gateway) recvBlock(addr unicastAddr, b *Block, h Hash) {
 	}
 	n.blockWaiters[h] = nil
 	n.mu.Unlock()
+}
+
+// deliverBlockProposal caches the received block proposal and
+// notifies the waiters of RequestBlockProposal.
+func (n *gateway) deliverBlockProposal(bp *BlockProposal, h Hash) {
+	n.bpCache.Add(h, bp)
+
+	n.mu.Lock()
+	for _, c := range n.bpWaiters[h] {
+		c <- bp
+	}
+	n.bpWaiters[h] = nil
+	n.mu.Unlock()
+}
+
+func (n *gateway) recvBlock(addr unicastAddr, b *Block, h Hash) {
+	if err := n.chain.ValidateRound(b.Round); err != nil {
+		log.Warn("received block of invalid round", "hash", h, "err", err)
+		return
+	}
+
+	go n.node.BlockForRoundProduced(b.Round)
+	n.deliverBlock(b, h)
 
 	_, broadcast, err := n.syncer.SyncBlock(addr, h, b.Round)
 	if err != nil {
@@ -494,14 +592,12 @@ func (n *gateway) recvBlock(addr unicastAddr, b *Block, h Hash) {
 }
 
 func (n *gateway) recvBlockProposal(addr unicastAddr, bp *BlockProposal, h Hash) {
-	n.bpCache.Add(h, bp)
-
-	n.mu.Lock()
-	for _, c := range n.bpWaiters[h] {
-		c <- bp
+	if err := n.chain.ValidateRound(bp.Round); err != nil {
+		log.Warn("received block proposal of invalid round", "hash", h, "err", err)
+		return
 	}
-	n.bpWaiters[h] = nil
-	n.mu.Unlock()
+
+	n.deliverBlockProposal(bp, h)
 
 	_, broadcast, err := n.syncer.SyncBlockProposal(addr, h)
 	if err != nil {
@@ -520,12 +616,37 @@ func (n *gateway) recvNtShare(addr unicastAddr, s *NtShare, h Hash) {
 		return
 	}
 
+	if err := n.chain.ValidateRound(s.Round); err != nil {
+		log.Warn("received nt share of invalid round", "hash", h, "err", err)
+		return
+	}
+
+	if n.ntShareCollector.Merged(s.BP) {
+		// a late share, the block proposal is already
+		// notarized, not an error.
+		log.Debug("skipped nt share of already notarized block proposal", "round", s.Round, "bp", s.BP)
+		return
+	}
+
+	if n.ntShareCollector.Stale(s.BP) {
+		log.Debug("skipped stale nt share, the share gossip window is closed", "round", s.Round, "bp", s.BP)
+		return
+	}
+
 	if !n.validateNtShare(addr, s) {
 		log.Error("received invalid nt share")
 		return
 	}
 
-	shares, broadcastNt := n.ntShareCollector.Add(s.BP, h, s)
+	shares, broadcastNt, err := n.collectNtShare(s, h)
+	if err == ErrProposalPruned {
+		log.Debug("skipped nt share of pruned block proposal", "round", s.Round, "bp", s.BP)
+		return
+	} else if err != nil {
+		log.Error("collect nt share error", "err", err)
+		return
+	}
+
 	if shares != nil {
 		ss := make([]*NtShare, len(shares))
 		for i := range ss {
@@ -541,14 +662,19 @@ func (n *gateway) recvNtShare(addr unicastAddr, s *NtShare, h Hash) {
 		if broadcast {
 			go n.broadcast(Item{T: blockProposalItem, Hash: s.BP})
 		}
-		n.ntShareCollector.Remove(s.BP)
 
-		block := recoverBlock(ss, bp, s.BP, n.chain.randomBeacon)
+		block, err := recoverBlock(ss, bp, s.BP, n.chain.randomBeacon, n.ntSigRecoverers)
+		if err != nil {
+			log.Error("error recover block from nt shares", "bp", s.BP, "err", err)
+			return
+		}
+
 		go n.recvBlock(addr, block, block.Hash())
 		// will broadcast block instead of the nt share.
 		return
 	}
 
+	log.Debug("collected nt share", "round", s.Round, "bp", s.BP, "count", n.ntShareCollector.Count(s.BP))
 	if broadcastNt {
 		go n.broadcast(Item{T: ntShareItem, Hash: h, Round: s.Round})
 	}
@@ -556,6 +682,42 @@ func (n *gateway) recvNtShare(addr unicastAddr, s *NtShare, h Hash) {
 	n.store.KeepLastRoundNtShare(s, h)
 }
 
+// collectNtShare adds the nt share to the nt share collector, the
+// collected shares are returned once the threshold is reached.
+// ErrProposalPruned is returned if the block proposal is pruned.
+func (n *gateway) collectNtShare(s *NtShare, h Hash) ([]interface{}, bool, error) {
+	n.ntShareMu.Lock()
+	defer n.ntShareMu.Unlock()
+
+	shares, broadcast, err := n.ntShareCollector.Add(s.BP, h, s.Owner, s)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if shares != nil {
+		delete(n.ntShareRounds, s.BP)
+	} else if broadcast {
+		n.ntShareRounds[s.BP] = s.Round
+	}
+	return shares, broadcast, nil
+}
+
+// pruneNtShares drops the nt shares collected for the block
+// proposals up to the given round, they can no longer be notarized
+// once the round is finalized. The shares arriving later for the
+// pruned block proposals are rejected.
+func (n *gateway) pruneNtShares(round uint64) {
+	n.ntShareMu.Lock()
+	defer n.ntShareMu.Unlock()
+
+	for bp, r := range n.ntShareRounds {
+		if r <= round {
+			n.ntShareCollector.Prune(bp)
+			delete(n.ntShareRounds, bp)
+		}
+	}
+}
+
 func ntToBlock(nt *NtShare, bp *BlockProposal, bpHash Hash) *Block {
 	b := &Block{
 		Owner:         bp.Owner,
@@ -567,24 +729,29 @@ func ntToBlock(nt *NtShare, bp *BlockProposal, bpHash Hash) *Block {
 	return b
 }
 
-func recoverBlock(shares []*NtShare, bp *BlockProposal, bpHash Hash, rb *RandomBeacon) *Block {
+// recoverBlock recovers the notarized block from the nt shares, an
+// error is returned if the committees of the block proposal's round
+// are unknown or the recovered signature is invalid.
+func recoverBlock(shares []*NtShare, bp *BlockProposal, bpHash Hash, rb *RandomBeacon, r *ntSigRecoverers) (*Block, error) {
 	log.Debug("generating block from proposal and notarization", "bp", bpHash)
-	sig, err := recoverNtSig(shares)
+	_, _, ntGroup, err := rb.Committees(bp.Round)
 	if err != nil {
-		// should not happen
-		panic(err)
+		return nil, err
 	}
 
-	_, _, ntGroup := rb.Committees(bp.Round)
+	sig, err := r.Recover(shares)
+	if err != nil {
+		return nil, err
+	}
 
 	b := ntToBlock(shares[0], bp, bpHash)
-	msg := b.Encode(false)
-	if !sig.Verify(rb.groups[ntGroup].PK, msg) {
-		panic(fmt.Errorf("should never happen: group %d sig not valid", ntGroup))
+	msg := NotarizationMessage(b)
+	if !rb.sigCache.Verify(sig, rb.groups[ntGroup].PK, msg) {
+		return nil, fmt.Errorf("recovered group %d sig not valid", ntGroup)
 	}
 
 	b.Notarization = sig
-	return b
+	return b, nil
 }
 
 func (n *gateway) recvInventory(addr unicastAddr, item Item) {
@@ -0,0 +1,82 @@
+package consensus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestConcurrentDelivery(t *testing.T) {
+	hub := newMemHub()
+	peer := hub.newTransport(PK{1}, 1)
+	n := newGateway(hub.newTransport(PK{2}, 2), nil, newStorage(), 3, 2, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		bp := &BlockProposal{Round: uint64(i + 1)}
+		bpHash := bp.Hash()
+		b := &Block{Round: uint64(i + 1), BlockProposal: bpHash}
+		h := b.Hash()
+
+		wg.Add(2)
+		go func() {
+			n.deliverBlockProposal(bp, bpHash)
+			wg.Done()
+		}()
+		go func() {
+			n.deliverBlock(b, h)
+			wg.Done()
+		}()
+
+		// the delivery interleaves with the requests, the
+		// requests must never miss it.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		r, err := n.RequestBlock(ctx, peer.addr, h)
+		assert.Nil(t, err)
+		assert.Equal(t, b, r)
+		p, err := n.RequestBlockProposal(ctx, peer.addr, r.BlockProposal)
+		assert.Nil(t, err)
+		assert.Equal(t, bp, p)
+		cancel()
+	}
+	wg.Wait()
+}
+
+func TestPruneNtShares(t *testing.T) {
+	hub := newMemHub()
+	n := newGateway(hub.newTransport(PK{1}, 1), nil, newStorage(), 3, 2, 0)
+
+	s1 := &NtShare{Round: 1, BP: Hash{1}, Owner: Addr{1}}
+	s2 := &NtShare{Round: 2, BP: Hash{2}, Owner: Addr{1}}
+	for _, s := range []*NtShare{s1, s2} {
+		shares, broadcast, err := n.collectNtShare(s, s.Hash())
+		assert.Nil(t, err)
+		assert.Nil(t, shares)
+		assert.True(t, broadcast)
+	}
+
+	n.pruneNtShares(1)
+	assert.Equal(t, 0, n.ntShareCollector.Count(s1.BP))
+	assert.Nil(t, n.ntShareCollector.Get(s1.Hash()))
+	assert.Equal(t, 1, n.ntShareCollector.Count(s2.BP))
+	assert.Equal(t, map[Hash]uint64{s2.BP: 2}, n.ntShareRounds)
+
+	// a late share of the pruned block proposal is rejected.
+	late := &NtShare{Round: 1, BP: s1.BP, Owner: Addr{2}}
+	shares, _, err := n.collectNtShare(late, late.Hash())
+	assert.Nil(t, shares)
+	assert.Equal(t, ErrProposalPruned, err)
+	assert.Equal(t, "proposal pruned", err.Error())
+	assert.Equal(t, 0, n.ntShareCollector.Count(s1.BP))
+
+	// the block proposal of the unfinalized round still reaches
+	// the threshold.
+	s3 := &NtShare{Round: 2, BP: s2.BP, Owner: Addr{2}}
+	shares, _, err = n.collectNtShare(s3, s3.Hash())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(shares))
+	assert.Equal(t, 0, len(n.ntShareRounds))
+}
@@ -29,6 +29,15 @@ type netAddr interface {
 
 type broadcast struct{}
 
+// transport is the network layer through which the gateway sends and
+// receives packets.
+type transport interface {
+	Start(host string, port int) (unicastAddr, error)
+	ConnectSeed(addr string) error
+	Send(addr netAddr, p packet) error
+	Recv() (unicastAddr, packet)
+}
+
 type packetAndAddr struct {
 	P packet
 	A unicastAddr
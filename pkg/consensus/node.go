@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/ethdb"
 	log "github.com/helinwang/log15"
 )
 
@@ -48,6 +49,76 @@ type Config struct {
 	BlockTime      time.Duration
 	GroupSize      int
 	GroupThreshold int
+	// BeaconTimeout is the duration after which the random beacon
+	// is considered stalled if no new random beacon signature is
+	// received, 0 disables the liveness watchdog.
+	BeaconTimeout time.Duration
+	// HistoryRetention is the number of the rounds below the
+	// last finalized round whose committee assignments are kept
+	// by the random beacon, 0 means keeping all of them. The
+	// unfinalized rounds are always kept, and the retention is at
+	// least minHistoryRetention.
+	HistoryRetention uint64
+	// MaxClockSkew is the tolerated difference between the local
+	// clock and the timestamp of a received block proposal, 0
+	// disables the timestamp check.
+	MaxClockSkew time.Duration
+	// MaxForks is the maximum number of the top-level branches
+	// of the unfinalized blocks, the lightest branches are
+	// dropped when exceeded, 0 means no limit.
+	MaxForks int
+	// ShareGossipWindow is the duration since the first received
+	// notarization share of a block proposal during which its
+	// shares are accepted, the later shares are stale. 0 means
+	// no limit.
+	ShareGossipWindow time.Duration
+	// MaxFutureRounds is the maximum number of rounds a received
+	// block, block proposal or notarization share can be ahead of
+	// the current round, 0 means no limit.
+	MaxFutureRounds uint64
+	// MaxRecentBlocks is the maximum number of the finalized
+	// blocks kept in memory, the older finalized blocks are
+	// offloaded to the block database. 0 means all blocks are
+	// kept in memory.
+	MaxRecentBlocks int
+	// MinBlockInterval is the minimum duration between the ends
+	// of two consecutive rounds, the next round is delayed if
+	// the block arrives early. 0 means no limit.
+	MinBlockInterval time.Duration
+	// Codec is the name of the codec used to store the
+	// offloaded blocks: "rlp" or "protobuf", empty means
+	// "rlp". The hashes and the signatures are always computed
+	// over the RLP encoding.
+	Codec string
+	// SigCacheSize is the maximum number of the verified group
+	// signatures and signature shares cached to skip their
+	// re-verification, 0 disables the cache.
+	SigCacheSize int
+	// Logger is the logger used by the chain, the notary and the
+	// random beacon, nil means the package logger.
+	Logger log.Logger
+	// FinalizeDepth is the number of rounds after which a block
+	// is finalized: when round n ends, the block of round
+	// n - FinalizeDepth is finalized if it has no competing
+	// block. 0 means 2, the minimum depth that is safe, the
+	// smaller values are treated as 2.
+	FinalizeDepth uint64
+}
+
+func (c Config) logger() log.Logger {
+	if c.Logger == nil {
+		return log.Root()
+	}
+
+	return c.Logger
+}
+
+func (c Config) finalizeDepth() uint64 {
+	if c.FinalizeDepth < 2 {
+		return 2
+	}
+
+	return c.FinalizeDepth
 }
 
 // NewNode creates a new node.
@@ -79,11 +150,28 @@ func (n *Node) Chain() *Chain {
 	return n.chain
 }
 
-// Start starts the p2p network service.
+// NtShareCount returns the number of the notarization shares
+// collected for the block proposal that is not notarized yet.
+func (n *Node) NtShareCount(bp Hash) int {
+	return n.gateway.ntShareCollector.Count(bp)
+}
+
+// Start starts the p2p network service, and the random beacon stall
+// watchdog if Config.BeaconTimeout is set.
 func (n *Node) Start(host string, port int, seedAddr string) error {
+	if n.cfg.BeaconTimeout > 0 {
+		n.chain.randomBeacon.startWatch()
+	}
+
 	return n.gateway.Start(host, port, seedAddr)
 }
 
+// Stop stops the random beacon stall watchdog started by Start, the
+// p2p network service is not stopped.
+func (n *Node) Stop() {
+	n.chain.randomBeacon.Stop()
+}
+
 func (n *Node) proposeBlock(round uint64, group int, lastRoundEndTime time.Time) {
 	n.chain.WaitUntil(round)
 	n.mu.Lock()
@@ -150,7 +238,12 @@ func (n *Node) StartRound(round uint64) {
 
 	n.round = round
 	var ntCancelCtx context.Context
-	rbGroup, bpGroup, ntGroup := n.chain.randomBeacon.Committees(round)
+	rbGroup, bpGroup, ntGroup, err := n.chain.randomBeacon.Committees(round)
+	if err != nil {
+		log.Error("can not start round", "round", round, "err", err)
+		return
+	}
+
 	log.Info("start round", "round", round, "rand beacon", SHA3(n.chain.randomBeacon.History()[round].Sig), "rb group", rbGroup, "bp group", bpGroup, "nt group", ntGroup)
 
 	for _, m := range n.memberships {
@@ -192,16 +285,29 @@ func (n *Node) BlockForRoundProduced(round uint64) {
 }
 
 // EndRound marks the end of the given round. It happens when the
-// block for the given round is received.
+// block for the given round is received. The earlier rounds whose
+// notifications are collapsed into the round are ended as well.
 func (n *Node) EndRound(round uint64) {
 	log.Info("end round", "round", round)
-	delete(n.notarizeChs, round)
-	if c := n.cancelNotarize[round]; c != nil {
-		c()
-		delete(n.cancelNotarize, round)
+	for r := range n.notarizeChs {
+		if r <= round {
+			delete(n.notarizeChs, r)
+		}
+	}
+
+	for r, c := range n.cancelNotarize {
+		if r <= round {
+			c()
+			delete(n.cancelNotarize, r)
+		}
+	}
+
+	rb, _, _, err := n.chain.randomBeacon.Committees(round)
+	if err != nil {
+		log.Error("can not end round", "round", round, "err", err)
+		return
 	}
 
-	rb, _, _ := n.chain.randomBeacon.Committees(round)
 	for _, m := range n.memberships {
 		if m.groupID != rb {
 			continue
@@ -247,18 +353,32 @@ func (n *Node) SendTxn(t []byte) {
 }
 
 // MakeNode makes a new node with the given configurations.
-func MakeNode(credentials NodeCredentials, cfg Config, genesis Genesis, state State, txnPool TxnPool, u Updater, proposerPK []byte) *Node {
+func MakeNode(credentials NodeCredentials, cfg Config, genesis Genesis, state State, txnPool TxnPool, u Updater, proposerPK []byte, blockDB ethdb.Database) *Node {
+	net := newNetwork(credentials.SK)
+	node := makeNode(credentials, cfg, genesis, state, txnPool, u, proposerPK, blockDB, net)
+	net.onPeerConnect = node.gateway.onPeerConnect
+	return node
+}
+
+func makeNode(credentials NodeCredentials, cfg Config, genesis Genesis, state State, txnPool TxnPool, u Updater, proposerPK []byte, blockDB ethdb.Database, net transport) *Node {
 	randSeed := Rand(SHA3([]byte("dex")))
 	err := state.Deserialize(genesis.State)
 	if err != nil {
 		panic(err)
 	}
 
+	codec, err := NewCodec(cfg.Codec)
+	if err != nil {
+		panic(err)
+	}
+
 	store := newStorage()
+	store.codec = codec
+	if cfg.MaxRecentBlocks > 0 {
+		store.SetBlockDB(blockDB, cfg.MaxRecentBlocks)
+	}
 	chain := NewChain(&genesis.Block, state, randSeed, cfg, txnPool, u, store, proposerPK)
-	net := newNetwork(credentials.SK)
-	gateway := newGateway(net, chain, store, cfg.GroupThreshold)
-	net.onPeerConnect = gateway.onPeerConnect
+	gateway := newGateway(net, chain, store, cfg.GroupSize, cfg.GroupThreshold, cfg.ShareGossipWindow)
 	node := NewNode(chain, credentials.SK, gateway, cfg, store)
 	for j := range credentials.Groups {
 		share := credentials.GroupShares[j]
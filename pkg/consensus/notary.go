@@ -1,12 +1,11 @@
 package consensus
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"math"
+	"sort"
 	"time"
-
-	log "github.com/helinwang/log15"
 )
 
 // Notary notarizes blocks.
@@ -26,40 +25,92 @@ func NewNotary(owner Addr, sk, share SK, chain *Chain, store *storage) *Notary {
 // Notarize notarizes block proposals.
 //
 // It will collect block proposals to notarize until ctx is done, then
-// it will notarize the highest weight accumulated block
-// proposals. And it will keep notarizing the newly collected block
-// proposal if the weight is equal to or greater than the collected
-// block proposals until cancel context is done.
+// it will notarize the best block proposal. And it will keep
+// notarizing the newly collected block proposal if it is better than
+// the notarized ones until cancel context is done.
+//
+// A block proposal is better if it has a lower rank, the block
+// proposals of the same rank are ordered by their hashes. So the
+// choice only depends on the collected block proposals rather than
+// the order they arrived, every notary of the committee with the
+// same block proposals picks the same one. An invalid block proposal
+// is skipped and the next best one is notarized instead, so an
+// invalid block proposal of a top ranked proposer can not stop the
+// notarization of the round.
 func (n *Notary) Notarize(ctx, cancel context.Context, bCh chan *BlockProposal, onNotarize func(*NtShare, time.Duration)) {
-	var bestRankBPs []*BlockProposal
-	bestRank := uint16(math.MaxUint16)
+	// best is the best notarized block proposal.
+	var best *bpCandidate
+	var collected []bpCandidate
 	recvBestRank := false
 	recvBestRankCh := make(chan struct{})
+
+	candidate := func(bp *BlockProposal) (bpCandidate, bool) {
+		rank, err := n.chain.randomBeacon.Rank(bp.Owner, bp.Round)
+		if err != nil {
+			n.chain.logger.Error("get rank error", "err", err, "bp round", bp.Round)
+			return bpCandidate{}, false
+		}
+
+		return bpCandidate{bp: bp, hash: bp.Hash(), rank: rank}, true
+	}
+
+	// try notarizes the candidate if it is better than the best
+	// notarized one, the best one is only replaced once the
+	// candidate is notarized. onNotarize is only called for the
+	// notarized block proposals, the skipped ones are not
+	// reported.
+	try := func(c bpCandidate) bool {
+		if best != nil && !c.better(*best) {
+			return false
+		}
+
+		s, dur, err := n.notarize(c.bp)
+		if err != nil {
+			// could be due to adversary, skip the invalid
+			// block proposal.
+			n.chain.logger.Warn("skip notarizing block proposal", "round", c.bp.Round, "bp", c.hash, "err", err)
+			return false
+		}
+
+		best = &c
+		onNotarize(s, dur)
+		return true
+	}
+
 	notarize := func() {
-		for _, bp := range bestRankBPs {
-			s, dur := n.notarize(bp, n.chain.txnPool)
-			if s != nil {
-				onNotarize(s, dur)
+		// the block proposals already queued are collected as
+		// well, so the choice does not depend on which select
+		// case is picked first.
+	drain:
+		for {
+			select {
+			case bp := <-bCh:
+				if c, ok := candidate(bp); ok {
+					collected = append(collected, c)
+				}
+			default:
+				break drain
+			}
+		}
+
+		sort.Slice(collected, func(i, j int) bool {
+			return collected[i].better(collected[j])
+		})
+
+		for _, c := range collected {
+			if try(c) {
+				break
 			}
 		}
+		collected = nil
 
 		for {
 			select {
 			case <-cancel.Done():
 				return
 			case bp := <-bCh:
-				rank, err := n.chain.randomBeacon.Rank(bp.Owner, bp.Round)
-				if err != nil {
-					log.Error("get rank error", "err", err, "bp round", bp.Round)
-					continue
-				}
-
-				if rank <= bestRank {
-					bestRank = rank
-					s, dur := n.notarize(bp, n.chain.txnPool)
-					if s != nil {
-						onNotarize(s, dur)
-					}
+				if c, ok := candidate(bp); ok {
+					try(c)
 				}
 			}
 		}
@@ -74,36 +125,43 @@ func (n *Notary) Notarize(ctx, cancel context.Context, bCh chan *BlockProposal,
 			notarize()
 			return
 		case bp := <-bCh:
-			rank, err := n.chain.randomBeacon.Rank(bp.Owner, bp.Round)
-			if err != nil {
-				log.Error("get rank error", "err", err, "bp round", bp.Round)
+			c, ok := candidate(bp)
+			if !ok {
 				continue
 			}
 
-			if rank == 0 && !recvBestRank {
+			collected = append(collected, c)
+			if c.rank == 0 && !recvBestRank {
 				recvBestRank = true
 				close(recvBestRankCh)
 			}
-
-			if len(bestRankBPs) == 0 {
-				bestRankBPs = []*BlockProposal{bp}
-				bestRank = rank
-				continue
-			}
-
-			if rank < bestRank {
-				bestRankBPs = []*BlockProposal{bp}
-				bestRank = rank
-			} else if rank == bestRank {
-				bestRankBPs = append(bestRankBPs, bp)
-			}
 		case <-cancel.Done():
 			return
 		}
 	}
 }
 
-func (n *Notary) notarize(bp *BlockProposal, pool TxnPool) (*NtShare, time.Duration) {
+// bpCandidate is a block proposal to notarize.
+type bpCandidate struct {
+	bp   *BlockProposal
+	hash Hash
+	rank uint16
+}
+
+// better returns true if the candidate is better than the other one.
+func (c bpCandidate) better(o bpCandidate) bool {
+	if c.rank != o.rank {
+		return c.rank < o.rank
+	}
+
+	return bytes.Compare(c.hash[:], o.hash[:]) < 0
+}
+
+// notarize notarizes the block proposal, it returns the notarization
+// share and the time spent notarizing. An error is returned if the
+// block proposal is skipped.
+func (n *Notary) notarize(bp *BlockProposal) (*NtShare, time.Duration, error) {
+	start := time.Now()
 	bpHash := bp.Hash()
 	nts := &NtShare{
 		Round: bp.Round,
@@ -117,31 +175,25 @@ func (n *Notary) notarize(bp *BlockProposal, pool TxnPool) (*NtShare, time.Durat
 
 	state := n.chain.BlockState(bp.PrevBlock)
 	if state == nil {
-		panic(fmt.Errorf("should not happen: can not find the state of pre block %v, bp: %v", bp.PrevBlock, bpHash))
+		// the prev block is finalized and buried by a later
+		// finalized block, the block proposal is stale.
+		return nil, 0, fmt.Errorf("can not find the state of prev block %v", bp.PrevBlock)
 	}
 
-	start := time.Now()
-	newState, _, err := state.CommitTxns(bp.Txns, pool, bp.Round)
+	_, stateRoot, err := n.chain.ApplyProposal(state, bp, bp.Round)
 	if err != nil {
-		panic("should not happen, record block proposal transaction error, could be due to adversary: " + err.Error())
+		return nil, 0, fmt.Errorf("record block proposal txns error: %v", err)
 	}
 
-	dur := time.Now().Sub(start)
-	log.Debug("notarize record txns done", "round", nts.Round, "bp", nts.BP, "dur", dur)
-
-	stateRoot := newState.Hash()
-	blk := &Block{
-		Owner:         bp.Owner,
-		Round:         bp.Round,
-		StateRoot:     stateRoot,
-		BlockProposal: bpHash,
-		PrevBlock:     bp.PrevBlock,
-	}
+	n.chain.logger.Debug("notarize record txns done", "round", nts.Round, "bp", nts.BP, "dur", time.Since(start))
 
 	nts.StateRoot = stateRoot
 	nts.BP = bpHash
-	nts.SigShare = n.share.Sign(blk.Encode(false))
+	// the block is derived the same way as the receivers recover
+	// it from the notarization shares.
+	blk := ntToBlock(nts, bp, bpHash)
+	nts.SigShare = n.share.Sign(NotarizationMessage(blk))
 	nts.Owner = n.owner
 	nts.Sig = n.sk.Sign(nts.Encode(false))
-	return nts, dur
+	return nts, time.Since(start), nil
 }
@@ -0,0 +1,264 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotarizeTieBreak(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	store := newStorage()
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, store, nil)
+	sk := DeterministicSK([]byte{1})
+	owner := sk.MustPK().Addr()
+	g := newGroup(nil)
+	g.Members = []Addr{owner}
+	chain.randomBeacon = NewRandomBeacon(Rand{}, []*group{g}, Config{})
+	chain.randomBeacon.deriveRand(SHA3([]byte{1}))
+
+	// the block proposals of the same owner have the same rank.
+	a := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner, Timestamp: 1}
+	b := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner, Timestamp: 2}
+	ah, bh := a.Hash(), b.Hash()
+	lowest := ah
+	if bytes.Compare(bh[:], ah[:]) < 0 {
+		lowest = bh
+	}
+
+	notarize := func(bps ...*BlockProposal) []Hash {
+		n := NewNotary(owner, sk, sk, chain, store)
+		ch := make(chan *BlockProposal, len(bps))
+		for _, bp := range bps {
+			ch <- bp
+		}
+
+		cancelCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		// the collecting ends immediately, the block proposals
+		// already received are notarized in the order of the
+		// rank and the hash.
+		ctx, stop := context.WithCancel(context.Background())
+		shares := make(chan *NtShare, len(bps))
+		go n.Notarize(ctx, cancelCtx, ch, func(s *NtShare, _ time.Duration) {
+			shares <- s
+		})
+		stop()
+
+		var r []Hash
+		for {
+			select {
+			case s := <-shares:
+				r = append(r, s.BP)
+			case <-time.After(200 * time.Millisecond):
+				return r
+			}
+		}
+	}
+
+	// exactly one nt share is produced, of the block proposal
+	// with the lowest hash, regardless of the arrival order.
+	assert.Equal(t, []Hash{lowest}, notarize(a, b))
+	assert.Equal(t, []Hash{lowest}, notarize(b, a))
+}
+
+func TestNotarizeGenesisChild(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	store := newStorage()
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, store, nil)
+	sk := DeterministicSK([]byte{1})
+	n := NewNotary(sk.MustPK().Addr(), sk, sk, chain, store)
+
+	bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Txns: []byte("txns")}
+	want, _, err := genesisState.CommitTxns(bp.Txns, nil, 1)
+	assert.Nil(t, err)
+
+	nts, _, err := n.notarize(bp)
+	assert.Nil(t, err)
+	assert.Equal(t, want.Hash(), nts.StateRoot)
+	assert.NotEqual(t, genesisState.Hash(), nts.StateRoot)
+
+	// the block proposal is stale once the round 1 is
+	// finalized, the genesis state is not kept.
+	prev := genesis.Hash()
+	var state State = genesisState
+	for round := uint64(1); round <= 3; round++ {
+		state, _, err = state.CommitTxns(nil, nil, round)
+		assert.Nil(t, err)
+		b := &Block{Round: round, PrevBlock: prev, StateRoot: state.Hash()}
+		_, err = chain.AddBlock(b, state, 1, 0)
+		assert.Nil(t, err)
+		prev = b.Hash()
+	}
+	assert.Equal(t, uint64(1), chain.FinalizedRound())
+	assert.Nil(t, chain.BlockState(genesis.Hash()))
+
+	_, _, err = n.notarize(bp)
+	assert.NotNil(t, err)
+}
+
+// invalidTxnsState fails to commit the txns "invalid".
+type invalidTxnsState struct {
+	testState
+}
+
+func (s *invalidTxnsState) CommitTxns(txns []byte, pool TxnPool, round uint64) (State, int, error) {
+	if string(txns) == "invalid" {
+		return nil, 0, errors.New("invalid txns")
+	}
+
+	return s.testState.CommitTxns(txns, pool, round)
+}
+
+func TestNotarizeReportsOnlyNotarized(t *testing.T) {
+	genesisState := &invalidTxnsState{testState{h: SHA3([]byte("genesis"))}}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	store := newStorage()
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, store, nil)
+	sk := DeterministicSK([]byte{1})
+	owner := sk.MustPK().Addr()
+	g := newGroup(nil)
+	g.Members = []Addr{owner}
+	chain.randomBeacon = NewRandomBeacon(Rand{}, []*group{g}, Config{})
+	chain.randomBeacon.deriveRand(SHA3([]byte{1}))
+
+	// the valid block proposal is better than the invalid one, so
+	// it is notarized no matter which one arrives first.
+	invalid := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner, Txns: []byte("invalid")}
+	ih := invalid.Hash()
+	valid := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner}
+	for {
+		vh := valid.Hash()
+		if bytes.Compare(vh[:], ih[:]) < 0 {
+			break
+		}
+		valid.Timestamp++
+	}
+
+	n := NewNotary(owner, sk, sk, chain, store)
+	ch := make(chan *BlockProposal, 2)
+	ch <- invalid
+	ch <- valid
+
+	type report struct {
+		s   *NtShare
+		dur time.Duration
+	}
+	reports := make(chan report, 2)
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx, stop := context.WithCancel(context.Background())
+	stop()
+	go n.Notarize(ctx, cancelCtx, ch, func(s *NtShare, dur time.Duration) {
+		reports <- report{s: s, dur: dur}
+	})
+
+	select {
+	case r := <-reports:
+		assert.Equal(t, valid.Hash(), r.s.BP)
+		assert.True(t, r.dur > 0)
+	case <-time.After(time.Second):
+		t.Fatal("the valid block proposal is not notarized")
+	}
+
+	select {
+	case r := <-reports:
+		t.Fatalf("unexpected notarization of %v", r.s.BP)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotarizeInvalidBestProposal(t *testing.T) {
+	genesisState := &invalidTxnsState{testState{h: SHA3([]byte("genesis"))}}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	store := newStorage()
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, store, nil)
+	sk := DeterministicSK([]byte{1})
+	owner := sk.MustPK().Addr()
+	g := newGroup(nil)
+	g.Members = []Addr{owner}
+	chain.randomBeacon = NewRandomBeacon(Rand{}, []*group{g}, Config{})
+	chain.randomBeacon.deriveRand(SHA3([]byte{1}))
+
+	// the invalid block proposal is the best one, it must not
+	// block the valid one behind it, whether it is collected
+	// before the collecting ends or arrives after.
+	invalid := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner, Txns: []byte("invalid")}
+	ih := invalid.Hash()
+	valid := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner}
+	for {
+		vh := valid.Hash()
+		if bytes.Compare(vh[:], ih[:]) > 0 {
+			break
+		}
+		valid.Timestamp++
+	}
+
+	for _, queued := range []bool{true, false} {
+		n := NewNotary(owner, sk, sk, chain, store)
+		ch := make(chan *BlockProposal, 2)
+		ch <- invalid
+		if queued {
+			ch <- valid
+		}
+
+		shares := make(chan *NtShare, 2)
+		cancelCtx, cancel := context.WithCancel(context.Background())
+		ctx, stop := context.WithCancel(context.Background())
+		stop()
+		go n.Notarize(ctx, cancelCtx, ch, func(s *NtShare, _ time.Duration) {
+			shares <- s
+		})
+		if !queued {
+			ch <- valid
+		}
+
+		select {
+		case s := <-shares:
+			assert.Equal(t, valid.Hash(), s.BP)
+		case <-time.After(time.Second):
+			t.Fatal("the valid block proposal is not notarized")
+		}
+		cancel()
+	}
+}
+
+// emptyTxnsState keeps the state root when committing an empty batch,
+// the same as the DEX state when no change is scheduled for the round.
+type emptyTxnsState struct {
+	testState
+}
+
+func (s *emptyTxnsState) CommitTxns(txns []byte, pool TxnPool, round uint64) (State, int, error) {
+	if len(txns) == 0 {
+		return s, 0, nil
+	}
+
+	return s.testState.CommitTxns(txns, pool, round)
+}
+
+func TestNotarizeEmptyProposal(t *testing.T) {
+	genesisState := &emptyTxnsState{testState{h: SHA3([]byte("genesis"))}}
+	genesis := &Block{StateRoot: genesisState.Hash()}
+	store := newStorage()
+	chain := NewChain(genesis, genesisState, Rand{}, Config{}, nil, &myUpdater{}, store, nil)
+	sk := DeterministicSK([]byte{1})
+	n := NewNotary(sk.MustPK().Addr(), sk, sk, chain, store)
+
+	for _, txns := range [][]byte{nil, {}} {
+		bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Txns: txns}
+		nts, _, err := n.notarize(bp)
+		assert.Nil(t, err)
+		assert.Equal(t, genesis.StateRoot, nts.StateRoot)
+
+		root, err := chain.ProposalStateRoot(bp)
+		assert.Nil(t, err)
+		assert.Equal(t, genesis.StateRoot, root)
+	}
+}
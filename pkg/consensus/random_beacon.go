@@ -3,15 +3,34 @@ package consensus
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	log "github.com/helinwang/log15"
 )
 
+const (
+	// maxFutureShareRounds is the number of rounds a random
+	// beacon signature share can be ahead of the expected round
+	// to be buffered, the shares further ahead are rejected.
+	maxFutureShareRounds = 1
+	// maxFutureShares is the maximum number of the buffered
+	// random beacon signature shares.
+	maxFutureShares = 1024
+)
+
+type futureShare struct {
+	round uint64
+	hash  Hash
+	owner Addr
+	apply func()
+}
+
 // RandomBeacon generates one random value at each round, selecting
 // the active random beacon generation group, block proposing group
 // and the notarization group for this round.
 type RandomBeacon struct {
 	cfg               Config
+	logger            log.Logger
 	n                 *Node
 	mu                sync.Mutex
 	roundWaitCh       map[uint64]chan struct{}
@@ -20,12 +39,33 @@ type RandomBeacon struct {
 	nextBPCmteHistory []int
 	nextBPRandHistory []Rand
 	groups            []*group
+	// sigCache memoizes the verified group signatures and
+	// signature shares.
+	sigCache *sigCache
+	// historyBase is the round of the first entry in the
+	// committee histories, the older entries are pruned.
+	historyBase uint64
+	// finalizedRound is the last finalized round of the chain,
+	// only the committees of the rounds below it are pruned.
+	finalizedRound uint64
 
 	rbRand Rand
 	ntRand Rand
 	bpRand Rand
 
 	sigHistory []*RandBeaconSig
+	// futureShares are the buffered random beacon signature
+	// shares of the rounds after the expected round, in the
+	// order of arrival.
+	futureShares []futureShare
+
+	lastSigTime  time.Time
+	stalledRound uint64
+	stalled      bool
+	onStall      func(round uint64, since time.Duration)
+	// stopWatch stops the stall watchdog goroutine, nil if the
+	// watchdog is not running.
+	stopWatch chan struct{}
 }
 
 // NewRandomBeacon creates a new random beacon
@@ -43,9 +83,12 @@ func NewRandomBeacon(seed Rand, groups []*group, cfg Config) *RandomBeacon {
 	initNtGroup := ntRand.Mod(mod)
 	initBPGroup := bpRand.Mod(mod)
 
+	logger := cfg.logger()
 	return &RandomBeacon{
 		cfg:               cfg,
+		logger:            logger,
 		groups:            groups,
+		sigCache:          newSigCache(cfg.SigCacheSize),
 		rbRand:            rbRand,
 		bpRand:            bpRand,
 		ntRand:            ntRand,
@@ -57,28 +100,126 @@ func NewRandomBeacon(seed Rand, groups []*group, cfg Config) *RandomBeacon {
 		sigHistory: []*RandBeaconSig{
 			{Sig: []byte("DEX random beacon 0th signature")},
 		},
+		lastSigTime: time.Now(),
+		onStall: func(round uint64, since time.Duration) {
+			logger.Error("random beacon stalled", "round", round, "since last sig", since)
+		},
+	}
+}
+
+// OnStall sets the callback that will be called when the random
+// beacon is stalled: no new random beacon signature is received
+// within Config.BeaconTimeout. The callback is called at most once
+// for each stalled round.
+func (r *RandomBeacon) OnStall(f func(round uint64, since time.Duration)) {
+	r.mu.Lock()
+	r.onStall = f
+	r.mu.Unlock()
+}
+
+// Stalled returns true if the random beacon is currently stalled.
+func (r *RandomBeacon) Stalled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stalled
+}
+
+// checkStall checks if the random beacon is stalled at the given
+// time. It only observes the random beacon, the random beacon
+// signature is never produced by the watchdog.
+func (r *RandomBeacon) checkStall(now time.Time) bool {
+	r.mu.Lock()
+	since := now.Sub(r.lastSigTime)
+	round := r.round()
+	if since < r.cfg.BeaconTimeout {
+		r.mu.Unlock()
+		return false
+	}
+
+	if r.stalled && r.stalledRound == round {
+		// already reported
+		r.mu.Unlock()
+		return true
+	}
+
+	r.stalled = true
+	r.stalledRound = round
+	f := r.onStall
+	r.mu.Unlock()
+
+	if f != nil {
+		f(round, since)
+	}
+	return true
+}
+
+// startWatch starts the stall watchdog goroutine if it is not
+// running, the goroutine exits when Stop is called.
+func (r *RandomBeacon) startWatch() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopWatch != nil {
+		return
+	}
+
+	r.stopWatch = make(chan struct{})
+	go r.watch(r.stopWatch)
+}
+
+// Stop stops the stall watchdog, it does nothing if the watchdog is
+// not running.
+func (r *RandomBeacon) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopWatch != nil {
+		close(r.stopWatch)
+		r.stopWatch = nil
+	}
+}
+
+func (r *RandomBeacon) watch(stop <-chan struct{}) {
+	interval := r.cfg.BeaconTimeout / 2
+	if interval <= 0 {
+		interval = r.cfg.BeaconTimeout
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.checkStall(now)
+		case <-stop:
+			return
+		}
 	}
 }
 
 func (r *RandomBeacon) AddRandBeaconSigShares(shares []*RandBeaconSigShare, groupID int) *RandBeaconSig {
 	s := shares[0]
-	log.Debug("add random beacon signature shares", "groupID", groupID, "share round", s.Round)
+	r.logger.Debug("add random beacon signature shares", "groupID", groupID, "share round", s.Round)
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if round := r.round(); round+1 != s.Round {
-		log.Debug("skipped the RandBeaconSigShare of different round than expected", "round", s.Round, "expected", round+1)
+		// the signature of the round is already recovered
+		// from the other shares or received, the round only
+		// advances once.
+		r.logger.Debug("skipped the RandBeaconSigShare of different round than expected", "round", s.Round, "expected", round+1)
 		return nil
 	}
 
 	sig, err := recoverRandBeaconSig(shares)
 	if err != nil {
-		log.Error("fatal: recoverRandBeaconSig error", "err", err)
+		r.logger.Error("fatal: recoverRandBeaconSig error", "err", err)
 		return nil
 	}
 
 	msg := randBeaconSigMsg(s.Round, s.LastSigHash)
-	if !sig.Verify(r.groups[groupID].PK, msg) {
+	if !r.sigCache.Verify(sig, r.groups[groupID].PK, msg) {
 		panic("impossible: random beacon group signature verification failed")
 	}
 
@@ -89,38 +230,122 @@ func (r *RandomBeacon) AddRandBeaconSigShares(shares []*RandBeaconSigShare, grou
 	return &rbs
 }
 
-// AddRandBeaconSig adds the random beacon signature.
+// AddRandBeaconSig adds the random beacon signature. The signature
+// of a round could be both recovered from the shares and received,
+// only the first one added advances the round, the later ones are
+// skipped and treated as success.
 func (r *RandomBeacon) AddRandBeaconSig(s *RandBeaconSig, syncDone bool) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	log.Debug("add random beacon signature", "round", s.Round)
+	r.logger.Debug("add random beacon signature", "round", s.Round)
 
 	if round := r.round(); round+1 != s.Round {
 		if s.Round > round+1 {
-			log.Warn("adding RandBeaconSig of higher round", "round", s.Round, "beacon round", round)
+			r.logger.Warn("adding RandBeaconSig of higher round", "round", s.Round, "beacon round", round)
 			return false
 		}
 
-		log.Debug("skipped RandBeaconSig of lower round", "round", s.Round, "beacon round", round)
+		r.logger.Debug("skipped RandBeaconSig of lower round", "round", s.Round, "beacon round", round)
 		// still treat as success
 		return true
 	}
 
 	r.deriveRand(SHA3(s.Sig))
 	r.sigHistory = append(r.sigHistory, s)
+	r.lastSigTime = time.Now()
+	r.stalled = false
 	round := r.round()
 	if ch, ok := r.roundWaitCh[round]; ok {
 		close(ch)
 		delete(r.roundWaitCh, round)
 	}
 
+	r.applyFutureShares()
 	if syncDone {
 		go r.n.StartRound(round)
 	}
 	return true
 }
 
+// DeferSigShare buffers the random beacon signature share if it is
+// ahead of the expected round by at most maxFutureShareRounds, apply
+// is called in a new goroutine once the random beacon reaches the
+// round of the share. It returns false if the share is not ahead and
+// can be applied immediately.
+//
+// The committee of a future round is not known yet, only the shares
+// owned by a group member are buffered, at most one for each owner
+// and round, so a peer can not fill the buffer with junk shares. The
+// share already buffered is deferred again without taking a new
+// slot. The caller must verify the owner signature of the share. An
+// error is returned if the share is too far ahead, not owned by a
+// group member, conflicts with the buffered share of the same owner,
+// or the buffer is full.
+func (r *RandomBeacon) DeferSigShare(s *RandBeaconSigShare, apply func()) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expected := r.round() + 1
+	if s.Round <= expected {
+		return false, nil
+	}
+
+	if s.Round > expected+maxFutureShareRounds {
+		return false, fmt.Errorf("random beacon sig share round %d is too far ahead of the expected round %d", s.Round, expected)
+	}
+
+	if !r.isMember(s.Owner) {
+		return false, fmt.Errorf("random beacon sig share owner %v is not a group member", s.Owner)
+	}
+
+	h := s.Hash()
+	for _, f := range r.futureShares {
+		if f.hash == h {
+			return true, nil
+		}
+
+		if f.owner == s.Owner && f.round == s.Round {
+			return false, fmt.Errorf("random beacon sig share of owner %v round %d is already buffered", s.Owner, s.Round)
+		}
+	}
+
+	if len(r.futureShares) >= maxFutureShares {
+		return false, fmt.Errorf("random beacon sig share buffer is full, size: %d", len(r.futureShares))
+	}
+
+	r.futureShares = append(r.futureShares, futureShare{round: s.Round, hash: h, owner: s.Owner, apply: apply})
+	return true, nil
+}
+
+// isMember returns true if the addr is a member of any group. It
+// must be called with r.mu held.
+func (r *RandomBeacon) isMember(addr Addr) bool {
+	for _, g := range r.groups {
+		if _, ok := g.MemberPK[addr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFutureShares applies the buffered sig shares of the next
+// round, the shares of the later rounds are kept buffered. It must be
+// called with r.mu held.
+func (r *RandomBeacon) applyFutureShares() {
+	expected := r.round() + 1
+	var remain []futureShare
+	for _, s := range r.futureShares {
+		if s.round > expected {
+			remain = append(remain, s)
+			continue
+		}
+
+		go s.apply()
+	}
+	r.futureShares = remain
+}
+
 func (r *RandomBeacon) round() uint64 {
 	return uint64(len(r.sigHistory) - 1)
 }
@@ -160,7 +385,13 @@ func (r *RandomBeacon) Rank(addr Addr, round uint64) (uint16, error) {
 	}
 
 	r.mu.Lock()
-	bp := r.nextBPCmteHistory[round]
+	i, ok := r.historyIdx(round)
+	if !ok {
+		r.mu.Unlock()
+		return 0, fmt.Errorf("committee of round %d not found, history starts at round %d", round, r.historyBase)
+	}
+
+	bp := r.nextBPCmteHistory[i]
 	g := r.groups[bp]
 	idx := -1
 	for i := range g.Members {
@@ -175,7 +406,7 @@ func (r *RandomBeacon) Rank(addr Addr, round uint64) (uint16, error) {
 		return 0, fmt.Errorf("addr %v not in the current block proposal group %d, round: %d", addr, bp, round)
 	}
 
-	perm := r.nextBPRandHistory[round].Perm(idx+1, len(g.Members))
+	perm := r.nextBPRandHistory[i].Perm(idx+1, len(g.Members))
 	r.mu.Unlock()
 	return uint16(perm[idx]), nil
 }
@@ -188,20 +419,141 @@ func (r *RandomBeacon) deriveRand(h Hash) {
 	r.bpRand = r.bpRand.Derive(h[:])
 	r.nextBPCmteHistory = append(r.nextBPCmteHistory, r.bpRand.Mod(len(r.groups)))
 	r.nextBPRandHistory = append(r.nextBPRandHistory, r.bpRand)
+	r.pruneHistory()
 }
 
-// Committees returns the current random beacon, block proposal,
-// notarization groups.
-func (r *RandomBeacon) Committees(round uint64) (rb, bp, nt int) {
+// historyIdx returns the index of the given round in the committee
+// histories.
+func (r *RandomBeacon) historyIdx(round uint64) (int, bool) {
+	if round < r.historyBase || round-r.historyBase >= uint64(len(r.nextRBCmteHistory)) {
+		return 0, false
+	}
+
+	return int(round - r.historyBase), true
+}
+
+// minHistoryRetention is the minimum number of the rounds below the
+// last finalized round whose committees are kept.
+const minHistoryRetention = 16
+
+// SetFinalizedRound sets the last finalized round of the chain. The
+// committees of the unfinalized rounds are needed to verify and sync
+// the blocks, they are never pruned.
+func (r *RandomBeacon) SetFinalizedRound(round uint64) {
 	r.mu.Lock()
-	rb = r.nextRBCmteHistory[round]
-	bp = r.nextBPCmteHistory[round]
-	nt = r.nextNtCmteHistory[round]
-	r.mu.Unlock()
+	defer r.mu.Unlock()
+
+	if round > r.finalizedRound {
+		r.finalizedRound = round
+		r.pruneHistory()
+	}
+}
+
+// pruneHistory keeps the committee histories of the unfinalized
+// rounds and of the Config.HistoryRetention rounds below the last
+// finalized round, the retention is at least minHistoryRetention.
+// Pruning happens when the prunable entries grow to the retention,
+// so the copying cost is amortized and the memory is bounded.
+func (r *RandomBeacon) pruneHistory() {
+	keep := r.cfg.HistoryRetention
+	if keep == 0 {
+		return
+	}
+
+	if keep < minHistoryRetention {
+		keep = minHistoryRetention
+	}
+
+	if r.finalizedRound < r.historyBase+2*keep {
+		return
+	}
+
+	// the beacon is never behind the finalized round, the
+	// pruned entries are all in the histories.
+	n := int(r.finalizedRound - keep - r.historyBase)
+	r.nextRBCmteHistory = append([]int(nil), r.nextRBCmteHistory[n:]...)
+	r.nextNtCmteHistory = append([]int(nil), r.nextNtCmteHistory[n:]...)
+	r.nextBPCmteHistory = append([]int(nil), r.nextBPCmteHistory[n:]...)
+	r.nextBPRandHistory = append([]Rand(nil), r.nextBPRandHistory[n:]...)
+	r.historyBase += uint64(n)
+}
+
+// Role is the role of a committee.
+type Role int
+
+// Committee roles
+const (
+	RandBeaconRole Role = iota
+	BlockProposalRole
+	NotarizationRole
+)
+
+func (r Role) String() string {
+	switch r {
+	case RandBeaconRole:
+		return "RandBeaconRole"
+	case BlockProposalRole:
+		return "BlockProposalRole"
+	case NotarizationRole:
+		return "NotarizationRole"
+	default:
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+}
+
+// HistoricalCommittee returns the group that served the given role in
+// the given round, it can be used to verify the signatures of the
+// past rounds.
+func (r *RandomBeacon) HistoricalCommittee(role Role, round uint64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var history []int
+	switch role {
+	case RandBeaconRole:
+		history = r.nextRBCmteHistory
+	case BlockProposalRole:
+		history = r.nextBPCmteHistory
+	case NotarizationRole:
+		history = r.nextNtCmteHistory
+	default:
+		return 0, fmt.Errorf("unknown committee role: %v", role)
+	}
+
+	i, ok := r.historyIdx(round)
+	if !ok {
+		return 0, fmt.Errorf("committee of round %d not found, available rounds: [%d, %d]", round, r.historyBase, r.historyBase+uint64(len(history))-1)
+	}
+
+	return history[i], nil
+}
+
+// Committees returns the random beacon, block proposal, notarization
+// groups of the round. An error is returned if the round is not
+// reached or its committees are already pruned from the history, the
+// round can come from the network, so the caller must reject the
+// item rather than crash.
+func (r *RandomBeacon) Committees(round uint64) (rb, bp, nt int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.historyIdx(round)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("committees of round %d not found, history starts at round %d", round, r.historyBase)
+	}
+
+	rb = r.nextRBCmteHistory[i]
+	bp = r.nextBPCmteHistory[i]
+	nt = r.nextNtCmteHistory[i]
 	return
 }
 
+// RandBeaconSig returns the random beacon signature of the round, nil
+// is returned if the round is not reached.
 func (r *RandomBeacon) RandBeaconSig(round uint64) *RandBeaconSig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if round > r.round() {
 		return nil
 	}
@@ -209,6 +561,48 @@ func (r *RandomBeacon) RandBeaconSig(round uint64) *RandBeaconSig {
 	return r.sigHistory[round]
 }
 
+// VerifyRandBeaconChain verifies the random beacon signatures of
+// rounds 1 to len(sigs) starting from the genesis seed, without the
+// block chain. Each signature must follow the previous one and be
+// signed by the random beacon committee derived from the randomness
+// of the previous round. groupPKs are the group public keys, in the
+// order of the groups in the genesis.
+func VerifyRandBeaconChain(seed Rand, sigs []*RandBeaconSig, groupPKs []PK) error {
+	if len(groupPKs) == 0 {
+		return fmt.Errorf("can not verify random beacon chain without groups")
+	}
+
+	groups := make([]*group, len(groupPKs))
+	for i, pk := range groupPKs {
+		groups[i] = newGroup(pk)
+	}
+
+	r := NewRandomBeacon(seed, groups, Config{})
+	for i, s := range sigs {
+		round := uint64(i + 1)
+		if s.Round != round {
+			return fmt.Errorf("random beacon sig of round %d found at round %d", s.Round, round)
+		}
+
+		if h := SHA3(r.RandBeaconSig(round - 1).Sig); s.LastSigHash != h {
+			return fmt.Errorf("random beacon sig of round %d does not follow the last sig, last sig hash: %v, expected: %v", round, s.LastSigHash, h)
+		}
+
+		rb, _, _, err := r.Committees(round - 1)
+		if err != nil {
+			return err
+		}
+
+		if !r.sigCache.Verify(s.Sig, groups[rb].PK, RandBeaconMessage(s)) {
+			return fmt.Errorf("invalid random beacon sig of round %d, group: %d", round, rb)
+		}
+
+		r.AddRandBeaconSig(s, false)
+	}
+
+	return nil
+}
+
 // History returns the random beacon signature history.
 func (r *RandomBeacon) History() []*RandBeaconSig {
 	r.mu.Lock()
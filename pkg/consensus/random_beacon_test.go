@@ -0,0 +1,330 @@
+package consensus
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomBeaconStallWatchdog(t *testing.T) {
+	r := NewRandomBeacon(Rand{}, nil, Config{BeaconTimeout: time.Second})
+	var fired []uint64
+	r.OnStall(func(round uint64, since time.Duration) {
+		fired = append(fired, round)
+	})
+
+	start := r.lastSigTime
+	assert.False(t, r.checkStall(start.Add(500*time.Millisecond)))
+	assert.False(t, r.Stalled())
+	assert.Equal(t, 0, len(fired))
+
+	assert.True(t, r.checkStall(start.Add(2*time.Second)))
+	assert.True(t, r.Stalled())
+	assert.Equal(t, []uint64{0}, fired)
+
+	// the same stalled round is only reported once
+	assert.True(t, r.checkStall(start.Add(3*time.Second)))
+	assert.Equal(t, []uint64{0}, fired)
+}
+
+func TestRandomBeaconStopWatchdog(t *testing.T) {
+	r := NewRandomBeacon(Rand{}, nil, Config{BeaconTimeout: 10 * time.Millisecond})
+	stalled := make(chan struct{}, 1)
+	r.OnStall(func(round uint64, since time.Duration) {
+		stalled <- struct{}{}
+	})
+
+	r.startWatch()
+	select {
+	case <-stalled:
+	case <-time.After(time.Second):
+		t.Fatal("the watchdog did not report the stall")
+	}
+
+	stop := r.stopWatch
+	r.Stop()
+	select {
+	case <-stop:
+	default:
+		t.Fatal("the watchdog is not stopped")
+	}
+	assert.Nil(t, r.stopWatch)
+	// stopping a stopped watchdog does nothing.
+	r.Stop()
+
+	// the watchdog goroutine exits once stopped.
+	stop = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.watch(stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the watchdog goroutine did not exit")
+	}
+}
+
+func TestHistoricalCommittee(t *testing.T) {
+	groups := []*group{newGroup(nil), newGroup(nil), newGroup(nil)}
+	r := NewRandomBeacon(Rand{}, groups, Config{})
+	for i := 0; i < 5; i++ {
+		r.deriveRand(SHA3([]byte{byte(i)}))
+	}
+
+	for round := uint64(0); round <= 5; round++ {
+		rb, bp, nt, err := r.Committees(round)
+		assert.Nil(t, err)
+		g, err := r.HistoricalCommittee(RandBeaconRole, round)
+		assert.Nil(t, err)
+		assert.Equal(t, rb, g)
+		g, err = r.HistoricalCommittee(BlockProposalRole, round)
+		assert.Nil(t, err)
+		assert.Equal(t, bp, g)
+		g, err = r.HistoricalCommittee(NotarizationRole, round)
+		assert.Nil(t, err)
+		assert.Equal(t, nt, g)
+	}
+
+	_, err := r.HistoricalCommittee(RandBeaconRole, 6)
+	assert.NotNil(t, err)
+	_, err = r.HistoricalCommittee(Role(10), 1)
+	assert.NotNil(t, err)
+}
+
+func TestRandomBeaconHistoryPruning(t *testing.T) {
+	groups := []*group{newGroup(nil), newGroup(nil), newGroup(nil)}
+	full := NewRandomBeacon(Rand{}, groups, Config{})
+	// the retention below the minimum is raised to the minimum.
+	pruned := NewRandomBeacon(Rand{}, groups, Config{HistoryRetention: 3})
+	const rounds = 10 * minHistoryRetention
+	for i := 0; i < rounds; i++ {
+		h := SHA3([]byte{byte(i)})
+		full.deriveRand(h)
+		pruned.deriveRand(h)
+		// the chain finalizes the rounds a few rounds behind
+		// the beacon.
+		if i > 2 {
+			pruned.SetFinalizedRound(uint64(i - 2))
+		}
+		assert.True(t, len(pruned.nextRBCmteHistory) < 2*minHistoryRetention+4)
+		assert.Equal(t, len(pruned.nextRBCmteHistory), len(pruned.nextBPRandHistory))
+	}
+
+	finalized := uint64(rounds - 3)
+	for round := finalized - minHistoryRetention; round <= rounds; round++ {
+		rb, bp, nt, _ := full.Committees(round)
+		rb1, bp1, nt1, err := pruned.Committees(round)
+		assert.Nil(t, err)
+		assert.Equal(t, []int{rb, bp, nt}, []int{rb1, bp1, nt1})
+
+		g, err := pruned.HistoricalCommittee(NotarizationRole, round)
+		assert.Nil(t, err)
+		assert.Equal(t, nt, g)
+	}
+
+	_, err := pruned.HistoricalCommittee(NotarizationRole, 1)
+	assert.NotNil(t, err)
+	_, err = pruned.HistoricalCommittee(NotarizationRole, rounds+1)
+	assert.NotNil(t, err)
+
+	// the pruned round can come from the network, it is
+	// reported as an error rather than a panic.
+	_, _, _, err = pruned.Committees(1)
+	assert.NotNil(t, err)
+	_, _, _, err = pruned.Committees(rounds + 1)
+	assert.NotNil(t, err)
+
+	// nothing is pruned before the rounds are finalized, e.g.,
+	// when a new node syncs the random beacon to the tip before
+	// syncing the blocks.
+	syncing := NewRandomBeacon(Rand{}, groups, Config{HistoryRetention: 3})
+	for i := 0; i < rounds; i++ {
+		syncing.deriveRand(SHA3([]byte{byte(i)}))
+	}
+	assert.Equal(t, uint64(0), syncing.historyBase)
+	_, _, _, err = syncing.Committees(1)
+	assert.Nil(t, err)
+}
+
+func TestRandomBeaconDeferSigShare(t *testing.T) {
+	owner := Addr{1}
+	g := newGroup(nil)
+	g.MemberPK[owner] = nil
+	r := NewRandomBeacon(Rand{}, []*group{g}, Config{})
+	applied := make(chan uint64, 1)
+	apply := func(s *RandBeaconSigShare) func() {
+		return func() { applied <- s.Round }
+	}
+
+	// the share of the expected round is applied immediately.
+	s := &RandBeaconSigShare{Round: 1, Owner: owner}
+	deferred, err := r.DeferSigShare(s, apply(s))
+	assert.Nil(t, err)
+	assert.False(t, deferred)
+
+	// the share one round ahead is buffered.
+	s = &RandBeaconSigShare{Round: 2, Owner: owner}
+	deferred, err = r.DeferSigShare(s, apply(s))
+	assert.Nil(t, err)
+	assert.True(t, deferred)
+
+	// the share far ahead is rejected.
+	s = &RandBeaconSigShare{Round: 3, Owner: owner}
+	deferred, err = r.DeferSigShare(s, apply(s))
+	assert.NotNil(t, err)
+	assert.False(t, deferred)
+
+	select {
+	case <-applied:
+		t.Fatal("the buffered share is applied before the round advances")
+	default:
+	}
+
+	assert.True(t, r.AddRandBeaconSig(&RandBeaconSig{Round: 1}, false))
+	select {
+	case round := <-applied:
+		assert.Equal(t, uint64(2), round)
+	case <-time.After(time.Second):
+		t.Fatal("the buffered share is not applied")
+	}
+	assert.Equal(t, 0, len(r.futureShares))
+}
+
+func TestRandomBeaconDeferSigShareFlood(t *testing.T) {
+	flooder, honest := Addr{1}, Addr{2}
+	g := newGroup(nil)
+	g.MemberPK[flooder] = nil
+	g.MemberPK[honest] = nil
+	r := NewRandomBeacon(Rand{}, []*group{g}, Config{})
+	applied := make(chan *RandBeaconSigShare, 1)
+	apply := func(s *RandBeaconSigShare) func() {
+		return func() { applied <- s }
+	}
+
+	// the junk shares of the non-members, and the conflicting
+	// shares of the same member, are not buffered.
+	for i := 0; i < 2*maxFutureShares; i++ {
+		s := &RandBeaconSigShare{Round: 2, Owner: Addr{byte(i), 1}, Share: []byte{byte(i)}}
+		_, err := r.DeferSigShare(s, apply(s))
+		assert.NotNil(t, err)
+
+		s = &RandBeaconSigShare{Round: 2, Owner: flooder, Share: []byte{byte(i), byte(i >> 8)}}
+		deferred, err := r.DeferSigShare(s, apply(s))
+		if i == 0 {
+			assert.Nil(t, err)
+			assert.True(t, deferred)
+		} else {
+			assert.NotNil(t, err)
+		}
+	}
+	assert.Equal(t, 1, len(r.futureShares))
+
+	// the re-gossiped share does not take a new slot.
+	share := &RandBeaconSigShare{Round: 2, Owner: honest, Share: []byte{1}}
+	for i := 0; i < 3; i++ {
+		deferred, err := r.DeferSigShare(share, apply(share))
+		assert.Nil(t, err)
+		assert.True(t, deferred)
+	}
+	assert.Equal(t, 2, len(r.futureShares))
+
+	assert.True(t, r.AddRandBeaconSig(&RandBeaconSig{Round: 1}, false))
+	got := make(map[Addr]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-applied:
+			got[s.Owner]++
+		case <-time.After(time.Second):
+			t.Fatal("the buffered share is not applied")
+		}
+	}
+	assert.Equal(t, map[Addr]int{flooder: 1, honest: 1}, got)
+}
+
+func TestRandomBeaconConcurrentSigAndShares(t *testing.T) {
+	r := NewRandomBeacon(Rand{}, []*group{newGroup(nil)}, Config{})
+	sig := &RandBeaconSig{Round: 1, LastSigHash: SHA3(r.RandBeaconSig(0).Sig), Sig: []byte{1}}
+	share := &RandBeaconSigShare{Round: 1, LastSigHash: sig.LastSigHash}
+
+	var wg sync.WaitGroup
+	var stale int32
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			// the sig received from the gossip, and the one
+			// recovered from the shares.
+			assert.True(t, r.AddRandBeaconSig(sig, false))
+			assert.True(t, r.AddRandBeaconSig(&RandBeaconSig{Round: 1, LastSigHash: sig.LastSigHash, Sig: []byte{2}}, false))
+		}()
+		go func() {
+			defer wg.Done()
+			r.WaitUntil(1)
+			if r.AddRandBeaconSigShares([]*RandBeaconSigShare{share}, 0) == nil {
+				atomic.AddInt32(&stale, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the round advances exactly once, the later sigs and shares
+	// of the round are no-ops.
+	assert.Equal(t, uint64(1), r.Round())
+	assert.Equal(t, 2, len(r.History()))
+	assert.Equal(t, int32(10), stale)
+	first := r.RandBeaconSig(1)
+	assert.True(t, bytes.Equal(first.Sig, []byte{1}) || bytes.Equal(first.Sig, []byte{2}))
+	assert.Nil(t, r.RandBeaconSig(2))
+}
+
+func TestVerifyRandBeaconChain(t *testing.T) {
+	seed := Rand(SHA3([]byte("seed")))
+	var sks []SK
+	var groups []*group
+	var groupPKs []PK
+	for i := 0; i < 3; i++ {
+		sk := DeterministicSK([]byte{byte(i)})
+		sks = append(sks, sk)
+		groups = append(groups, newGroup(sk.MustPK()))
+		groupPKs = append(groupPKs, sk.MustPK())
+	}
+
+	r := NewRandomBeacon(seed, groups, Config{})
+	var sigs []*RandBeaconSig
+	var signers []int
+	for round := uint64(1); round <= 6; round++ {
+		rb, _, _, _ := r.Committees(round - 1)
+		s := &RandBeaconSig{Round: round, LastSigHash: SHA3(r.RandBeaconSig(round - 1).Sig)}
+		s.Sig = sks[rb].Sign(RandBeaconMessage(s))
+		assert.True(t, r.AddRandBeaconSig(s, false))
+		sigs = append(sigs, s)
+		signers = append(signers, rb)
+	}
+
+	assert.Nil(t, VerifyRandBeaconChain(seed, sigs, groupPKs))
+	assert.Nil(t, VerifyRandBeaconChain(seed, sigs[:3], groupPKs))
+	assert.NotNil(t, VerifyRandBeaconChain(Rand(SHA3([]byte("other seed"))), sigs, groupPKs))
+
+	// the sig of round k is forged by a group other than the
+	// random beacon committee.
+	const k = 3
+	forged := append([]*RandBeaconSig(nil), sigs...)
+	f := *sigs[k-1]
+	f.Sig = sks[(signers[k-1]+1)%len(sks)].Sign(RandBeaconMessage(&f))
+	forged[k-1] = &f
+	assert.NotNil(t, VerifyRandBeaconChain(seed, forged, groupPKs))
+	assert.Nil(t, VerifyRandBeaconChain(seed, forged[:k-1], groupPKs))
+
+	// the sigs must be in order.
+	forged = append([]*RandBeaconSig(nil), sigs...)
+	forged[1], forged[2] = forged[2], forged[1]
+	assert.NotNil(t, VerifyRandBeaconChain(seed, forged, groupPKs))
+	assert.NotNil(t, VerifyRandBeaconChain(seed, sigs, nil))
+}
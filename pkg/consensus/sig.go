@@ -8,6 +8,13 @@ func RandSK() SK {
 	return SK(sk.GetLittleEndian())
 }
 
+// DeterministicSK returns the secret key derived from the seed, the
+// same seed always produces the same key. It is for the tests and
+// fixtures, use RandSK for the real keys.
+func DeterministicSK(seed []byte) SK {
+	return Rand(SHA3(seed)).SK()
+}
+
 // PK is a serialized public key.
 type PK []byte
 
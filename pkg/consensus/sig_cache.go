@@ -0,0 +1,62 @@
+package consensus
+
+import lru "github.com/hashicorp/golang-lru"
+
+type sigCacheKey struct {
+	msg Hash
+	pk  string
+	sig string
+}
+
+// sigCache memoizes the successful signature verifications. Only the
+// valid signatures are cached, and the key covers the message, the
+// public key and the signature, so a cached result never applies to
+// a different group key or signature. A nil sigCache verifies every
+// signature.
+type sigCache struct {
+	cache *lru.Cache
+}
+
+// newSigCache creates a signature cache holding at most size
+// verified signatures, it returns nil if size is not positive.
+func newSigCache(size int) *sigCache {
+	if size <= 0 {
+		return nil
+	}
+
+	c, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+
+	return &sigCache{cache: c}
+}
+
+// Verify verifies the signature of the message, the verification is
+// skipped if the same signature is verified before.
+func (c *sigCache) Verify(sig Sig, pk PK, msg []byte) bool {
+	if c == nil {
+		return sig.Verify(pk, msg)
+	}
+
+	key := sigCacheKey{msg: SHA3(msg), pk: string(pk), sig: string(sig)}
+	if c.cache.Contains(key) {
+		return true
+	}
+
+	if !sig.Verify(pk, msg) {
+		return false
+	}
+
+	c.cache.Add(key, struct{}{})
+	return true
+}
+
+// Len returns the number of the cached signatures.
+func (c *sigCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	return c.cache.Len()
+}
@@ -0,0 +1,38 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigCache(t *testing.T) {
+	sk := DeterministicSK([]byte{1})
+	pk := sk.MustPK()
+	otherPK := DeterministicSK([]byte{2}).MustPK()
+	msg := []byte("msg")
+	sig := sk.Sign(msg)
+
+	c := newSigCache(10)
+	assert.True(t, c.Verify(sig, pk, msg))
+	assert.Equal(t, 1, c.Len())
+	assert.True(t, c.Verify(sig, pk, msg))
+	assert.Equal(t, 1, c.Len())
+
+	// the cached signature does not validate a different
+	// message, key or signature.
+	assert.False(t, c.Verify(sig, pk, []byte("other msg")))
+	assert.False(t, c.Verify(sig, otherPK, msg))
+	assert.False(t, c.Verify(sk.Sign([]byte("other msg")), pk, msg))
+	assert.Equal(t, 1, c.Len())
+
+	// the invalid signatures are not cached.
+	assert.False(t, c.Verify(sig, otherPK, msg))
+	assert.Equal(t, 1, c.Len())
+
+	// the nil cache verifies every signature.
+	var nilCache *sigCache
+	assert.True(t, nilCache.Verify(sig, pk, msg))
+	assert.False(t, nilCache.Verify(sig, otherPK, msg))
+	assert.Nil(t, newSigCache(0))
+}
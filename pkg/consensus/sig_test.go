@@ -0,0 +1,14 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeterministicSK(t *testing.T) {
+	sk := DeterministicSK([]byte{1})
+	assert.Equal(t, sk, DeterministicSK([]byte{1}))
+	assert.Equal(t, sk.MustPK(), DeterministicSK([]byte{1}).MustPK())
+	assert.NotEqual(t, sk.MustPK(), DeterministicSK([]byte{2}).MustPK())
+}
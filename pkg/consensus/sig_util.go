@@ -1,7 +1,14 @@
 package consensus
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
 	"github.com/dfinity/go-dfinity-crypto/bls"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 func recoverNtSig(shares []*NtShare) (Sig, error) {
@@ -27,6 +34,272 @@ func recoverNtSig(shares []*NtShare) (Sig, error) {
 	return Sig(sign.Serialize()), nil
 }
 
+// sigRecoverer recovers the group signatures from the signature
+// shares of a fixed set of owners. The Lagrange coefficients are
+// computed once, so recovering the signatures of many messages signed
+// by the same owners does not repeat the interpolation.
+type sigRecoverer struct {
+	idx    map[Addr]int
+	coeffs []bls.Fr
+}
+
+func newSigRecoverer(owners []Addr) (*sigRecoverer, error) {
+	idx := make(map[Addr]int, len(owners))
+	xs := make([]bls.Fr, len(owners))
+	for i, o := range owners {
+		if _, ok := idx[o]; ok {
+			return nil, fmt.Errorf("duplicate signature share owner %v", o)
+		}
+
+		idx[o] = i
+		// the same as the Fr of Addr.ID
+		xs[i].SetHashOf(o[:])
+	}
+
+	coeffs := make([]bls.Fr, len(xs))
+	for i := range xs {
+		// the Lagrange coefficient evaluated at 0:
+		// prod(x_j / (x_j - x_i)) for j != i.
+		coeffs[i].SetInt64(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+
+			var d, f bls.Fr
+			bls.FrSub(&d, &xs[j], &xs[i])
+			if d.IsZero() {
+				return nil, errors.New("duplicate signature share owner ID")
+			}
+
+			bls.FrDiv(&f, &xs[j], &d)
+			bls.FrMul(&coeffs[i], &coeffs[i], &f)
+		}
+	}
+
+	return &sigRecoverer{idx: idx, coeffs: coeffs}, nil
+}
+
+// Recover recovers the group signature, shares[i] is the signature
+// share of owners[i].
+func (r *sigRecoverer) Recover(owners []Addr, shares []Sig) (Sig, error) {
+	if len(shares) != len(r.coeffs) || len(owners) != len(shares) {
+		return nil, fmt.Errorf("expected %d signature shares, got %d", len(r.coeffs), len(shares))
+	}
+
+	var sum bls.G1
+	for i := range shares {
+		j, ok := r.idx[owners[i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown signature share owner %v", owners[i])
+		}
+
+		var p, t bls.G1
+		err := p.Deserialize(shares[i])
+		if err != nil {
+			return nil, err
+		}
+
+		bls.G1Mul(&t, &p, &r.coeffs[j])
+		if i == 0 {
+			sum = t
+		} else {
+			bls.G1Add(&sum, &sum, &t)
+		}
+	}
+
+	return Sig(sum.Serialize()), nil
+}
+
+// ntSigRecoverers recovers the notarization signatures from the nt
+// shares, the signature recoverers are cached by the set of the share
+// owners, so the Lagrange coefficients are reused across the block
+// proposals notarized by the same owners.
+type ntSigRecoverers struct {
+	cache *lru.Cache
+}
+
+func newNtSigRecoverers(size int) *ntSigRecoverers {
+	cache, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+
+	return &ntSigRecoverers{cache: cache}
+}
+
+// Recover recovers the notarization signature from the nt shares.
+func (r *ntSigRecoverers) Recover(shares []*NtShare) (Sig, error) {
+	owners := make([]Addr, len(shares))
+	sigShares := make([]Sig, len(shares))
+	for i, s := range shares {
+		owners[i] = s.Owner
+		sigShares[i] = s.SigShare
+	}
+
+	sorted := append([]Addr(nil), owners...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+
+	key := SHA3(addrsBytes(sorted))
+	var recoverer *sigRecoverer
+	if v, ok := r.cache.Get(key); ok {
+		recoverer = v.(*sigRecoverer)
+	} else {
+		var err error
+		recoverer, err = newSigRecoverer(sorted)
+		if err != nil {
+			return nil, err
+		}
+		r.cache.Add(key, recoverer)
+	}
+
+	return recoverer.Recover(owners, sigShares)
+}
+
+// recoverNtSigs recovers the notarization signatures of multiple
+// block proposals, the Lagrange coefficients are reused across the
+// block proposals notarized by the same set of owners.
+func recoverNtSigs(batch [][]*NtShare) ([]Sig, error) {
+	r := newNtSigRecoverers(len(batch) + 1)
+	sigs := make([]Sig, len(batch))
+	for i, shares := range batch {
+		sig, err := r.Recover(shares)
+		if err != nil {
+			return nil, err
+		}
+
+		sigs[i] = sig
+	}
+
+	return sigs, nil
+}
+
+func addrsBytes(addrs []Addr) []byte {
+	b := make([]byte, 0, len(addrs)*addrBytes)
+	for _, a := range addrs {
+		b = append(b, a[:]...)
+	}
+	return b
+}
+
+// InvalidBlockError is returned by VerifyBlocksBatch when the
+// notarization of a block in the batch is invalid.
+type InvalidBlockError struct {
+	Index int
+	Hash  Hash
+}
+
+func (e *InvalidBlockError) Error() string {
+	return fmt.Sprintf("invalid notarization of block %v at index %d", e.Hash, e.Index)
+}
+
+var (
+	g2GenOnce sync.Once
+	g2Gen     bls.G2
+)
+
+// g2Generator returns the generator used by the public keys, which
+// is the public key of the secret key 1.
+func g2Generator() *bls.G2 {
+	g2GenOnce.Do(func() {
+		var sk bls.SecretKey
+		err := sk.SetLittleEndian([]byte{1})
+		if err != nil {
+			panic(err)
+		}
+
+		err = g2Gen.Deserialize(sk.GetPublicKey().Serialize())
+		if err != nil {
+			panic(err)
+		}
+	})
+	return &g2Gen
+}
+
+// VerifyBlocksBatch verifies the notarization signatures of the
+// blocks at once. Each signature is weighted by a random scalar so
+// invalid signatures can not cancel each other out, and the pairing
+// is computed once per notarization group rather than once per
+// block. When the batch is invalid, *InvalidBlockError of the first
+// invalid block is returned.
+func VerifyBlocksBatch(blocks []*Block, beacon *RandomBeacon) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	var sigSum bls.G1
+	msgSums := make(map[int]*bls.G1)
+	for i, b := range blocks {
+		nt, err := beacon.HistoricalCommittee(NotarizationRole, b.Round)
+		if err != nil {
+			return err
+		}
+
+		var sig, h, t bls.G1
+		err = sig.Deserialize(b.Notarization)
+		if err != nil {
+			return &InvalidBlockError{Index: i, Hash: b.Hash()}
+		}
+
+		err = h.HashAndMapTo(NotarizationMessage(b))
+		if err != nil {
+			return err
+		}
+
+		var r bls.Fr
+		r.SetByCSPRNG()
+		bls.G1Mul(&t, &sig, &r)
+		if i == 0 {
+			sigSum = t
+		} else {
+			bls.G1Add(&sigSum, &sigSum, &t)
+		}
+
+		bls.G1Mul(&t, &h, &r)
+		if sum, ok := msgSums[nt]; ok {
+			bls.G1Add(sum, sum, &t)
+		} else {
+			msgSums[nt] = &t
+		}
+	}
+
+	var lhs, rhs, acc, ml bls.GT
+	bls.Pairing(&lhs, &sigSum, g2Generator())
+	first := true
+	for nt, sum := range msgSums {
+		var pk bls.G2
+		err := pk.Deserialize(beacon.groups[nt].PK)
+		if err != nil {
+			return err
+		}
+
+		bls.MillerLoop(&ml, sum, &pk)
+		if first {
+			acc = ml
+			first = false
+		} else {
+			bls.GTMul(&acc, &acc, &ml)
+		}
+	}
+	bls.FinalExp(&rhs, &acc)
+
+	if lhs.IsEqual(&rhs) {
+		return nil
+	}
+
+	// find the invalid block.
+	for i, b := range blocks {
+		nt, _ := beacon.HistoricalCommittee(NotarizationRole, b.Round)
+		if !beacon.sigCache.Verify(b.Notarization, beacon.groups[nt].PK, NotarizationMessage(b)) {
+			return &InvalidBlockError{Index: i, Hash: b.Hash()}
+		}
+	}
+
+	return errors.New("batch notarization verification failed, but each block is valid")
+}
+
 func recoverRandBeaconSig(shares []*RandBeaconSigShare) (Sig, error) {
 	signs := make([]bls.Sign, len(shares))
 	idVec := make([]bls.ID, len(shares))
@@ -52,13 +325,25 @@ func recoverRandBeaconSig(shares []*RandBeaconSigShare) (Sig, error) {
 	return Sig(sign.Serialize()), nil
 }
 
-func randBeaconSigMsg(round uint64, lastSigHash Hash) []byte {
-	var rbs RandBeaconSig
-	rbs.LastSigHash = lastSigHash
-	rbs.Round = round
+// NotarizationMessage returns the message signed by the notarization
+// committee for the block, it is the block encoded without the
+// notarization. The notaries sign it and the receivers verify the
+// notarization against it.
+func NotarizationMessage(b *Block) []byte {
+	return b.Encode(false)
+}
+
+// RandBeaconMessage returns the message signed by the random beacon
+// committee for the random beacon signature, it is the signature
+// encoded without the group signature.
+func RandBeaconMessage(rbs *RandBeaconSig) []byte {
 	return rbs.Encode(false)
 }
 
+func randBeaconSigMsg(round uint64, lastSigHash Hash) []byte {
+	return RandBeaconMessage(&RandBeaconSig{Round: round, LastSigHash: lastSigHash})
+}
+
 func signRandBeaconSigShare(sk, keyShare SK, round uint64, lastSigHash Hash) *RandBeaconSigShare {
 	msg := randBeaconSigMsg(round, lastSigHash)
 	share := keyShare.Sign(msg)
@@ -0,0 +1,210 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/dfinity/go-dfinity-crypto/bls"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeNtShareBatch creates the nt shares of numBP block proposals,
+// each notarized by the same threshold members of the group.
+func makeNtShareBatch(numBP, threshold int) (PK, [][]*NtShare) {
+	rand := Rand(SHA3([]byte("nt share batch")))
+	owners := make([]Addr, threshold)
+	idVec := make([]bls.ID, threshold)
+	for i := range owners {
+		owners[i] = rand.SK().MustPK().Addr()
+		idVec[i] = owners[i].ID()
+		rand = rand.Derive(rand[:])
+	}
+
+	pk, shares, _ := makeGroupShares(threshold, idVec, rand)
+	batch := make([][]*NtShare, numBP)
+	for i := range batch {
+		msg := SHA3([]byte{byte(i)})
+		batch[i] = make([]*NtShare, threshold)
+		for j := range shares {
+			batch[i][j] = &NtShare{Owner: owners[j], SigShare: shares[j].Sign(msg[:])}
+		}
+	}
+	return pk, batch
+}
+
+func TestRecoverNtSigs(t *testing.T) {
+	pk, batch := makeNtShareBatch(3, 4)
+	// the order of the shares does not matter.
+	batch[1][0], batch[1][3] = batch[1][3], batch[1][0]
+	sigs, err := recoverNtSigs(batch)
+	if err != nil {
+		panic(err)
+	}
+
+	for i := range batch {
+		expected, err := recoverNtSig(batch[i])
+		if err != nil {
+			panic(err)
+		}
+
+		assert.Equal(t, expected, sigs[i])
+		msg := SHA3([]byte{byte(i)})
+		assert.True(t, sigs[i].Verify(pk, msg[:]))
+	}
+}
+
+func TestNtSigRecoverersReuse(t *testing.T) {
+	pk, batch := makeNtShareBatch(3, 4)
+	r := newNtSigRecoverers(8)
+	for i := range batch {
+		sig, err := r.Recover(batch[i])
+		if err != nil {
+			panic(err)
+		}
+
+		msg := SHA3([]byte{byte(i)})
+		assert.True(t, sig.Verify(pk, msg[:]))
+	}
+
+	// the block proposals are notarized by the same owners, the
+	// recoverer is created once.
+	assert.Equal(t, 1, r.cache.Len())
+}
+
+func BenchmarkRecoverNtSig(b *testing.B) {
+	_, batch := makeNtShareBatch(10, 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, shares := range batch {
+			_, err := recoverNtSig(shares)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRecoverNtSigsBatched(b *testing.B) {
+	_, batch := makeNtShareBatch(10, 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := recoverNtSigs(batch)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// makeNotarizedBlocks creates numBlock blocks of consecutive rounds,
+// notarized by the notarization committee of each round.
+func makeNotarizedBlocks(numBlock int) ([]*Block, *RandomBeacon) {
+	const numGroup = 4
+	sks := make([]SK, numGroup)
+	groups := make([]*group, numGroup)
+	for i := range groups {
+		sks[i] = DeterministicSK([]byte{byte(i)})
+		groups[i] = newGroup(sks[i].MustPK())
+	}
+
+	beacon := NewRandomBeacon(Rand{}, groups, Config{})
+	blocks := make([]*Block, numBlock)
+	for i := range blocks {
+		beacon.deriveRand(SHA3([]byte{byte(i)}))
+		round := uint64(i + 1)
+		_, _, nt, _ := beacon.Committees(round)
+		b := &Block{Round: round, StateRoot: SHA3([]byte{byte(i)})}
+		b.Notarization = sks[nt].Sign(b.Encode(false))
+		blocks[i] = b
+	}
+
+	return blocks, beacon
+}
+
+func TestVerifyBlocksBatch(t *testing.T) {
+	blocks, beacon := makeNotarizedBlocks(10)
+	assert.Nil(t, VerifyBlocksBatch(blocks, beacon))
+
+	bad := *blocks[3]
+	bad.StateRoot = Hash{1}
+	blocks[3] = &bad
+	err := VerifyBlocksBatch(blocks, beacon)
+	e, ok := err.(*InvalidBlockError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, 3, e.Index)
+		assert.Equal(t, bad.Hash(), e.Hash)
+	}
+}
+
+func BenchmarkVerifyBlocks(b *testing.B) {
+	blocks, beacon := makeNotarizedBlocks(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, blk := range blocks {
+			nt, _ := beacon.HistoricalCommittee(NotarizationRole, blk.Round)
+			if !blk.Notarization.Verify(beacon.groups[nt].PK, blk.Encode(false)) {
+				panic("invalid notarization")
+			}
+		}
+	}
+}
+
+func BenchmarkVerifyBlocksBatch(b *testing.B) {
+	blocks, beacon := makeNotarizedBlocks(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := VerifyBlocksBatch(blocks, beacon)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkVerifyBlocksCached(b *testing.B) {
+	blocks, beacon := makeNotarizedBlocks(100)
+	beacon.sigCache = newSigCache(len(blocks))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, blk := range blocks {
+			nt, _ := beacon.HistoricalCommittee(NotarizationRole, blk.Round)
+			if !beacon.sigCache.Verify(blk.Notarization, beacon.groups[nt].PK, blk.Encode(false)) {
+				panic("invalid notarization")
+			}
+		}
+	}
+}
+
+func TestNotarizationMessage(t *testing.T) {
+	sk := DeterministicSK([]byte{1})
+	bp := &BlockProposal{Owner: Addr{1}, Round: 2, PrevBlock: Hash{3}, Txns: []byte("txns")}
+	bpHash := bp.Hash()
+	nts := &NtShare{Round: bp.Round, BP: bpHash, StateRoot: Hash{4}}
+
+	b := ntToBlock(nts, bp, bpHash)
+	msg := NotarizationMessage(b)
+	expected := (&Block{
+		Owner:         bp.Owner,
+		Round:         bp.Round,
+		StateRoot:     nts.StateRoot,
+		BlockProposal: bpHash,
+		PrevBlock:     bp.PrevBlock,
+	}).Encode(false)
+	assert.Equal(t, expected, msg)
+
+	// the notarization is not part of the message.
+	b.Notarization = sk.Sign(msg)
+	assert.Equal(t, msg, NotarizationMessage(b))
+	assert.True(t, b.Notarization.Verify(sk.MustPK(), NotarizationMessage(b)))
+}
+
+func TestRandBeaconMessage(t *testing.T) {
+	sk := DeterministicSK([]byte{1})
+	rbs := &RandBeaconSig{Round: 1, LastSigHash: Hash{1}}
+	msg := RandBeaconMessage(rbs)
+	assert.Equal(t, rbs.Encode(false), msg)
+	assert.Equal(t, randBeaconSigMsg(rbs.Round, rbs.LastSigHash), msg)
+
+	// the group signature is not part of the message.
+	rbs.Sig = sk.Sign(msg)
+	assert.Equal(t, msg, RandBeaconMessage(rbs))
+	assert.True(t, rbs.Sig.Verify(sk.MustPK(), RandBeaconMessage(rbs)))
+}
@@ -9,11 +9,17 @@ type State interface {
 	Serialize() (TrieBlob, error)
 	Deserialize(TrieBlob) error
 	CommitCache()
+	// CommitTxns commits the serialized txns of a block of the
+	// given round, returning the new state and the number of the
+	// committed txns. An empty batch is valid, it only applies
+	// the changes scheduled for the round, if any.
 	CommitTxns([]byte, TxnPool, uint64) (State, int, error)
 }
 
 var ErrTxnNonceTooBig = errors.New("txn's nonce is too big, but txn can be used for future")
 
+var ErrBlockCostExceeded = errors.New("txn exceeds the block execution cost budget, but txn can be used for future")
+
 // Transition is the transition from one State to another State.
 type Transition interface {
 	// Record records a transition to the state transition.
@@ -36,7 +42,16 @@ type Txn struct {
 	MinerFeeTxn bool
 	Owner       Addr
 	Nonce       uint64
-	Raw         []byte
+	// ValidUntilRound is the last round the transaction can be
+	// included in, 0 means the transaction never expires.
+	ValidUntilRound uint64
+	Raw             []byte
+}
+
+// Expired returns true if the transaction can not be included in
+// the given round.
+func (t *Txn) Expired(round uint64) bool {
+	return t.ValidUntilRound > 0 && round > t.ValidUntilRound
 }
 
 // TxnPool is the pool that stores the received transactions.
@@ -50,5 +65,14 @@ type TxnPool interface {
 	NotSeen(hash Hash) bool
 	Txns() []*Txn
 	Remove(hash Hash)
+	// RemoveExpired removes the transactions that can not be
+	// included in the given round, returns the number of the
+	// removed transactions.
+	RemoveExpired(round uint64) int
+	// Reinject adds back the transactions of the serialized
+	// block body that are still valid against the given state,
+	// e.g., the transactions of the blocks discarded by a reorg.
+	// Returns the number of the reinjected transactions.
+	Reinject(body []byte, s State) int
 	Size() int
 }
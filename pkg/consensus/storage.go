@@ -1,7 +1,18 @@
 package consensus
 
 import (
+	"bytes"
+	"sort"
 	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/helinwang/log15"
+)
+
+var (
+	blockPrefix         = []byte("block")
+	blockProposalPrefix = []byte("bp")
 )
 
 // storage stores the blockchain data.
@@ -20,6 +31,16 @@ type storage struct {
 	lastRoundRandBeaconSig      map[Hash]*RandBeaconSig
 	lastRandBeaconSigShareRound uint64
 	lastRoundRandBeaconSigShare map[Hash]*RandBeaconSigShare
+	// unNotarized is the rounds of the block proposals that are
+	// not notarized by any added block.
+	unNotarized map[Hash]uint64
+	// blockDB stores the offloaded finalized blocks and their
+	// block proposals, nil means they are kept in memory.
+	blockDB      ethdb.Database
+	recentBlocks *lru.Cache
+	recentBPs    *lru.Cache
+	// codec encodes the offloaded blocks and block proposals.
+	codec Codec
 }
 
 func newStorage() *storage {
@@ -32,17 +53,52 @@ func newStorage() *storage {
 		lastRoundNtShare:            make(map[Hash]*NtShare),
 		lastRoundRandBeaconSig:      make(map[Hash]*RandBeaconSig),
 		lastRoundRandBeaconSigShare: make(map[Hash]*RandBeaconSigShare),
+		unNotarized:                 make(map[Hash]uint64),
+		codec:                       rlpCodec{},
+	}
+}
+
+// SetBlockDB sets the database where the finalized blocks and their
+// block proposals are offloaded to, at most maxRecentBlocks offloaded
+// blocks and block proposals are cached in memory.
+func (s *storage) SetBlockDB(db ethdb.Database, maxRecentBlocks int) {
+	blocks, err := lru.New(maxRecentBlocks)
+	if err != nil {
+		panic(err)
+	}
+
+	bps, err := lru.New(maxRecentBlocks)
+	if err != nil {
+		panic(err)
 	}
+
+	s.mu.Lock()
+	s.blockDB = db
+	s.recentBlocks = blocks
+	s.recentBPs = bps
+	s.mu.Unlock()
+}
+
+func blockPath(h Hash) []byte {
+	return append(append([]byte(nil), blockPrefix...), h[:]...)
+}
+
+func blockProposalPath(h Hash) []byte {
+	return append(append([]byte(nil), blockProposalPrefix...), h[:]...)
 }
 
 func (s *storage) AddBlock(b *Block, h Hash) bool {
 	s.mu.Lock()
 	broadcast := false
-	if _, ok := s.blocks[h]; !ok {
+	if _, ok := s.blocks[h]; !ok && s.coldBlock(h) == nil {
 		s.blocks[h] = b
 		broadcast = true
 	}
 
+	// the block proposal could be notarized already or never
+	// added, deleting it is a no-op then.
+	delete(s.unNotarized, b.BlockProposal)
+
 	s.keepLastRoundBlock(b, h)
 	s.mu.Unlock()
 	return broadcast
@@ -50,29 +106,227 @@ func (s *storage) AddBlock(b *Block, h Hash) bool {
 
 func (s *storage) AddBlockProposal(bp *BlockProposal, h Hash) bool {
 	s.mu.Lock()
-	if _, ok := s.blockProposals[h]; ok {
+	if _, ok := s.blockProposals[h]; ok || s.coldBlockProposal(h) != nil {
 		s.mu.Unlock()
 		return false
 	}
 	s.blockProposals[h] = bp
+	s.unNotarized[h] = bp.Round
 
 	s.keepLastRoundBlockProposal(bp, h)
 	s.mu.Unlock()
 	return true
 }
 
-func (s *storage) Block(h Hash) *Block {
+// RemoveAbove removes the blocks and the block proposals above the
+// given round.
+func (s *storage) RemoveAbove(round uint64) {
 	s.mu.Lock()
-	b := s.blocks[h]
+	for h, b := range s.blocks {
+		if b.Round > round {
+			delete(s.blocks, h)
+		}
+	}
+
+	for h, bp := range s.blockProposals {
+		if bp.Round > round {
+			delete(s.blockProposals, h)
+			delete(s.unNotarized, h)
+		}
+	}
+
+	if s.lastBlockRound > round {
+		for k := range s.lastRoundBlock {
+			delete(s.lastRoundBlock, k)
+		}
+		s.lastBlockRound = round
+	}
+
+	if s.lastBPRound > round {
+		for k := range s.lastRoundBP {
+			delete(s.lastRoundBP, k)
+		}
+		s.lastBPRound = round
+	}
 	s.mu.Unlock()
+}
+
+// RemoveBlock removes the block and its block proposal, it is used
+// to discard the blocks of the branches dropped by the finalization.
+func (s *storage) RemoveBlock(h Hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blocks[h]
+	if !ok {
+		return
+	}
+
+	delete(s.blocks, h)
+	delete(s.lastRoundBlock, h)
+	// a block proposal is notarized by at most one unfinalized
+	// block.
+	delete(s.blockProposals, b.BlockProposal)
+	delete(s.unNotarized, b.BlockProposal)
+}
+
+// UnNotarized returns the block proposals of the given round that are
+// not notarized by any added block, ordered by their hashes.
+func (s *storage) UnNotarized(round uint64) []*BlockProposal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hashes []Hash
+	for h, r := range s.unNotarized {
+		if r == round {
+			hashes = append(hashes, h)
+		}
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+
+	bps := make([]*BlockProposal, len(hashes))
+	for i, h := range hashes {
+		bps[i] = s.blockProposals[h]
+	}
+	return bps
+}
+
+// RemoveUnNotarized removes the block proposals that are not
+// notarized by any added block up to the given round, they can no
+// longer be notarized once the round is finalized. It returns the
+// number of the removed block proposals.
+func (s *storage) RemoveUnNotarized(round uint64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for h, r := range s.unNotarized {
+		if r <= round {
+			delete(s.blockProposals, h)
+			delete(s.unNotarized, h)
+			n++
+		}
+	}
+	return n
+}
+
+// Offload moves the finalized block and its block proposal from
+// memory to the block database, they are still served to the syncing
+// peers. It does nothing if the block database is not set.
+func (s *storage) Offload(h Hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.blockDB == nil {
+		return
+	}
+
+	b, ok := s.blocks[h]
+	if !ok {
+		return
+	}
+
+	err := s.blockDB.Put(blockPath(h), s.codec.EncodeBlock(b))
+	if err != nil {
+		log.Error("error offload block", "hash", h, "err", err)
+		return
+	}
+
+	delete(s.blocks, h)
+	s.recentBlocks.Add(h, b)
+
+	bp, ok := s.blockProposals[b.BlockProposal]
+	if !ok {
+		return
+	}
+
+	err = s.blockDB.Put(blockProposalPath(b.BlockProposal), s.codec.EncodeBlockProposal(bp))
+	if err != nil {
+		log.Error("error offload block proposal", "hash", b.BlockProposal, "err", err)
+		return
+	}
+
+	delete(s.blockProposals, b.BlockProposal)
+	s.recentBPs.Add(b.BlockProposal, bp)
+}
+
+// Block returns the block of the given hash, the offloaded block is
+// loaded from the block database on a miss of the recent block
+// cache.
+func (s *storage) Block(h Hash) *Block {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b, ok := s.blocks[h]; ok {
+		return b
+	}
+
+	return s.coldBlock(h)
+}
+
+func (s *storage) coldBlock(h Hash) *Block {
+	if s.blockDB == nil {
+		return nil
+	}
+
+	if b, ok := s.recentBlocks.Get(h); ok {
+		return b.(*Block)
+	}
+
+	d, err := s.blockDB.Get(blockPath(h))
+	if err != nil {
+		return nil
+	}
+
+	b, err := s.codec.DecodeBlock(d)
+	if err != nil {
+		log.Error("error decode offloaded block", "hash", h, "err", err)
+		return nil
+	}
+
+	s.recentBlocks.Add(h, b)
 	return b
 }
 
+// BlockProposal returns the block proposal of the given hash, the
+// offloaded block proposal is loaded from the block database on a
+// miss of the recent block proposal cache.
 func (s *storage) BlockProposal(h Hash) *BlockProposal {
 	s.mu.Lock()
-	b := s.blockProposals[h]
-	s.mu.Unlock()
-	return b
+	defer s.mu.Unlock()
+
+	if bp, ok := s.blockProposals[h]; ok {
+		return bp
+	}
+
+	return s.coldBlockProposal(h)
+}
+
+func (s *storage) coldBlockProposal(h Hash) *BlockProposal {
+	if s.blockDB == nil {
+		return nil
+	}
+
+	if bp, ok := s.recentBPs.Get(h); ok {
+		return bp.(*BlockProposal)
+	}
+
+	d, err := s.blockDB.Get(blockProposalPath(h))
+	if err != nil {
+		return nil
+	}
+
+	bp, err := s.codec.DecodeBlockProposal(d)
+	if err != nil {
+		log.Error("error decode offloaded block proposal", "hash", h, "err", err)
+		return nil
+	}
+
+	s.recentBPs.Add(h, bp)
+	return bp
 }
 
 func (s *storage) keepLastRoundBlock(b *Block, h Hash) {
@@ -0,0 +1,86 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageOffloadBlock(t *testing.T) {
+	s := newStorage()
+	s.SetBlockDB(ethdb.NewMemDatabase(), 1)
+
+	bp1 := &BlockProposal{Round: 1, Txns: []byte{1, 2, 3}}
+	bp2 := &BlockProposal{Round: 2, Txns: []byte{4}}
+	bpHash1, bpHash2 := bp1.Hash(), bp2.Hash()
+	assert.True(t, s.AddBlockProposal(bp1, bpHash1))
+	assert.True(t, s.AddBlockProposal(bp2, bpHash2))
+	b1 := &Block{Round: 1, BlockProposal: bpHash1, SysTxns: []SysTxn{{Type: ListGroups, Data: []byte{1}}}, Notarization: Sig{1}}
+	b2 := &Block{Round: 2, PrevBlock: b1.Hash(), BlockProposal: bpHash2}
+	h1, h2 := b1.Hash(), b2.Hash()
+	assert.True(t, s.AddBlock(b1, h1))
+	assert.True(t, s.AddBlock(b2, h2))
+
+	s.Offload(h1)
+	s.Offload(h2)
+
+	// the cold block is evicted from memory.
+	_, ok := s.blocks[h1]
+	assert.False(t, ok)
+	assert.False(t, s.recentBlocks.Contains(h1))
+	assert.True(t, s.recentBlocks.Contains(h2))
+
+	// but still returned from the block database.
+	b := s.Block(h1)
+	assert.NotNil(t, b)
+	assert.Equal(t, h1, b.Hash())
+	assert.Equal(t, h2, s.Block(h2).Hash())
+	assert.Nil(t, s.Block(Hash{1}))
+
+	// the offloaded block is not added again.
+	assert.False(t, s.AddBlock(b1, h1))
+
+	// the block proposals of the offloaded blocks are offloaded
+	// as well, and still served to the syncing peers.
+	assert.Equal(t, 0, len(s.blockProposals))
+	assert.False(t, s.recentBPs.Contains(bpHash1))
+	bp := s.BlockProposal(bpHash1)
+	assert.NotNil(t, bp)
+	assert.Equal(t, bpHash1, bp.Hash())
+	assert.Equal(t, bpHash2, s.BlockProposal(bpHash2).Hash())
+	assert.False(t, s.AddBlockProposal(bp1, bpHash1))
+	assert.Equal(t, 0, len(s.blockProposals))
+}
+
+func TestStorageRemoveUnNotarized(t *testing.T) {
+	s := newStorage()
+	var bps []*BlockProposal
+	for i := 0; i < 3; i++ {
+		bp := &BlockProposal{Round: 1, Owner: Addr{byte(i)}}
+		bps = append(bps, bp)
+		assert.True(t, s.AddBlockProposal(bp, bp.Hash()))
+	}
+	bp2 := &BlockProposal{Round: 2}
+	assert.True(t, s.AddBlockProposal(bp2, bp2.Hash()))
+	assert.Equal(t, 4, len(s.unNotarized))
+
+	b := &Block{Round: 1, BlockProposal: bps[0].Hash()}
+	s.AddBlock(b, b.Hash())
+	assert.Equal(t, 3, len(s.unNotarized))
+	// a block of the already notarized block proposal, or of an
+	// unknown one, changes nothing.
+	b1 := &Block{Round: 1, BlockProposal: bps[0].Hash(), Owner: Addr{1}}
+	s.AddBlock(b1, b1.Hash())
+	b2 := &Block{Round: 1, BlockProposal: Hash{1}}
+	s.AddBlock(b2, b2.Hash())
+	assert.Equal(t, 3, len(s.unNotarized))
+
+	assert.Equal(t, 2, s.RemoveUnNotarized(1))
+	assert.Equal(t, 1, len(s.unNotarized))
+	assert.NotNil(t, s.BlockProposal(bps[0].Hash()))
+	assert.Nil(t, s.BlockProposal(bps[1].Hash()))
+	assert.Nil(t, s.BlockProposal(bps[2].Hash()))
+	assert.NotNil(t, s.BlockProposal(bp2.Hash()))
+	assert.Equal(t, 0, s.RemoveUnNotarized(1))
+}
@@ -106,11 +106,21 @@ func (s *syncer) syncBlock(addr unicastAddr, hash Hash, round uint64) (b *Block,
 		return
 	}
 
+	err = s.chain.ValidateRound(b.Round)
+	if err != nil {
+		return
+	}
+
 	bp, _, err := s.SyncBlockProposal(addr, b.BlockProposal)
 	if err != nil {
 		return
 	}
 
+	err = validateBlockSysTxns(b, bp)
+	if err != nil {
+		return
+	}
+
 	var weight float64
 	s.chain.randomBeacon.WaitUntil(b.Round)
 	prev := s.store.Block(b.PrevBlock)
@@ -124,8 +134,12 @@ func (s *syncer) syncBlock(addr unicastAddr, hash Hash, round uint64) (b *Block,
 		return
 	}
 
-	_, _, nt := s.chain.randomBeacon.Committees(b.Round)
-	success := b.Notarization.Verify(s.chain.randomBeacon.groups[nt].PK, b.Encode(false))
+	_, _, nt, err := s.chain.randomBeacon.Committees(b.Round)
+	if err != nil {
+		return
+	}
+
+	success := s.chain.randomBeacon.sigCache.Verify(b.Notarization, s.chain.randomBeacon.groups[nt].PK, NotarizationMessage(b))
 	if !success {
 		err = fmt.Errorf("validate block group sig failed, group:%d", nt)
 		return
@@ -136,20 +150,16 @@ func (s *syncer) syncBlock(addr unicastAddr, hash Hash, round uint64) (b *Block,
 		err = fmt.Errorf("error get rank, but group sig is valid: %v", err)
 		return
 	}
-	weight = rankToWeight(rank)
-
-	state := s.chain.BlockState(b.PrevBlock)
-	newState, count, err := state.CommitTxns(bp.Txns, s.chain.txnPool, bp.Round)
-	if err != nil {
-		return
-	}
+	weight = s.chain.blockWeight(b.Owner, rank)
 
-	if newState.Hash() != b.StateRoot {
-		err = errors.New("invalid state root")
+	broadcast, err = s.chain.addBlock(b, bp, weight)
+	if err == ErrBlockExists {
+		// the block is added while being synced, replaying
+		// it is a no-op.
+		err = nil
 		return
 	}
 
-	broadcast, err = s.chain.AddBlock(b, newState, weight, count)
 	if err != nil {
 		return
 	}
@@ -157,6 +167,18 @@ func (s *syncer) syncBlock(addr unicastAddr, hash Hash, round uint64) (b *Block,
 	return
 }
 
+// validateBlockSysTxns returns an error if the sys txns of the block
+// do not match the ones of its block proposal. The block proposals
+// do not carry sys txns yet, so the block notarized from a block
+// proposal must not carry any either.
+func validateBlockSysTxns(b *Block, bp *BlockProposal) error {
+	if len(b.SysTxns) > 0 {
+		return fmt.Errorf("block has %d sys txns, but its block proposal has none", len(b.SysTxns))
+	}
+
+	return nil
+}
+
 func rankToWeight(rank uint16) float64 {
 	if rank < 0 {
 		panic(rank)
@@ -176,6 +198,11 @@ func (s *syncer) SyncBlockProposal(addr unicastAddr, hash Hash) (bp *BlockPropos
 		return
 	}
 
+	err = s.chain.ValidateRound(bp.Round)
+	if err != nil {
+		return
+	}
+
 	var prev *Block
 	if bp.Round == 1 {
 		if bp.PrevBlock != s.chain.Genesis() {
@@ -191,29 +218,11 @@ func (s *syncer) SyncBlockProposal(addr unicastAddr, hash Hash) (bp *BlockPropos
 	}
 
 	s.chain.randomBeacon.WaitUntil(bp.Round)
-
-	if prev.Round != bp.Round-1 {
-		err = errors.New("prev block round is not block proposal round - 1")
-		return
-	}
-
-	// make sure proposer is in the current proposal group
-	_, err = s.chain.randomBeacon.Rank(bp.Owner, bp.Round)
+	err = s.chain.validateBlockProposal(bp, prev)
 	if err != nil {
 		return
 	}
 
-	pk, ok := s.chain.lastFinalizedSysState.addrToPK[bp.Owner]
-	if !ok {
-		err = errors.New("block proposal owner not found")
-		return
-	}
-
-	if !bp.OwnerSig.Verify(pk, bp.Encode(false)) {
-		err = errors.New("invalid block proposal signature")
-		return
-	}
-
 	broadcast = s.store.AddBlockProposal(bp, hash)
 
 	if broadcast {
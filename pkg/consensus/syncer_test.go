@@ -0,0 +1,80 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBlockSysTxns(t *testing.T) {
+	bp := &BlockProposal{Round: 1}
+	nt := &NtShare{Round: 1, BP: bp.Hash()}
+	b := ntToBlock(nt, bp, nt.BP)
+	assert.Nil(t, validateBlockSysTxns(b, bp))
+
+	b.SysTxns = []SysTxn{{Type: ListGroups}}
+	assert.NotNil(t, validateBlockSysTxns(b, bp))
+}
+
+type blockRequester struct {
+	b  *Block
+	bp *BlockProposal
+}
+
+func (r *blockRequester) RequestBlock(ctx context.Context, addr unicastAddr, hash Hash) (*Block, error) {
+	if r.b.Hash() != hash {
+		return nil, errors.New("block not found")
+	}
+	return r.b, nil
+}
+
+func (r *blockRequester) RequestBlockProposal(ctx context.Context, addr unicastAddr, hash Hash) (*BlockProposal, error) {
+	if r.bp.Hash() != hash {
+		return nil, errors.New("block proposal not found")
+	}
+	return r.bp, nil
+}
+
+func (r *blockRequester) RequestRandBeaconSig(ctx context.Context, addr unicastAddr, round uint64) (*RandBeaconSig, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestSyncBlockBehindRetention(t *testing.T) {
+	genesisState := &testState{h: SHA3([]byte("genesis"))}
+	sk := DeterministicSK([]byte{1})
+	owner := sk.MustPK().Addr()
+	genesis := &Block{
+		StateRoot: genesisState.Hash(),
+		SysTxns: []SysTxn{
+			{Type: ReadyJoinGroup, Data: testGobEncode(ReadyJoinGroupTxn{ID: 0, PK: sk.MustPK()})},
+		},
+	}
+	store := newStorage()
+	cfg := Config{HistoryRetention: 1}
+	chain := NewChain(genesis, genesisState, Rand{}, cfg, nil, &myUpdater{}, store, nil)
+	g := newGroup(sk.MustPK())
+	g.Members = []Addr{owner}
+	chain.randomBeacon = NewRandomBeacon(Rand{}, []*group{g}, cfg)
+
+	// the random beacon is synced to the tip before the blocks,
+	// far beyond the retention.
+	for round := uint64(1); round <= 3*minHistoryRetention; round++ {
+		assert.True(t, chain.randomBeacon.AddRandBeaconSig(&RandBeaconSig{Round: round, Sig: []byte{byte(round)}}, false))
+	}
+
+	bp := &BlockProposal{Round: 1, PrevBlock: genesis.Hash(), Owner: owner}
+	_, root, err := chain.ApplyProposal(genesisState, bp, 1)
+	assert.Nil(t, err)
+	b := &Block{Round: 1, PrevBlock: genesis.Hash(), StateRoot: root, BlockProposal: bp.Hash(), Owner: owner}
+	b.Notarization = sk.Sign(NotarizationMessage(b))
+
+	s := newSyncer(chain, &blockRequester{b: b, bp: bp}, store)
+	// the block proposal is received before, it is not
+	// validated again.
+	store.AddBlockProposal(bp, bp.Hash())
+	_, _, err = s.SyncBlock(unicastAddr{}, b.Hash(), b.Round)
+	assert.Nil(t, err)
+	assert.NotNil(t, store.Block(b.Hash()))
+}
@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 // SysState is the system state, the system state can be changed by
@@ -11,19 +15,28 @@ import (
 type SysState struct {
 	nodeIDToPK map[int]PK
 	addrToPK   map[Addr]PK
-	idToGroup  map[int]*group
-	groups     []*group
+	// addrToStake is the stake of each registered node.
+	addrToStake map[Addr]uint64
+	idToGroup   map[int]*group
+	groups      []*group
 }
 
 // NewSysState creates a new system state.
 func NewSysState() *SysState {
 	return &SysState{
-		nodeIDToPK: make(map[int]PK),
-		addrToPK:   make(map[Addr]PK),
-		idToGroup:  make(map[int]*group),
+		nodeIDToPK:  make(map[int]PK),
+		addrToPK:    make(map[Addr]PK),
+		addrToStake: make(map[Addr]uint64),
+		idToGroup:   make(map[int]*group),
 	}
 }
 
+// Stake returns the stake of the node, 0 is returned if the node is
+// not registered.
+func (s *SysState) Stake(addr Addr) uint64 {
+	return s.addrToStake[addr]
+}
+
 // SysTransition is the system transition used to change the system
 // state.
 type SysTransition struct {
@@ -45,17 +58,26 @@ func (s *SysTransition) Txns() []SysTxn {
 // Commit commits the recorded transactions and creates a new system
 // state.
 func (s *SysTransition) Commit() *SysState {
+	state, err := s.commit()
+	if err != nil {
+		// TODO: handle error when open participation is
+		// supported.
+		panic(err)
+	}
+
+	return state
+}
+
+func (s *SysTransition) commit() (*SysState, error) {
 	// TODO: this is assuming that there will be no more sys txn
 	// after genesis. This is not true after we support open
 	// participation though DKG.
 	err := s.s.applySysTxns(s.txns)
 	if err != nil {
-		// TODO: handle error when open participation is
-		// supported.
-		panic(err)
+		return nil, err
 	}
 
-	return s.s
+	return s.s, nil
 }
 
 // Clear clears the recorded transactions.
@@ -68,10 +90,120 @@ func (s *SysState) Transition() *SysTransition {
 	return &SysTransition{s: s}
 }
 
+// Replay applies the sys txns to a copy of the system state and
+// returns the new system state and its hash, the system state itself
+// is not modified. Light clients can use it to verify the system
+// state alongside the DEX state.
+func (s *SysState) Replay(txns []SysTxn) (*SysState, Hash, error) {
+	r := s.clone()
+	err := r.applySysTxns(txns)
+	if err != nil {
+		return nil, Hash{}, err
+	}
+
+	return r, r.Hash(), nil
+}
+
+func (s *SysState) clone() *SysState {
+	r := NewSysState()
+	for k, v := range s.nodeIDToPK {
+		r.nodeIDToPK[k] = v
+	}
+
+	for k, v := range s.addrToPK {
+		r.addrToPK[k] = v
+	}
+
+	for k, v := range s.addrToStake {
+		r.addrToStake[k] = v
+	}
+
+	// groups are never modified once registered, they can be
+	// shared.
+	for k, v := range s.idToGroup {
+		r.idToGroup[k] = v
+	}
+
+	r.groups = append([]*group(nil), s.groups...)
+	return r
+}
+
+type sysStateNode struct {
+	ID    uint64
+	PK    PK
+	Stake uint64
+}
+
+type sysStateGroup struct {
+	ID        uint64
+	PK        PK
+	Members   []Addr
+	MemberPKs []PK
+}
+
+type sysStateEncoding struct {
+	Nodes  []sysStateNode
+	Groups []sysStateGroup
+	Listed []uint64
+}
+
+// Hash returns the hash of the system state, the nodes and the
+// registered groups are ordered by their IDs, so the hash does not
+// depend on the map iteration order.
+func (s *SysState) Hash() Hash {
+	var en sysStateEncoding
+	nodeIDs := make([]int, 0, len(s.nodeIDToPK))
+	for id := range s.nodeIDToPK {
+		nodeIDs = append(nodeIDs, id)
+	}
+	sort.Ints(nodeIDs)
+	for _, id := range nodeIDs {
+		pk := s.nodeIDToPK[id]
+		en.Nodes = append(en.Nodes, sysStateNode{ID: uint64(id), PK: pk, Stake: s.addrToStake[pk.Addr()]})
+	}
+
+	groupIDs := make([]int, 0, len(s.idToGroup))
+	groupToID := make(map[*group]int, len(s.idToGroup))
+	for id, g := range s.idToGroup {
+		groupIDs = append(groupIDs, id)
+		groupToID[g] = id
+	}
+	sort.Ints(groupIDs)
+	for _, id := range groupIDs {
+		g := s.idToGroup[id]
+		pks := make([]PK, len(g.Members))
+		for i, addr := range g.Members {
+			pks[i] = g.MemberPK[addr]
+		}
+		en.Groups = append(en.Groups, sysStateGroup{ID: uint64(id), PK: g.PK, Members: g.Members, MemberPKs: pks})
+	}
+
+	for _, g := range s.groups {
+		id, ok := groupToID[g]
+		if !ok {
+			panic("should not happen: listed group is not registered")
+		}
+		en.Listed = append(en.Listed, uint64(id))
+	}
+
+	b, err := rlp.EncodeToBytes(en)
+	if err != nil {
+		panic(err)
+	}
+
+	return SHA3(b)
+}
+
 func (s *SysState) applyReadyJoinGroup(t ReadyJoinGroupTxn) error {
 	addr := t.PK.Addr()
+	stake := t.Stake
+	if stake == 0 {
+		stake = DefaultStake
+	}
+
 	s.nodeIDToPK[t.ID] = t.PK
 	s.addrToPK[addr] = t.PK
+	s.addrToStake[addr] = stake
 	return nil
 }
 
@@ -109,43 +241,43 @@ func (s *SysState) applyListGroups(t ListGroupsTxn) error {
 }
 
 func (s *SysState) applySysTxns(txns []SysTxn) error {
-	for _, txn := range txns {
-		dec := gob.NewDecoder(bytes.NewReader(txn.Data))
-		switch txn.Type {
-		case ReadyJoinGroup:
-			var t ReadyJoinGroupTxn
-			err := dec.Decode(&t)
-			if err != nil {
-				return err
-			}
-
-			err = s.applyReadyJoinGroup(t)
-			if err != nil {
-				return err
-			}
-		case RegGroup:
-			var t RegGroupTxn
-			err := dec.Decode(&t)
-			if err != nil {
-				return err
-			}
-
-			err = s.applyRegGroup(t)
-			if err != nil {
-				return err
-			}
-		case ListGroups:
-			var t ListGroupsTxn
-			err := dec.Decode(&t)
-			if err != nil {
-				return err
-			}
-
-			err = s.applyListGroups(t)
-			if err != nil {
-				return err
-			}
+	for i, txn := range txns {
+		err := s.applySysTxn(txn)
+		if err != nil {
+			return fmt.Errorf("error apply sys txn %d, type: %d: %v", i, txn.Type, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SysState) applySysTxn(txn SysTxn) error {
+	dec := gob.NewDecoder(bytes.NewReader(txn.Data))
+	switch txn.Type {
+	case ReadyJoinGroup:
+		var t ReadyJoinGroupTxn
+		err := dec.Decode(&t)
+		if err != nil {
+			return err
+		}
+
+		return s.applyReadyJoinGroup(t)
+	case RegGroup:
+		var t RegGroupTxn
+		err := dec.Decode(&t)
+		if err != nil {
+			return err
+		}
+
+		return s.applyRegGroup(t)
+	case ListGroups:
+		var t ListGroupsTxn
+		err := dec.Decode(&t)
+		if err != nil {
+			return err
 		}
+
+		return s.applyListGroups(t)
 	}
 
 	return nil
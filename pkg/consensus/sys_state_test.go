@@ -0,0 +1,67 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSysPK(b ...byte) PK {
+	h := SHA3(b)
+	return PK(h[:])
+}
+
+func makeGroupSysTxns(groupID int, memberIDs []int) []SysTxn {
+	var txns []SysTxn
+	vvec := make([]PK, len(memberIDs))
+	for i, id := range memberIDs {
+		pk := testSysPK(byte(id))
+		txns = append(txns, SysTxn{Type: ReadyJoinGroup, Data: testGobEncode(ReadyJoinGroupTxn{ID: id, PK: pk})})
+		vvec[i] = testSysPK(byte(groupID), byte(id))
+	}
+
+	gpk := testSysPK(byte(groupID))
+	txns = append(txns, SysTxn{Type: RegGroup, Data: testGobEncode(RegGroupTxn{ID: groupID, PK: gpk, MemberIDs: memberIDs, MemberVVec: vvec})})
+	return txns
+}
+
+func TestSysStateReplay(t *testing.T) {
+	prev := NewSysState()
+	emptyHash := prev.Hash()
+
+	txns := makeGroupSysTxns(0, []int{0, 1, 2})
+	txns = append(txns, makeGroupSysTxns(1, []int{3, 4, 5})...)
+	txns = append(txns, SysTxn{Type: ListGroups, Data: testGobEncode(ListGroupsTxn{GroupIDs: []int{1, 0}})})
+
+	s, h, err := prev.Replay(txns)
+	assert.Nil(t, err)
+	assert.Equal(t, s.Hash(), h)
+	assert.NotEqual(t, emptyHash, h)
+	assert.Equal(t, 2, len(s.groups))
+	assert.Equal(t, s.idToGroup[1], s.groups[0])
+
+	// the previous state is not modified.
+	assert.Equal(t, emptyHash, prev.Hash())
+	assert.Equal(t, 0, len(prev.idToGroup))
+
+	// replaying is deterministic, and matches the transition.
+	s0, h0, err := prev.Replay(txns)
+	assert.Nil(t, err)
+	assert.Equal(t, h, h0)
+	trans := NewSysState().Transition()
+	for _, txn := range txns {
+		trans.Record(txn)
+	}
+	assert.Equal(t, h, trans.Commit().Hash())
+
+	// the listed group order is part of the state.
+	list := SysTxn{Type: ListGroups, Data: testGobEncode(ListGroupsTxn{GroupIDs: []int{0, 1}})}
+	_, h1, err := s0.Replay([]SysTxn{list})
+	assert.Nil(t, err)
+	assert.NotEqual(t, h, h1)
+	assert.Equal(t, h, s0.Hash())
+
+	_, _, err = prev.Replay(makeGroupSysTxns(2, []int{6})[1:])
+	assert.NotNil(t, err)
+	assert.Equal(t, emptyHash, prev.Hash())
+}
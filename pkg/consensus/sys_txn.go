@@ -25,12 +25,20 @@ type SysTxn struct {
 // receive transaction fee when notarizing a block. Group members are
 // selected randomly by the random beacon, same as which group is the
 // notary committe group.
+//
+// Stake is the stake weight of the node, the fork choice weight of a
+// block is the stake of its proposer times 0.5^rank. 0 means
+// DefaultStake.
 type ReadyJoinGroupTxn struct {
 	ID    int
 	PK    PK
 	Proof []byte
+	Stake uint64
 }
 
+// DefaultStake is the stake of the node registered without a stake.
+const DefaultStake = 1
+
 // RegGroupTxn registers a group to the blockchain.
 //
 // Mebers of a group is selected by the random beacon, they will run a
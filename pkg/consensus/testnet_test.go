@@ -0,0 +1,357 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfinity/go-dfinity-crypto/bls"
+	"github.com/stretchr/testify/assert"
+)
+
+// memHub connects the in-process transports of the test network.
+type memHub struct {
+	mu    sync.Mutex
+	peers map[unicastAddr]*memTransport
+}
+
+func newMemHub() *memHub {
+	return &memHub{peers: make(map[unicastAddr]*memTransport)}
+}
+
+func (h *memHub) newTransport(pk PK, idx int) *memTransport {
+	t := &memTransport{
+		hub:  h,
+		addr: unicastAddr{Addr: fmt.Sprintf("mem-%d", idx), PKStr: string(pk)},
+		ch:   make(chan packetAndAddr, 1000),
+	}
+
+	h.mu.Lock()
+	h.peers[t.addr] = t
+	h.mu.Unlock()
+	return t
+}
+
+// memTransport is an in-process transport, packets are gob encoded
+// and decoded just as they are on the wire, so nodes never share the
+// same objects.
+type memTransport struct {
+	hub  *memHub
+	addr unicastAddr
+	ch   chan packetAndAddr
+}
+
+func (t *memTransport) Start(host string, port int) (unicastAddr, error) {
+	return t.addr, nil
+}
+
+func (t *memTransport) ConnectSeed(addr string) error {
+	return nil
+}
+
+func (t *memTransport) deliver(to *memTransport, b []byte) {
+	var p packet
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&p)
+	if err != nil {
+		panic(err)
+	}
+
+	to.ch <- packetAndAddr{A: t.addr, P: p}
+}
+
+func (t *memTransport) Send(addr netAddr, p packet) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(p)
+	if err != nil {
+		return err
+	}
+
+	switch v := addr.(type) {
+	case unicastAddr:
+		t.hub.mu.Lock()
+		to, ok := t.hub.peers[v]
+		t.hub.mu.Unlock()
+		if !ok {
+			return errors.New("can not find the send address")
+		}
+
+		go t.deliver(to, buf.Bytes())
+	case broadcast:
+		t.hub.mu.Lock()
+		for addr, to := range t.hub.peers {
+			if addr == t.addr {
+				continue
+			}
+
+			go t.deliver(to, buf.Bytes())
+		}
+		t.hub.mu.Unlock()
+	default:
+		panic(addr)
+	}
+	return nil
+}
+
+func (t *memTransport) Recv() (unicastAddr, packet) {
+	p := <-t.ch
+	return p.A, p.P
+}
+
+// testState is a minimal State whose hash is chained through every
+// committed round.
+type testState struct {
+	h Hash
+}
+
+func (s *testState) Hash() Hash {
+	return s.h
+}
+
+func (s *testState) Transition(round uint64, proposerPK []byte) Transition {
+	return &testTransition{s: s, round: round}
+}
+
+func (s *testState) Serialize() (TrieBlob, error) {
+	return TrieBlob{Root: s.h}, nil
+}
+
+func (s *testState) Deserialize(b TrieBlob) error {
+	s.h = b.Root
+	return nil
+}
+
+func (s *testState) CommitCache() {
+}
+
+func (s *testState) CommitTxns(txns []byte, pool TxnPool, round uint64) (State, int, error) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, round)
+	return &testState{h: SHA3(s.h[:], txns, b)}, 0, nil
+}
+
+type testTransition struct {
+	s     *testState
+	round uint64
+}
+
+func (t *testTransition) Record(*Txn) error {
+	return nil
+}
+
+func (t *testTransition) Txns() []byte {
+	return nil
+}
+
+func (t *testTransition) Commit() State {
+	s, _, _ := t.s.CommitTxns(nil, nil, t.round)
+	return s
+}
+
+func (t *testTransition) StateHash() Hash {
+	return t.Commit().Hash()
+}
+
+// testTxnPool is an always empty transaction pool.
+type testTxnPool struct {
+}
+
+func (p *testTxnPool) Add(b []byte) (*Txn, bool) {
+	return nil, false
+}
+
+func (p *testTxnPool) Get(hash Hash) *Txn {
+	return nil
+}
+
+func (p *testTxnPool) NotSeen(hash Hash) bool {
+	return false
+}
+
+func (p *testTxnPool) Txns() []*Txn {
+	return nil
+}
+
+func (p *testTxnPool) Remove(hash Hash) {
+}
+
+func (p *testTxnPool) RemoveExpired(round uint64) int {
+	return 0
+}
+
+func (p *testTxnPool) Reinject(body []byte, s State) int {
+	return 0
+}
+
+func (p *testTxnPool) Size() int {
+	return 0
+}
+
+// testnet is a set of nodes sharing the same genesis, connected
+// through in-process transports.
+type testnet struct {
+	nodes []*Node
+}
+
+func makeGroupShares(threshold int, idVec []bls.ID, rand Rand) (PK, []SK, Rand) {
+	msk := make([]bls.SecretKey, threshold)
+	for i := range msk {
+		msk[i] = rand.SK().MustGet()
+		rand = rand.Derive(rand[:])
+	}
+
+	shares := make([]SK, len(idVec))
+	for i := range shares {
+		var sk bls.SecretKey
+		err := sk.Set(msk, &idVec[i])
+		if err != nil {
+			panic(err)
+		}
+		shares[i] = SK(sk.GetLittleEndian())
+	}
+
+	return PK(msk[0].GetPublicKey().Serialize()), shares, rand
+}
+
+func testGobEncode(v interface{}) []byte {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestnet creates numNode nodes, each group consists of groupSize
+// consecutive nodes.
+func newTestnet(numNode, numGroup, groupSize, threshold int, blockTime time.Duration) *testnet {
+	rand := Rand(SHA3([]byte("testnet")))
+	credentials := make([]NodeCredentials, numNode)
+	var sysTxns []SysTxn
+	for i := range credentials {
+		credentials[i].SK = rand.SK()
+		rand = rand.Derive(rand[:])
+		txn := ReadyJoinGroupTxn{ID: i, PK: credentials[i].SK.MustPK()}
+		sysTxns = append(sysTxns, SysTxn{Type: ReadyJoinGroup, Data: testGobEncode(txn)})
+	}
+
+	groupIDs := make([]int, numGroup)
+	for i := range groupIDs {
+		idxs := make([]int, groupSize)
+		idVec := make([]bls.ID, groupSize)
+		for j := range idxs {
+			idxs[j] = (i*groupSize + j) % numNode
+			idVec[j] = credentials[idxs[j]].SK.MustPK().Addr().ID()
+		}
+
+		var pk PK
+		var shares []SK
+		pk, shares, rand = makeGroupShares(threshold, idVec, rand)
+		vvec := make([]PK, len(shares))
+		for j := range shares {
+			vvec[j] = shares[j].MustPK()
+			c := &credentials[idxs[j]]
+			c.Groups = append(c.Groups, i)
+			c.GroupShares = append(c.GroupShares, shares[j])
+		}
+
+		groupIDs[i] = i
+		txn := RegGroupTxn{ID: i, PK: pk, MemberIDs: idxs, MemberVVec: vvec}
+		sysTxns = append(sysTxns, SysTxn{Type: RegGroup, Data: testGobEncode(txn)})
+	}
+	sysTxns = append(sysTxns, SysTxn{Type: ListGroups, Data: testGobEncode(ListGroupsTxn{GroupIDs: groupIDs})})
+
+	genesisState := &testState{h: SHA3([]byte("testnet genesis"))}
+	blob, err := genesisState.Serialize()
+	if err != nil {
+		panic(err)
+	}
+
+	genesis := Genesis{
+		Block: Block{StateRoot: genesisState.Hash(), SysTxns: sysTxns},
+		State: blob,
+	}
+
+	cfg := Config{BlockTime: blockTime, GroupSize: groupSize, GroupThreshold: threshold, BeaconTimeout: 10 * blockTime}
+	hub := newMemHub()
+	t := &testnet{}
+	for i, c := range credentials {
+		net := hub.newTransport(c.SK.MustPK(), i)
+		n := makeNode(c, cfg, genesis, &testState{}, &testTxnPool{}, &myUpdater{}, nil, nil, net)
+		t.nodes = append(t.nodes, n)
+	}
+	return t
+}
+
+// Start starts every node and kicks off the first round.
+func (t *testnet) Start() {
+	for _, n := range t.nodes {
+		err := n.Start("", 0, "")
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	for _, n := range t.nodes {
+		n.EndRound(0)
+	}
+}
+
+// Stop stops every node.
+func (t *testnet) Stop() {
+	for _, n := range t.nodes {
+		n.Stop()
+	}
+}
+
+// WaitFinalized waits until every node has finalized the given
+// round.
+func (t *testnet) WaitFinalized(round uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, n := range t.nodes {
+		for n.Chain().FinalizedRound() < round {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timeout waiting for round %d to be finalized, node finalized round: %d", round, n.Chain().FinalizedRound())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// Finalized returns the first count finalized block hashes of each
+// node.
+func (t *testnet) Finalized(count int) [][]Hash {
+	r := make([][]Hash, len(t.nodes))
+	for i, n := range t.nodes {
+		c := n.Chain()
+		c.mu.Lock()
+		r[i] = append([]Hash(nil), c.finalized[:count]...)
+		c.mu.Unlock()
+	}
+	return r
+}
+
+func TestTestnetFinalizationConverges(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping multi-node test in short mode")
+	}
+
+	const round = 5
+	net := newTestnet(4, 4, 3, 2, 200*time.Millisecond)
+	net.Start()
+	defer net.Stop()
+	err := net.WaitFinalized(round, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chains := net.Finalized(round + 1)
+	for i := 1; i < len(chains); i++ {
+		assert.Equal(t, chains[0], chains[i])
+	}
+}
@@ -1,6 +1,7 @@
 package dex
 
 import (
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -46,29 +47,32 @@ func (o *OrderID) Encode() string {
 	return fmt.Sprintf("%d_%d_%d", o.Market.Base, o.Market.Quote, o.ID)
 }
 
+// Decode decodes the order id encoded by Encode, in the format of
+// BASE_QUOTE_ID, each part is a base 10 uint64.
 func (o *OrderID) Decode(str string) error {
-	ss := strings.Split(str, "_")
-	if len(ss) != 3 {
-		return errors.New("invalid order id format")
-	}
-
-	a, err := strconv.ParseUint(ss[0], 10, 64)
-	if err != nil {
-		return fmt.Errorf("error parsing order id: %v", err)
+	if str == "" {
+		return errors.New("invalid order id format: empty string")
 	}
 
-	b, err := strconv.ParseUint(ss[1], 10, 64)
-	if err != nil {
-		return fmt.Errorf("error parsing order id: %v", err)
+	ss := strings.Split(str, "_")
+	if len(ss) != 3 {
+		return fmt.Errorf("invalid order id format %q: expected 3 parts separated by _, got %d", str, len(ss))
 	}
 
-	c, err := strconv.ParseUint(ss[2], 10, 64)
-	if err != nil {
-		return fmt.Errorf("error parsing order id: %v", err)
+	var parts [3]uint64
+	for i, name := range []string{"base token", "quote token", "id"} {
+		v, err := strconv.ParseUint(ss[i], 10, 64)
+		if err != nil {
+			if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+				return fmt.Errorf("error parsing order id %q: %s %q overflows uint64", str, name, ss[i])
+			}
+			return fmt.Errorf("error parsing order id %q: %s %q is not a number", str, name, ss[i])
+		}
+		parts[i] = v
 	}
 
-	o.Market = MarketSymbol{Base: TokenID(a), Quote: TokenID(b)}
-	o.ID = c
+	o.Market = MarketSymbol{Base: TokenID(parts[0]), Quote: TokenID(parts[1])}
+	o.ID = parts[2]
 	return nil
 }
 
@@ -78,6 +82,16 @@ type PendingOrder struct {
 	Order
 }
 
+// OrderStatus is the fill status of a resting order.
+type OrderStatus struct {
+	ID       OrderID
+	Quant    uint64
+	Executed uint64
+	// Remaining is the quantity not filled yet, the quantity
+	// minus the executed quantity.
+	Remaining uint64
+}
+
 // Account is a cached proxy to the account data inside the state
 // trie.
 type Account struct {
@@ -92,6 +106,9 @@ type Account struct {
 	balanceDirty   bool
 	reportIdx      *uint32
 	reportIdxDirty bool
+	// elem is the element in the LRU list of the state's
+	// account cache, nil if the account is not cached.
+	elem *list.Element
 }
 
 func (a *Account) ExecutionReports() []ExecutionReport {
@@ -134,6 +151,22 @@ func (a *Account) PendingOrder(id OrderID) (PendingOrder, bool) {
 	return a.state.PendingOrder(a.addr, id)
 }
 
+// Prunable returns true if the account has no balance and no
+// pending order.
+func (a *Account) Prunable() bool {
+	if a.balances == nil {
+		a.loadBalances()
+	}
+
+	for _, b := range a.balances {
+		if !b.Empty() {
+			return false
+		}
+	}
+
+	return len(a.PendingOrders()) == 0
+}
+
 func (a *Account) UpdatePendingOrder(p PendingOrder) {
 	a.state.UpdatePendingOrder(a.addr, p)
 }
@@ -153,6 +186,14 @@ func (a *Account) Balance(tokenID TokenID) Balance {
 	return a.balances[tokenID]
 }
 
+// Spendable returns the quantity of the token that can be used to
+// place orders. The frozen quantity and the quantity held by the
+// pending orders are kept outside of Balance.Available, so it is
+// Available.
+func (a *Account) Spendable(tokenID TokenID) uint64 {
+	return a.Balance(tokenID).Available
+}
+
 func (a *Account) loadBalances() {
 	a.balances = make(map[TokenID]Balance)
 	bs, ids := a.state.Balances(a.addr)
@@ -173,6 +214,10 @@ func (a *Account) PK() PK {
 	return a.pk
 }
 
+func (a *Account) dirty() bool {
+	return a.pkDirty || a.nonceDirty || a.balanceDirty || a.reportIdxDirty
+}
+
 func (a *Account) CommitCache(s *State) {
 	if a.pkDirty {
 		a.state.UpdatePK(a.pk)
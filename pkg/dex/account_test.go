@@ -31,6 +31,37 @@ func TestOrderIDEncodeDecode(t *testing.T) {
 	assert.Equal(t, str, id.Encode())
 }
 
+func TestOrderIDDecodeMalformed(t *testing.T) {
+	cases := []struct {
+		str string
+		err string
+	}{
+		{"", "empty string"},
+		{"1_2", "got 2"},
+		{"1_2_3_4", "got 4"},
+		{"1__3", "quote token \"\" is not a number"},
+		{"a_2_3", "base token \"a\" is not a number"},
+		{"1_2_-3", "id \"-3\" is not a number"},
+		{"1_18446744073709551616_3", "quote token \"18446744073709551616\" overflows uint64"},
+		{"1_2_99999999999999999999", "id \"99999999999999999999\" overflows uint64"},
+	}
+
+	for _, c := range cases {
+		id := OrderID{ID: 7}
+		err := id.Decode(c.str)
+		if assert.NotNil(t, err, c.str) {
+			assert.Contains(t, err.Error(), c.err)
+		}
+		// the id is not changed on error.
+		assert.Equal(t, OrderID{ID: 7}, id)
+	}
+
+	max := "18446744073709551615_18446744073709551615_18446744073709551615"
+	var id OrderID
+	assert.Nil(t, id.Decode(max))
+	assert.Equal(t, max, id.Encode())
+}
+
 func TestAccountHashDeterministic(t *testing.T) {
 	a := Account{
 		pk:    PK{1, 2, 3},
@@ -54,3 +85,22 @@ func TestAccountHashDeterministic(t *testing.T) {
 		lastHash = h
 	}
 }
+
+func TestAccountSpendable(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pk, _ := RandKeyPair()
+	acc := s.NewAccount(pk)
+	assert.Equal(t, 0, int(acc.Spendable(0)))
+
+	// clean
+	acc.UpdateBalance(0, Balance{Available: 100})
+	assert.Equal(t, 100, int(acc.Spendable(0)))
+
+	// held by the pending orders
+	acc.UpdateBalance(1, Balance{Available: 30, Pending: 70})
+	assert.Equal(t, 30, int(acc.Spendable(1)))
+
+	// frozen
+	acc.UpdateBalance(2, Balance{Frozen: []Frozen{{AvailableRound: 3, Quant: 50}}})
+	assert.Equal(t, 0, int(acc.Spendable(2)))
+}
@@ -0,0 +1,286 @@
+package dex
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/helinwang/dex/pkg/consensus"
+)
+
+// the domain separation prefixes of the order book merkle tree, a
+// leaf hash can never be taken as an inner node hash.
+var (
+	bookLeafPrefix = []byte{0}
+	bookNodePrefix = []byte{1}
+)
+
+// BookLeaf is a resting order committed by the order book merkle
+// root.
+type BookLeaf struct {
+	ID       uint64
+	Owner    consensus.Addr
+	SellSide bool
+	Price    uint64
+	// Quant is the unfilled quantity of the order.
+	Quant uint64
+}
+
+func (l BookLeaf) hash() consensus.Hash {
+	b, err := rlp.EncodeToBytes(l)
+	if err != nil {
+		panic(err)
+	}
+
+	return consensus.SHA3(bookLeafPrefix, b)
+}
+
+// leaves returns the resting orders of the order book sorted by the
+// order ID.
+func (o *orderBook) leaves() []BookLeaf {
+	var r []BookLeaf
+	add := func(p *pricePoint, sellSide bool) {
+		for ; p != nil; p = p.NextPoint {
+			for e := p.ListHead; e != nil; e = e.Next {
+				if e.Quant == 0 {
+					// filled or canceled.
+					continue
+				}
+
+				r = append(r, BookLeaf{
+					ID:       e.ID,
+					Owner:    e.Owner,
+					SellSide: sellSide,
+					Price:    p.Price,
+					Quant:    e.Quant,
+				})
+			}
+		}
+	}
+
+	add(o.askMin, true)
+	add(o.bidMax, false)
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].ID < r[j].ID
+	})
+	return r
+}
+
+// bookTree returns the levels of the merkle tree of the leaves, from
+// the leaf hashes to the tree root. The last node of a level with an
+// odd number of nodes is carried to the next level unchanged.
+func bookTree(leaves []BookLeaf) [][]consensus.Hash {
+	level := make([]consensus.Hash, len(leaves))
+	for i, l := range leaves {
+		level[i] = l.hash()
+	}
+
+	levels := [][]consensus.Hash{level}
+	for len(level) > 1 {
+		next := make([]consensus.Hash, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = consensus.SHA3(bookNodePrefix, level[2*i][:], level[2*i+1][:])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// bookRoot returns the order book merkle root of the tree root of
+// count leaves. The leaf count is committed, so a proof can not
+// claim a leaf is the first or the last one when it is not.
+func bookRoot(count uint64, treeRoot consensus.Hash) consensus.Hash {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], count)
+	return consensus.SHA3(b[:], treeRoot[:])
+}
+
+func bookTreeRoot(levels [][]consensus.Hash) consensus.Hash {
+	var treeRoot consensus.Hash
+	if top := levels[len(levels)-1]; len(top) > 0 {
+		treeRoot = top[0]
+	}
+
+	return bookRoot(uint64(len(levels[0])), treeRoot)
+}
+
+// BookLeafProof is the merkle proof of a leaf of the order book.
+type BookLeafProof struct {
+	Leaf BookLeaf
+	// Index is the index of the leaf in the leaves sorted by the
+	// order ID.
+	Index uint64
+	// Siblings are the sibling hashes from the leaf level up,
+	// the levels where the node has no sibling are omitted.
+	Siblings []consensus.Hash
+}
+
+func leafProof(levels [][]consensus.Hash, leaves []BookLeaf, idx int) BookLeafProof {
+	p := BookLeafProof{Leaf: leaves[idx], Index: uint64(idx)}
+	for _, level := range levels[:len(levels)-1] {
+		if sibling := idx ^ 1; sibling < len(level) {
+			p.Siblings = append(p.Siblings, level[sibling])
+		}
+		idx /= 2
+	}
+	return p
+}
+
+// root returns the order book merkle root derived from the leaf
+// proof of a tree of count leaves.
+func (p BookLeafProof) root(count uint64) (consensus.Hash, error) {
+	if p.Index >= count {
+		return consensus.Hash{}, fmt.Errorf("leaf index %d out of range, leaf count: %d", p.Index, count)
+	}
+
+	h := p.Leaf.hash()
+	siblings := p.Siblings
+	for idx, n := p.Index, count; n > 1; idx, n = idx/2, (n+1)/2 {
+		if idx^1 >= n {
+			continue
+		}
+
+		if len(siblings) == 0 {
+			return consensus.Hash{}, errors.New("leaf proof has too few siblings")
+		}
+
+		if idx%2 == 0 {
+			h = consensus.SHA3(bookNodePrefix, h[:], siblings[0][:])
+		} else {
+			h = consensus.SHA3(bookNodePrefix, siblings[0][:], h[:])
+		}
+		siblings = siblings[1:]
+	}
+
+	if len(siblings) > 0 {
+		return consensus.Hash{}, errors.New("leaf proof has too many siblings")
+	}
+
+	return bookRoot(count, h), nil
+}
+
+// BookProof proves whether an order is in the order book of a
+// market.
+//
+// If the order is in the order book, Leaves is the proof of the
+// order's leaf. Otherwise Leaves are the proofs of the adjacent
+// leaves whose order IDs enclose the order ID, or the proof of the
+// first or the last leaf if the order ID is out of the range of the
+// order IDs. Leaves is empty if the order book is empty.
+type BookProof struct {
+	ID     uint64
+	Count  uint64
+	Leaves []BookLeafProof
+}
+
+// ErrInvalidBookProof is returned when the order book proof does not
+// prove the membership or the non-membership of the order.
+var ErrInvalidBookProof = errors.New("invalid order book proof")
+
+// Verify verifies the proof against the order book merkle root, it
+// returns true if the order is proven to be in the order book, false
+// if it is proven not to be in the order book.
+func (p *BookProof) Verify(root consensus.Hash) (bool, error) {
+	for _, l := range p.Leaves {
+		r, err := l.root(p.Count)
+		if err != nil {
+			return false, err
+		}
+
+		if r != root {
+			return false, fmt.Errorf("leaf %d does not match the order book merkle root", l.Leaf.ID)
+		}
+	}
+
+	switch len(p.Leaves) {
+	case 0:
+		if p.Count == 0 && bookRoot(0, consensus.Hash{}) == root {
+			return false, nil
+		}
+	case 1:
+		l := p.Leaves[0]
+		switch {
+		case l.Leaf.ID == p.ID:
+			return true, nil
+		case l.Index == 0 && p.ID < l.Leaf.ID:
+			return false, nil
+		case l.Index == p.Count-1 && p.ID > l.Leaf.ID:
+			return false, nil
+		}
+	case 2:
+		lo, hi := p.Leaves[0], p.Leaves[1]
+		if hi.Index == lo.Index+1 && lo.Leaf.ID < p.ID && p.ID < hi.Leaf.ID {
+			return false, nil
+		}
+	}
+
+	return false, ErrInvalidBookProof
+}
+
+// BookMerkleRoot returns the merkle root of the resting orders of the
+// market's order book. The leaves are the resting orders sorted by
+// the order ID.
+//
+// The root is committed in the state trie whenever the order book is
+// saved, so it is covered by the state root: a client holding
+// Block.StateRoot verifies the root with a trie proof of the key
+// bookRootPath, then the order with BookProof.Verify against the
+// root.
+func (s *State) BookMerkleRoot(market MarketSymbol) consensus.Hash {
+	s.mu.Lock()
+	b := s.trie.Get(bookRootPath(market))
+	s.mu.Unlock()
+	if b != nil {
+		var root consensus.Hash
+		copy(root[:], b)
+		return root
+	}
+
+	var leaves []BookLeaf
+	if book := s.loadOrderBook(market); book != nil {
+		leaves = book.leaves()
+	}
+
+	// the order book is not saved, or saved before its root
+	// was committed.
+	return bookTreeRoot(bookTree(leaves))
+}
+
+// BookMembershipProof returns the proof of whether the order is in
+// the order book of its market, the proof is verified against
+// BookMerkleRoot of the market.
+func (s *State) BookMembershipProof(id OrderID) BookProof {
+	var leaves []BookLeaf
+	if book := s.loadOrderBook(id.Market); book != nil {
+		leaves = book.leaves()
+	}
+
+	p := BookProof{ID: id.ID, Count: uint64(len(leaves))}
+	if len(leaves) == 0 {
+		return p
+	}
+
+	levels := bookTree(leaves)
+	idx := sort.Search(len(leaves), func(i int) bool {
+		return leaves[i].ID >= id.ID
+	})
+
+	switch {
+	case idx < len(leaves) && leaves[idx].ID == id.ID:
+		p.Leaves = []BookLeafProof{leafProof(levels, leaves, idx)}
+	case idx == 0:
+		p.Leaves = []BookLeafProof{leafProof(levels, leaves, 0)}
+	case idx == len(leaves):
+		p.Leaves = []BookLeafProof{leafProof(levels, leaves, idx-1)}
+	default:
+		p.Leaves = []BookLeafProof{leafProof(levels, leaves, idx-1), leafProof(levels, leaves, idx)}
+	}
+	return p
+}
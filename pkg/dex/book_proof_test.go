@@ -0,0 +1,110 @@
+package dex
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/helinwang/dex/pkg/consensus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBookMembershipProof(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	market := MarketSymbol{Base: 0, Quote: 1}
+	book := newOrderBook()
+	for i := 0; i < 7; i++ {
+		book.Limit(Order{Owner: consensus.Addr{byte(i)}, SellSide: i%2 == 0, Quant: 10, Price: uint64(110 - 10*(i%2))})
+	}
+	// order 3 is canceled, it is not in the order book.
+	book.Cancel(3)
+	s.saveOrderBook(market, book)
+	root := s.BookMerkleRoot(market)
+	// the root is committed in the state trie.
+	assert.Equal(t, root[:], s.trie.Get(bookRootPath(market)))
+	assert.Equal(t, bookTreeRoot(bookTree(book.leaves())), root)
+
+	for _, id := range []uint64{0, 1, 2, 4, 5, 6} {
+		p := s.BookMembershipProof(OrderID{ID: id, Market: market})
+		in, err := p.Verify(root)
+		assert.Nil(t, err)
+		assert.True(t, in, "order %d", id)
+	}
+
+	// the canceled order and the order IDs out of the range.
+	for _, id := range []uint64{3, 7, 100} {
+		p := s.BookMembershipProof(OrderID{ID: id, Market: market})
+		in, err := p.Verify(root)
+		assert.Nil(t, err)
+		assert.False(t, in, "order %d", id)
+	}
+
+	// the proof does not verify if the leaf is altered.
+	p := s.BookMembershipProof(OrderID{ID: 2, Market: market})
+	p.Leaves[0].Leaf.Quant++
+	_, err := p.Verify(root)
+	assert.NotNil(t, err)
+
+	// the leaves proving the non-membership must be adjacent.
+	lo := s.BookMembershipProof(OrderID{ID: 1, Market: market})
+	hi := s.BookMembershipProof(OrderID{ID: 5, Market: market})
+	forged := BookProof{ID: 3, Count: lo.Count, Leaves: []BookLeafProof{lo.Leaves[0], hi.Leaves[0]}}
+	_, err = forged.Verify(root)
+	assert.Equal(t, ErrInvalidBookProof, err)
+
+	// the proof does not verify against another root.
+	book.Cancel(4)
+	s.saveOrderBook(market, book)
+	assert.NotEqual(t, root, s.BookMerkleRoot(market))
+	p = s.BookMembershipProof(OrderID{ID: 2, Market: market})
+	_, err = p.Verify(root)
+	assert.NotNil(t, err)
+}
+
+func TestBookMembershipProofEmptyBook(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	market := MarketSymbol{Base: 0, Quote: 1}
+	root := s.BookMerkleRoot(market)
+
+	p := s.BookMembershipProof(OrderID{ID: 1, Market: market})
+	assert.Equal(t, 0, len(p.Leaves))
+	in, err := p.Verify(root)
+	assert.Nil(t, err)
+	assert.False(t, in)
+
+	// an empty proof does not verify against a non-empty book.
+	book := newOrderBook()
+	book.Limit(Order{Owner: consensus.Addr{1}, SellSide: true, Quant: 10, Price: 100})
+	s.saveOrderBook(market, book)
+	_, err = p.Verify(s.BookMerkleRoot(market))
+	assert.Equal(t, ErrInvalidBookProof, err)
+}
+
+func TestBookMerkleRootCommitted(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pk, sk := RandKeyPair()
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100})
+	pker := &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+	empty := s.BookMerkleRoot(market)
+
+	trans := s.Transition(1, nil)
+	order := PlaceOrderTxn{SellSide: true, Quant: 10, Price: 100, Market: market}
+	pt, err := parseTxn(MakePlaceOrderTxn(sk, pk.Addr(), order, 0), pker)
+	if err != nil {
+		panic(err)
+	}
+	assert.Nil(t, trans.Record(pt))
+	s1 := trans.Commit().(*State)
+
+	// the root of the order book saved by the transition is
+	// committed in the state trie.
+	root := s1.BookMerkleRoot(market)
+	assert.NotEqual(t, empty, root)
+	assert.Equal(t, root[:], s1.trie.Get(bookRootPath(market)))
+	p := s1.BookMembershipProof(OrderID{ID: 0, Market: market})
+	in, err := p.Verify(root)
+	assert.Nil(t, err)
+	assert.True(t, in)
+}
@@ -0,0 +1,88 @@
+package dex
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/helinwang/dex/pkg/pb"
+)
+
+// TxnCodec encodes the txns sent to the wallet service, so the
+// non-Ethereum tooling can send txns without RLP. The txn signatures
+// are always computed over the canonical RLP encoding, and the block
+// proposals always carry the RLP encoded txns. The protobuf encoding
+// is described by txn.proto.
+type TxnCodec interface {
+	EncodeTxn(txn *Txn) []byte
+	DecodeTxn(d []byte) (*Txn, error)
+}
+
+// NewTxnCodec returns the txn codec of the given name: "rlp" or
+// "protobuf", the empty name means "rlp".
+func NewTxnCodec(name string) (TxnCodec, error) {
+	switch name {
+	case "", "rlp":
+		return rlpTxnCodec{}, nil
+	case "protobuf":
+		return protobufTxnCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+type rlpTxnCodec struct{}
+
+func (rlpTxnCodec) EncodeTxn(txn *Txn) []byte {
+	return txn.Encode(true)
+}
+
+func (rlpTxnCodec) DecodeTxn(d []byte) (*Txn, error) {
+	var txn Txn
+	err := rlp.DecodeBytes(d, &txn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &txn, nil
+}
+
+// protobufTxnCodec encodes the fields in the order of the struct
+// fields, numbered from 1.
+type protobufTxnCodec struct{}
+
+func (protobufTxnCodec) EncodeTxn(txn *Txn) []byte {
+	var e pb.Encoder
+	e.Uint64(1, uint64(txn.T))
+	e.Bytes(2, txn.Data)
+	e.Uint64(3, txn.Nonce)
+	e.Bytes(4, txn.Owner[:])
+	e.Uint64(5, txn.ValidUntilRound)
+	e.Bytes(6, txn.Sig)
+	return e.Data()
+}
+
+func (protobufTxnCodec) DecodeTxn(d []byte) (*Txn, error) {
+	var txn Txn
+	err := pb.Decode(d, func(field int, v uint64, f []byte) error {
+		switch field {
+		case 1:
+			txn.T = TxnType(v)
+		case 2:
+			txn.Data = pb.Copy(f)
+		case 3:
+			txn.Nonce = v
+		case 4:
+			return pb.Fixed(txn.Owner[:], f)
+		case 5:
+			txn.ValidUntilRound = v
+		case 6:
+			txn.Sig = pb.Copy(f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &txn, nil
+}
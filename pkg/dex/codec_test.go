@@ -0,0 +1,62 @@
+package dex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxnCodecRoundTrip(t *testing.T) {
+	pk, sk := RandKeyPair()
+	to, _ := RandKeyPair()
+	raw, err := SetValidUntilRound(sk, MakeSendTokenTxn(sk, pk.Addr(), to, 0, 20, 1), 10)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range []string{"rlp", "protobuf"} {
+		codec, err := NewTxnCodec(name)
+		assert.Nil(t, err)
+
+		txn, err := rlpTxnCodec{}.DecodeTxn(raw)
+		assert.Nil(t, err)
+		decoded, err := codec.DecodeTxn(codec.EncodeTxn(txn))
+		assert.Nil(t, err, name)
+		assert.Equal(t, txn, decoded, name)
+
+		// the canonical encoding is preserved, so is the
+		// signature.
+		assert.Equal(t, raw, decoded.Encode(true), name)
+		assert.True(t, decoded.Sig.Verify(decoded.Encode(false), pk), name)
+	}
+
+	_, err = NewTxnCodec("json")
+	assert.NotNil(t, err)
+}
+
+type chanSender chan []byte
+
+func (c chanSender) SendTxn(t []byte) {
+	c <- t
+}
+
+func TestRPCServerTxnCodec(t *testing.T) {
+	pk, sk := RandKeyPair()
+	to, _ := RandKeyPair()
+	raw := MakeSendTokenTxn(sk, pk.Addr(), to, 0, 20, 1)
+	txn, err := rlpTxnCodec{}.DecodeTxn(raw)
+	if err != nil {
+		panic(err)
+	}
+
+	sent := make(chanSender, 1)
+	r := NewRPCServer()
+	r.SetSender(sent)
+	r.SetTxnCodec(protobufTxnCodec{})
+
+	// the txn is forwarded in the canonical RLP encoding.
+	assert.Nil(t, r.sendTxn(protobufTxnCodec{}.EncodeTxn(txn), nil))
+	assert.Equal(t, raw, <-sent)
+
+	assert.NotNil(t, r.sendTxn([]byte{0xff}, nil))
+}
@@ -0,0 +1,99 @@
+package dex
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/helinwang/dex/pkg/consensus"
+)
+
+// StateVersion is the schema version of the newly created states.
+const StateVersion = 2
+
+// Migration migrates the state from one schema version to the next
+// version.
+type Migration func(s *State) error
+
+var migrations = map[int]Migration{
+	0: migrateV0ToV1,
+	1: migrateV1ToV2,
+}
+
+// migrateV0ToV1 is the migration of version 0, which has no version
+// header. Version 1 introduces the version header, written by
+// MigrateState after each step, no other data is changed.
+func migrateV0ToV1(s *State) error {
+	return nil
+}
+
+// migrateV1ToV2 is the migration of version 1. Version 2 adds the
+// last trades, the recent round trades and the trading volumes to
+// the state trie, they start empty since the earlier trades were not
+// recorded. It also adds the merkle roots of the order books, which
+// are committed for the existing order books.
+func migrateV1ToV2(s *State) error {
+	for _, m := range s.marketsWithPrefix(marketPrefix) {
+		s.saveOrderBook(m, s.loadOrderBook(m))
+	}
+	return nil
+}
+
+// RegisterMigration registers the migration from version from to
+// version from+1.
+func RegisterMigration(from int, m Migration) {
+	if _, ok := migrations[from]; ok {
+		panic(fmt.Errorf("migration from version %d already registered", from))
+	}
+
+	migrations[from] = m
+}
+
+// MigrateState migrates the state of the given root stored in db
+// from version from to version to, applying the registered
+// migrations in order. It returns the root of the migrated state,
+// which is committed to db.
+func MigrateState(from, to int, root consensus.Hash, db ethdb.Database) (consensus.Hash, error) {
+	if from > to {
+		return consensus.Hash{}, fmt.Errorf("can not migrate state from version %d to older version %d", from, to)
+	}
+
+	tdb := trie.NewDatabase(db)
+	t, err := trie.New(common.Hash(root), tdb)
+	if err != nil {
+		return consensus.Hash{}, err
+	}
+
+	s := newState(t, tdb, db)
+	if v := s.Version(); v != from {
+		return consensus.Hash{}, fmt.Errorf("state version %d does not match the version %d to migrate from", v, from)
+	}
+
+	for v := from; v < to; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return consensus.Hash{}, fmt.Errorf("migration from version %d not found", v)
+		}
+
+		err = m(s)
+		if err != nil {
+			return consensus.Hash{}, fmt.Errorf("migration from version %d error: %v", v, err)
+		}
+
+		s.CommitCache()
+		s.UpdateVersion(v + 1)
+	}
+
+	r, err := s.trie.Commit(nil)
+	if err != nil {
+		return consensus.Hash{}, err
+	}
+
+	err = tdb.Commit(r, false)
+	if err != nil {
+		return consensus.Hash{}, err
+	}
+
+	return consensus.Hash(r), nil
+}
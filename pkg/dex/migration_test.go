@@ -0,0 +1,56 @@
+package dex
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/helinwang/dex/pkg/consensus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateState(t *testing.T) {
+	token := Token{ID: 1, TokenInfo: TokenInfo{Symbol: "BNB", Decimals: 8, TotalUnits: 10000000000}}
+
+	market := MarketSymbol{Base: 0, Quote: 1}
+	book := newOrderBook()
+	book.Limit(Order{Owner: consensus.Addr{1}, SellSide: true, Quant: 10, Price: 100})
+	b, err := rlp.EncodeToBytes(book)
+	if err != nil {
+		panic(err)
+	}
+
+	memDB := ethdb.NewMemDatabase()
+	old := NewState(memDB)
+	old.UpdateToken(token)
+	// the order book saved before its merkle root was committed.
+	old.trie.Update(marketPath(market.Key()), b)
+	assert.Equal(t, 0, old.Version())
+	root, err := old.trie.Commit(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	err = old.db.Commit(root, false)
+	if err != nil {
+		panic(err)
+	}
+
+	migrated, err := MigrateState(0, StateVersion, consensus.Hash(root), memDB)
+	if err != nil {
+		panic(err)
+	}
+
+	expected := NewState(ethdb.NewMemDatabase())
+	expected.UpdateToken(token)
+	expected.saveOrderBook(market, book)
+	expected.UpdateVersion(StateVersion)
+	assert.Equal(t, expected.Hash(), migrated)
+	assert.NotEqual(t, consensus.Hash(root), migrated)
+
+	_, err = MigrateState(0, StateVersion, migrated, memDB)
+	assert.NotNil(t, err)
+
+	_, err = MigrateState(StateVersion, StateVersion+1, migrated, memDB)
+	assert.NotNil(t, err)
+}
@@ -1,7 +1,10 @@
 package dex
 
 import (
+	"fmt"
 	"io"
+	"math/big"
+	"math/bits"
 
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/helinwang/dex/pkg/consensus"
@@ -81,79 +84,110 @@ func (o *orderBook) getEntry(data orderBookEntryData) *orderBookEntry {
 	return e
 }
 
-// Limit processes a incoming limit order.
+// MatchingMode is how the incoming order is allocated among the
+// resting orders of the same price level.
+type MatchingMode uint8
+
+const (
+	// PriceTimeMatching fills the resting orders of the same
+	// price level in the order of their arrival.
+	PriceTimeMatching MatchingMode = iota
+	// ProRataMatching fills the resting orders of the same price
+	// level proportionally to their remaining quantity.
+	ProRataMatching
+)
+
+// SelfTradePrevention is how the incoming order is matched against
+// the resting orders of the same owner.
+type SelfTradePrevention uint8
+
+const (
+	// AllowSelfTrade matches the incoming order against the
+	// resting orders of the same owner.
+	AllowSelfTrade SelfTradePrevention = iota
+	// SkipSelfTrade skips the resting orders of the same owner,
+	// they keep resting with their time priority, and the
+	// incoming order is matched against the orders of the other
+	// owners behind them. The unfilled part of the incoming order
+	// is canceled if it crosses the orders of the same owner, so
+	// the order book is never crossed.
+	SkipSelfTrade
+	// CancelRestingSelfTrade cancels the resting orders of the
+	// same owner crossing the incoming order before it is
+	// matched. The order book skips them the same as
+	// SkipSelfTrade, the caller must cancel them and refund their
+	// pending balance.
+	CancelRestingSelfTrade
+)
+
+// skipsSelfTrade returns true if the incoming order is not matched
+// against the resting orders of the same owner.
+func (s SelfTradePrevention) skipsSelfTrade() bool {
+	return s == SkipSelfTrade || s == CancelRestingSelfTrade
+}
+
+// TimeInForce is how long the unfilled part of an order rests on the
+// order book.
+type TimeInForce uint8
+
+const (
+	// GoodTillCancel rests the unfilled part of the order on the
+	// order book until it is filled, canceled or expired.
+	GoodTillCancel TimeInForce = iota
+	// ImmediateOrCancel cancels the unfilled part of the order
+	// after matching.
+	ImmediateOrCancel
+	// FillOrKill rejects the order if it can not be fully filled
+	// immediately.
+	FillOrKill
+)
+
+// Limit processes a incoming limit order using price-time matching.
 func (o *orderBook) Limit(order Order) (id uint64, executions []orderExecution) {
-	id = o.nextOrderID
-	o.nextOrderID++
+	return o.LimitWithMode(order, PriceTimeMatching)
+}
 
-	if !order.SellSide {
-		// match the incoming buy order
-		for o.askMin != nil && order.Price >= o.askMin.Price {
-			entry := o.askMin.ListHead
-			for entry != nil {
-				if entry.Quant >= order.Quant {
-					// order is filled
-					execA := orderExecution{
-						Owner:    order.Owner,
-						ID:       id,
-						SellSide: false,
-						Quant:    order.Quant,
-						Price:    o.askMin.Price,
-						Taker:    true,
-					}
+// LimitWithMode processes a incoming limit order using the given
+// matching mode.
+func (o *orderBook) LimitWithMode(order Order, mode MatchingMode) (id uint64, executions []orderExecution) {
+	return o.LimitWithSTP(order, mode, AllowSelfTrade)
+}
 
-					execB := orderExecution{
-						Owner:    entry.Owner,
-						ID:       entry.ID,
-						SellSide: true,
-						Quant:    order.Quant,
-						Price:    o.askMin.Price,
-						Taker:    false,
-					}
+// LimitWithSTP processes a incoming limit order using the given
+// matching mode and self-trade prevention.
+func (o *orderBook) LimitWithSTP(order Order, mode MatchingMode, stp SelfTradePrevention) (id uint64, executions []orderExecution) {
+	return o.LimitWithTIF(order, mode, stp, GoodTillCancel)
+}
 
-					executions = append(executions, execA, execB)
-					entry.Quant -= order.Quant
-					if entry.Quant == 0 {
-						if entry.Next != nil {
-							o.askMin.ListHead = entry.Next
-						} else {
-							o.askMin = o.askMin.NextPoint
-						}
-					}
-					return
-				}
+// LimitWithTIF processes a incoming limit order using the given
+// matching mode, self-trade prevention and time in force. Only the
+// unfilled part of a GoodTillCancel order is added to the order book,
+// with SkipSelfTrade it is canceled instead if it crosses the resting
+// orders of the same owner.
+// The caller must check that a FillOrKill order can be fully filled
+// with FillableQuant, it is matched the same as an ImmediateOrCancel
+// order.
+func (o *orderBook) LimitWithTIF(order Order, mode MatchingMode, stp SelfTradePrevention, tif TimeInForce) (id uint64, executions []orderExecution) {
+	id = o.nextOrderID
+	o.nextOrderID++
 
-				if entry.Quant > 0 {
-					order.Quant -= entry.Quant
-					execA := orderExecution{
-						Owner:    order.Owner,
-						ID:       id,
-						SellSide: false,
-						Quant:    entry.Quant,
-						Price:    o.askMin.Price,
-						Taker:    true,
-					}
+	best := &o.askMin
+	if order.SellSide {
+		best = &o.bidMax
+	}
 
-					execB := orderExecution{
-						Owner:    entry.Owner,
-						ID:       entry.ID,
-						SellSide: true,
-						Quant:    entry.Quant,
-						Price:    o.askMin.Price,
-						Taker:    false,
-					}
-					executions = append(executions, execA, execB)
-					entry.Quant = 0
-				}
-				entry = entry.Next
-			}
+	executions, filled := match(best, &order, id, mode, stp)
+	if filled || tif != GoodTillCancel {
+		return
+	}
 
-			// all the orders in the current price point
-			// is filled, move to next price point.
-			o.askMin = o.askMin.NextPoint
-		}
+	if stp == SkipSelfTrade && *best != nil && crosses(order, *best) {
+		// only the price levels holding the skipped orders
+		// of the same owner are left crossing the order.
+		return
+	}
 
-		// TODO: if a IOC order, do not need to insert
+	if !order.SellSide {
 		// no more matching orders, add to the order book
 		entry := o.getEntry(orderBookEntryData{
 			ID:    id,
@@ -192,71 +226,6 @@ func (o *orderBook) Limit(order Order) (id uint64, executions []orderExecution)
 			}
 		}
 	} else {
-		// match the incoming sell order
-		for o.bidMax != nil && order.Price <= o.bidMax.Price {
-			entry := o.bidMax.ListHead
-			for entry != nil {
-				if entry.Quant >= order.Quant {
-					// order is filled
-					execA := orderExecution{
-						Owner:    order.Owner,
-						ID:       id,
-						SellSide: true,
-						Quant:    order.Quant,
-						Price:    o.bidMax.Price,
-						Taker:    true,
-					}
-
-					execB := orderExecution{
-						Owner:    entry.Owner,
-						ID:       entry.ID,
-						SellSide: false,
-						Quant:    order.Quant,
-						Price:    o.bidMax.Price,
-						Taker:    false,
-					}
-
-					executions = append(executions, execA, execB)
-					entry.Quant -= order.Quant
-					if entry.Quant == 0 {
-						if entry.Next != nil {
-							o.bidMax.ListHead = entry.Next
-						} else {
-							o.bidMax = o.bidMax.NextPoint
-						}
-					}
-					return
-				}
-
-				if entry.Quant > 0 {
-					order.Quant -= entry.Quant
-					execA := orderExecution{
-						Owner:    order.Owner,
-						ID:       id,
-						SellSide: true,
-						Quant:    entry.Quant,
-						Price:    o.bidMax.Price,
-						Taker:    true,
-					}
-
-					execB := orderExecution{
-						Owner:    entry.Owner,
-						ID:       entry.ID,
-						SellSide: false,
-						Quant:    entry.Quant,
-						Price:    o.bidMax.Price,
-						Taker:    false,
-					}
-					executions = append(executions, execA, execB)
-					entry.Quant = 0
-				}
-				entry = entry.Next
-			}
-
-			o.bidMax = o.bidMax.NextPoint
-		}
-
-		// TODO: if a IOC order, do not need to insert
 		entry := o.getEntry(orderBookEntryData{
 			ID:    id,
 			Owner: order.Owner,
@@ -298,6 +267,366 @@ func (o *orderBook) Limit(order Order) (id uint64, executions []orderExecution)
 	return
 }
 
+// crosses returns true if the order can be matched against the
+// price level of the opposite side.
+func crosses(order Order, p *pricePoint) bool {
+	if order.SellSide {
+		return order.Price <= p.Price
+	}
+	return order.Price >= p.Price
+}
+
+// match matches the incoming order against the price levels of the
+// opposite side starting from best, the order's quantity is reduced
+// by the filled quantity. It returns true if the order is fully
+// filled.
+//
+// The fully filled price levels are removed, the price levels
+// holding the skipped orders of the same owner are kept.
+func match(best **pricePoint, order *Order, id uint64, mode MatchingMode, stp SelfTradePrevention) (executions []orderExecution, filled bool) {
+	skip := func(e *orderBookEntry) bool {
+		return stp.skipsSelfTrade() && e.Owner == order.Owner
+	}
+
+	fill := func(e *orderBookEntry, quant, price uint64) {
+		execA := orderExecution{
+			Owner:    order.Owner,
+			ID:       id,
+			SellSide: order.SellSide,
+			Quant:    quant,
+			Price:    price,
+			Taker:    true,
+		}
+
+		execB := orderExecution{
+			Owner:    e.Owner,
+			ID:       e.ID,
+			SellSide: !order.SellSide,
+			Quant:    quant,
+			Price:    price,
+			Taker:    false,
+		}
+		executions = append(executions, execA, execB)
+		e.Quant -= quant
+		order.Quant -= quant
+	}
+
+	// next is the link to the current price level, it moves past
+	// the price levels that are kept.
+	next := best
+	for p := *next; p != nil && crosses(*order, p); p = *next {
+		if mode == ProRataMatching && matchableQuant(p, skip) > order.Quant {
+			executions = append(executions, matchProRata(p, *order, id, skip)...)
+			return executions, true
+		}
+
+		kept := false
+		for e := p.ListHead; e != nil; e = e.Next {
+			if skip(e) {
+				kept = kept || e.Quant > 0
+				continue
+			}
+
+			if e.Quant >= order.Quant {
+				fill(e, order.Quant, p.Price)
+				if e.Quant == 0 && !kept {
+					if e.Next != nil {
+						p.ListHead = e.Next
+					} else {
+						*next = p.NextPoint
+					}
+				}
+				return executions, true
+			}
+
+			if e.Quant > 0 {
+				fill(e, e.Quant, p.Price)
+			}
+		}
+
+		if kept {
+			next = &p.NextPoint
+		} else {
+			// all the orders in the current price point
+			// is filled, move to next price point.
+			*next = p.NextPoint
+		}
+	}
+
+	return executions, false
+}
+
+// matchProRata fills the incoming order at the price level whose
+// matchable quantity is greater than the order's quantity. Each
+// resting order receives its proportional share rounded down, the
+// remaining units are allocated one each to the resting orders in
+// time priority. The skipped resting orders are not filled.
+func matchProRata(p *pricePoint, order Order, id uint64, skip func(*orderBookEntry) bool) []orderExecution {
+	total := matchableQuant(p, skip)
+	var entries []*orderBookEntry
+	var alloc []uint64
+	var allocated uint64
+	for e := p.ListHead; e != nil; e = e.Next {
+		if e.Quant == 0 || skip(e) {
+			continue
+		}
+
+		// order.Quant < total, so the quotient fits in
+		// uint64.
+		hi, lo := bits.Mul64(order.Quant, e.Quant)
+		q, _ := bits.Div64(hi, lo, total)
+		entries = append(entries, e)
+		alloc = append(alloc, q)
+		allocated += q
+	}
+
+	for i := 0; allocated < order.Quant; i++ {
+		if alloc[i] < entries[i].Quant {
+			alloc[i]++
+			allocated++
+		}
+	}
+
+	var executions []orderExecution
+	for i, e := range entries {
+		if alloc[i] == 0 {
+			continue
+		}
+
+		execA := orderExecution{
+			Owner:    order.Owner,
+			ID:       id,
+			SellSide: order.SellSide,
+			Quant:    alloc[i],
+			Price:    p.Price,
+			Taker:    true,
+		}
+
+		execB := orderExecution{
+			Owner:    e.Owner,
+			ID:       e.ID,
+			SellSide: !order.SellSide,
+			Quant:    alloc[i],
+			Price:    p.Price,
+			Taker:    false,
+		}
+		executions = append(executions, execA, execB)
+		e.Quant -= alloc[i]
+	}
+	return executions
+}
+
+// matchCount returns the upper bound of the number of the resting
+// orders filled by the order, each fill produces two executions. The
+// order book is not mutated.
+//
+// With pro-rata matching, every matchable order of the last price
+// level reached is counted, since the fill is spread among them.
+func (o *orderBook) matchCount(order Order, mode MatchingMode, stp SelfTradePrevention) int {
+	p := o.askMin
+	if order.SellSide {
+		p = o.bidMax
+	}
+
+	skip := func(e *orderBookEntry) bool {
+		return stp.skipsSelfTrade() && e.Owner == order.Owner
+	}
+
+	var count int
+	var filled uint64
+	for ; p != nil && filled < order.Quant; p = p.NextPoint {
+		if (order.SellSide && order.Price > p.Price) || (!order.SellSide && order.Price < p.Price) {
+			break
+		}
+
+		for e := p.ListHead; e != nil; e = e.Next {
+			if e.Quant == 0 || skip(e) {
+				continue
+			}
+
+			if filled >= order.Quant && mode != ProRataMatching {
+				break
+			}
+
+			count++
+			filled += e.Quant
+		}
+	}
+
+	return count
+}
+
+// FillableQuant returns the quantity of the order that can be filled
+// immediately by the resting orders crossing the order's price, the
+// skipped resting orders of the same owner are not counted. The order
+// book is not mutated.
+func (o *orderBook) FillableQuant(order Order, stp SelfTradePrevention) uint64 {
+	p := o.askMin
+	if order.SellSide {
+		p = o.bidMax
+	}
+
+	skip := func(e *orderBookEntry) bool {
+		return stp.skipsSelfTrade() && e.Owner == order.Owner
+	}
+
+	var filled uint64
+	for ; p != nil && filled < order.Quant; p = p.NextPoint {
+		if (order.SellSide && order.Price > p.Price) || (!order.SellSide && order.Price < p.Price) {
+			break
+		}
+
+		filled += matchableQuant(p, skip)
+	}
+
+	if filled > order.Quant {
+		return order.Quant
+	}
+	return filled
+}
+
+// worstFillPrice returns the price of the last resting order the
+// order would be filled against, it is the farthest fill price from
+// the top of the book. False is returned if the order crosses no
+// resting order. The order book is not mutated.
+func (o *orderBook) worstFillPrice(order Order, stp SelfTradePrevention) (uint64, bool) {
+	p := o.askMin
+	if order.SellSide {
+		p = o.bidMax
+	}
+
+	skip := func(e *orderBookEntry) bool {
+		return stp.skipsSelfTrade() && e.Owner == order.Owner
+	}
+
+	var price, filled uint64
+	var ok bool
+	for ; p != nil && filled < order.Quant; p = p.NextPoint {
+		if (order.SellSide && order.Price > p.Price) || (!order.SellSide && order.Price < p.Price) {
+			break
+		}
+
+		q := matchableQuant(p, skip)
+		if q == 0 {
+			continue
+		}
+
+		price, ok = p.Price, true
+		filled += q
+	}
+
+	return price, ok
+}
+
+// simulateMarket walks the order book without mutating it, returning
+// the volume-weighted average price rounded down and the quantity
+// that a market order of the given side and quantity would fill.
+func (o *orderBook) simulateMarket(sellSide bool, quant uint64) (avgPrice, filled uint64) {
+	p := o.askMin
+	if sellSide {
+		p = o.bidMax
+	}
+
+	var value, v big.Int
+	for ; p != nil && filled < quant; p = p.NextPoint {
+		q := liveQuant(p)
+		if q > quant-filled {
+			q = quant - filled
+		}
+
+		v.SetUint64(p.Price)
+		v.Mul(&v, new(big.Int).SetUint64(q))
+		value.Add(&value, &v)
+		filled += q
+	}
+
+	if filled == 0 {
+		return 0, 0
+	}
+
+	value.Div(&value, new(big.Int).SetUint64(filled))
+	return value.Uint64(), filled
+}
+
+func liveQuant(p *pricePoint) uint64 {
+	var quant uint64
+	for e := p.ListHead; e != nil; e = e.Next {
+		quant += e.Quant
+	}
+	return quant
+}
+
+// matchableQuant returns the live quantity of the price level
+// excluding the skipped orders.
+func matchableQuant(p *pricePoint, skip func(*orderBookEntry) bool) uint64 {
+	var quant uint64
+	for e := p.ListHead; e != nil; e = e.Next {
+		if !skip(e) {
+			quant += e.Quant
+		}
+	}
+	return quant
+}
+
+// PriceLevelFor returns the price at which the order should be placed
+// so that the number of the price levels of the order's side does not
+// go beyond maxLevels.
+//
+// A new price level is only created when the order is not fully
+// filled. If the new price level is beyond the cap and
+// roundToExisting is true, the order is rounded to the nearest
+// existing price level on the more conservative side for the owner:
+// a bid rounds down and never pays more than its price, an ask rounds
+// up and never sells for less. An error is returned if there is no
+// such level, or if roundToExisting is false.
+func (o *orderBook) PriceLevelFor(sellSide bool, quant, price uint64, maxLevels int, roundToExisting bool) (uint64, error) {
+	own, other := o.bidMax, o.askMin
+	if sellSide {
+		own, other = o.askMin, o.bidMax
+	}
+
+	// quantity that can be filled immediately
+	var filled uint64
+	for p := other; p != nil && filled < quant; p = p.NextPoint {
+		if (!sellSide && p.Price > price) || (sellSide && p.Price < price) {
+			break
+		}
+
+		filled += liveQuant(p)
+	}
+
+	if filled >= quant {
+		return price, nil
+	}
+
+	levels := 0
+	var worse *pricePoint
+	for p := own; p != nil; p = p.NextPoint {
+		if liveQuant(p) == 0 {
+			continue
+		}
+
+		if p.Price == price {
+			return price, nil
+		}
+
+		if worse == nil && ((!sellSide && p.Price < price) || (sellSide && p.Price > price)) {
+			worse = p
+		}
+		levels++
+	}
+
+	if levels < maxLevels {
+		return price, nil
+	}
+
+	if roundToExisting && worse != nil {
+		return worse.Price, nil
+	}
+
+	return 0, fmt.Errorf("order book reached the max price level count: %d", maxLevels)
+}
+
 type orderBookPointToMarshal struct {
 	Price   uint64
 	Entries []orderBookEntryData
@@ -0,0 +1,60 @@
+package dex
+
+import (
+	"testing"
+
+	"github.com/helinwang/dex/pkg/consensus"
+)
+
+// populatedBook creates an order book of levels ask price levels,
+// each level has ordersPerLevel orders of quant 10.
+func populatedBook(levels, ordersPerLevel int) *orderBook {
+	book := newOrderBook()
+	for i := 0; i < levels; i++ {
+		for j := 0; j < ordersPerLevel; j++ {
+			book.Limit(Order{
+				Owner:    consensus.Addr{1},
+				SellSide: true,
+				Quant:    10,
+				Price:    uint64(1000 + i),
+			})
+		}
+	}
+	return book
+}
+
+func benchmarkMatchOrders(b *testing.B, sweepLevels int) {
+	const (
+		levels         = 1000
+		ordersPerLevel = 5
+	)
+
+	// the buy order fills all the orders of sweepLevels price
+	// levels.
+	order := Order{
+		Owner: consensus.Addr{2},
+		Quant: uint64(10 * ordersPerLevel * sweepLevels),
+		Price: uint64(1000 + sweepLevels - 1),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		book := populatedBook(levels, ordersPerLevel)
+		b.StartTimer()
+
+		_, executions := book.Limit(order)
+		if len(executions) != 2*ordersPerLevel*sweepLevels {
+			b.Fatalf("unexpected execution count: %d", len(executions))
+		}
+	}
+}
+
+func BenchmarkMatchOrdersShallow(b *testing.B) {
+	benchmarkMatchOrders(b, 1)
+}
+
+func BenchmarkMatchOrdersDeep(b *testing.B) {
+	benchmarkMatchOrders(b, 100)
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/helinwang/dex/pkg/consensus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -203,3 +204,134 @@ func TestCancelOrder(t *testing.T) {
 	assert.Equal(t, 1, int(book.bidMax.Price))
 	assert.Equal(t, 0, int(book.bidMax.ListHead.Quant))
 }
+
+func TestOrderBookPriceLevelCap(t *testing.T) {
+	book := newOrderBook()
+	for i := 1; i <= 3; i++ {
+		price, err := book.PriceLevelFor(false, 10, uint64(i), 3, false)
+		assert.Nil(t, err)
+		book.Limit(Order{Quant: 10, Price: price})
+	}
+
+	// existing level is allowed
+	price, err := book.PriceLevelFor(false, 10, 2, 3, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), price)
+
+	// new level beyond the cap is rejected
+	_, err = book.PriceLevelFor(false, 10, 4, 3, false)
+	assert.NotNil(t, err)
+
+	// or rounded to the nearest worse existing level
+	price, err = book.PriceLevelFor(false, 10, 4, 3, true)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), price)
+
+	// no worse level to round to
+	_, err = book.PriceLevelFor(false, 10, 0, 3, true)
+	assert.NotNil(t, err)
+
+	// fully filled order does not create a new level
+	book.Limit(Order{Quant: 10, Price: 5, SellSide: true})
+	_, err = book.PriceLevelFor(false, 10, 6, 3, false)
+	assert.Nil(t, err)
+	_, err = book.PriceLevelFor(false, 11, 6, 3, false)
+	assert.NotNil(t, err)
+}
+
+func TestOrderBookMatchingMode(t *testing.T) {
+	resting := []uint64{10, 20, 30}
+	cases := []struct {
+		mode     MatchingMode
+		quant    uint64
+		expected []uint64
+	}{
+		{PriceTimeMatching, 31, []uint64{10, 20, 1}},
+		// 31*10/60=5, 31*20/60=10, 31*30/60=15, the remaining
+		// unit goes to the earliest order.
+		{ProRataMatching, 31, []uint64{6, 10, 15}},
+		{ProRataMatching, 3, []uint64{1, 1, 1}},
+		// fully filling the level is the same in both modes.
+		{ProRataMatching, 60, []uint64{10, 20, 30}},
+	}
+
+	for _, c := range cases {
+		for _, sellSide := range []bool{false, true} {
+			book := newOrderBook()
+			for _, q := range resting {
+				book.Limit(Order{SellSide: !sellSide, Quant: q, Price: 5})
+			}
+
+			id, executions := book.LimitWithMode(Order{SellSide: sellSide, Quant: c.quant, Price: 5}, c.mode)
+			assert.Equal(t, uint64(len(resting)), id)
+
+			filled := make([]uint64, len(resting))
+			var takerFilled uint64
+			for _, e := range executions {
+				assert.Equal(t, uint64(5), e.Price)
+				if e.Taker {
+					assert.Equal(t, sellSide, e.SellSide)
+					takerFilled += e.Quant
+					continue
+				}
+
+				assert.Equal(t, !sellSide, e.SellSide)
+				filled[e.ID] += e.Quant
+			}
+
+			assert.Equal(t, c.expected, filled)
+			assert.Equal(t, c.quant, takerFilled)
+		}
+	}
+}
+
+func TestOrderBookSkipSelfTrade(t *testing.T) {
+	a := consensus.Addr{1}
+	b := consensus.Addr{2}
+	c := consensus.Addr{3}
+	d := consensus.Addr{4}
+	for _, mode := range []MatchingMode{PriceTimeMatching, ProRataMatching} {
+		for _, sellSide := range []bool{false, true} {
+			book := newOrderBook()
+			// the taker's own order is sandwiched between the
+			// orders of the others at the same price level.
+			book.Limit(Order{Owner: a, SellSide: !sellSide, Quant: 2, Price: 5})
+			book.Limit(Order{Owner: c, SellSide: !sellSide, Quant: 3, Price: 5})
+			book.Limit(Order{Owner: b, SellSide: !sellSide, Quant: 3, Price: 5})
+
+			_, executions := book.LimitWithSTP(Order{Owner: c, SellSide: sellSide, Quant: 3, Price: 5}, mode, SkipSelfTrade)
+			// in pro-rata matching, 3*2/5=1, 3*3/5=1, the
+			// remaining unit goes to the earliest order.
+			assert.Equal(t, []orderExecution{
+				{Owner: c, ID: 3, SellSide: sellSide, Quant: 2, Price: 5, Taker: true},
+				{Owner: a, ID: 0, SellSide: !sellSide, Quant: 2, Price: 5},
+				{Owner: c, ID: 3, SellSide: sellSide, Quant: 1, Price: 5, Taker: true},
+				{Owner: b, ID: 2, SellSide: !sellSide, Quant: 1, Price: 5},
+			}, executions)
+
+			// the skipped order keeps its time priority.
+			_, executions = book.LimitWithSTP(Order{Owner: d, SellSide: sellSide, Quant: 4, Price: 5}, PriceTimeMatching, SkipSelfTrade)
+			assert.Equal(t, []orderExecution{
+				{Owner: d, ID: 4, SellSide: sellSide, Quant: 3, Price: 5, Taker: true},
+				{Owner: c, ID: 1, SellSide: !sellSide, Quant: 3, Price: 5},
+				{Owner: d, ID: 4, SellSide: sellSide, Quant: 1, Price: 5, Taker: true},
+				{Owner: b, ID: 2, SellSide: !sellSide, Quant: 1, Price: 5},
+			}, executions)
+			resting := book.askMin
+			if sellSide {
+				resting = book.bidMax
+			}
+			assert.Equal(t, uint64(1), liveQuant(resting))
+
+			// the unfilled part crossing the order of the same
+			// owner is canceled, the order book is not crossed.
+			_, executions = book.LimitWithSTP(Order{Owner: b, SellSide: sellSide, Quant: 4, Price: 5}, mode, SkipSelfTrade)
+			assert.Equal(t, 0, len(executions))
+			taker := book.bidMax
+			if sellSide {
+				taker = book.askMin
+			}
+			assert.Nil(t, taker)
+		}
+	}
+}
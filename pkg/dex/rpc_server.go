@@ -20,10 +20,12 @@ type ChainStater interface {
 	ChainStatus() consensus.ChainStatus
 	Graphviz(int) string
 	TxnPoolSize() int
+	FinalizedState() consensus.State
 }
 
 type RPCServer struct {
 	sender TxnSender
+	codec  TxnCodec
 
 	mu    sync.Mutex
 	chain ChainStater
@@ -31,7 +33,13 @@ type RPCServer struct {
 }
 
 func NewRPCServer() *RPCServer {
-	return &RPCServer{}
+	return &RPCServer{codec: rlpTxnCodec{}}
+}
+
+// SetTxnCodec sets the codec of the txns received by the wallet
+// service, the default codec is RLP. It must be called before Start.
+func (r *RPCServer) SetTxnCodec(c TxnCodec) {
+	r.codec = c
 }
 
 // SetSender sets the transaction sender, it must be called before
@@ -134,8 +142,47 @@ func (r *RPCServer) tokens(_ int, t *TokenState) error {
 	return nil
 }
 
+// LastTradeState is the most recent finalized trade of a market.
+//
+// The ticker is served from the last finalized state rather than
+// from a Chain.LastTrade method: the consensus package knows nothing
+// about the markets and the trades, and it can not import the dex
+// package. The last trade is committed in the state trie, so every
+// validator serves the same trade for the same finalized block.
+type LastTradeState struct {
+	Trade
+	Exists bool
+}
+
+func (r *RPCServer) lastTrade(m MarketSymbol, t *LastTradeState) error {
+	s, ok := r.chain.FinalizedState().(*State)
+	if !ok {
+		return errors.New("waiting for reaching consensus")
+	}
+
+	t.Trade, t.Exists = s.LastTrade(m)
+	return nil
+}
+
+func (r *RPCServer) markets(m *[]MarketInfo) error {
+	s, ok := r.chain.FinalizedState().(*State)
+	if !ok {
+		return errors.New("waiting for reaching consensus")
+	}
+
+	*m = s.Markets()
+	return nil
+}
+
 func (r *RPCServer) sendTxn(t []byte, _ *int) error {
-	go r.sender.SendTxn(t)
+	txn, err := r.codec.DecodeTxn(t)
+	if err != nil {
+		return err
+	}
+
+	// the txns are gossiped and included in the block
+	// proposals in the canonical RLP encoding.
+	go r.sender.SendTxn(txn.Encode(true))
 	return nil
 }
 
@@ -171,13 +218,11 @@ func (r *RPCServer) nonce(addr consensus.Addr, nonce *uint64) error {
 		return errors.New("waiting for reaching consensus")
 	}
 
-	acc := r.s.Account(addr)
-	if acc == nil {
+	if r.s.PK(addr) == nil {
 		return fmt.Errorf("account %v does not exist", addr)
 	}
 
-	n := acc.Nonce()
-	*nonce = n
+	*nonce = r.s.Nonce(addr)
 	return nil
 }
 
@@ -194,6 +239,16 @@ func (s *WalletService) Tokens(d int, t *TokenState) error {
 	return s.s.tokens(d, t)
 }
 
+// LastTrade returns the most recent finalized trade of the market.
+func (s *WalletService) LastTrade(m MarketSymbol, t *LastTradeState) error {
+	return s.s.lastTrade(m, t)
+}
+
+// Markets returns the finalized markets and their configurations.
+func (s *WalletService) Markets(_ int, m *[]MarketInfo) error {
+	return s.s.markets(m)
+}
+
 func (s *WalletService) SendTxn(t []byte, d *int) error {
 	return s.s.sendTxn(t, d)
 }
@@ -2,8 +2,13 @@ package dex
 
 import (
 	"bytes"
+	"container/list"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"math/bits"
+	"sort"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -33,6 +38,22 @@ func (m *MarketSymbol) Encode() []byte {
 	return buf[:n0+n1]
 }
 
+// Key returns the canonical byte key of the market, it is used to
+// place the market's data in the state trie. Every node must derive
+// the same key for the same market, so the key must never change,
+// even if Encode changes.
+//
+// The key is the uvarint encoded quote token ID followed by the
+// uvarint encoded base token ID. The uvarint encoding is
+// self-delimiting, so the keys of different markets are distinct and
+// no key is a prefix of another.
+func (m *MarketSymbol) Key() []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n0 := binary.PutUvarint(buf, uint64(m.Quote))
+	n1 := binary.PutUvarint(buf[n0:], uint64(m.Base))
+	return buf[:n0+n1]
+}
+
 func (m *MarketSymbol) Decode(b []byte) (int, error) {
 	v, n0 := binary.Uvarint(b)
 	m.Quote = TokenID(v)
@@ -41,6 +62,149 @@ func (m *MarketSymbol) Decode(b []byte) (int, error) {
 	return n0 + n1, nil
 }
 
+// MarketConfig is the configuration of a market.
+type MarketConfig struct {
+	// MaxPriceLevels is the maximum number of distinct price
+	// levels on each side of the order book, 0 means unlimited.
+	MaxPriceLevels uint64
+	// RoundToExistingLevel rounds the order which would create a
+	// price level beyond MaxPriceLevels to the nearest existing
+	// level instead of rejecting it, down for a bid and up for an
+	// ask.
+	RoundToExistingLevel bool
+	// MatchingMode is the matching mode of the market, the
+	// default is price-time matching.
+	MatchingMode MatchingMode
+	// PriceBandPercent is the maximum percentage a trade price
+	// can deviate from the last finalized trade price. The
+	// order that would trade outside of the band is dropped
+	// without trading and halts the matching of the market for
+	// the rest of the round, the price of an order is never
+	// changed. 0 disables the band.
+	PriceBandPercent uint64
+	// OpenRound is the first round that orders can be placed
+	// in the market, 0 means the market is open since genesis.
+	OpenRound uint64
+	// CloseRound is the round since which orders can no longer
+	// be placed in the market, the pending orders can still be
+	// canceled. 0 means the market never closes.
+	CloseRound uint64
+	// SelfTradePrevention is how an order is matched against the
+	// resting orders of the same owner, the default allows the
+	// self trade.
+	SelfTradePrevention SelfTradePrevention
+	// FeeTiers is the trading fee schedule ordered by
+	// MinVolume, the fee of a fill is charged at the rate of
+	// the highest tier reached by the account's trading volume
+	// in the market. No fee is charged if it is empty or
+	// FeeCollector is empty.
+	FeeTiers []FeeTier
+	// FeeVolumeWindow is the number of rounds the trading
+	// volume of an account is accumulated over, the volume is
+	// reset once the window passes. 0 means never reset.
+	FeeVolumeWindow uint64
+	// FeeCollector receives the trading fees.
+	FeeCollector PK
+	// MinQuant is the minimum quantity of an order, 0 means no
+	// minimum.
+	MinQuant uint64
+	// PriceTick is the tick size of the order price, the price
+	// of an order must be a multiple of it. 0 means any price is
+	// allowed.
+	PriceTick uint64
+}
+
+// FeeTier is a tier of the trading fee schedule.
+type FeeTier struct {
+	// MinVolume is the trading volume in the quote token units
+	// from which the tier applies.
+	MinVolume uint64
+	// FeeRate is the fee rate in basis points of the quantity
+	// received by the fill, rates above 10000 are treated as
+	// 10000.
+	FeeRate uint64
+}
+
+const feeRateBase = 10000
+
+// chargesFee returns true if the trading fee is charged in the
+// market.
+func (c MarketConfig) chargesFee() bool {
+	return len(c.FeeTiers) > 0 && len(c.FeeCollector) > 0
+}
+
+// fee returns the fee of the received quantity for the account of
+// the given trading volume.
+func (c MarketConfig) fee(volume, recv uint64) uint64 {
+	var rate uint64
+	for _, tier := range c.FeeTiers {
+		if volume < tier.MinVolume {
+			break
+		}
+		rate = tier.FeeRate
+	}
+
+	if rate > feeRateBase {
+		rate = feeRateBase
+	}
+
+	// avoid the overflow of recv * rate.
+	return recv/feeRateBase*rate + recv%feeRateBase*rate/feeRateBase
+}
+
+// isOpen returns true if orders can be placed in the market in the
+// given round.
+func (c MarketConfig) isOpen(round uint64) bool {
+	if round < c.OpenRound {
+		return false
+	}
+
+	return c.CloseRound == 0 || round < c.CloseRound
+}
+
+// checkOrderSize returns an error if the quantity is below the
+// minimum order size or the price is not a multiple of the tick
+// size.
+func (c MarketConfig) checkOrderSize(quant, price uint64) error {
+	if quant < c.MinQuant {
+		return fmt.Errorf("order quantity %d is below the market minimum %d", quant, c.MinQuant)
+	}
+
+	if c.PriceTick > 0 && price%c.PriceTick != 0 {
+		return fmt.Errorf("order price %d is not a multiple of the market tick size %d", price, c.PriceTick)
+	}
+
+	return nil
+}
+
+// bandWidth returns the maximum deviation from the reference price
+// allowed by the price band, rounded down.
+func (c MarketConfig) bandWidth(ref uint64) uint64 {
+	hi, lo := bits.Mul64(ref, c.PriceBandPercent)
+	if hi >= 100 {
+		// the width does not fit in uint64.
+		return math.MaxUint64
+	}
+
+	q, _ := bits.Div64(hi, lo, 100)
+	return q
+}
+
+// inPriceBand returns true if the price is within the price band
+// around the reference price.
+func (c MarketConfig) inPriceBand(ref, price uint64) bool {
+	if c.PriceBandPercent == 0 {
+		return true
+	}
+
+	diff := price - ref
+	if price < ref {
+		diff = ref - price
+	}
+
+	return diff <= c.bandWidth(ref)
+}
+
 // State is the state of the DEX.
 type State struct {
 	db     *trie.Database
@@ -49,6 +213,39 @@ type State struct {
 	mu           sync.Mutex
 	trie         *trie.Trie
 	accountCache map[consensus.Addr]*Account
+	// accountLRU orders the cached accounts from the most
+	// recently used to the least recently used.
+	accountLRU *list.List
+	// maxCachedAccounts is the maximum number of the accounts
+	// kept in the cache after committing the cache, 0 means no
+	// limit.
+	maxCachedAccounts int
+	// maxBlockCost is the total execution cost budget of the
+	// txns in a block, 0 means no limit.
+	maxBlockCost uint64
+	// maxOpenNotional is the maximum total notional of the open
+	// orders of an account, 0 means no limit.
+	maxOpenNotional uint64
+	// accountCreationFee is the native coin fee paid by the
+	// sender of the txn creating an account to
+	// accountFeeCollector, 0 means free.
+	accountCreationFee  uint64
+	accountFeeCollector PK
+	// requireMarketConfig is true if orders can only be placed
+	// on the markets having a configuration.
+	requireMarketConfig bool
+	// maxBodySize and maxBodyTxns are the maximum size and the
+	// maximum number of the serialized txns of a block, 0 means
+	// no limit.
+	maxBodySize int
+	maxBodyTxns int
+	// strictProposals is true if an invalid txn invalidates the
+	// whole block, otherwise the invalid txns are skipped.
+	strictProposals bool
+	// finalizeDepth is the number of rounds after which a block
+	// is finalized, the price bands are referenced to the last
+	// finalized trade.
+	finalizeDepth uint64
 }
 
 var BNBInfo = TokenInfo{
@@ -57,7 +254,26 @@ var BNBInfo = TokenInfo{
 	TotalUnits: 200000000 * 100000000,
 }
 
-func CreateGenesisState(recipients []PK, additionalTokens []TokenInfo) *State {
+// GenesisMarket is a market configured in the genesis state.
+type GenesisMarket struct {
+	Symbol MarketSymbol
+	Config MarketConfig
+}
+
+// CreateGenesisState creates the genesis state, the total units of
+// each token are evenly distributed to the recipients. The native
+// token has the token ID 0, the additional tokens are assigned the
+// IDs from 1 in the given order, the genesis markets refer to the
+// tokens by these IDs.
+//
+// The recipients are processed in the order of their addresses, so
+// the genesis state root does not depend on the order of the given
+// recipients, every validator must derive the same genesis root.
+//
+// An error is returned if the token symbols are not unique
+// case-insensitively, if a recipient is given more than once, or if
+// a genesis market is invalid or given more than once.
+func CreateGenesisState(recipients []PK, additionalTokens []TokenInfo, markets []GenesisMarket) (*State, error) {
 	memDB := ethdb.NewMemDatabase()
 	s := NewState(memDB)
 	tokens := make([]Token, len(additionalTokens)+1)
@@ -66,7 +282,13 @@ func CreateGenesisState(recipients []PK, additionalTokens []TokenInfo) *State {
 	tokens[0] = Token{ID: tokenID, TokenInfo: BNBInfo}
 	tokenID++
 
+	symbols := map[TokenSymbol]bool{BNBInfo.Symbol.normalize(): true}
 	for i, t := range additionalTokens {
+		if symbols[t.Symbol.normalize()] {
+			return nil, fmt.Errorf("duplicate token symbol %v", t.Symbol)
+		}
+		symbols[t.Symbol.normalize()] = true
+
 		token := Token{ID: tokenID, TokenInfo: t}
 		tokenID++
 		tokens[i+1] = token
@@ -76,7 +298,34 @@ func CreateGenesisState(recipients []PK, additionalTokens []TokenInfo) *State {
 		s.UpdateToken(t)
 	}
 
-	for _, pk := range recipients {
+	configured := make(map[MarketSymbol]bool)
+	for _, m := range markets {
+		if !m.Symbol.Valid() || int(m.Symbol.Base) >= len(tokens) || int(m.Symbol.Quote) >= len(tokens) {
+			return nil, fmt.Errorf("invalid genesis market %v", m.Symbol)
+		}
+
+		if configured[m.Symbol] {
+			return nil, fmt.Errorf("duplicate genesis market %v", m.Symbol)
+		}
+		configured[m.Symbol] = true
+
+		s.UpdateMarketConfig(m.Symbol, m.Config)
+	}
+
+	sorted := make([]PK, len(recipients))
+	copy(sorted, recipients)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].Addr(), sorted[j].Addr()
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Addr() == sorted[i-1].Addr() {
+			return nil, fmt.Errorf("duplicate genesis recipient %v", sorted[i].Addr())
+		}
+	}
+
+	for _, pk := range sorted {
 		account := s.NewAccount(pk)
 		for _, t := range tokens {
 			avg := t.TotalUnits / uint64(len(recipients))
@@ -84,8 +333,9 @@ func CreateGenesisState(recipients []PK, additionalTokens []TokenInfo) *State {
 		}
 	}
 
+	s.UpdateVersion(StateVersion)
 	s.CommitCache()
-	return s
+	return s, nil
 }
 
 func newState(state *trie.Trie, db *trie.Database, diskDB ethdb.Database) *State {
@@ -94,6 +344,14 @@ func newState(state *trie.Trie, db *trie.Database, diskDB ethdb.Database) *State
 		db:           db,
 		trie:         state,
 		accountCache: make(map[consensus.Addr]*Account),
+		accountLRU:   list.New(),
+		maxBlockCost: DefaultMaxBlockCost,
+		maxBodySize:  DefaultMaxBodySize,
+		maxBodyTxns:  DefaultMaxBodyTxns,
+		// an invalid txn invalidates the whole block by
+		// default.
+		strictProposals: true,
+		finalizeDepth:   DefaultFinalizeDepth,
 	}
 }
 
@@ -118,8 +376,35 @@ var (
 	pendingOrdersPrefix    = []byte{7}
 	executionReportsPrefix = []byte{8}
 	reportIdxPrefix        = []byte{9}
+	marketConfigPrefix     = []byte{10}
+	stateVersionPrefix     = []byte{11}
+	lastTradePrefix        = []byte{12}
+	tradeVolumePrefix      = []byte{13}
+	bookRootPrefix         = []byte{14}
+	roundTradesPrefix      = []byte{15}
 )
 
+func roundTradesPath(m MarketSymbol) []byte {
+	return append(roundTradesPrefix, m.Key()...)
+}
+
+func bookRootPath(m MarketSymbol) []byte {
+	return append(bookRootPrefix, m.Key()...)
+}
+
+func lastTradePath(m MarketSymbol) []byte {
+	return append(lastTradePrefix, m.Key()...)
+}
+
+func tradeVolumePath(addr consensus.Addr, m MarketSymbol) []byte {
+	p := append(tradeVolumePrefix, addr[:]...)
+	return append(p, m.Key()...)
+}
+
+func marketConfigPath(m MarketSymbol) []byte {
+	return append(marketConfigPrefix, m.Key()...)
+}
+
 func addrReportIdxPath(addr consensus.Addr) []byte {
 	return append(reportIdxPrefix, addr[:]...)
 }
@@ -183,6 +468,20 @@ func marketPath(path []byte) []byte {
 	return append(marketPrefix, path...)
 }
 
+// decodePath is the inverse of encodePath, the terminator nibble of
+// a leaf path is ignored.
+func decodePath(nibbles []byte) []byte {
+	if len(nibbles)%2 == 1 && nibbles[len(nibbles)-1] == 16 {
+		nibbles = nibbles[:len(nibbles)-1]
+	}
+
+	str := make([]byte, len(nibbles)/2)
+	for i := range str {
+		str[i] = nibbles[i*2]*16 + nibbles[i*2+1]
+	}
+	return str
+}
+
 func encodePath(str []byte) []byte {
 	l := len(str) * 2
 	var nibbles = make([]byte, l)
@@ -211,6 +510,8 @@ func (s *State) commitCache() {
 	}
 }
 
+// CommitCache writes the cached accounts into the state trie, then
+// evicts the least recently used accounts exceeding the cache limit.
 func (s *State) CommitCache() {
 	s.mu.Lock()
 	accounts := s.cachedAccounts()
@@ -221,6 +522,138 @@ func (s *State) CommitCache() {
 		// outside of s.mu
 		acc.CommitCache(s)
 	}
+
+	s.mu.Lock()
+	s.evictAccounts()
+	s.mu.Unlock()
+}
+
+// SetMaxBlockCost sets the total execution cost budget of the txns
+// in a block, 0 means no limit. The budget is inherited by the states
+// derived from the state. All nodes must use the same budget, the
+// block exceeding the budget is invalid.
+func (s *State) SetMaxBlockCost(n uint64) {
+	s.mu.Lock()
+	s.maxBlockCost = n
+	s.mu.Unlock()
+}
+
+// SetMaxBody sets the maximum size in bytes and the maximum number of
+// the serialized txns of a block, 0 means no limit. The limits are
+// inherited by the states derived from the state. All nodes must use
+// the same limits, the block exceeding the limits is invalid.
+func (s *State) SetMaxBody(size, txns int) {
+	s.mu.Lock()
+	s.maxBodySize = size
+	s.maxBodyTxns = txns
+	s.mu.Unlock()
+}
+
+// SetAccountCreationFee sets the native coin fee paid by the sender
+// of the txn creating an account, the fee is credited to the
+// collector account rather than the block proposer, so a proposer can
+// not create accounts for free. The collector can be an account whose
+// secret key is unknown to burn the fee. 0 means free. The fee is
+// inherited by the states derived from the state. All nodes must use
+// the same fee and collector.
+func (s *State) SetAccountCreationFee(fee uint64, collector PK) {
+	if fee > 0 && len(collector) == 0 {
+		panic("the account creation fee collector is not set")
+	}
+
+	s.mu.Lock()
+	s.accountCreationFee = fee
+	s.accountFeeCollector = collector
+	s.mu.Unlock()
+}
+
+// SetRequireMarketConfig sets whether a market must be registered
+// with UpdateMarketConfig before orders can be placed on it. The
+// setting is inherited by the states derived from the state. All
+// nodes must use the same setting.
+func (s *State) SetRequireMarketConfig(b bool) {
+	s.mu.Lock()
+	s.requireMarketConfig = b
+	s.mu.Unlock()
+}
+
+// SetStrictProposals sets whether an invalid txn invalidates the
+// whole block, so the proposer including it is penalized by losing
+// the block. Otherwise the invalid txns are skipped and the valid
+// ones are committed. The setting is inherited by the states derived
+// from the state. All nodes must use the same setting.
+func (s *State) SetStrictProposals(b bool) {
+	s.mu.Lock()
+	s.strictProposals = b
+	s.mu.Unlock()
+}
+
+// SetMaxOpenNotional sets the maximum total notional of the open
+// orders of an account, 0 means no limit. The notional of an order is
+// the quote token quant of its unexecuted part. The limit is
+// inherited by the states derived from the state. All nodes must use
+// the same limit, the block exceeding the limit is invalid.
+func (s *State) SetMaxOpenNotional(n uint64) {
+	s.mu.Lock()
+	s.maxOpenNotional = n
+	s.mu.Unlock()
+}
+
+// SetFinalizeDepth sets the number of rounds after which a block is
+// finalized, it must match the finalize depth of the consensus. The
+// price bands are referenced to the last trade of the finalized
+// blocks. The depth is inherited by the states derived from the
+// state. All nodes must use the same depth.
+func (s *State) SetFinalizeDepth(d uint64) {
+	s.mu.Lock()
+	s.finalizeDepth = d
+	s.mu.Unlock()
+}
+
+// SetMaxCachedAccounts sets the maximum number of the accounts kept
+// in the in-memory cache, 0 means no limit. The limit is inherited by
+// the states derived from the state.
+//
+// The accounts are only evicted when the cache is committed, the
+// evicted accounts are read from the state trie when used again, so
+// the state root is not affected.
+func (s *State) SetMaxCachedAccounts(n int) {
+	s.mu.Lock()
+	s.maxCachedAccounts = n
+	s.mu.Unlock()
+}
+
+// cacheAccount adds the account to the account cache as the most
+// recently used one. It must be called with s.mu held.
+func (s *State) cacheAccount(acc *Account) {
+	if acc.elem != nil {
+		s.accountLRU.MoveToFront(acc.elem)
+		return
+	}
+
+	s.accountCache[acc.addr] = acc
+	acc.elem = s.accountLRU.PushFront(acc)
+}
+
+// evictAccounts evicts the least recently used accounts that are not
+// dirty until the cache fits maxCachedAccounts. It must be called
+// with s.mu held.
+func (s *State) evictAccounts() {
+	if s.maxCachedAccounts <= 0 {
+		return
+	}
+
+	e := s.accountLRU.Back()
+	for len(s.accountCache) > s.maxCachedAccounts && e != nil {
+		prev := e.Prev()
+		acc := e.Value.(*Account)
+		if !acc.dirty() {
+			s.accountLRU.Remove(e)
+			acc.elem = nil
+			delete(s.accountCache, acc.addr)
+		}
+		e = prev
+	}
 }
 
 func (s *State) NewAccount(pk PK) *Account {
@@ -232,11 +665,81 @@ func (s *State) NewAccount(pk PK) *Account {
 	}
 
 	s.mu.Lock()
-	s.accountCache[account.addr] = account
+	if cache := s.accountCache[account.addr]; cache != nil {
+		s.accountLRU.Remove(cache.elem)
+		cache.elem = nil
+	}
+	s.cacheAccount(account)
 	s.mu.Unlock()
 	return account
 }
 
+// PruneAccount removes the account from the state, except for its
+// nonce: the txns signed before pruning must never become valid
+// again when the account is created again. The cached changes of the
+// account must be committed before pruning.
+func (s *State) PruneAccount(addr consensus.Addr) {
+	reportIdx := s.ReportIdx(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acc := s.accountCache[addr]; acc != nil {
+		s.accountLRU.Remove(acc.elem)
+		acc.elem = nil
+		delete(s.accountCache, addr)
+	}
+
+	for i := uint32(0); i < reportIdx; i++ {
+		s.trie.Delete(addrExecutionReportPath(addr, i))
+	}
+	s.trie.Delete(addrReportIdxPath(addr))
+	s.trie.Delete(addrBalancePath(addr))
+	s.trie.Delete(addrPKPath(addr))
+
+	// the fee tier must not be inherited by the account created
+	// again.
+	for _, key := range s.tradeVolumeKeys(addr) {
+		s.trie.Delete(key)
+	}
+}
+
+// tradeVolumeKeys returns the trie keys of the trading volumes of the
+// account, the keys are collected before deleting since the trie must
+// not be mutated while iterated. It must be called with s.mu held.
+func (s *State) tradeVolumeKeys(addr consensus.Addr) [][]byte {
+	prefix := encodePath(append(tradeVolumePrefix, addr[:]...))
+	iter := s.trie.NodeIterator(prefix)
+
+	var r [][]byte
+	hasNext := true
+	foundPrefix := false
+
+	for ; hasNext; hasNext = iter.Next(true) {
+		if err := iter.Error(); err != nil {
+			log.Error("error iterating state trie's trade volumes", "err", err)
+			break
+		}
+
+		if !iter.Leaf() {
+			continue
+		}
+
+		path := iter.Path()
+		if !bytes.HasPrefix(path, prefix) {
+			if foundPrefix {
+				break
+			}
+
+			continue
+		}
+		foundPrefix = true
+
+		r = append(r, append([]byte(nil), iter.LeafKey()...))
+	}
+	return r
+}
+
 func (s *State) pk(addr consensus.Addr) (PK, bool) {
 	b := s.trie.Get(addrPKPath(addr))
 	if len(b) == 0 {
@@ -246,13 +749,20 @@ func (s *State) pk(addr consensus.Addr) (PK, bool) {
 	return PK(b), true
 }
 
+// PK returns the public key of the account, nil is returned if the
+// account does not exist. The accounts created but not committed yet
+// are included.
 func (s *State) PK(addr consensus.Addr) PK {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if acc := s.accountCache[addr]; acc != nil {
+		return acc.pk
+	}
+
 	pk, ok := s.pk(addr)
 	if !ok {
-		panic(fmt.Errorf("account for address %v does not exist", addr))
+		return nil
 	}
 	return pk
 }
@@ -266,6 +776,7 @@ func (s *State) UpdatePK(pk PK) {
 	s.trie.Update(path, pk)
 }
 
+// UpdateNonce updates the next expected nonce of the account.
 func (s *State) UpdateNonce(addr consensus.Addr, nonce uint64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -279,6 +790,9 @@ func (s *State) UpdateNonce(addr consensus.Addr, nonce uint64) {
 	s.trie.Update(path, b)
 }
 
+// Nonce returns the next expected nonce of the account, the nonce of
+// the next txn the account sends. It reads the nonce without loading
+// the account, zero is returned if the account never sent a txn.
 func (s *State) Nonce(addr consensus.Addr) uint64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -402,6 +916,26 @@ func (s *State) PendingOrders(addr consensus.Addr) []PendingOrder {
 	return r
 }
 
+// AccountOrders returns the fill status of the resting orders of the
+// account, in the same order as PendingOrders. The executed quantity
+// is updated on each fill, the fully filled orders are not resting.
+func (s *State) AccountOrders(addr consensus.Addr) []OrderStatus {
+	s.mu.Lock()
+	orders := s.PendingOrders(addr)
+	s.mu.Unlock()
+
+	r := make([]OrderStatus, len(orders))
+	for i, o := range orders {
+		r[i] = OrderStatus{
+			ID:        o.ID,
+			Quant:     o.Quant,
+			Executed:  o.Executed,
+			Remaining: o.Quant - o.Executed,
+		}
+	}
+	return r
+}
+
 func (s *State) AddExecutionReport(addr consensus.Addr, e ExecutionReport, idx uint32) {
 	b, err := rlp.EncodeToBytes(e)
 	if err != nil {
@@ -477,6 +1011,7 @@ func (s *State) Account(addr consensus.Addr) *Account {
 
 	cache := s.accountCache[addr]
 	if cache != nil {
+		s.cacheAccount(cache)
 		return cache
 	}
 
@@ -490,7 +1025,7 @@ func (s *State) Account(addr consensus.Addr) *Account {
 		state: s,
 	}
 
-	s.accountCache[addr] = account
+	s.cacheAccount(account)
 	return account
 }
 
@@ -499,7 +1034,7 @@ func (s *State) loadOrderBook(m MarketSymbol) *orderBook {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	path := marketPath(m.Encode())
+	path := marketPath(m.Key())
 	b := s.trie.Get(path)
 	if b == nil {
 		return nil
@@ -514,15 +1049,356 @@ func (s *State) loadOrderBook(m MarketSymbol) *orderBook {
 	return &book
 }
 
+// PriceImpact simulates a market order of the given side and
+// quantity against the market's order book without changing the
+// state. It returns the volume-weighted average fill price and the
+// quantity that can be filled, both are 0 when there is no order to
+// match.
+func (s *State) PriceImpact(market MarketSymbol, sellSide bool, quant uint64) (avgPrice uint64, filled uint64, err error) {
+	if !market.Valid() {
+		return 0, 0, fmt.Errorf("invalid market: %v", market)
+	}
+
+	if quant == 0 {
+		return 0, 0, errors.New("quantity must be greater than 0")
+	}
+
+	book := s.loadOrderBook(market)
+	if book == nil {
+		return 0, 0, nil
+	}
+
+	avgPrice, filled = book.simulateMarket(sellSide, quant)
+	return avgPrice, filled, nil
+}
+
+// saveOrderBook saves the order book and its merkle root to the
+// state trie. The root is committed under its own key, so it is
+// chained to the state root, which is Block.StateRoot, and a proof
+// of the order book can be verified against a block.
 func (s *State) saveOrderBook(m MarketSymbol, book *orderBook) {
 	b, err := rlp.EncodeToBytes(book)
 	if err != nil {
 		panic(err)
 	}
 
+	root := bookTreeRoot(bookTree(book.leaves()))
 	s.mu.Lock()
-	path := marketPath(m.Encode())
+	path := marketPath(m.Key())
 	s.trie.Update(path, b)
+	s.trie.Update(bookRootPath(m), root[:])
+	s.mu.Unlock()
+}
+
+// MarketInfo is a market and its configuration.
+type MarketInfo struct {
+	Symbol MarketSymbol
+	Config MarketConfig
+}
+
+// Markets returns the markets that are configured or have an order
+// book, ordered by the market key.
+func (s *State) Markets() []MarketInfo {
+	markets := make(map[string]MarketSymbol)
+	for _, m := range s.marketsWithPrefix(marketConfigPrefix) {
+		markets[string(m.Key())] = m
+	}
+
+	for _, m := range s.marketsWithPrefix(marketPrefix) {
+		markets[string(m.Key())] = m
+	}
+
+	keys := make([]string, 0, len(markets))
+	for k := range markets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r := make([]MarketInfo, len(keys))
+	for i, k := range keys {
+		m := markets[k]
+		r[i] = MarketInfo{Symbol: m, Config: s.MarketConfig(m)}
+	}
+	return r
+}
+
+// marketsWithPrefix returns the markets whose keys follow the prefix
+// in the state trie.
+func (s *State) marketsWithPrefix(p []byte) []MarketSymbol {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := encodePath(p)
+	iter := s.trie.NodeIterator(prefix)
+
+	var r []MarketSymbol
+	hasNext := true
+	foundPrefix := false
+
+	for ; hasNext; hasNext = iter.Next(true) {
+		if err := iter.Error(); err != nil {
+			log.Error("error iterating state trie's markets", "err", err)
+			break
+		}
+
+		if !iter.Leaf() {
+			continue
+		}
+
+		path := iter.Path()
+		if !bytes.HasPrefix(path, prefix) {
+			if foundPrefix {
+				break
+			}
+
+			continue
+		}
+		foundPrefix = true
+
+		var m MarketSymbol
+		m.Decode(decodePath(path)[len(p):])
+		r = append(r, m)
+	}
+	return r
+}
+
+// MarketConfig returns the configuration of the market, the zero
+// value is returned if the market is not configured.
+func (s *State) MarketConfig(m MarketSymbol) MarketConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var c MarketConfig
+	b := s.trie.Get(marketConfigPath(m))
+	if len(b) == 0 {
+		return c
+	}
+
+	err := rlp.DecodeBytes(b, &c)
+	if err != nil {
+		panic(err)
+	}
+
+	// the empty lists are decoded as empty slices, keep them
+	// nil as the zero value.
+	if len(c.FeeTiers) == 0 {
+		c.FeeTiers = nil
+	}
+	if len(c.FeeCollector) == 0 {
+		c.FeeCollector = nil
+	}
+
+	return c
+}
+
+func (s *State) hasMarketConfig(m MarketSymbol) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.trie.Get(marketConfigPath(m))) > 0
+}
+
+// UpdateMarketConfig updates the configuration of the market.
+func (s *State) UpdateMarketConfig(m MarketSymbol, c MarketConfig) {
+	b, err := rlp.EncodeToBytes(c)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	s.trie.Update(marketConfigPath(m), b)
+	s.mu.Unlock()
+}
+
+// Trade is a trade executed in a market.
+type Trade struct {
+	Round uint64
+	Price uint64
+	Quant uint64
+	// TakerSellSide is true if the taker is the seller.
+	TakerSellSide bool
+}
+
+// LastTrade returns the most recent trade of the market, false is
+// returned if the market has no trade.
+func (s *State) LastTrade(m MarketSymbol) (Trade, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var t Trade
+	b := s.trie.Get(lastTradePath(m))
+	if len(b) == 0 {
+		return t, false
+	}
+
+	err := rlp.DecodeBytes(b, &t)
+	if err != nil {
+		panic(err)
+	}
+
+	return t, true
+}
+
+// LastPrice returns the price of the most recent trade of the
+// market, false is returned if the market has no trade. The price is
+// stored in the state trie, so it is covered by the state root.
+func (s *State) LastPrice(m MarketSymbol) (uint64, bool) {
+	t, ok := s.LastTrade(m)
+	return t.Price, ok
+}
+
+// UpdateLastTrade updates the most recent trade of the market. The
+// last trade of each of the unfinalized rounds is kept as well, see
+// finalizedTrade.
+func (s *State) UpdateLastTrade(m MarketSymbol, t Trade) {
+	b, err := rlp.EncodeToBytes(t)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trie.Update(lastTradePath(m), b)
+
+	trades := s.roundTrades(m)
+	if n := len(trades); n > 0 && trades[n-1].Round == t.Round {
+		trades[n-1] = t
+	} else {
+		trades = append(trades, t)
+	}
+
+	// the later rounds only need the most recent trade finalized
+	// by the round of t and the newer ones.
+	for len(trades) > 1 && trades[1].Round+s.finalizeDepth < t.Round {
+		trades = trades[1:]
+	}
+
+	b, err = rlp.EncodeToBytes(trades)
+	if err != nil {
+		panic(err)
+	}
+
+	s.trie.Update(roundTradesPath(m), b)
+}
+
+// roundTrades returns the last trade of each of the recent rounds of
+// the market, the oldest first. It must be called with s.mu held.
+func (s *State) roundTrades(m MarketSymbol) []Trade {
+	b := s.trie.Get(roundTradesPath(m))
+	if len(b) == 0 {
+		return nil
+	}
+
+	var trades []Trade
+	err := rlp.DecodeBytes(b, &trades)
+	if err != nil {
+		panic(err)
+	}
+
+	return trades
+}
+
+// finalizedTrade returns the most recent trade of the market in the
+// blocks finalized before the given round starts, false is returned
+// if there is none. When round n ends, the block of round
+// n - finalizeDepth is finalized.
+func (s *State) finalizedTrade(m MarketSymbol, round uint64) (Trade, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trades := s.roundTrades(m)
+	for i := len(trades) - 1; i >= 0; i-- {
+		if trades[i].Round+s.finalizeDepth < round {
+			return trades[i], true
+		}
+	}
+
+	return Trade{}, false
+}
+
+// TradeVolume is the trading volume of an account in a market.
+type TradeVolume struct {
+	// StartRound is the round the volume started accumulating.
+	StartRound uint64
+	// Volume is in the quote token units.
+	Volume uint64
+}
+
+// at returns the trading volume at the given round, the volume is
+// reset if the window passed. The window starts from the first
+// trade.
+func (v TradeVolume) at(round, window uint64) TradeVolume {
+	if v.Volume == 0 || window > 0 && round >= v.StartRound+window {
+		return TradeVolume{StartRound: round}
+	}
+
+	return v
+}
+
+// TradeVolume returns the trading volume of the account in the
+// market. The volume is only accumulated when the market charges the
+// trading fee.
+func (s *State) TradeVolume(addr consensus.Addr, m MarketSymbol) TradeVolume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var v TradeVolume
+	b := s.trie.Get(tradeVolumePath(addr, m))
+	if len(b) == 0 {
+		return v
+	}
+
+	err := rlp.DecodeBytes(b, &v)
+	if err != nil {
+		panic(err)
+	}
+
+	return v
+}
+
+// UpdateTradeVolume updates the trading volume of the account in the
+// market.
+func (s *State) UpdateTradeVolume(addr consensus.Addr, m MarketSymbol, v TradeVolume) {
+	b, err := rlp.EncodeToBytes(v)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	s.trie.Update(tradeVolumePath(addr, m), b)
+	s.mu.Unlock()
+}
+
+// Version returns the schema version of the state, a state without
+// the version header is of version 0.
+func (s *State) Version() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.trie.Get(stateVersionPrefix)
+	if len(b) == 0 {
+		return 0
+	}
+
+	var v uint64
+	err := rlp.DecodeBytes(b, &v)
+	if err != nil {
+		panic(err)
+	}
+
+	return int(v)
+}
+
+// UpdateVersion updates the schema version of the state.
+func (s *State) UpdateVersion(v int) {
+	b, err := rlp.EncodeToBytes(uint64(v))
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	s.trie.Update(stateVersionPrefix, b)
 	s.mu.Unlock()
 }
 
@@ -569,6 +1445,18 @@ func (s *State) Tokens() []Token {
 	return r
 }
 
+// TokenBySymbol returns the token of the symbol, the symbol is
+// compared case-insensitively.
+func (s *State) TokenBySymbol(symbol TokenSymbol) (Token, bool) {
+	for _, t := range s.Tokens() {
+		if t.Symbol.normalize() == symbol.normalize() {
+			return t, true
+		}
+	}
+
+	return Token{}, false
+}
+
 func (s *State) Serialize() (consensus.TrieBlob, error) {
 	s.CommitCache()
 	return serializeTrie(s.trie, s.db, s.db.DiskDB())
@@ -605,12 +1493,38 @@ func (s *State) Transition(round uint64, proposer []byte) consensus.Transition {
 
 	s.mu.Lock()
 	newTrie := *s.trie
+	maxCachedAccounts := s.maxCachedAccounts
+	maxBlockCost := s.maxBlockCost
+	maxOpenNotional := s.maxOpenNotional
+	accountCreationFee := s.accountCreationFee
+	accountFeeCollector := s.accountFeeCollector
+	requireMarketConfig := s.requireMarketConfig
+	maxBodySize := s.maxBodySize
+	maxBodyTxns := s.maxBodyTxns
+	strictProposals := s.strictProposals
+	finalizeDepth := s.finalizeDepth
 	s.mu.Unlock()
 
 	state := newState(&newTrie, s.db, s.diskDB)
+	state.maxCachedAccounts = maxCachedAccounts
+	state.maxBlockCost = maxBlockCost
+	state.maxOpenNotional = maxOpenNotional
+	state.accountCreationFee = accountCreationFee
+	state.accountFeeCollector = accountFeeCollector
+	state.requireMarketConfig = requireMarketConfig
+	state.maxBodySize = maxBodySize
+	state.maxBodyTxns = maxBodyTxns
+	state.strictProposals = strictProposals
+	state.finalizeDepth = finalizeDepth
 	return newTransition(state, round, PK(proposer))
 }
 
+// CommitTxns commits the serialized txns of a block. An empty batch,
+// nil or an encoded empty list, produces the same state root as the
+// current state unless orders expire or tokens are released in the
+// round. An error is returned on the first invalid txn in the strict
+// mode, otherwise the invalid txns are skipped, see
+// SetStrictProposals.
 func (s *State) CommitTxns(txns []byte, pool consensus.TxnPool, round uint64) (consensus.State, int, error) {
 	// use nil as the proposer argument, since currently is
 	// replaying block txns, rather than proposing block.
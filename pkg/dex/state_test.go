@@ -1,10 +1,12 @@
 package dex
 
 import (
+	"math"
 	"testing"
 	"unsafe"
 
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/helinwang/dex/pkg/consensus"
 	"github.com/stretchr/testify/assert"
 )
@@ -32,6 +34,34 @@ func TestMarketEncodeDecode(t *testing.T) {
 	assert.Equal(t, m, m1)
 }
 
+func TestMarketSymbolKey(t *testing.T) {
+	m := MarketSymbol{Base: 1, Quote: 2}
+	// the key must be stable, otherwise the markets stored in the
+	// state trie can not be found.
+	assert.Equal(t, []byte{2, 1}, m.Key())
+	assert.Equal(t, m.Key(), (&MarketSymbol{Base: 1, Quote: 2}).Key())
+
+	big := MarketSymbol{Base: 1<<64 - 1, Quote: 300}
+	assert.Equal(t, []byte{0xac, 0x02, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, big.Key())
+
+	markets := []MarketSymbol{
+		{Base: 0, Quote: 1},
+		{Base: 1, Quote: 0},
+		{Base: 1, Quote: 2},
+		{Base: 2, Quote: 1},
+		{Base: 128, Quote: 1},
+		{Base: 1, Quote: 128},
+		big,
+	}
+	keys := make(map[string]MarketSymbol)
+	for _, m := range markets {
+		k := string(m.Key())
+		_, ok := keys[k]
+		assert.False(t, ok, "duplicate key for market %v", m)
+		keys[k] = m
+	}
+}
+
 func TestStateTokens(t *testing.T) {
 	memDB := ethdb.NewMemDatabase()
 	s := NewState(memDB)
@@ -42,11 +72,109 @@ func TestStateTokens(t *testing.T) {
 	assert.Equal(t, []Token{token0, token1}, s.Tokens())
 }
 
+func TestStateMarkets(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	assert.Equal(t, 0, len(s.Markets()))
+
+	m0 := MarketSymbol{Base: 1, Quote: 2}
+	m1 := MarketSymbol{Base: 0, Quote: 1}
+	m2 := MarketSymbol{Base: 0, Quote: 300}
+	c0 := MarketConfig{MaxPriceLevels: 10, OpenRound: 5}
+	c1 := MarketConfig{PriceBandPercent: 20, CloseRound: 100}
+	s.UpdateMarketConfig(m0, c0)
+	s.UpdateMarketConfig(m1, c1)
+	// the market without configuration but with an order book.
+	s.saveOrderBook(m2, newOrderBook())
+	s.saveOrderBook(m1, newOrderBook())
+
+	expected := []MarketInfo{
+		{Symbol: m1, Config: c1},
+		{Symbol: m0, Config: c0},
+		{Symbol: m2},
+	}
+	assert.Equal(t, expected, s.Markets())
+}
+
+func TestGenesisStateRecipientOrder(t *testing.T) {
+	var pks []PK
+	for i := 0; i < 5; i++ {
+		pk, _ := RandKeyPair()
+		pks = append(pks, pk)
+	}
+
+	reversed := make([]PK, len(pks))
+	for i := range pks {
+		reversed[len(pks)-1-i] = pks[i]
+	}
+
+	tokens := []TokenInfo{{Symbol: "BTC", Decimals: 8, TotalUnits: 21000000 * 100000000}}
+	s0, err := CreateGenesisState(pks, tokens, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	s1, err := CreateGenesisState(reversed, tokens, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, s0.Hash(), s1.Hash())
+	assert.Equal(t, pks[0], reversed[len(pks)-1], "input should not be modified")
+}
+
+func TestGenesisStateDuplicateSymbol(t *testing.T) {
+	owner, _ := RandKeyPair()
+	btc := TokenInfo{Symbol: "BTC", Decimals: 8, TotalUnits: 10000000000}
+	_, err := CreateGenesisState([]PK{owner}, []TokenInfo{btc, {Symbol: "btc", Decimals: 8, TotalUnits: 1}}, nil)
+	assert.NotNil(t, err)
+
+	_, err = CreateGenesisState([]PK{owner}, []TokenInfo{{Symbol: "Bnb", Decimals: 8, TotalUnits: 1}}, nil)
+	assert.NotNil(t, err)
+
+	_, err = CreateGenesisState([]PK{owner}, []TokenInfo{btc}, nil)
+	assert.Nil(t, err)
+}
+
+func TestGenesisStateMarkets(t *testing.T) {
+	owner, _ := RandKeyPair()
+	btc := TokenInfo{Symbol: "BTC", Decimals: 8, TotalUnits: 10000000000}
+	m := MarketSymbol{Base: 1, Quote: 0}
+	cfg := MarketConfig{MinQuant: 10, PriceTick: 100}
+
+	_, err := CreateGenesisState([]PK{owner}, []TokenInfo{btc}, []GenesisMarket{{Symbol: MarketSymbol{Base: 2, Quote: 0}, Config: cfg}})
+	assert.NotNil(t, err)
+
+	_, err = CreateGenesisState([]PK{owner}, []TokenInfo{btc}, []GenesisMarket{{Symbol: m, Config: cfg}, {Symbol: m}})
+	assert.NotNil(t, err)
+
+	s, err := CreateGenesisState([]PK{owner}, []TokenInfo{btc}, []GenesisMarket{{Symbol: m, Config: cfg}})
+	assert.Nil(t, err)
+	assert.Equal(t, cfg, s.MarketConfig(m))
+}
+
+func TestGenesisStateDuplicateRecipient(t *testing.T) {
+	a, _ := RandKeyPair()
+	b, _ := RandKeyPair()
+	dup := make(PK, len(a))
+	copy(dup, a)
+	_, err := CreateGenesisState([]PK{a, b, dup}, nil, nil)
+	assert.NotNil(t, err)
+
+	s, err := CreateGenesisState([]PK{a, b}, nil, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, s.Account(a.Addr()))
+	assert.NotNil(t, s.Account(b.Addr()))
+}
+
 func TestStateSerialize(t *testing.T) {
 	owner, _ := RandKeyPair()
 	token0 := Token{ID: 1, TokenInfo: TokenInfo{Symbol: "BTC", Decimals: 8, TotalUnits: 10000000000}}
 	token1 := Token{ID: 2, TokenInfo: TokenInfo{Symbol: "ETH", Decimals: 8, TotalUnits: 1000000000}}
-	s := CreateGenesisState([]PK{owner}, []TokenInfo{token0.TokenInfo, token1.TokenInfo})
+	s, err := CreateGenesisState([]PK{owner}, []TokenInfo{token0.TokenInfo, token1.TokenInfo}, nil)
+	if err != nil {
+		panic(err)
+	}
+
 	nativeToken := Token{ID: 0, TokenInfo: BNBInfo}
 	s.UpdateToken(token0)
 	s.UpdateToken(token1)
@@ -84,6 +212,51 @@ func TestStateNonce(t *testing.T) {
 	assert.Equal(t, 1, int(s.Nonce(addr)))
 }
 
+func TestStateNonceAfterTxns(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	acc := s.NewAccount(pk)
+	acc.UpdateBalance(0, Balance{Available: 100})
+	s.CommitCache()
+	pker := &myPKer{m: map[consensus.Addr]PK{addr: pk}}
+	to, _ := RandKeyPair()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, uint64(i), s.Nonce(addr))
+		trans := s.Transition(uint64(i+1), nil)
+		// the txns are built with the nonce read from the
+		// state.
+		pt, err := parseTxn(MakeSendTokenTxn(sk, addr, to, 0, 1, s.Nonce(addr)), pker)
+		assert.Nil(t, err)
+		assert.Nil(t, trans.Record(pt))
+		s = trans.Commit().(*State)
+	}
+
+	assert.Equal(t, uint64(3), s.Nonce(addr))
+	assert.Equal(t, uint64(3), s.Account(addr).Nonce())
+	assert.Equal(t, uint64(0), s.Nonce(to.Addr()))
+}
+
+func TestStateCommitEmptyTxns(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pk, _ := RandKeyPair()
+	s.NewAccount(pk)
+	s.UpdateBalances(pk.Addr(), []Balance{{Available: 100}}, []TokenID{0})
+	s.CommitCache()
+	root := s.Hash()
+
+	emptyList, err := rlp.EncodeToBytes([][]byte{})
+	assert.Nil(t, err)
+	for _, txns := range [][]byte{nil, {}, emptyList} {
+		next, count, err := s.CommitTxns(txns, nil, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, count)
+		assert.Equal(t, root, next.Hash())
+	}
+	assert.Equal(t, root, s.Hash())
+}
+
 func TestStateBalances(t *testing.T) {
 	s := NewState(ethdb.NewMemDatabase())
 	addr := consensus.RandSK().MustPK().Addr()
@@ -146,3 +319,148 @@ func TestStateUpdateBalance(t *testing.T) {
 	acc := s.Account(addr)
 	assert.Equal(t, 100, int(acc.Balance(0).Available))
 }
+
+func TestStatePriceImpact(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	m := MarketSymbol{Base: 0, Quote: 1}
+	book := newOrderBook()
+	book.Limit(Order{SellSide: true, Quant: 5, Price: 10})
+	book.Limit(Order{SellSide: true, Quant: 5, Price: 12})
+	book.Limit(Order{SellSide: true, Quant: 10, Price: 15})
+	book.Limit(Order{SellSide: false, Quant: 4, Price: 8})
+	book.Limit(Order{SellSide: false, Quant: 6, Price: 7})
+	s.saveOrderBook(m, book)
+	before := s.Hash()
+
+	avg, filled, err := s.PriceImpact(m, false, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(11), avg)
+	assert.Equal(t, uint64(10), filled)
+
+	// not enough liquidity: (5*10+5*12+10*15)/20 = 13
+	avg, filled, err = s.PriceImpact(m, false, 30)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(13), avg)
+	assert.Equal(t, uint64(20), filled)
+
+	// (4*8+2*7)/6 = 7.67, rounded down
+	avg, filled, err = s.PriceImpact(m, true, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), avg)
+	assert.Equal(t, uint64(6), filled)
+	assert.Equal(t, before, s.Hash())
+
+	avg, filled, err = s.PriceImpact(MarketSymbol{Base: 0, Quote: 2}, true, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), avg)
+	assert.Equal(t, uint64(0), filled)
+
+	_, _, err = s.PriceImpact(m, true, 0)
+	assert.NotNil(t, err)
+	_, _, err = s.PriceImpact(MarketSymbol{Base: 1, Quote: 1}, true, 1)
+	assert.NotNil(t, err)
+}
+
+func TestStateAccountCacheEviction(t *testing.T) {
+	var pks []PK
+	for i := 0; i < 5; i++ {
+		pk, _ := RandKeyPair()
+		pks = append(pks, pk)
+	}
+
+	update := func(s *State) {
+		for i, pk := range pks {
+			acc := s.NewAccount(pk)
+			acc.UpdateBalance(1, Balance{Available: uint64(i + 1)})
+		}
+		s.CommitCache()
+
+		for i, pk := range pks {
+			acc := s.Account(pk.Addr())
+			b := acc.Balance(1)
+			b.Available += 10
+			acc.UpdateBalance(1, b)
+			acc.IncrementNonce()
+			assert.Equal(t, uint64(i+11), acc.Balance(1).Available)
+		}
+		s.CommitCache()
+	}
+
+	s0 := NewState(ethdb.NewMemDatabase())
+	update(s0)
+
+	s1 := NewState(ethdb.NewMemDatabase())
+	s1.SetMaxCachedAccounts(2)
+	update(s1)
+	assert.Equal(t, 2, len(s1.accountCache))
+	assert.Equal(t, 2, s1.accountLRU.Len())
+	assert.Equal(t, s0.Hash(), s1.Hash())
+
+	// the most recently used accounts are kept.
+	assert.NotNil(t, s1.accountCache[pks[4].Addr()])
+	assert.NotNil(t, s1.accountCache[pks[3].Addr()])
+	acc := s1.Account(pks[0].Addr())
+	assert.Equal(t, uint64(11), acc.Balance(1).Available)
+	assert.Equal(t, uint64(1), acc.Nonce())
+
+	trans := s1.Transition(1, nil).(*Transition)
+	assert.Equal(t, 2, trans.state.maxCachedAccounts)
+}
+
+func TestPriceBandLargePrice(t *testing.T) {
+	c := MarketConfig{PriceBandPercent: 10}
+	ref := uint64(math.MaxUint64 / 2)
+	// ref*10 overflows uint64.
+	assert.True(t, c.inPriceBand(ref, ref+ref/20))
+	assert.False(t, c.inPriceBand(ref, ref-ref/5))
+}
+
+func TestFinalizedTrade(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	m := MarketSymbol{Quote: 1, Base: 0}
+	_, ok := s.finalizedTrade(m, 10)
+	assert.False(t, ok)
+
+	for round := uint64(1); round <= 5; round++ {
+		s.UpdateLastTrade(m, Trade{Round: round, Price: round, Quant: 1})
+		s.UpdateLastTrade(m, Trade{Round: round, Price: round * 10, Quant: 1})
+	}
+
+	// the round 1 is no longer needed since round 5.
+	assert.Equal(t, 4, len(s.roundTrades(m)))
+	trade, _ := s.finalizedTrade(m, 5)
+	assert.Equal(t, uint64(20), trade.Price)
+	trade, _ = s.finalizedTrade(m, 6)
+	assert.Equal(t, uint64(30), trade.Price)
+	trade, _ = s.finalizedTrade(m, 100)
+	assert.Equal(t, uint64(50), trade.Price)
+
+	s.SetFinalizeDepth(4)
+	trans := s.Transition(6, nil).(*Transition)
+	_, ok = trans.bandRef(m)
+	assert.False(t, ok)
+}
+
+func TestPruneAccountTradeVolume(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	m0 := MarketSymbol{Quote: 1, Base: 0}
+	m1 := MarketSymbol{Quote: 2, Base: 0}
+	c := MarketConfig{FeeTiers: []FeeTier{{MinVolume: 0, FeeRate: 100}, {MinVolume: 1000, FeeRate: 50}}}
+	pk, _ := RandKeyPair()
+	pkOther, _ := RandKeyPair()
+	s.NewAccount(pk)
+	s.NewAccount(pkOther)
+	s.CommitCache()
+	s.UpdateTradeVolume(pk.Addr(), m0, TradeVolume{StartRound: 1, Volume: 2000})
+	s.UpdateTradeVolume(pk.Addr(), m1, TradeVolume{StartRound: 1, Volume: 3000})
+	s.UpdateTradeVolume(pkOther.Addr(), m0, TradeVolume{StartRound: 1, Volume: 4000})
+
+	s.PruneAccount(pk.Addr())
+	s.NewAccount(pk)
+	s.CommitCache()
+	// the account created again starts from the lowest fee tier.
+	assert.Equal(t, TradeVolume{}, s.TradeVolume(pk.Addr(), m0))
+	assert.Equal(t, TradeVolume{}, s.TradeVolume(pk.Addr(), m1))
+	assert.Equal(t, uint64(100), c.fee(s.TradeVolume(pk.Addr(), m0).Volume, feeRateBase))
+	assert.Equal(t, TradeVolume{StartRound: 1, Volume: 4000}, s.TradeVolume(pkOther.Addr(), m0))
+}
@@ -34,13 +34,21 @@ func newTokenCache(s *State) *TokenCache {
 	tokens := s.Tokens()
 	for _, t := range tokens {
 		c.idToInfo[t.ID] = t.TokenInfo
-		c.exists[t.Symbol] = true
+		c.exists[t.Symbol.normalize()] = true
 	}
 	return c
 }
 
+// normalize returns the upper case symbol, token symbols are unique
+// case-insensitively.
+func (s TokenSymbol) normalize() TokenSymbol {
+	return TokenSymbol(strings.ToUpper(string(s)))
+}
+
+// Exists returns true if a token of the symbol exists, the symbol is
+// compared case-insensitively.
 func (t *TokenCache) Exists(s TokenSymbol) bool {
-	return t.exists[s]
+	return t.exists[s.normalize()]
 }
 
 var zeroInfo TokenInfo
@@ -51,7 +59,7 @@ func (t *TokenCache) Info(id TokenID) TokenInfo {
 
 func (t *TokenCache) Update(id TokenID, info TokenInfo) {
 	t.idToInfo[id] = info
-	t.exists[TokenSymbol(strings.ToUpper(string(info.Symbol)))] = true
+	t.exists[info.Symbol.normalize()] = true
 }
 
 func (t *TokenCache) Size() int {
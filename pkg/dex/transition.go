@@ -1,22 +1,94 @@
 package dex
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
-	"strings"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/helinwang/dex/pkg/consensus"
 	log "github.com/helinwang/log15"
 )
 
+// ErrUnknownAccount is returned when the owner of a txn does not
+// exist in the state.
+var ErrUnknownAccount = errors.New("txn owner account not found")
+
+// ErrUnknownMarket is returned when an order is placed on a market
+// without a configuration while the configuration is required.
+var ErrUnknownMarket = errors.New("market not registered")
+
+// ErrOrderNotFillable is returned when a FillOrKill order can not be
+// fully filled immediately, the order is rejected without any fill.
+var ErrOrderNotFillable = errors.New("fill-or-kill order can not be fully filled")
+
 var flatFee = uint64(0.0001 * math.Pow10(int(BNBInfo.Decimals)))
 
+// The deterministic execution cost of each txn type. Placing an order
+// additionally costs matchCost for each execution, and
+// cancelOrderCost for each resting order of the owner it cancels.
+// Canceling all orders additionally costs cancelOrderCost for each
+// canceled order. The additional cost is bounded before the txn
+// changes any state, the txn is rejected if the bound exceeds the
+// remaining budget of the block.
+const (
+	placeOrderCost  = 4
+	cancelOrderCost = 2
+	cancelAllCost   = 2
+	issueTokenCost  = 4
+	sendTokenCost   = 1
+	freezeTokenCost = 1
+	burnTokenCost   = 1
+	matchCost       = 1
+)
+
+// DefaultMaxBlockCost is the default total execution cost budget of
+// the txns in a block.
+const DefaultMaxBlockCost = 1000000
+
+const (
+	// DefaultMaxBodySize is the default maximum size in bytes of
+	// the serialized txns of a block.
+	DefaultMaxBodySize = 64 << 20
+	// DefaultMaxBodyTxns is the default maximum number of the
+	// serialized txns of a block, it is larger than the number
+	// of the txns fitting in DefaultMaxBlockCost.
+	DefaultMaxBodyTxns = 1 << 20
+)
+
+// DefaultFinalizeDepth is the default number of rounds after which
+// a block is finalized, it matches the default of the consensus.
+const DefaultFinalizeDepth = 2
+
+func txnCost(txn interface{}) uint64 {
+	switch txn.(type) {
+	case *PlaceOrderTxn:
+		return placeOrderCost
+	case *CancelOrderTxn:
+		return cancelOrderCost
+	case *CancelAllTxn:
+		return cancelAllCost
+	case *IssueTokenTxn:
+		return issueTokenCost
+	case *SendTokenTxn:
+		return sendTokenCost
+	case *FreezeTokenTxn:
+		return freezeTokenCost
+	case *BurnTokenTxn:
+		return burnTokenCost
+	default:
+		return 0
+	}
+}
+
 type Transition struct {
 	round uint64
 	fee   uint64
+	// cost is the total execution cost of the recorded txns.
+	cost uint64
 	// don't collect fee if proposer is nil, this happens when:
 	// a. replaying a block rather than proposing a block
 	// b. in unit test
@@ -30,6 +102,15 @@ type Transition struct {
 	orderBooks      map[MarketSymbol]*orderBook
 	dirtyOrderBooks map[MarketSymbol]bool
 	tokenCache      *TokenCache
+	// bandRefs is the last finalized trade of the markets, used
+	// as the reference of the price bands.
+	bandRefs map[MarketSymbol]Trade
+	// halted is the markets whose matching is halted for the
+	// rest of the round by the price band.
+	halted map[MarketSymbol]bool
+	// pruneCandidates is the owners of the recorded txns, they
+	// are pruned at the end of the block if prunable.
+	pruneCandidates map[consensus.Addr]bool
 }
 
 func newTransition(s *State, round uint64, proposer PK) *Transition {
@@ -41,37 +122,124 @@ func newTransition(s *State, round uint64, proposer PK) *Transition {
 		orderBooks:      make(map[MarketSymbol]*orderBook),
 		dirtyOrderBooks: make(map[MarketSymbol]bool),
 		tokenCache:      newTokenCache(s),
+		bandRefs:        make(map[MarketSymbol]Trade),
+		halted:          make(map[MarketSymbol]bool),
+		pruneCandidates: make(map[consensus.Addr]bool),
 		filledOrders:    make([]PendingOrder, 0, 1000), // optimization: preallocate buffer
 	}
 }
 
+// RecordSerialized records the serialized txns of a block, it
+// returns the number of the recorded txns.
 func (t *Transition) RecordSerialized(blob []byte, pool consensus.TxnPool) (int, error) {
-	var txns [][]byte
-	err := rlp.DecodeBytes(blob, &txns)
+	count, _, err := t.RecordSerializedAdmitted(blob, pool)
+	return count, err
+}
+
+// RecordSerializedAdmitted records the serialized txns of a block, it
+// returns the number of the recorded txns and the hashes of the txns
+// newly admitted to the txn pool, in the order of the block. The txns
+// already in the pool or recently seen by the pool are not admitted
+// again.
+//
+// In the strict mode an error is returned on the first invalid txn,
+// otherwise the invalid txns are skipped and not counted.
+func (t *Transition) RecordSerializedAdmitted(blob []byte, pool consensus.TxnPool) (int, []consensus.Hash, error) {
+	txns, err := decodeBody(blob, t.state.maxBodySize, t.state.maxBodyTxns)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
+	var admitted []consensus.Hash
+	count := 0
 	for _, b := range txns {
 		hash := consensus.SHA3(b)
 		txn := pool.Get(hash)
 		if txn == nil {
-			txn, _ = pool.Add(b)
+			var added bool
+			txn, added = pool.Add(b)
+			if added {
+				admitted = append(admitted, hash)
+			}
+		}
+
+		if txn == nil {
+			// the pool parses the txn against its own view
+			// of the accounts, which differs between the
+			// nodes, e.g., the owner is created earlier in
+			// the same block. The validity is decided by the
+			// state being transitioned only.
+			txn, err = parseTxn(b, t.state)
+			if err != nil {
+				if t.state.strictProposals {
+					return 0, nil, err
+				}
+
+				log.Debug("skip invalid txn", "hash", hash, "err", err)
+				continue
+			}
 		}
 
 		if txn.MinerFeeTxn {
 			t.giveMinerFee(*txn.Decoded.(*MinerFeeTxn))
+			count++
 			continue
 		}
 
-		err = t.RecordImpl(txn, true)
+		if prune, ok := txn.Decoded.(*PruneAccountsTxn); ok {
+			err = t.pruneAccounts(prune.Addrs)
+		} else {
+			err = t.RecordImpl(txn, true)
+			if err == nil {
+				pool.Remove(hash)
+			}
+		}
+
 		if err != nil {
-			return 0, err
+			if t.state.strictProposals {
+				return 0, nil, err
+			}
+
+			log.Debug("skip invalid txn", "hash", hash, "err", err)
+			continue
 		}
-		pool.Remove(hash)
+		count++
 	}
 
-	return len(txns), nil
+	return count, admitted, nil
+}
+
+// decodeBody decodes the serialized txns of a block. The size and
+// the number of the txns are checked before decoding, so an
+// oversized body can not exhaust the memory. 0 means no limit.
+func decodeBody(blob []byte, maxSize, maxTxns int) ([][]byte, error) {
+	if maxSize > 0 && len(blob) > maxSize {
+		return nil, fmt.Errorf("txns body size %d exceeds the limit %d", len(blob), maxSize)
+	}
+
+	if maxTxns > 0 {
+		content, _, err := rlp.SplitList(blob)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := rlp.CountValues(content)
+		if err != nil {
+			return nil, err
+		}
+
+		if n > maxTxns {
+			return nil, fmt.Errorf("txns body has %d txns, exceeds the limit %d", n, maxTxns)
+		}
+	}
+
+	var txns [][]byte
+	err := rlp.DecodeBytes(blob, &txns)
+	if err != nil {
+		return nil, err
+	}
+
+	return txns, nil
 }
 
 // Record records a transition to the state transition.
@@ -83,9 +251,13 @@ func (t *Transition) RecordImpl(txn *consensus.Txn, forceFee bool) (err error) {
 	if t.finalized {
 		panic("record should never be called after finalized")
 	}
+	if txn.Expired(t.round) {
+		return fmt.Errorf("txn expired, valid until round: %d, cur round: %d", txn.ValidUntilRound, t.round)
+	}
+
 	acc := t.state.Account(txn.Owner)
 	if acc == nil {
-		return errors.New("txn owner not found")
+		return ErrUnknownAccount
 	}
 
 	if !txn.MinerFeeTxn {
@@ -96,6 +268,11 @@ func (t *Transition) RecordImpl(txn *consensus.Txn, forceFee bool) (err error) {
 		}
 	}
 
+	cost := txnCost(txn.Decoded)
+	if !t.withinBudget(cost) {
+		return consensus.ErrBlockCostExceeded
+	}
+
 	payFee := forceFee || t.proposer != nil
 
 	if payFee {
@@ -108,7 +285,14 @@ func (t *Transition) RecordImpl(txn *consensus.Txn, forceFee bool) (err error) {
 		acc.UpdateBalance(0, nativeCoin)
 		t.fee += flatFee
 	}
+	// reserved before the execution, so the additional cost is
+	// checked against the remaining budget.
+	t.cost += cost
 	defer func() {
+		if err != nil {
+			t.cost -= cost
+		}
+
 		if payFee && err != nil {
 			nativeCoin := acc.Balance(0)
 			nativeCoin.Available += flatFee
@@ -130,6 +314,10 @@ func (t *Transition) RecordImpl(txn *consensus.Txn, forceFee bool) (err error) {
 		if err := t.cancelOrder(acc, tx); err != nil {
 			return err
 		}
+	case *CancelAllTxn:
+		if err := t.cancelAll(acc, tx); err != nil {
+			return err
+		}
 	case *IssueTokenTxn:
 		if err := t.issueToken(acc, tx); err != nil {
 			return err
@@ -150,10 +338,18 @@ func (t *Transition) RecordImpl(txn *consensus.Txn, forceFee bool) (err error) {
 		return fmt.Errorf("unknown txn type: %T", txn.Decoded)
 	}
 
+	t.pruneCandidates[txn.Owner] = true
 	t.txns = append(t.txns, txn.Raw)
 	return nil
 }
 
+// withinBudget returns true if the extra execution cost fits in the
+// remaining cost budget of the block.
+func (t *Transition) withinBudget(extra uint64) bool {
+	max := t.state.maxBlockCost
+	return max == 0 || t.cost+extra <= max
+}
+
 func (t *Transition) burnToken(acc *Account, txn *BurnTokenTxn) error {
 	if txn.Quant == 0 {
 		return errors.New("burn token quantity should not be 0")
@@ -193,6 +389,18 @@ func (t *Transition) getOrderBook(m MarketSymbol) *orderBook {
 	return book
 }
 
+// openNotional returns the total notional of the unexecuted part of
+// the account's open orders.
+func (t *Transition) openNotional(owner *Account) uint64 {
+	var sum uint64
+	for _, o := range owner.PendingOrders() {
+		baseInfo := t.tokenCache.Info(o.ID.Market.Base)
+		quoteInfo := t.tokenCache.Info(o.ID.Market.Quote)
+		sum += calcQuoteQuant(o.Quant-o.Executed, quoteInfo.Decimals, o.Price, OrderPriceDecimals, baseInfo.Decimals)
+	}
+	return sum
+}
+
 func calcQuoteQuant(baseQuantUnit uint64, quoteDecimals uint8, priceQuantUnit uint64, priceDecimals, baseDecimals uint8) uint64 {
 	var quantUnit big.Int
 	var quoteDenominator big.Int
@@ -218,14 +426,84 @@ func (t *Transition) cancelOrder(owner *Account, txn *CancelOrderTxn) error {
 		return fmt.Errorf("can not find the order to cancel: %v", txn.ID)
 	}
 
-	book := t.getOrderBook(txn.ID.Market)
-	book.Cancel(txn.ID.ID)
-	t.dirtyOrderBooks[txn.ID.Market] = true
-	owner.RemovePendingOrder(txn.ID)
-	t.refundAfterCancel(owner, cancel, txn.ID.Market)
+	t.cancelPending(owner, cancel)
+	return nil
+}
+
+// cancelPending removes the pending order of the owner from the order
+// book and the account, and refunds its pending balance.
+func (t *Transition) cancelPending(owner *Account, po PendingOrder) {
+	market := po.ID.Market
+	book := t.getOrderBook(market)
+	book.Cancel(po.ID.ID)
+	t.dirtyOrderBooks[market] = true
+	owner.RemovePendingOrder(po.ID)
+	t.refundAfterCancel(owner, po, market)
+}
+
+func (t *Transition) cancelAll(owner *Account, txn *CancelAllTxn) error {
+	if !txn.AllMarkets && !txn.Market.Valid() {
+		return fmt.Errorf("cancel all market is invalid: %v", txn.Market)
+	}
+
+	var cancels []PendingOrder
+	// the pending orders are iterated in the state trie key
+	// order, so the cancellation is deterministic.
+	for _, cancel := range owner.PendingOrders() {
+		if !txn.AllMarkets && cancel.ID.Market != txn.Market {
+			continue
+		}
+
+		cancels = append(cancels, cancel)
+	}
+
+	if len(cancels) == 0 {
+		return errors.New("no pending order to cancel")
+	}
+
+	cost := cancelOrderCost * uint64(len(cancels))
+	if !t.withinBudget(cost) {
+		return consensus.ErrBlockCostExceeded
+	}
+
+	for _, cancel := range cancels {
+		t.cancelPending(owner, cancel)
+	}
+
+	t.cost += cost
 	return nil
 }
 
+// selfCrossing returns the pending orders of the owner in the market
+// that would cross an incoming order of the given side and price.
+func selfCrossing(owner *Account, market MarketSymbol, sellSide bool, price uint64) []PendingOrder {
+	var r []PendingOrder
+	// the pending orders are iterated in the state trie key
+	// order, so the cancellation is deterministic.
+	for _, po := range owner.PendingOrders() {
+		if po.ID.Market != market || po.SellSide == sellSide {
+			continue
+		}
+
+		if sellSide && po.Price < price || !sellSide && po.Price > price {
+			continue
+		}
+
+		r = append(r, po)
+	}
+	return r
+}
+
+// cancelSelfCrossing cancels the given self-crossing pending orders
+// of the owner, and refunds their pending balance.
+func (t *Transition) cancelSelfCrossing(owner *Account, cancels []PendingOrder) {
+	for _, cancel := range cancels {
+		t.cancelPending(owner, cancel)
+	}
+
+	t.cost += cancelOrderCost * uint64(len(cancels))
+}
+
 func (t *Transition) refundAfterCancel(owner *Account, cancel PendingOrder, market MarketSymbol) {
 	if cancel.Quant <= cancel.Executed {
 		panic(fmt.Errorf("pending order remain amount should be greater than 0, total: %d, executed: %d", cancel.Quant, cancel.Executed))
@@ -267,10 +545,25 @@ type ExecutionReport struct {
 	Fee        uint64
 }
 
+// bandRef returns the last finalized trade of the market, false is
+// returned if there is none.
+func (t *Transition) bandRef(m MarketSymbol) (Trade, bool) {
+	if ref, ok := t.bandRefs[m]; ok {
+		return ref, ref != Trade{}
+	}
+
+	ref, _ := t.state.finalizedTrade(m, t.round)
+	t.bandRefs[m] = ref
+	return ref, ref != Trade{}
+}
+
 func (t *Transition) placeOrder(owner *Account, txn *PlaceOrderTxn, round uint64) error {
 	if !txn.Market.Valid() {
 		return fmt.Errorf("order's market is invalid: %v", txn.Market)
 	}
+	if t.state.requireMarketConfig && !t.state.hasMarketConfig(txn.Market) {
+		return ErrUnknownMarket
+	}
 	if txn.ExpireRound > 0 && round >= txn.ExpireRound {
 		return fmt.Errorf("order already expired, order expire round: %d, cur round: %d", txn.ExpireRound, round)
 	}
@@ -285,16 +578,77 @@ func (t *Transition) placeOrder(owner *Account, txn *PlaceOrderTxn, round uint64
 		return fmt.Errorf("trying to place order on nonexistent token: %d", txn.Market.Quote)
 	}
 
+	cfg := t.state.MarketConfig(txn.Market)
+	if !cfg.isOpen(round) {
+		return fmt.Errorf("market %v is not open in round %d, open round: %d, close round: %d", txn.Market, round, cfg.OpenRound, cfg.CloseRound)
+	}
+
+	if err := cfg.checkOrderSize(txn.Quant, txn.Price); err != nil {
+		return err
+	}
+
+	if t.halted[txn.Market] {
+		return fmt.Errorf("matching of market %v is halted for the rest of the round", txn.Market)
+	}
+
+	price := txn.Price
+	book := t.getOrderBook(txn.Market)
+	if cfg.MaxPriceLevels > 0 && txn.TimeInForce == GoodTillCancel {
+		// only the GoodTillCancel orders can rest on a new
+		// price level.
+		p, err := book.PriceLevelFor(txn.SellSide, txn.Quant, price, int(cfg.MaxPriceLevels), cfg.RoundToExistingLevel)
+		if err != nil {
+			return err
+		}
+		price = p
+	}
+
+	if max := t.state.maxOpenNotional; max > 0 {
+		notional := t.openNotional(owner) + calcQuoteQuant(txn.Quant, quoteInfo.Decimals, price, OrderPriceDecimals, baseInfo.Decimals)
+		if notional > max {
+			return fmt.Errorf("open orders notional exceeds the limit, notional: %d, limit: %d", notional, max)
+		}
+	}
+
+	if txn.TimeInForce == FillOrKill {
+		// checked before the balance is locked, so the killed
+		// order changes nothing.
+		o := Order{Owner: owner.PK().Addr(), SellSide: txn.SellSide, Quant: txn.Quant, Price: price}
+		if book.FillableQuant(o, cfg.SelfTradePrevention) < txn.Quant {
+			return ErrOrderNotFillable
+		}
+	}
+
+	var selfCancels []PendingOrder
+	if cfg.SelfTradePrevention == CancelRestingSelfTrade {
+		selfCancels = selfCrossing(owner, txn.Market, txn.SellSide, price)
+	}
+
+	tif := txn.TimeInForce
+	if cfg.SelfTradePrevention == SkipSelfTrade && tif == GoodTillCancel && len(selfCrossing(owner, txn.Market, txn.SellSide, price)) > 0 {
+		// the unfilled part would cross the resting orders of
+		// the same owner, it is canceled instead of resting.
+		tif = ImmediateOrCancel
+	}
+
+	// bounded before the balance is locked, so the order over
+	// the budget changes nothing.
+	o := Order{Owner: owner.PK().Addr(), SellSide: txn.SellSide, Quant: txn.Quant, Price: price}
+	fills := book.matchCount(o, cfg.MatchingMode, cfg.SelfTradePrevention)
+	if !t.withinBudget(matchCost*2*uint64(fills) + cancelOrderCost*uint64(len(selfCancels))) {
+		return consensus.ErrBlockCostExceeded
+	}
+
 	if txn.SellSide {
 		if txn.Quant == 0 {
 			return errors.New("sell: can not sell 0 quantity")
 		}
 
-		baseBalance := owner.Balance(txn.Market.Base)
-		if baseBalance.Available < txn.Quant {
-			return fmt.Errorf("sell failed: insufficient balance, quant: %d, available: %d", txn.Quant, baseBalance.Available)
+		if spendable := owner.Spendable(txn.Market.Base); spendable < txn.Quant {
+			return fmt.Errorf("sell failed: insufficient balance, quant: %d, spendable: %d", txn.Quant, spendable)
 		}
 
+		baseBalance := owner.Balance(txn.Market.Base)
 		baseBalance.Available -= txn.Quant
 		baseBalance.Pending += txn.Quant
 		owner.UpdateBalance(txn.Market.Base, baseBalance)
@@ -303,31 +657,53 @@ func (t *Transition) placeOrder(owner *Account, txn *PlaceOrderTxn, round uint64
 			return errors.New("buy failed: can not buy 0 quantity")
 		}
 
-		pendingQuant := calcQuoteQuant(txn.Quant, quoteInfo.Decimals, txn.Price, OrderPriceDecimals, baseInfo.Decimals)
+		pendingQuant := calcQuoteQuant(txn.Quant, quoteInfo.Decimals, price, OrderPriceDecimals, baseInfo.Decimals)
 		if pendingQuant == 0 {
 			return errors.New("buy failed: converted quote quant is 0")
 		}
 
-		quoteBalance := owner.Balance(txn.Market.Quote)
-		if quoteBalance.Available < pendingQuant {
-			return fmt.Errorf("buy failed, insufficient balance, required: %d, available %d", pendingQuant, quoteBalance.Available)
+		if spendable := owner.Spendable(txn.Market.Quote); spendable < pendingQuant {
+			return fmt.Errorf("buy failed, insufficient balance, required: %d, spendable %d", pendingQuant, spendable)
 		}
 
+		quoteBalance := owner.Balance(txn.Market.Quote)
 		quoteBalance.Available -= pendingQuant
 		quoteBalance.Pending += pendingQuant
 		owner.UpdateBalance(txn.Market.Quote, quoteBalance)
 	}
 
+	if ref, ok := t.bandRef(txn.Market); ok {
+		// checked after the balance, so only the order that
+		// would trade halts the market.
+		if p, ok := book.worstFillPrice(o, cfg.SelfTradePrevention); ok && !cfg.inPriceBand(ref.Price, p) {
+			// the order is dropped without trading, the txn
+			// stays valid, so every node replaying the block
+			// halts the market at the same txn.
+			log.Warn("trade out of price band, halting market", "market", txn.Market, "price", p, "ref price", ref.Price)
+			t.refundAfterCancel(owner, PendingOrder{Order: o}, txn.Market)
+			t.halted[txn.Market] = true
+			return nil
+		}
+	}
+
+	if len(selfCancels) > 0 {
+		t.cancelSelfCrossing(owner, selfCancels)
+	}
+
 	order := Order{
 		Owner:       owner.PK().Addr(),
 		SellSide:    txn.SellSide,
 		Quant:       txn.Quant,
-		Price:       txn.Price,
+		Price:       price,
 		ExpireRound: txn.ExpireRound,
 	}
+	if tif != GoodTillCancel {
+		// the order never rests on the order book.
+		order.ExpireRound = 0
+	}
 
-	book := t.getOrderBook(txn.Market)
-	orderID, executions := book.Limit(order)
+	orderID, executions := book.LimitWithTIF(order, cfg.MatchingMode, cfg.SelfTradePrevention, tif)
+	t.cost += matchCost * uint64(len(executions))
 	t.dirtyOrderBooks[txn.Market] = true
 	id := OrderID{ID: orderID, Market: txn.Market}
 	pendingOrder := PendingOrder{
@@ -340,15 +716,38 @@ func (t *Transition) placeOrder(owner *Account, txn *PlaceOrderTxn, round uint64
 	}
 
 	if len(executions) > 0 {
+		// each fill has exactly one maker execution, the last
+		// one is the most recent trade.
+		for i := len(executions) - 1; i >= 0; i-- {
+			if exec := executions[i]; !exec.Taker {
+				t.state.UpdateLastTrade(txn.Market, Trade{
+					Round:         round,
+					Price:         exec.Price,
+					Quant:         exec.Quant,
+					TakerSellSide: !exec.SellSide,
+				})
+				break
+			}
+		}
+
 		for _, exec := range executions {
 			acc := t.state.Account(exec.Owner)
 			orderID := OrderID{ID: exec.ID, Market: txn.Market}
+			notional := calcQuoteQuant(exec.Quant, quoteInfo.Decimals, exec.Price, OrderPriceDecimals, baseInfo.Decimals)
+			// the seller receives the quote token, the
+			// buyer receives the base token.
+			recvToken, recvQuant := txn.Market.Base, exec.Quant
+			if exec.SellSide {
+				recvToken, recvQuant = txn.Market.Quote, notional
+			}
+			fee := t.tradeFee(exec.Owner, txn.Market, cfg, round, notional, recvQuant)
 			report := ExecutionReport{
 				Round:      round,
 				ID:         orderID,
 				SellSide:   exec.SellSide,
 				TradePrice: exec.Price,
 				Quant:      exec.Quant,
+				Fee:        fee,
 			}
 			acc.AddExecutionReport(report)
 			executedOrder, ok := acc.PendingOrder(orderID)
@@ -372,14 +771,12 @@ func (t *Transition) placeOrder(owner *Account, txn *PlaceOrderTxn, round uint64
 				}
 
 				baseBalance.Pending -= exec.Quant
-				recvQuant := calcQuoteQuant(exec.Quant, quoteInfo.Decimals, exec.Price, OrderPriceDecimals, baseInfo.Decimals)
-				quoteBalance.Available += recvQuant
+				quoteBalance.Available += recvQuant - fee
 				acc.UpdateBalance(txn.Market.Base, baseBalance)
 				acc.UpdateBalance(txn.Market.Quote, quoteBalance)
 			} else {
-				recvQuant := exec.Quant
 				pendingQuant := calcQuoteQuant(exec.Quant, quoteInfo.Decimals, executedOrder.Price, OrderPriceDecimals, baseInfo.Decimals)
-				givenQuant := calcQuoteQuant(exec.Quant, quoteInfo.Decimals, exec.Price, OrderPriceDecimals, baseInfo.Decimals)
+				givenQuant := notional
 
 				if quoteBalance.Pending < pendingQuant {
 					panic(fmt.Errorf("insufficient pending balance, owner: %v, pending %d, executed: %d, buy side, taker: %t", exec.Owner, quoteBalance.Pending, exec.Quant, exec.Taker))
@@ -388,22 +785,66 @@ func (t *Transition) placeOrder(owner *Account, txn *PlaceOrderTxn, round uint64
 				quoteBalance.Pending -= pendingQuant
 				quoteBalance.Available += pendingQuant
 				quoteBalance.Available -= givenQuant
-				baseBalance.Available += recvQuant
+				baseBalance.Available += recvQuant - fee
 				acc.UpdateBalance(txn.Market.Base, baseBalance)
 				acc.UpdateBalance(txn.Market.Quote, quoteBalance)
 			}
+
+			if fee > 0 {
+				t.collectFee(cfg.FeeCollector, recvToken, fee)
+			}
+		}
+	}
+
+	if tif != GoodTillCancel {
+		// the unfilled part is not on the order book, cancel
+		// it and refund its pending balance.
+		if po, ok := owner.PendingOrder(id); ok {
+			owner.RemovePendingOrder(id)
+			t.refundAfterCancel(owner, po, txn.Market)
 		}
 	}
 	return nil
 }
 
+// tradeFee returns the trading fee of the fill received by the
+// account, and adds the notional of the fill to the account's
+// trading volume. The fee rate is of the tier reached by the volume
+// before the fill, so the fills after crossing a tier boundary,
+// including the later fills of the same round, are charged at the
+// rate of the new tier.
+func (t *Transition) tradeFee(addr consensus.Addr, m MarketSymbol, cfg MarketConfig, round, notional, recvQuant uint64) uint64 {
+	if !cfg.chargesFee() {
+		return 0
+	}
+
+	v := t.state.TradeVolume(addr, m).at(round, cfg.FeeVolumeWindow)
+	fee := cfg.fee(v.Volume, recvQuant)
+	v.Volume += notional
+	t.state.UpdateTradeVolume(addr, m, v)
+	return fee
+}
+
+// collectFee credits the fee to the collector account, the account
+// is created if it does not exist.
+func (t *Transition) collectFee(collector PK, token TokenID, fee uint64) {
+	acc := t.state.Account(collector.Addr())
+	if acc == nil {
+		acc = t.state.NewAccount(collector)
+	}
+
+	b := acc.Balance(token)
+	b.Available += fee
+	acc.UpdateBalance(token, b)
+}
+
 func (t *Transition) issueToken(owner *Account, txn *IssueTokenTxn) error {
 	if t.tokenCache.Exists(txn.Info.Symbol) {
 		return fmt.Errorf("token symbol %v already exists", txn.Info.Symbol)
 	}
 
 	for _, v := range t.tokenCreations {
-		if strings.ToUpper(string(txn.Info.Symbol)) == strings.ToUpper(string(v.Symbol)) {
+		if txn.Info.Symbol.normalize() == v.Symbol.normalize() {
 			return fmt.Errorf("token symbol %v already exists in the current transition", txn.Info.Symbol)
 		}
 	}
@@ -429,7 +870,32 @@ func (t *Transition) sendToken(owner *Account, txn *SendTokenTxn) error {
 	toAddr := txn.To.Addr()
 	toAcc := t.state.Account(toAddr)
 	if toAcc == nil {
+		fee := t.state.accountCreationFee
+		if fee > 0 {
+			// the sender pays the account creation fee in
+			// the native coin, on top of the sent quant.
+			required := fee
+			if txn.TokenID == 0 {
+				required += txn.Quant
+			}
+
+			nativeCoin := owner.Balance(0)
+			if nativeCoin.Available < required {
+				return fmt.Errorf("insufficient native coin balance to pay the account creation fee, required: %d, available: %d", required, nativeCoin.Available)
+			}
+
+			nativeCoin.Available -= fee
+			owner.UpdateBalance(0, nativeCoin)
+		}
+
 		toAcc = t.state.NewAccount(txn.To)
+		if fee > 0 {
+			// credited after the account is created, the
+			// collector could be the created account or the
+			// sender.
+			t.collectFee(t.state.accountFeeCollector, 0, fee)
+			b = owner.Balance(txn.TokenID)
+		}
 	}
 
 	b.Available -= txn.Quant
@@ -493,9 +959,80 @@ func (t *Transition) appendFeeTxn() {
 	}
 }
 
+// appendPruneTxn prunes the owners of the recorded txns that are
+// left without balance and pending order, appending the
+// PruneAccountsTxn. The txn is only created when proposing a block,
+// the replaying validators apply the txn in the block instead.
+func (t *Transition) appendPruneTxn() {
+	if t.proposer == nil {
+		return
+	}
+
+	var addrs []consensus.Addr
+	for addr := range t.pruneCandidates {
+		acc := t.state.Account(addr)
+		if acc != nil && acc.Prunable() {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+
+	txn := Txn{
+		T:    PruneAccounts,
+		Data: gobEncode(PruneAccountsTxn{Addrs: addrs}),
+	}
+
+	b, err := rlp.EncodeToBytes(txn)
+	if err != nil {
+		panic(err)
+	}
+
+	err = t.pruneAccounts(addrs)
+	if err != nil {
+		panic(fmt.Errorf("should not happen: prune checked accounts error: %v", err))
+	}
+	t.txns = append(t.txns, b)
+}
+
+// pruneAccounts prunes the accounts, an error is returned if any
+// account does not exist or is not prunable, or the addresses are not
+// sorted, so all validators agree on the pruned accounts.
+func (t *Transition) pruneAccounts(addrs []consensus.Addr) error {
+	for i, addr := range addrs {
+		if i > 0 && bytes.Compare(addrs[i-1][:], addr[:]) >= 0 {
+			return errors.New("pruned accounts are not sorted")
+		}
+
+		acc := t.state.Account(addr)
+		if acc == nil {
+			return fmt.Errorf("pruned account %v not found", addr)
+		}
+
+		if !acc.Prunable() {
+			return fmt.Errorf("account %v is not prunable", addr)
+		}
+	}
+
+	for _, addr := range addrs {
+		t.state.Account(addr).CommitCache(t.state)
+		t.state.PruneAccount(addr)
+	}
+	return nil
+}
+
 func (t *Transition) finalizeState() {
 	if !t.finalized {
 		t.appendFeeTxn()
+		// must be called after t.appendFeeTxn, in the same
+		// order as the txns are replayed.
+		t.appendPruneTxn()
 		t.removeFilledOrderFromExpiration()
 		// must be called after
 		// t.removeFilledOrderFromExpiration
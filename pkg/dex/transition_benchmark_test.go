@@ -36,7 +36,11 @@ func genStateTxns(p *myPKer) (consensus.State, []byte) {
 		Decimals:   8,
 		TotalUnits: 200000000 * 100000000,
 	}
-	state := CreateGenesisState(accountPKs, []TokenInfo{BTCInfo})
+	state, err := CreateGenesisState(accountPKs, []TokenInfo{BTCInfo}, nil)
+	if err != nil {
+		panic(err)
+	}
+
 	var txns [][]byte
 	for i := 0; i < orderCount; i++ {
 		idx := rand.Intn(len(accountSKs))
@@ -71,3 +75,34 @@ func BenchmarkPlaceOrder(b *testing.B) {
 		_, _, _ = state.CommitTxns(body, pool, 1)
 	}
 }
+
+func benchmarkAccountCache(b *testing.B, maxCachedAccounts int) {
+	const accountCount = 10000
+	pks := make([]PK, accountCount)
+	for i := range pks {
+		pks[i], _ = RandKeyPair()
+	}
+
+	state, err := CreateGenesisState(pks, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	state.SetMaxCachedAccounts(maxCachedAccounts)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		acc := state.Account(pks[rand.Intn(len(pks))].Addr())
+		acc.IncrementNonce()
+		if i%100 == 0 {
+			state.CommitCache()
+		}
+	}
+}
+
+func BenchmarkAccountCache(b *testing.B) {
+	benchmarkAccountCache(b, 0)
+}
+
+func BenchmarkAccountCacheEviction(b *testing.B) {
+	benchmarkAccountCache(b, 1000)
+}
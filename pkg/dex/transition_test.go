@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/helinwang/dex/pkg/consensus"
 	"github.com/stretchr/testify/assert"
 )
@@ -52,6 +53,348 @@ func TestSendToken(t *testing.T) {
 	assert.Equal(t, 20, int(recv.Balance(0).Available))
 }
 
+func TestSendTokenInsufficientBalance(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	// the pending balance can not be sent.
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100, Pending: 50})
+	pker := &myPKer{m: map[consensus.Addr]PK{addr: pk}}
+	pkTo, _ := RandKeyPair()
+
+	record := func(txn []byte) error {
+		pt, err := parseTxn(txn, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		trans := s.Transition(1, nil)
+		err = trans.Record(pt)
+		if err != nil {
+			return err
+		}
+		s = trans.Commit().(*State)
+		return nil
+	}
+
+	assert.NotNil(t, record(MakeSendTokenTxn(sk, addr, pkTo, 0, 101, 0)))
+	assert.NotNil(t, record(MakeSendTokenTxn(sk, addr, pkTo, 0, 0, 0)))
+	assert.Nil(t, s.Account(pkTo.Addr()))
+	send := s.Account(addr)
+	assert.Equal(t, 100, int(send.Balance(0).Available))
+	assert.Equal(t, 50, int(send.Balance(0).Pending))
+	assert.Equal(t, uint64(0), send.Nonce())
+
+	assert.Nil(t, record(MakeSendTokenTxn(sk, addr, pkTo, 0, 100, 0)))
+	assert.Equal(t, 0, int(s.Account(addr).Balance(0).Available))
+	assert.Equal(t, 100, int(s.Account(pkTo.Addr()).Balance(0).Available))
+	assert.Equal(t, uint64(1), s.Account(addr).Nonce())
+}
+
+func TestAccountCreationFee(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pkCollector, _ := RandKeyPair()
+	s.SetAccountCreationFee(5, pkCollector)
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	// the two txns pay the flat fee to the proposer.
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100 + 2*flatFee})
+	pker := &myPKer{m: map[consensus.Addr]PK{addr: pk}}
+	pkTo, _ := RandKeyPair()
+	pkProposer, _ := RandKeyPair()
+
+	send := func(trans consensus.Transition, quant, nonce uint64) error {
+		pt, err := parseTxn(MakeSendTokenTxn(sk, addr, pkTo, 0, quant, nonce), pker)
+		if err != nil {
+			panic(err)
+		}
+		return trans.Record(pt)
+	}
+
+	// creating the account, the fee is charged and credited to
+	// the collector, the proposer receives only the txn fee.
+	trans := s.Transition(1, pkProposer)
+	assert.NotNil(t, send(trans, 96+flatFee, 0))
+	assert.Nil(t, send(trans, 20, 0))
+	assert.Equal(t, flatFee, trans.(*Transition).fee)
+	s = trans.Commit().(*State)
+	assert.Equal(t, 75+flatFee, s.Account(addr).Balance(0).Available)
+	assert.Equal(t, 20, int(s.Account(pkTo.Addr()).Balance(0).Available))
+	assert.Equal(t, 5, int(s.Account(pkCollector.Addr()).Balance(0).Available))
+	assert.Equal(t, flatFee, s.Account(pkProposer.Addr()).Balance(0).Available)
+
+	// sending to the existing account, no fee is charged.
+	trans = s.Transition(2, pkProposer)
+	assert.Nil(t, send(trans, 20, 1))
+	s = trans.Commit().(*State)
+	assert.Equal(t, 55, int(s.Account(addr).Balance(0).Available))
+	assert.Equal(t, 40, int(s.Account(pkTo.Addr()).Balance(0).Available))
+	assert.Equal(t, 5, int(s.Account(pkCollector.Addr()).Balance(0).Available))
+	assert.Equal(t, 2*flatFee, s.Account(pkProposer.Addr()).Balance(0).Available)
+}
+
+func TestTxnValidUntilRound(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100})
+	pker := &myPKer{m: map[consensus.Addr]PK{addr: pk}}
+
+	pkTo, _ := RandKeyPair()
+	b, err := SetValidUntilRound(sk, MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 0), 2)
+	if err != nil {
+		panic(err)
+	}
+
+	pt, err := parseTxn(b, pker)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, uint64(2), pt.ValidUntilRound)
+
+	// expired before inclusion
+	trans := s.Transition(3, nil)
+	assert.NotNil(t, trans.Record(pt))
+
+	trans = s.Transition(2, nil)
+	assert.Nil(t, trans.Record(pt))
+	s = trans.Commit().(*State)
+	assert.Equal(t, 20, int(s.Account(pkTo.Addr()).Balance(0).Available))
+}
+
+// recordOrder records the order placed by the account in the
+// transition.
+func recordOrder(trans consensus.Transition, pker pker, sk SK, pk PK, nonce uint64, market MarketSymbol, sellSide bool, quant, price uint64) error {
+	order := PlaceOrderTxn{
+		SellSide: sellSide,
+		Quant:    quant,
+		Price:    price,
+		Market:   market,
+	}
+	pt, err := parseTxn(MakePlaceOrderTxn(sk, pk.Addr(), order, nonce), pker)
+	if err != nil {
+		panic(err)
+	}
+	return trans.Record(pt)
+}
+
+func TestBlockCostBudget(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.SetMaxBlockCost(3 * sendTokenCost)
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100 + 4*flatFee})
+	pker := &myPKer{m: map[consensus.Addr]PK{addr: pk}}
+	pkTo, _ := RandKeyPair()
+
+	var txns [][]byte
+	for i := 0; i < 4; i++ {
+		txns = append(txns, MakeSendTokenTxn(sk, addr, pkTo, 0, 20, uint64(i)))
+	}
+
+	// fill the block to the cost budget.
+	trans := s.Transition(1, nil)
+	for _, txn := range txns[:3] {
+		pt, err := parseTxn(txn, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		assert.Nil(t, trans.Record(pt))
+	}
+
+	pt, err := parseTxn(txns[3], pker)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, consensus.ErrBlockCostExceeded, trans.Record(pt))
+	newState := trans.Commit().(*State)
+	assert.Equal(t, 40+4*flatFee, newState.Account(addr).Balance(0).Available)
+	assert.Equal(t, uint64(3), newState.Account(addr).Nonce())
+
+	body, err := rlp.EncodeToBytes(txns[:3])
+	if err != nil {
+		panic(err)
+	}
+
+	_, count, err := s.CommitTxns(body, NewTxnPool(pker), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	// the block with the overflowing txn is invalid.
+	body, err = rlp.EncodeToBytes(txns)
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, err = s.CommitTxns(body, NewTxnPool(pker), 1)
+	assert.Equal(t, consensus.ErrBlockCostExceeded, err)
+
+	// the executions of an order sweeping the book are bounded by
+	// the remaining budget before matching.
+	s = NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	s.SetMaxBlockCost(5*placeOrderCost + placeOrderCost + 2*3*matchCost)
+	pkSell, skSell := RandKeyPair()
+	pkBuy, skBuy := RandKeyPair()
+	s.NewAccount(pkSell).UpdateBalance(0, Balance{Available: 100})
+	s.NewAccount(pkBuy).UpdateBalance(1, Balance{Available: 100})
+	pker = &myPKer{m: map[consensus.Addr]PK{pkSell.Addr(): pkSell, pkBuy.Addr(): pkBuy}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+	unit := uint64(math.Pow10(OrderPriceDecimals))
+
+	trans = s.Transition(1, nil)
+	for i := uint64(0); i < 5; i++ {
+		assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, i, market, true, 1, unit))
+	}
+
+	// sweeping all 5 resting orders exceeds the budget, the
+	// order changes nothing.
+	assert.Equal(t, consensus.ErrBlockCostExceeded, recordOrder(trans, pker, skBuy, pkBuy, 0, market, false, 5, unit))
+	assert.Equal(t, uint64(5*placeOrderCost), trans.(*Transition).cost)
+	assert.Equal(t, uint64(100), s.Account(pkBuy.Addr()).Balance(1).Available)
+	assert.Equal(t, uint64(0), s.Account(pkBuy.Addr()).Balance(1).Pending)
+
+	// sweeping 3 resting orders fits exactly.
+	assert.Nil(t, recordOrder(trans, pker, skBuy, pkBuy, 0, market, false, 3, unit))
+	assert.Equal(t, s.maxBlockCost, trans.(*Transition).cost)
+	newState = trans.Commit().(*State)
+	assert.Equal(t, uint64(3), newState.Account(pkBuy.Addr()).Balance(0).Available)
+}
+
+func TestRecordSerializedAdmitted(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100 + 2*flatFee})
+	pker := &myPKer{m: map[consensus.Addr]PK{addr: pk}}
+	pkTo, _ := RandKeyPair()
+	txns := [][]byte{
+		MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 0),
+		MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 1),
+	}
+	body, err := rlp.EncodeToBytes(txns)
+	if err != nil {
+		panic(err)
+	}
+
+	pool := NewTxnPool(pker)
+	_, added := pool.Add(txns[0])
+	assert.True(t, added)
+
+	count, admitted, err := s.Transition(1, nil).(*Transition).RecordSerializedAdmitted(body, pool)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, []consensus.Hash{consensus.SHA3(txns[1])}, admitted)
+
+	// the same body is recorded again, no txn is newly admitted.
+	count, admitted, err = s.Transition(1, nil).(*Transition).RecordSerializedAdmitted(body, pool)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 0, len(admitted))
+}
+
+func TestStrictProposals(t *testing.T) {
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	pker := &myPKer{m: map[consensus.Addr]PK{addr: pk}}
+	pkTo, _ := RandKeyPair()
+	txns := [][]byte{
+		MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 0),
+		// not a txn.
+		{1, 2, 3},
+		// the nonce is too big.
+		MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 5),
+		MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 1),
+	}
+	body, err := rlp.EncodeToBytes(txns)
+	if err != nil {
+		panic(err)
+	}
+
+	newState := func(strict bool) *State {
+		s := NewState(ethdb.NewMemDatabase())
+		s.SetStrictProposals(strict)
+		s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100 + 2*flatFee})
+		return s
+	}
+
+	_, _, err = newState(true).CommitTxns(body, NewTxnPool(pker), 1)
+	assert.NotNil(t, err)
+
+	s, count, err := newState(false).CommitTxns(body, NewTxnPool(pker), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	acc := s.(*State).Account(addr)
+	assert.Equal(t, uint64(60), acc.Balance(0).Available)
+	assert.Equal(t, uint64(2), acc.Nonce())
+	assert.Equal(t, uint64(40), s.(*State).Account(pkTo.Addr()).Balance(0).Available)
+
+	// the setting is inherited by the derived states.
+	_, _, err = s.(*State).CommitTxns(body, NewTxnPool(pker), 2)
+	assert.Nil(t, err)
+}
+
+func TestRecordSerializedStalePool(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100 + 2*flatFee})
+	pkTo, skTo := RandKeyPair()
+	txns := [][]byte{
+		MakeSendTokenTxn(sk, addr, pkTo, 0, 20+flatFee, 0),
+		// the owner is created by the txn above, in the
+		// same block.
+		MakeSendTokenTxn(skTo, pkTo.Addr(), pk, 0, 10, 0),
+	}
+	body, err := rlp.EncodeToBytes(txns)
+	if err != nil {
+		panic(err)
+	}
+
+	// the pool does not know the owner of the second txn.
+	pool := NewTxnPool(&myPKer{m: map[consensus.Addr]PK{addr: pk}})
+	trans := s.Transition(1, nil).(*Transition)
+	count, _, err := trans.RecordSerializedAdmitted(body, pool)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	s1 := trans.Commit().(*State)
+	assert.Equal(t, uint64(1), s1.Account(pkTo.Addr()).Nonce())
+}
+
+func TestDecodeBody(t *testing.T) {
+	txns := [][]byte{{1}, {2, 3}, {4}}
+	blob, err := rlp.EncodeToBytes(txns)
+	if err != nil {
+		panic(err)
+	}
+
+	// at the size and the count boundaries.
+	decoded, err := decodeBody(blob, len(blob), len(txns))
+	assert.Nil(t, err)
+	assert.Equal(t, txns, decoded)
+	_, err = decodeBody(blob, len(blob)-1, 0)
+	assert.NotNil(t, err)
+	_, err = decodeBody(blob, 0, len(txns)-1)
+	assert.NotNil(t, err)
+
+	// a small body of many empty txns.
+	bomb, err := rlp.EncodeToBytes(make([][]byte, 100000))
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = decodeBody(bomb, 0, 1000)
+	assert.NotNil(t, err)
+
+	s := NewState(ethdb.NewMemDatabase())
+	s.SetMaxBody(0, 1000)
+	_, err = s.Transition(1, nil).(*Transition).RecordSerialized(bomb, NewTxnPool(s))
+	assert.NotNil(t, err)
+}
+
 func TestFreezeToken(t *testing.T) {
 	s := NewState(ethdb.NewMemDatabase())
 	pk, sk := RandKeyPair()
@@ -119,6 +462,93 @@ func TestIssueToken(t *testing.T) {
 	assert.Equal(t, 0, len(acc.Balance(1).Frozen))
 }
 
+func TestIssueTokenAndPlaceOrder(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	pkIssuer, skIssuer := RandKeyPair()
+	pkBuy, skBuy := RandKeyPair()
+	s.NewAccount(pkIssuer)
+	s.NewAccount(pkBuy).UpdateBalance(0, Balance{Available: 1000})
+	pker := &myPKer{m: map[consensus.Addr]PK{
+		pkIssuer.Addr(): pkIssuer,
+		pkBuy.Addr():    pkBuy,
+	}}
+
+	record := func(round uint64, b []byte) error {
+		trans := s.Transition(round, nil)
+		pt, err := parseTxn(b, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		err = trans.Record(pt)
+		if err != nil {
+			return err
+		}
+
+		s = trans.Commit().(*State)
+		return nil
+	}
+
+	info := TokenInfo{Symbol: "XYZ", Decimals: 8, TotalUnits: 500}
+	assert.Nil(t, record(1, MakeIssueTokenTxn(skIssuer, pkIssuer.Addr(), info, 0)))
+	_, ok := s.TokenBySymbol("ABC")
+	assert.False(t, ok)
+	token, ok := s.TokenBySymbol("xyz")
+	assert.True(t, ok)
+	assert.Equal(t, TokenID(1), token.ID)
+	assert.Equal(t, info, token.TokenInfo)
+
+	// the new token is traded against the native coin.
+	market := MarketSymbol{Base: token.ID, Quote: 0}
+	price := 2 * uint64(math.Pow10(OrderPriceDecimals))
+	sell := PlaceOrderTxn{SellSide: true, Quant: 100, Price: price, Market: market}
+	assert.Nil(t, record(2, MakePlaceOrderTxn(skIssuer, pkIssuer.Addr(), sell, 1)))
+	buy := PlaceOrderTxn{Quant: 100, Price: price, Market: market}
+	assert.Nil(t, record(3, MakePlaceOrderTxn(skBuy, pkBuy.Addr(), buy, 0)))
+
+	issuer := s.Account(pkIssuer.Addr())
+	assert.Equal(t, 400, int(issuer.Balance(token.ID).Available))
+	assert.Equal(t, 200, int(issuer.Balance(0).Available))
+	buyer := s.Account(pkBuy.Addr())
+	assert.Equal(t, 100, int(buyer.Balance(token.ID).Available))
+	assert.Equal(t, 800, int(buyer.Balance(0).Available))
+	trade, ok := s.LastTrade(market)
+	assert.True(t, ok)
+	assert.Equal(t, price, trade.Price)
+}
+
+func TestIssueTokenDuplicateSymbol(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	s.NewAccount(pk)
+	pker := &myPKer{m: map[consensus.Addr]PK{addr: pk}}
+	issue := func(trans consensus.Transition, symbol TokenSymbol, nonce uint64) error {
+		info := TokenInfo{Symbol: symbol, Decimals: 8, TotalUnits: 100}
+		pt, err := parseTxn(MakeIssueTokenTxn(sk, addr, info, nonce), pker)
+		if err != nil {
+			panic(err)
+		}
+		return trans.Record(pt)
+	}
+
+	trans := s.Transition(1, nil)
+	assert.NotNil(t, issue(trans, "bnb", 0))
+	assert.Nil(t, issue(trans, "BTC", 0))
+	// duplicate in the same transition
+	assert.NotNil(t, issue(trans, "Btc", 1))
+	s = trans.Commit().(*State)
+
+	// duplicate of a committed token
+	trans = s.Transition(2, nil)
+	assert.NotNil(t, issue(trans, "btc", 1))
+	assert.Nil(t, issue(trans, "ETH", 1))
+	s = trans.Commit().(*State)
+	assert.Equal(t, 3, len(s.Tokens()))
+}
+
 func TestOrderAlreadyExpired(t *testing.T) {
 	s := NewState(ethdb.NewMemDatabase())
 	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
@@ -300,6 +730,102 @@ func TestMinerFee(t *testing.T) {
 	assert.Equal(t, root, newState0.Hash())
 }
 
+func TestPruneAccounts(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pkDust, skDust := RandKeyPair()
+	pkOrder, skOrder := RandKeyPair()
+	pkTo, _ := RandKeyPair()
+	s.NewAccount(pkDust).UpdateBalance(0, Balance{Available: 20 + flatFee})
+	s.NewAccount(pkOrder).UpdateBalance(0, Balance{Available: 20 + flatFee})
+	s.CommitCache()
+	pker := &myPKer{m: map[consensus.Addr]PK{
+		pkDust.Addr():  pkDust,
+		pkOrder.Addr(): pkOrder,
+	}}
+
+	miner, _ := RandKeyPair()
+	trans := s.Transition(1, miner)
+	record := func(b []byte) {
+		pt, err := parseTxn(b, pker)
+		if err != nil {
+			panic(err)
+		}
+		assert.Nil(t, trans.Record(pt))
+	}
+
+	// the dust account sends all its balance away.
+	record(MakeSendTokenTxn(skDust, pkDust.Addr(), pkTo, 0, 20, 0))
+	// the other account places an order with all its balance.
+	record(MakePlaceOrderTxn(skOrder, pkOrder.Addr(), PlaceOrderTxn{
+		SellSide: true,
+		Quant:    20,
+		Price:    1,
+		Market:   MarketSymbol{Base: 0, Quote: 1},
+	}, 0))
+
+	body := trans.Txns()
+	newState := trans.Commit().(*State)
+	assert.Nil(t, newState.Account(pkDust.Addr()))
+	// the nonce is kept, so the pruned account's txns can not
+	// be replayed.
+	assert.Equal(t, uint64(1), newState.Nonce(pkDust.Addr()))
+	assert.NotNil(t, newState.Account(pkOrder.Addr()))
+	assert.NotNil(t, newState.Account(pkTo.Addr()))
+
+	// the validators prune the same accounts.
+	replayed, _, err := s.CommitTxns(body, NewTxnPool(pker), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, newState.Hash(), replayed.Hash())
+
+	// pruning the account with an open order is rejected.
+	var txns [][]byte
+	err = rlp.DecodeBytes(body, &txns)
+	if err != nil {
+		panic(err)
+	}
+	prune := Txn{T: PruneAccounts, Data: gobEncode(PruneAccountsTxn{Addrs: []consensus.Addr{pkOrder.Addr()}})}
+	txns[len(txns)-1] = prune.Encode(true)
+	body, err = rlp.EncodeToBytes(txns)
+	if err != nil {
+		panic(err)
+	}
+	_, _, err = s.CommitTxns(body, NewTxnPool(pker), 1)
+	assert.NotNil(t, err)
+}
+
+func TestTxnFromUnknownAccount(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	s.CommitCache()
+	pk, sk := RandKeyPair()
+	b := MakePlaceOrderTxn(sk, pk.Addr(), PlaceOrderTxn{
+		SellSide: true,
+		Quant:    20,
+		Price:    1,
+		Market:   MarketSymbol{Base: 0, Quote: 1},
+	}, 0)
+
+	_, err := parseTxn(b, s)
+	assert.Equal(t, ErrUnknownAccount, err)
+
+	pt, err := parseTxn(b, &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}})
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, ErrUnknownAccount, s.Transition(1, nil).Record(pt))
+
+	body, err := rlp.EncodeToBytes([][]byte{b})
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, err = s.CommitTxns(body, NewTxnPool(s), 1)
+	assert.Equal(t, ErrUnknownAccount, err)
+}
+
 func TestBurnToken(t *testing.T) {
 	const burn = 1000
 	s := NewState(ethdb.NewMemDatabase())
@@ -429,6 +955,763 @@ func TestPlaceOrder(t *testing.T) {
 	assert.Equal(t, 40, int(po.Quant))
 }
 
+func TestTimeInForce(t *testing.T) {
+	market := MarketSymbol{Quote: 1, Base: 0}
+	price := 2 * uint64(math.Pow10(OrderPriceDecimals))
+	pkSell, skSell := RandKeyPair()
+	pkBuy, skBuy := RandKeyPair()
+	pker := &myPKer{m: map[consensus.Addr]PK{
+		pkBuy.Addr():  pkBuy,
+		pkSell.Addr(): pkSell,
+	}}
+
+	record := func(s *State, round uint64, b []byte) (*State, error) {
+		trans := s.Transition(round, nil)
+		pt, err := parseTxn(b, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		err = trans.Record(pt)
+		if err != nil {
+			return nil, err
+		}
+
+		return trans.Commit().(*State), nil
+	}
+
+	// the book only has a sell order of 30.
+	shallowBook := func() *State {
+		s := NewState(ethdb.NewMemDatabase())
+		s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+		s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+		s.NewAccount(pkSell).UpdateBalance(0, Balance{Available: 100})
+		s.NewAccount(pkBuy).UpdateBalance(1, Balance{Available: 200})
+		sell := PlaceOrderTxn{SellSide: true, Quant: 30, Price: price, Market: market}
+		s, err := record(s, 1, MakePlaceOrderTxn(skSell, pkSell.Addr(), sell, 0))
+		assert.Nil(t, err)
+		return s
+	}
+
+	buy := func(s *State, quant uint64, tif TimeInForce) (*State, error) {
+		order := PlaceOrderTxn{Quant: quant, Price: price, Market: market, ExpireRound: 10, TimeInForce: tif}
+		return record(s, 2, MakePlaceOrderTxn(skBuy, pkBuy.Addr(), order, 0))
+	}
+
+	// the unfilled 20 rests on the book.
+	s, err := buy(shallowBook(), 50, GoodTillCancel)
+	assert.Nil(t, err)
+	acc := s.Account(pkBuy.Addr())
+	assert.Equal(t, 30, int(acc.Balance(0).Available))
+	assert.Equal(t, 100, int(acc.Balance(1).Available))
+	assert.Equal(t, 40, int(acc.Balance(1).Pending))
+	assert.Equal(t, 1, len(acc.PendingOrders()))
+	_, filled, err := s.PriceImpact(market, true, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, int(filled))
+
+	// the unfilled 20 is canceled.
+	s, err = buy(shallowBook(), 50, ImmediateOrCancel)
+	assert.Nil(t, err)
+	acc = s.Account(pkBuy.Addr())
+	assert.Equal(t, 30, int(acc.Balance(0).Available))
+	assert.Equal(t, 140, int(acc.Balance(1).Available))
+	assert.Equal(t, 0, int(acc.Balance(1).Pending))
+	assert.Equal(t, 0, len(acc.PendingOrders()))
+	assert.Equal(t, 1, len(acc.ExecutionReports()))
+	_, filled, err = s.PriceImpact(market, true, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, int(filled))
+	assert.Equal(t, 0, len(s.GetOrderExpirations(10)))
+
+	// nothing is filled if the order can not be fully filled.
+	book := shallowBook()
+	root := book.Hash()
+	_, err = buy(book, 50, FillOrKill)
+	assert.Equal(t, ErrOrderNotFillable, err)
+	assert.Equal(t, root, book.Hash())
+	acc = book.Account(pkBuy.Addr())
+	assert.Equal(t, 200, int(acc.Balance(1).Available))
+	assert.Equal(t, 0, int(acc.Balance(1).Pending))
+	assert.Equal(t, uint64(0), acc.Nonce())
+
+	s, err = buy(book, 30, FillOrKill)
+	assert.Nil(t, err)
+	acc = s.Account(pkBuy.Addr())
+	assert.Equal(t, 30, int(acc.Balance(0).Available))
+	assert.Equal(t, 140, int(acc.Balance(1).Available))
+	assert.Equal(t, 0, int(acc.Balance(1).Pending))
+	assert.Equal(t, 0, len(acc.PendingOrders()))
+	_, filled, err = s.PriceImpact(market, false, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, int(filled))
+}
+
+func TestLastTrade(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pkSell, skSell := RandKeyPair()
+	pkBuy, skBuy := RandKeyPair()
+	s.NewAccount(pkSell).UpdateBalance(0, Balance{Available: 100})
+	s.NewAccount(pkBuy).UpdateBalance(1, Balance{Available: 200})
+	pker := &myPKer{m: map[consensus.Addr]PK{
+		pkBuy.Addr():  pkBuy,
+		pkSell.Addr(): pkSell,
+	}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+	unit := uint64(math.Pow10(OrderPriceDecimals))
+
+	// the placement does not set the last trade.
+	trans := s.Transition(1, nil)
+	assert.Nil(t, recordOrder(trans, pker, skBuy, pkBuy, 0, market, false, 40, 2*unit))
+	s1 := trans.Commit().(*State)
+	_, ok := s1.LastTrade(market)
+	assert.False(t, ok)
+	_, ok = s1.LastPrice(market)
+	assert.False(t, ok)
+
+	trans = s1.Transition(2, nil)
+	assert.Nil(t, recordOrder(trans, pker, skBuy, pkBuy, 1, market, false, 20, 3*unit))
+	// 20 fill at 3.0, then 35 fill at 2.0
+	assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, 0, market, true, 55, 2*unit))
+	s2 := trans.Commit().(*State)
+	trade, ok := s2.LastTrade(market)
+	assert.True(t, ok)
+	assert.Equal(t, Trade{Round: 2, Price: 2 * unit, Quant: 35, TakerSellSide: true}, trade)
+	price, ok := s2.LastPrice(market)
+	assert.True(t, ok)
+	assert.Equal(t, 2*unit, price)
+
+	trans = s2.Transition(3, nil)
+	assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, 1, market, true, 5, 2*unit))
+	// the placement not crossing the book keeps the last trade.
+	assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, 2, market, true, 10, 3*unit))
+	s3 := trans.Commit().(*State)
+	trade, ok = s3.LastTrade(market)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), trade.Round)
+	assert.Equal(t, uint64(5), trade.Quant)
+	price, ok = s3.LastPrice(market)
+	assert.True(t, ok)
+	assert.Equal(t, 2*unit, price)
+
+	// the trade of a previous state is not changed.
+	trade, ok = s2.LastTrade(market)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), trade.Round)
+	_, ok = s3.LastTrade(MarketSymbol{Quote: 0, Base: 1})
+	assert.False(t, ok)
+
+	// the last trade is part of the state root.
+	h := s3.Hash()
+	s3.UpdateLastTrade(market, Trade{Round: 3, Price: 3 * unit, Quant: 10})
+	assert.NotEqual(t, h, s3.Hash())
+}
+
+func TestPriceBandHalt(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pkSell, skSell := RandKeyPair()
+	pkBuy, skBuy := RandKeyPair()
+	s.NewAccount(pkSell).UpdateBalance(0, Balance{Available: 100})
+	s.NewAccount(pkBuy).UpdateBalance(1, Balance{Available: 10000})
+	pker := &myPKer{m: map[consensus.Addr]PK{
+		pkBuy.Addr():  pkBuy,
+		pkSell.Addr(): pkSell,
+	}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+	unit := uint64(math.Pow10(OrderPriceDecimals))
+	s.UpdateMarketConfig(market, MarketConfig{PriceBandPercent: 10})
+	s.UpdateLastTrade(market, Trade{Round: 1, Price: 10 * unit, Quant: 1})
+
+	// the trade of round 3 is not finalized in round 4, the
+	// reference is still the trade of round 1.
+	s.UpdateLastTrade(market, Trade{Round: 3, Price: 20 * unit, Quant: 1})
+	trans := s.Transition(4, nil)
+	// within the band, the trade proceeds.
+	assert.Nil(t, recordOrder(trans, pker, skBuy, pkBuy, 0, market, false, 10, 10*unit+unit/2))
+	assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, 0, market, true, 10, 10*unit+unit/2))
+	assert.False(t, trans.(*Transition).halted[market])
+
+	// the buy order would trade at 12 outside of the band, it is
+	// recorded but dropped without trading, and the market is
+	// halted.
+	assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, 1, market, true, 10, 12*unit))
+	assert.Nil(t, recordOrder(trans, pker, skBuy, pkBuy, 1, market, false, 10, 13*unit))
+	assert.True(t, trans.(*Transition).halted[market])
+	assert.NotNil(t, recordOrder(trans, pker, skBuy, pkBuy, 2, market, false, 1, 9*unit))
+	s2 := trans.Commit().(*State)
+	buyer := s2.Account(pkBuy.Addr())
+	assert.Equal(t, 0, len(buyer.PendingOrders()))
+	assert.Equal(t, uint64(2), buyer.Nonce())
+	assert.Equal(t, uint64(0), buyer.Balance(1).Pending)
+	orders := s2.Account(pkSell.Addr()).PendingOrders()
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, 12*unit, orders[0].Price)
+	trade, ok := s2.LastTrade(market)
+	assert.True(t, ok)
+	assert.Equal(t, 10*unit+unit/2, trade.Price)
+
+	// the halt lasts for the rest of the round only. The trade of
+	// round 4 is not finalized in round 5 either, the buy order
+	// at the signed price 13 still trades outside of the band.
+	trans = s2.Transition(5, nil)
+	assert.Nil(t, recordOrder(trans, pker, skBuy, pkBuy, 2, market, false, 1, 13*unit))
+	assert.True(t, trans.(*Transition).halted[market])
+	assert.Equal(t, uint64(0), trans.(*Transition).state.Account(pkBuy.Addr()).Balance(1).Pending)
+
+	// the trade at 10.5 of round 4 is finalized in round 7, the
+	// ask at 12 is outside of its band as well.
+	trans = s2.Transition(7, nil)
+	assert.Nil(t, recordOrder(trans, pker, skBuy, pkBuy, 2, market, false, 1, 11*unit))
+	assert.False(t, trans.(*Transition).halted[market])
+	ref, ok := trans.(*Transition).bandRef(market)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), ref.Round)
+	s3 := trans.Commit().(*State)
+	assert.Equal(t, 1, len(s3.Account(pkBuy.Addr()).PendingOrders()))
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	unit := uint64(math.Pow10(OrderPriceDecimals))
+	market := MarketSymbol{Quote: 1, Base: 0}
+
+	for _, stp := range []SelfTradePrevention{SkipSelfTrade, CancelRestingSelfTrade} {
+		s := NewState(ethdb.NewMemDatabase())
+		s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+		s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+		pkSelf, skSelf := RandKeyPair()
+		pkOther, skOther := RandKeyPair()
+		self := s.NewAccount(pkSelf)
+		self.UpdateBalance(0, Balance{Available: 100})
+		self.UpdateBalance(1, Balance{Available: 1000})
+		s.NewAccount(pkOther).UpdateBalance(0, Balance{Available: 100})
+		pker := &myPKer{m: map[consensus.Addr]PK{
+			pkSelf.Addr():  pkSelf,
+			pkOther.Addr(): pkOther,
+		}}
+		s.UpdateMarketConfig(market, MarketConfig{SelfTradePrevention: stp})
+
+		// the buy order crosses the ask of the same owner at
+		// price 10 before the ask of the other owner at 11.
+		trans := s.Transition(1, nil)
+		assert.Nil(t, recordOrder(trans, pker, skSelf, pkSelf, 0, market, true, 10, 10*unit))
+		assert.Nil(t, recordOrder(trans, pker, skOther, pkOther, 0, market, true, 10, 11*unit))
+		assert.Nil(t, recordOrder(trans, pker, skSelf, pkSelf, 1, market, false, 10, 11*unit))
+		s1 := trans.Commit().(*State)
+
+		acc := s1.Account(pkSelf.Addr())
+		other := s1.Account(pkOther.Addr())
+		// the buy order is filled by the other owner in both
+		// policies.
+		assert.Equal(t, uint64(0), other.Balance(0).Pending, "%v", stp)
+		assert.Equal(t, uint64(90), other.Balance(0).Available, "%v", stp)
+		assert.Equal(t, uint64(110), other.Balance(1).Available, "%v", stp)
+		assert.Equal(t, uint64(890), acc.Balance(1).Available, "%v", stp)
+		assert.Equal(t, uint64(0), acc.Balance(1).Pending, "%v", stp)
+
+		orders := acc.PendingOrders()
+		if stp == SkipSelfTrade {
+			// the ask keeps resting with its balance
+			// pending.
+			assert.Equal(t, 1, len(orders))
+			assert.True(t, orders[0].SellSide)
+			assert.Equal(t, uint64(10), acc.Balance(0).Pending)
+			assert.Equal(t, uint64(100), acc.Balance(0).Available)
+
+			// the buy order crossing the ask of the same
+			// owner is canceled instead of resting on a
+			// crossed order book, its balance refunded.
+			trans = s1.Transition(2, nil)
+			assert.Nil(t, recordOrder(trans, pker, skSelf, pkSelf, 2, market, false, 5, 11*unit))
+			s2 := trans.Commit().(*State)
+			acc = s2.Account(pkSelf.Addr())
+			assert.Equal(t, 1, len(acc.PendingOrders()))
+			assert.Equal(t, uint64(0), acc.Balance(1).Pending)
+			assert.Equal(t, uint64(890), acc.Balance(1).Available)
+			assert.Nil(t, s2.loadOrderBook(market).bidMax)
+		} else {
+			// the ask is canceled and its balance
+			// refunded.
+			assert.Equal(t, 0, len(orders))
+			assert.Equal(t, uint64(0), acc.Balance(0).Pending)
+			assert.Equal(t, uint64(110), acc.Balance(0).Available)
+		}
+	}
+}
+
+func TestPriceLevelRounding(t *testing.T) {
+	unit := uint64(math.Pow10(OrderPriceDecimals))
+	market := MarketSymbol{Quote: 1, Base: 0}
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pk, sk := RandKeyPair()
+	acc := s.NewAccount(pk)
+	acc.UpdateBalance(0, Balance{Available: 100})
+	acc.UpdateBalance(1, Balance{Available: 1000})
+	pker := &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}}
+	s.UpdateMarketConfig(market, MarketConfig{MaxPriceLevels: 2, RoundToExistingLevel: true})
+
+	trans := s.Transition(1, nil)
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 0, market, false, 10, 10*unit))
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 1, market, false, 10, 12*unit))
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 2, market, true, 10, 20*unit))
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 3, market, true, 10, 22*unit))
+	// the bid rounds down and the ask rounds up to the existing
+	// levels.
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 4, market, false, 10, 11*unit))
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 5, market, true, 10, 21*unit))
+	// there is no existing bid level below 9.
+	assert.NotNil(t, recordOrder(trans, pker, sk, pk, 6, market, false, 10, 9*unit))
+	s1 := trans.Commit().(*State)
+
+	book := s1.loadOrderBook(market)
+	assert.Equal(t, 12*unit, book.bidMax.Price)
+	assert.Equal(t, 10*unit, book.bidMax.NextPoint.Price)
+	assert.Nil(t, book.bidMax.NextPoint.NextPoint)
+	assert.Equal(t, 20*unit, book.askMin.Price)
+	assert.Equal(t, 22*unit, book.askMin.NextPoint.Price)
+	assert.Nil(t, book.askMin.NextPoint.NextPoint)
+
+	// the balance is locked at the rounded price.
+	acc = s1.Account(pk.Addr())
+	assert.Equal(t, uint64(100+120+100), acc.Balance(1).Pending)
+	assert.Equal(t, uint64(30), acc.Balance(0).Pending)
+
+	// without rounding, the order beyond the cap is rejected.
+	s1.UpdateMarketConfig(market, MarketConfig{MaxPriceLevels: 2})
+	trans = s1.Transition(2, nil)
+	assert.NotNil(t, recordOrder(trans, pker, sk, pk, 6, market, false, 10, 11*unit))
+	assert.NotNil(t, recordOrder(trans, pker, sk, pk, 6, market, true, 10, 21*unit))
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 6, market, false, 10, 10*unit))
+}
+
+func TestMarketSchedule(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pk, sk := RandKeyPair()
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100})
+	pker := &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+	s.UpdateMarketConfig(market, MarketConfig{OpenRound: 3, CloseRound: 5})
+
+	record := func(round uint64, b []byte) (*State, error) {
+		trans := s.Transition(round, nil)
+		pt, err := parseTxn(b, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		err = trans.Record(pt)
+		if err != nil {
+			return nil, err
+		}
+
+		return trans.Commit().(*State), nil
+	}
+
+	order := PlaceOrderTxn{SellSide: true, Quant: 1, Price: 1, Market: market}
+	// before the market opens.
+	_, err := record(2, MakePlaceOrderTxn(sk, pk.Addr(), order, 0))
+	assert.NotNil(t, err)
+
+	// within the window.
+	s, err = record(3, MakePlaceOrderTxn(sk, pk.Addr(), order, 0))
+	assert.Nil(t, err)
+	orders := s.Account(pk.Addr()).PendingOrders()
+	assert.Equal(t, 1, len(orders))
+
+	// after the market closes, the pending order can still be
+	// canceled.
+	_, err = record(5, MakePlaceOrderTxn(sk, pk.Addr(), order, 1))
+	assert.NotNil(t, err)
+	s, err = record(5, MakeCancelOrderTxn(sk, pk.Addr(), orders[0].ID, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(s.Account(pk.Addr()).PendingOrders()))
+}
+
+func TestMarketOrderSize(t *testing.T) {
+	pk, sk := RandKeyPair()
+	market := MarketSymbol{Base: 1, Quote: 0}
+	markets := []GenesisMarket{{Symbol: market, Config: MarketConfig{MinQuant: 10, PriceTick: 100}}}
+	s, err := CreateGenesisState([]PK{pk}, []TokenInfo{{Symbol: "BTC", Decimals: 8, TotalUnits: 10000000000}}, markets)
+	if err != nil {
+		panic(err)
+	}
+
+	pker := &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}}
+	root := s.Hash()
+	balance := s.Account(pk.Addr()).Balance(1).Available
+
+	record := func(order PlaceOrderTxn) (*State, error) {
+		trans := s.Transition(1, nil)
+		pt, err := parseTxn(MakePlaceOrderTxn(sk, pk.Addr(), order, 0), pker)
+		if err != nil {
+			panic(err)
+		}
+
+		err = trans.Record(pt)
+		return trans.Commit().(*State), err
+	}
+
+	// below the minimum quantity.
+	s0, err := record(PlaceOrderTxn{SellSide: true, Quant: 9, Price: 1000, Market: market})
+	assert.NotNil(t, err)
+	assert.Equal(t, root, s0.Hash())
+	assert.Equal(t, balance, s0.Account(pk.Addr()).Balance(1).Available)
+	assert.Equal(t, 0, len(s0.Account(pk.Addr()).PendingOrders()))
+
+	// the price is not a multiple of the tick size.
+	s0, err = record(PlaceOrderTxn{SellSide: true, Quant: 10, Price: 1050, Market: market})
+	assert.NotNil(t, err)
+	assert.Equal(t, root, s0.Hash())
+	assert.Equal(t, balance, s0.Account(pk.Addr()).Balance(1).Available)
+	assert.Equal(t, 0, len(s0.Account(pk.Addr()).PendingOrders()))
+
+	s0, err = record(PlaceOrderTxn{SellSide: true, Quant: 10, Price: 1000, Market: market})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(s0.Account(pk.Addr()).PendingOrders()))
+}
+
+func TestCancelPartiallyFilledOrder(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pkSell, skSell := RandKeyPair()
+	pkBuy, skBuy := RandKeyPair()
+	s.NewAccount(pkSell).UpdateBalance(0, Balance{Available: 100})
+	s.NewAccount(pkBuy).UpdateBalance(1, Balance{Available: 200})
+	pker := &myPKer{m: map[consensus.Addr]PK{
+		pkBuy.Addr():  pkBuy,
+		pkSell.Addr(): pkSell,
+	}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+
+	record := func(round uint64, b []byte) error {
+		trans := s.Transition(round, nil)
+		pt, err := parseTxn(b, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		err = trans.Record(pt)
+		if err != nil {
+			return err
+		}
+
+		s = trans.Commit().(*State)
+		return nil
+	}
+
+	price := 2 * uint64(math.Pow10(OrderPriceDecimals))
+	// buy 40, pending 40*2.
+	buy := PlaceOrderTxn{Quant: 40, Price: price, Market: market}
+	assert.Nil(t, record(1, MakePlaceOrderTxn(skBuy, pkBuy.Addr(), buy, 0)))
+	// sell 15, fills 15 of the buy order.
+	sell := PlaceOrderTxn{SellSide: true, Quant: 15, Price: price, Market: market}
+	assert.Nil(t, record(2, MakePlaceOrderTxn(skSell, pkSell.Addr(), sell, 0)))
+
+	buyAcc := s.Account(pkBuy.Addr())
+	orders := buyAcc.PendingOrders()
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, 15, int(orders[0].Executed))
+	assert.Equal(t, 50, int(buyAcc.Balance(1).Pending))
+	assert.Equal(t, 120, int(buyAcc.Balance(1).Available))
+
+	// only the pending balance of the remaining 25 is refunded.
+	assert.Nil(t, record(3, MakeCancelOrderTxn(skBuy, pkBuy.Addr(), orders[0].ID, 1)))
+	buyAcc = s.Account(pkBuy.Addr())
+	assert.Equal(t, 0, len(buyAcc.PendingOrders()))
+	assert.Equal(t, 0, int(buyAcc.Balance(1).Pending))
+	assert.Equal(t, 170, int(buyAcc.Balance(1).Available))
+	assert.Equal(t, 15, int(buyAcc.Balance(0).Available))
+	assert.Equal(t, uint64(2), buyAcc.Nonce())
+
+	// the order is canceled already, or never placed, the nonce
+	// is not consumed.
+	assert.NotNil(t, record(4, MakeCancelOrderTxn(skBuy, pkBuy.Addr(), orders[0].ID, 2)))
+	unknown := OrderID{ID: orders[0].ID.ID + 1, Market: market}
+	assert.NotNil(t, record(4, MakeCancelOrderTxn(skBuy, pkBuy.Addr(), unknown, 2)))
+	assert.Equal(t, uint64(2), s.Account(pkBuy.Addr()).Nonce())
+	assert.Equal(t, 170, int(s.Account(pkBuy.Addr()).Balance(1).Available))
+}
+
+func TestAccountOrdersPartialFill(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pkSell, skSell := RandKeyPair()
+	pkBuy, skBuy := RandKeyPair()
+	s.NewAccount(pkSell).UpdateBalance(0, Balance{Available: 100})
+	s.NewAccount(pkBuy).UpdateBalance(1, Balance{Available: 200})
+	pker := &myPKer{m: map[consensus.Addr]PK{
+		pkBuy.Addr():  pkBuy,
+		pkSell.Addr(): pkSell,
+	}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+
+	record := func(round uint64, b []byte) {
+		trans := s.Transition(round, nil)
+		pt, err := parseTxn(b, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		assert.Nil(t, trans.Record(pt))
+		s = trans.Commit().(*State)
+	}
+
+	price := 2 * uint64(math.Pow10(OrderPriceDecimals))
+	record(1, MakePlaceOrderTxn(skBuy, pkBuy.Addr(), PlaceOrderTxn{Quant: 40, Price: price, Market: market}, 0))
+	orders := s.AccountOrders(pkBuy.Addr())
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, OrderStatus{ID: orders[0].ID, Quant: 40, Remaining: 40}, orders[0])
+
+	sell := PlaceOrderTxn{SellSide: true, Quant: 15, Price: price, Market: market}
+	record(2, MakePlaceOrderTxn(skSell, pkSell.Addr(), sell, 0))
+	orders = s.AccountOrders(pkBuy.Addr())
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, OrderStatus{ID: orders[0].ID, Quant: 40, Executed: 15, Remaining: 25}, orders[0])
+	assert.Equal(t, 0, len(s.AccountOrders(pkSell.Addr())))
+
+	record(3, MakePlaceOrderTxn(skSell, pkSell.Addr(), sell, 1))
+	orders = s.AccountOrders(pkBuy.Addr())
+	assert.Equal(t, OrderStatus{ID: orders[0].ID, Quant: 40, Executed: 30, Remaining: 10}, orders[0])
+
+	// the fully filled order is not resting.
+	record(4, MakePlaceOrderTxn(skSell, pkSell.Addr(), sell, 2))
+	assert.Equal(t, 0, len(s.AccountOrders(pkBuy.Addr())))
+	orders = s.AccountOrders(pkSell.Addr())
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, uint64(10), orders[0].Executed)
+	assert.Equal(t, uint64(5), orders[0].Remaining)
+}
+
+func TestCancelAll(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 2, TokenInfo: BNBInfo})
+	pk, sk := RandKeyPair()
+	acc := s.NewAccount(pk)
+	for id := TokenID(0); id <= 2; id++ {
+		acc.UpdateBalance(id, Balance{Available: 1000})
+	}
+	pker := &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}}
+	m0 := MarketSymbol{Quote: 1, Base: 0}
+	m1 := MarketSymbol{Quote: 1, Base: 2}
+
+	var nonce uint64
+	record := func(b []byte) error {
+		trans := s.Transition(1, nil)
+		pt, err := parseTxn(b, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		err = trans.Record(pt)
+		if err != nil {
+			return err
+		}
+
+		s = trans.Commit().(*State)
+		nonce++
+		return nil
+	}
+
+	orders := []PlaceOrderTxn{
+		{SellSide: true, Quant: 10, Price: 2e8, Market: m0},
+		{SellSide: false, Quant: 10, Price: 1e8, Market: m0},
+		{SellSide: true, Quant: 10, Price: 2e8, Market: m1},
+		{SellSide: false, Quant: 10, Price: 1e8, Market: m1},
+	}
+	for _, o := range orders {
+		assert.Nil(t, record(MakePlaceOrderTxn(sk, pk.Addr(), o, nonce)))
+	}
+	assert.Equal(t, 4, len(s.Account(pk.Addr()).PendingOrders()))
+
+	// cancel all the orders in one market.
+	assert.Nil(t, record(MakeCancelAllTxn(sk, pk.Addr(), CancelAllTxn{Market: m0}, nonce)))
+	acc = s.Account(pk.Addr())
+	assert.Equal(t, uint64(5), acc.Nonce())
+	pending := acc.PendingOrders()
+	assert.Equal(t, 2, len(pending))
+	for _, o := range pending {
+		assert.Equal(t, m1, o.ID.Market)
+	}
+	assert.Equal(t, uint64(1000), acc.Balance(0).Available)
+	assert.Equal(t, uint64(0), acc.Balance(0).Pending)
+	// the quote token and the base token are still held by the
+	// orders in the other market.
+	for id := TokenID(1); id <= 2; id++ {
+		assert.Equal(t, uint64(990), acc.Balance(id).Available)
+		assert.Equal(t, uint64(10), acc.Balance(id).Pending)
+	}
+
+	// nothing to cancel in the market.
+	assert.NotNil(t, record(MakeCancelAllTxn(sk, pk.Addr(), CancelAllTxn{Market: m0}, nonce)))
+
+	// cancel all the orders in all the markets.
+	assert.Nil(t, record(MakeCancelAllTxn(sk, pk.Addr(), CancelAllTxn{AllMarkets: true}, nonce)))
+	acc = s.Account(pk.Addr())
+	assert.Equal(t, uint64(6), acc.Nonce())
+	assert.Equal(t, 0, len(acc.PendingOrders()))
+	for id := TokenID(0); id <= 2; id++ {
+		assert.Equal(t, uint64(1000), acc.Balance(id).Available)
+		assert.Equal(t, uint64(0), acc.Balance(id).Pending)
+	}
+}
+
+func TestUnknownMarket(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 2, TokenInfo: BNBInfo})
+	s.SetRequireMarketConfig(true)
+	pk, sk := RandKeyPair()
+	s.NewAccount(pk).UpdateBalance(0, Balance{Available: 100})
+	pker := &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}}
+	registered := MarketSymbol{Quote: 1, Base: 0}
+	s.UpdateMarketConfig(registered, MarketConfig{})
+
+	record := func(b []byte) error {
+		pt, err := parseTxn(b, pker)
+		if err != nil {
+			panic(err)
+		}
+
+		return s.Transition(1, nil).Record(pt)
+	}
+
+	order := PlaceOrderTxn{SellSide: true, Quant: 1, Price: 1, Market: MarketSymbol{Quote: 2, Base: 0}}
+	assert.Equal(t, ErrUnknownMarket, record(MakePlaceOrderTxn(sk, pk.Addr(), order, 0)))
+
+	order.Market = registered
+	assert.Nil(t, record(MakePlaceOrderTxn(sk, pk.Addr(), order, 0)))
+}
+
+func TestMaxOpenNotional(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	s.SetMaxOpenNotional(100)
+	pk, sk := RandKeyPair()
+	acc := s.NewAccount(pk)
+	acc.UpdateBalance(0, Balance{Available: 1000})
+	acc.UpdateBalance(1, Balance{Available: 1000})
+	pker := &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+	unit := uint64(math.Pow10(OrderPriceDecimals))
+
+	trans := s.Transition(1, nil)
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 0, market, false, 30, 2*unit))
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 1, market, false, 10, 2*unit))
+	s = trans.Commit().(*State)
+
+	// the limit is inherited, and the open orders of both sides
+	// count towards the limit: 80 + 8 * 2.5 = 100.
+	trans = s.Transition(2, nil)
+	assert.NotNil(t, recordOrder(trans, pker, sk, pk, 2, market, true, 11, 2*unit+unit/2))
+	assert.Nil(t, recordOrder(trans, pker, sk, pk, 2, market, true, 8, 2*unit+unit/2))
+	assert.NotNil(t, recordOrder(trans, pker, sk, pk, 3, market, false, 1, 2*unit))
+}
+
+func TestPlaceOrderFrozenAndHeld(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pk, sk := RandKeyPair()
+	acc := s.NewAccount(pk)
+	acc.UpdateBalance(0, Balance{Available: 10, Frozen: []Frozen{{AvailableRound: 3, Quant: 100}}})
+	acc.UpdateBalance(1, Balance{Available: 10, Pending: 100})
+	pker := &myPKer{m: map[consensus.Addr]PK{pk.Addr(): pk}}
+
+	trans := s.Transition(1, nil)
+	order := PlaceOrderTxn{
+		SellSide: true,
+		Quant:    20,
+		Price:    uint64(math.Pow10(OrderPriceDecimals)),
+		Market:   MarketSymbol{Quote: 1, Base: 0},
+	}
+	pt, err := parseTxn(MakePlaceOrderTxn(sk, pk.Addr(), order, 0), pker)
+	if err != nil {
+		panic(err)
+	}
+	assert.NotNil(t, trans.Record(pt))
+
+	order.SellSide = false
+	pt, err = parseTxn(MakePlaceOrderTxn(sk, pk.Addr(), order, 0), pker)
+	if err != nil {
+		panic(err)
+	}
+	assert.NotNil(t, trans.Record(pt))
+}
+
 func TestCalcQuoteQuant(t *testing.T) {
 	assert.Equal(t, 40, int(calcQuoteQuant(40, 8, uint64(math.Pow10(OrderPriceDecimals)), 8, 8)))
 }
+
+func TestTradeFeeTiers(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	s.UpdateToken(Token{ID: 0, TokenInfo: BNBInfo})
+	s.UpdateToken(Token{ID: 1, TokenInfo: BNBInfo})
+	pkSell, skSell := RandKeyPair()
+	pkBuy, skBuy := RandKeyPair()
+	collector, _ := RandKeyPair()
+	s.NewAccount(pkSell).UpdateBalance(0, Balance{Available: 2100})
+	s.NewAccount(pkBuy).UpdateBalance(1, Balance{Available: 2100})
+	pker := &myPKer{m: map[consensus.Addr]PK{
+		pkBuy.Addr():  pkBuy,
+		pkSell.Addr(): pkSell,
+	}}
+	market := MarketSymbol{Quote: 1, Base: 0}
+	unit := uint64(math.Pow10(OrderPriceDecimals))
+	s.UpdateMarketConfig(market, MarketConfig{
+		FeeTiers:        []FeeTier{{MinVolume: 0, FeeRate: 100}, {MinVolume: 1000, FeeRate: 50}},
+		FeeVolumeWindow: 10,
+		FeeCollector:    collector,
+	})
+
+	trans := s.Transition(1, nil)
+	assert.Nil(t, recordOrder(trans, pker, skBuy, pkBuy, 0, market, false, 2100, unit))
+	s = trans.Commit().(*State)
+
+	// the first fill crosses the tier boundary, the second fill
+	// in the same round is charged at the discounted rate.
+	trans = s.Transition(2, nil)
+	assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, 0, market, true, 1000, unit))
+	assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, 1, market, true, 1000, unit))
+	s = trans.Commit().(*State)
+
+	var fees []uint64
+	for _, r := range s.ExecutionReports(pkSell.Addr()) {
+		fees = append(fees, r.Fee)
+	}
+	assert.Equal(t, []uint64{10, 5}, fees)
+	fees = nil
+	for _, r := range s.ExecutionReports(pkBuy.Addr()) {
+		fees = append(fees, r.Fee)
+	}
+	assert.Equal(t, []uint64{10, 5}, fees)
+
+	assert.Equal(t, uint64(1985), s.Account(pkSell.Addr()).Balance(1).Available)
+	assert.Equal(t, uint64(1985), s.Account(pkBuy.Addr()).Balance(0).Available)
+	assert.Equal(t, uint64(15), s.Account(collector.Addr()).Balance(0).Available)
+	assert.Equal(t, uint64(15), s.Account(collector.Addr()).Balance(1).Available)
+	assert.Equal(t, TradeVolume{StartRound: 2, Volume: 2000}, s.TradeVolume(pkSell.Addr(), market))
+
+	// the volume is reset once the window passes.
+	trans = s.Transition(12, nil)
+	assert.Nil(t, recordOrder(trans, pker, skSell, pkSell, 2, market, true, 100, unit))
+	s = trans.Commit().(*State)
+	reports := s.ExecutionReports(pkSell.Addr())
+	assert.Equal(t, uint64(1), reports[len(reports)-1].Fee)
+	assert.Equal(t, TradeVolume{StartRound: 12, Volume: 100}, s.TradeVolume(pkSell.Addr(), market))
+	// the buyer's window started at round 2 as well.
+	reports = s.ExecutionReports(pkBuy.Addr())
+	assert.Equal(t, uint64(1), reports[len(reports)-1].Fee)
+}
@@ -24,6 +24,8 @@ const (
 	FreezeToken
 	BurnToken
 	MinerFee
+	PruneAccounts
+	CancelAll
 )
 
 type Txn struct {
@@ -31,7 +33,10 @@ type Txn struct {
 	Data  []byte
 	Nonce uint64
 	Owner consensus.Addr
-	Sig   Sig
+	// ValidUntilRound is the last round the txn can be included
+	// in, 0 means the txn never expires.
+	ValidUntilRound uint64
+	Sig             Sig
 }
 
 func (b *Txn) Encode(withSig bool) []byte {
@@ -62,6 +67,9 @@ type PlaceOrderTxn struct {
 	// the order is expired when ExpireRound >= block height
 	ExpireRound uint64
 	Market      MarketSymbol
+	// TimeInForce is how long the unfilled part of the order
+	// rests on the order book, the zero value is GoodTillCancel.
+	TimeInForce TimeInForce
 }
 
 func (p *PlaceOrderTxn) Encode() []byte {
@@ -74,7 +82,16 @@ func (p *PlaceOrderTxn) Encode() []byte {
 	n = binary.PutUvarint(b, p.ExpireRound)
 	buf.Write(b[:n])
 	buf.Write(p.Market.Encode())
-	if p.SellSide {
+	if p.TimeInForce != GoodTillCancel {
+		// the side is always written before the time in
+		// force, the GoodTillCancel orders are encoded the
+		// same as before the time in force is added.
+		side := byte(0)
+		if p.SellSide {
+			side = 1
+		}
+		buf.Write([]byte{side, byte(p.TimeInForce)})
+	} else if p.SellSide {
 		buf.Write([]byte{1})
 	}
 	return buf.Bytes()
@@ -100,9 +117,17 @@ func (p *PlaceOrderTxn) Decode(b []byte) error {
 	}
 
 	b = b[n:]
-	if len(b) == 1 {
+	switch len(b) {
+	case 0:
+	case 1:
 		t.SellSide = true
-	} else if len(b) > 1 {
+	case 2:
+		t.SellSide = b[0] == 1
+		t.TimeInForce = TimeInForce(b[1])
+		if b[0] > 1 || t.TimeInForce == GoodTillCancel || t.TimeInForce > FillOrKill {
+			return fmt.Errorf("invalid side and time in force: %d, %d", b[0], b[1])
+		}
+	default:
 		return fmt.Errorf("unexpected bytes remaining, count: %d", len(b))
 	}
 
@@ -114,6 +139,28 @@ type CancelOrderTxn struct {
 	ID OrderID
 }
 
+// CancelAllTxn cancels all the pending orders of the owner in the
+// market, or in all the markets if AllMarkets is true.
+type CancelAllTxn struct {
+	AllMarkets bool
+	Market     MarketSymbol
+}
+
+// SetValidUntilRound sets the last round the serialized txn can be
+// included in, and signs the txn again. 0 means the txn never
+// expires.
+func SetValidUntilRound(sk SK, b []byte, round uint64) ([]byte, error) {
+	var txn Txn
+	err := rlp.DecodeBytes(b, &txn)
+	if err != nil {
+		return nil, fmt.Errorf("error decode txn: %v", err)
+	}
+
+	txn.ValidUntilRound = round
+	txn.Sig = sk.Sign(txn.Encode(false))
+	return txn.Encode(true), nil
+}
+
 func MakeCancelOrderTxn(sk SK, owner consensus.Addr, id OrderID, nonce uint64) []byte {
 	t := CancelOrderTxn{
 		ID: id,
@@ -130,6 +177,18 @@ func MakeCancelOrderTxn(sk SK, owner consensus.Addr, id OrderID, nonce uint64) [
 	return txn.Encode(true)
 }
 
+func MakeCancelAllTxn(sk SK, owner consensus.Addr, t CancelAllTxn, nonce uint64) []byte {
+	txn := &Txn{
+		T:     CancelAll,
+		Owner: owner,
+		Nonce: nonce,
+		Data:  gobEncode(t),
+	}
+
+	txn.Sig = sk.Sign(txn.Encode(false))
+	return txn.Encode(true)
+}
+
 func MakeSendTokenTxn(from SK, owner consensus.Addr, to PK, tokenID TokenID, quant uint64, nonce uint64) []byte {
 	send := SendTokenTxn{
 		TokenID: tokenID,
@@ -202,6 +261,14 @@ type MinerFeeTxn struct {
 	Fee   uint64
 }
 
+// PruneAccountsTxn removes the accounts without balance and pending
+// order. It is created by the block proposer rather than signed by
+// an account, every validator checks the accounts are prunable when
+// replaying the block.
+type PruneAccountsTxn struct {
+	Addrs []consensus.Addr
+}
+
 type BurnTokenTxn struct {
 	ID    TokenID
 	Quant uint64
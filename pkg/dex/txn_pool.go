@@ -13,6 +13,8 @@ import (
 	log "github.com/helinwang/log15"
 )
 
+// pker returns the public key of the account, nil if the account
+// does not exist.
 type pker interface {
 	PK(addr consensus.Addr) PK
 }
@@ -51,9 +53,10 @@ func parseTxn(b []byte, pker pker) (*consensus.Txn, error) {
 	}
 
 	ret := &consensus.Txn{
-		Raw:   b,
-		Owner: txn.Owner,
-		Nonce: txn.Nonce,
+		Raw:             b,
+		Owner:           txn.Owner,
+		Nonce:           txn.Nonce,
+		ValidUntilRound: txn.ValidUntilRound,
 	}
 
 	switch txn.T {
@@ -72,6 +75,14 @@ func parseTxn(b []byte, pker pker) (*consensus.Txn, error) {
 			return nil, fmt.Errorf("CancelOrderTxn decode failed: %v", err)
 		}
 		ret.Decoded = &txn
+	case CancelAll:
+		dec := gob.NewDecoder(bytes.NewReader(txn.Data))
+		var txn CancelAllTxn
+		err := dec.Decode(&txn)
+		if err != nil {
+			return nil, fmt.Errorf("CancelAllTxn decode failed: %v", err)
+		}
+		ret.Decoded = &txn
 	case IssueToken:
 		dec := gob.NewDecoder(bytes.NewReader(txn.Data))
 		var txn IssueTokenTxn
@@ -104,6 +115,14 @@ func parseTxn(b []byte, pker pker) (*consensus.Txn, error) {
 			return nil, fmt.Errorf("BurnTokenTxn decode failed: %v", err)
 		}
 		ret.Decoded = &txn
+	case PruneAccounts:
+		dec := gob.NewDecoder(bytes.NewReader(txn.Data))
+		var txn PruneAccountsTxn
+		err := dec.Decode(&txn)
+		if err != nil {
+			return nil, fmt.Errorf("PruneAccountsTxn decode failed: %v", err)
+		}
+		ret.Decoded = &txn
 	case MinerFee:
 		dec := gob.NewDecoder(bytes.NewReader(txn.Data))
 		var txn MinerFeeTxn
@@ -117,8 +136,15 @@ func parseTxn(b []byte, pker pker) (*consensus.Txn, error) {
 		return nil, fmt.Errorf("unknown txn type: %v", txn.T)
 	}
 
-	if !ret.MinerFeeTxn && !txn.Sig.Verify(txn.Encode(false), pker.PK(txn.Owner)) {
-		return nil, fmt.Errorf("txn signature verification failed")
+	if !ret.MinerFeeTxn && txn.T != PruneAccounts {
+		pk := pker.PK(txn.Owner)
+		if pk == nil {
+			return nil, ErrUnknownAccount
+		}
+
+		if !txn.Sig.Verify(txn.Encode(false), pk) {
+			return nil, fmt.Errorf("txn signature verification failed")
+		}
 	}
 
 	return ret, nil
@@ -147,7 +173,7 @@ func (t *TxnPool) Add(b []byte) (*consensus.Txn, bool) {
 		return nil, false
 	}
 
-	if ret.MinerFeeTxn {
+	if _, prune := ret.Decoded.(*PruneAccountsTxn); ret.MinerFeeTxn || prune {
 		return ret, false
 	}
 
@@ -203,6 +229,66 @@ func (t *TxnPool) Remove(hash consensus.Hash) {
 	delete(t.txns, hash)
 }
 
+// RemoveExpired removes the txns that can not be included in the
+// given round, from both the pool and the cache, so an expired txn
+// is neither returned by Get nor taken back by Add.
+func (t *TxnPool) RemoveExpired(round uint64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := 0
+	for h, txn := range t.txns {
+		if txn.Expired(round) {
+			delete(t.txns, h)
+			t.cache.Remove(h)
+			count++
+		}
+	}
+	return count
+}
+
+// Reinject adds back the txns of the serialized block body, the txns
+// whose nonces are already used in the state are skipped.
+func (t *TxnPool) Reinject(b []byte, s consensus.State) int {
+	var txns [][]byte
+	err := rlp.DecodeBytes(b, &txns)
+	if err != nil {
+		log.Error("error decode txns in Reinject", "err", err)
+		return 0
+	}
+
+	state := s.(*State)
+	count := 0
+	for _, raw := range txns {
+		h := consensus.SHA3(raw)
+		txn := t.Get(h)
+		if txn == nil {
+			txn, err = parseTxn(raw, state)
+			if err != nil {
+				continue
+			}
+		}
+
+		if _, prune := txn.Decoded.(*PruneAccountsTxn); txn.MinerFeeTxn || prune {
+			continue
+		}
+
+		acc := state.Account(txn.Owner)
+		if acc == nil || txn.Nonce < acc.Nonce() {
+			continue
+		}
+
+		t.cache.Add(h, txn)
+		t.mu.Lock()
+		if _, ok := t.txns[h]; !ok {
+			t.txns[h] = txn
+			count++
+		}
+		t.mu.Unlock()
+	}
+	return count
+}
+
 func (t *TxnPool) RemoveTxns(b []byte) int {
 	var txns [][]byte
 	err := rlp.DecodeBytes(b, &txns)
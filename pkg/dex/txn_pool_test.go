@@ -0,0 +1,39 @@
+package dex
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/helinwang/dex/pkg/consensus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxnPoolReinject(t *testing.T) {
+	s := NewState(ethdb.NewMemDatabase())
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	acc := s.NewAccount(pk)
+	acc.UpdateBalance(0, Balance{Available: 100})
+	acc.IncrementNonce()
+	s.CommitCache()
+	pkTo, _ := RandKeyPair()
+	txns := [][]byte{
+		MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 0),
+		MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 1),
+	}
+	body, err := rlp.EncodeToBytes(txns)
+	if err != nil {
+		panic(err)
+	}
+
+	// the txn of the used nonce is not reinjected.
+	pool := NewTxnPool(s)
+	assert.Equal(t, 1, pool.Reinject(body, s))
+	assert.Equal(t, 1, pool.Size())
+	assert.NotNil(t, pool.Get(consensus.SHA3(txns[1])))
+	assert.True(t, pool.NotSeen(consensus.SHA3(txns[0])))
+
+	// the txn already in the pool is not counted again.
+	assert.Equal(t, 0, pool.Reinject(body, s))
+}
@@ -43,4 +43,51 @@ func TestPlaceOrderEncodeDecode(t *testing.T) {
 	err := p0.Decode(b)
 	assert.Nil(t, err)
 	assert.Equal(t, p, p0)
+
+	for _, tif := range []TimeInForce{ImmediateOrCancel, FillOrKill} {
+		for _, sell := range []bool{true, false} {
+			p.TimeInForce = tif
+			p.SellSide = sell
+			var p1 PlaceOrderTxn
+			err = p1.Decode(p.Encode())
+			assert.Nil(t, err)
+			assert.Equal(t, p, p1)
+		}
+	}
+
+	// the GoodTillCancel orders are only encoded in the short
+	// form.
+	p.TimeInForce = GoodTillCancel
+	p.SellSide = false
+	b = append(p.Encode(), 1, byte(GoodTillCancel))
+	assert.NotNil(t, p0.Decode(b))
+	b = append(p.Encode(), 1, byte(FillOrKill+1))
+	assert.NotNil(t, p0.Decode(b))
+}
+
+func TestTxnPoolRemoveExpired(t *testing.T) {
+	pk, sk := RandKeyPair()
+	addr := pk.Addr()
+	pool := NewTxnPool(&myPKer{m: map[consensus.Addr]PK{addr: pk}})
+	pkTo, _ := RandKeyPair()
+
+	expiring, err := SetValidUntilRound(sk, MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 0), 2)
+	if err != nil {
+		panic(err)
+	}
+
+	_, broadcast := pool.Add(expiring)
+	assert.True(t, broadcast)
+	_, broadcast = pool.Add(MakeSendTokenTxn(sk, addr, pkTo, 0, 20, 1))
+	assert.True(t, broadcast)
+
+	assert.Equal(t, 0, pool.RemoveExpired(2))
+	assert.Equal(t, 2, pool.Size())
+	assert.Equal(t, 1, pool.RemoveExpired(3))
+	assert.Equal(t, 1, pool.Size())
+	assert.Equal(t, uint64(0), pool.Txns()[0].ValidUntilRound)
+	// the expired txn is evicted from the cache as well.
+	assert.Nil(t, pool.Get(consensus.SHA3(expiring)))
+	_, ok := pool.Add(expiring)
+	assert.True(t, ok)
 }
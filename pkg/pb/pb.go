@@ -0,0 +1,129 @@
+// Package pb implements the subset of the protocol buffers wire
+// format used by the protobuf codecs: the varint and the
+// length-delimited fields.
+package pb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Encoder encodes the fields of a message. The zero values are
+// omitted as in proto3.
+type Encoder struct {
+	buf []byte
+}
+
+func (e *Encoder) tag(field, wireType int) {
+	e.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (e *Encoder) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+// Uint64 encodes a varint field.
+func (e *Encoder) Uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+
+	e.tag(field, wireVarint)
+	e.varint(v)
+}
+
+// Bool encodes a bool field.
+func (e *Encoder) Bool(field int, v bool) {
+	if v {
+		e.Uint64(field, 1)
+	}
+}
+
+// Bytes encodes a length-delimited field.
+func (e *Encoder) Bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+
+	e.Message(field, b)
+}
+
+// Message encodes an embedded message field, it is encoded even if
+// empty, so the elements of a repeated field are never omitted.
+func (e *Encoder) Message(field int, m []byte) {
+	e.tag(field, wireBytes)
+	e.varint(uint64(len(m)))
+	e.buf = append(e.buf, m...)
+}
+
+// Data returns the encoded message.
+func (e *Encoder) Data() []byte {
+	return e.buf
+}
+
+// Decode decodes the fields of a message, calling f with the field
+// number and the value: v for a varint field, b for a
+// length-delimited field.
+func Decode(d []byte, f func(field int, v uint64, b []byte) error) error {
+	for len(d) > 0 {
+		tag, n := binary.Uvarint(d)
+		if n <= 0 {
+			return errors.New("invalid field tag")
+		}
+		d = d[n:]
+
+		field := int(tag >> 3)
+		switch wireType := int(tag & 7); wireType {
+		case wireVarint:
+			v, n := binary.Uvarint(d)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint of field %d", field)
+			}
+			d = d[n:]
+
+			if err := f(field, v, nil); err != nil {
+				return err
+			}
+		case wireBytes:
+			l, n := binary.Uvarint(d)
+			if n <= 0 || uint64(len(d)-n) < l {
+				return fmt.Errorf("invalid length of field %d", field)
+			}
+			b := d[n : n+int(l)]
+			d = d[n+int(l):]
+
+			if err := f(field, 0, b); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported wire type %d of field %d", wireType, field)
+		}
+	}
+
+	return nil
+}
+
+// Fixed copies the length-delimited value to the fixed size array
+// dst, an error is returned if the lengths do not match.
+func Fixed(dst, b []byte) error {
+	if len(b) != len(dst) {
+		return fmt.Errorf("invalid fixed size value length: %d, expected: %d", len(b), len(dst))
+	}
+
+	copy(dst, b)
+	return nil
+}
+
+// Copy returns a copy of the length-delimited value, the decoded
+// values must not share the memory of the decoded message.
+func Copy(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,34 @@
+package pb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	var e Encoder
+	e.Uint64(1, 300)
+	e.Uint64(2, 0)
+	e.Bool(3, true)
+	e.Bytes(4, []byte("dex"))
+	e.Message(5, nil)
+
+	// the same bytes as encoded by protoc.
+	assert.Equal(t, []byte{0x08, 0xac, 0x02, 0x18, 0x01, 0x22, 0x03, 'd', 'e', 'x', 0x2a, 0x00}, e.Data())
+
+	fields := make(map[int]interface{})
+	err := Decode(e.Data(), func(field int, v uint64, b []byte) error {
+		if b != nil {
+			fields[field] = string(b)
+		} else {
+			fields[field] = v
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]interface{}{1: uint64(300), 3: uint64(1), 4: "dex", 5: ""}, fields)
+
+	err = Decode([]byte{0x22, 0x05, 'd'}, func(int, uint64, []byte) error { return nil })
+	assert.NotNil(t, err)
+}